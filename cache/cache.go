@@ -11,7 +11,10 @@ package cache
 
 import (
 	"crypto/sha1"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -22,6 +25,15 @@ import (
 type elem struct {
 	expiration time.Time // time added + TTL, after this the elem is invalid
 	msg        *dns.Msg
+	inserted   time.Time
+	hits       int // lookups of a message on probation
+}
+
+// Entry is a message held in a Cache, see Entries.
+type Entry struct {
+	Msg        *dns.Msg
+	Inserted   time.Time
+	Expiration time.Time
 }
 
 // Cache is a cache that holds on the a number of RRs or DNS messages. The cache
@@ -29,68 +41,236 @@ type elem struct {
 type Cache struct {
 	sync.RWMutex
 
-	capacity int
-	m        map[string]*elem
-	ttl      time.Duration
+	capacity  int
+	m         map[string]*elem
+	ttl       time.Duration
+	evictions int64
+	// With minHits above 1, messages are held in probation until they
+	// were looked up minHits times, see SetMinHits.
+	minHits   int
+	probation map[string]*elem
 }
 
 // New returns a new cache with the capacity and the ttl specified.
 func New(capacity, ttl int) *Cache {
 	c := new(Cache)
 	c.m = make(map[string]*elem)
+	c.probation = make(map[string]*elem)
 	c.capacity = capacity
 	c.ttl = time.Duration(ttl) * time.Second
 	return c
 }
 
-func (c *Cache) Capacity() int { return c.capacity }
+func (c *Cache) Capacity() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.capacity
+}
+
+// SetCapacity changes the number of messages the cache holds. If it holds
+// more, the messages closest to expiring, the oldest ones, are evicted.
+func (c *Cache) SetCapacity(capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = capacity
+	trimOldest(c.probation, capacity)
+	atomic.AddInt64(&c.evictions, int64(trimOldest(c.m, capacity)))
+}
+
+// trimOldest removes the messages closest to expiring from m until it
+// holds at most capacity and returns the number removed.
+func trimOldest(m map[string]*elem, capacity int) int {
+	n := len(m) - capacity
+	if n <= 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return m[keys[i]].expiration.Before(m[keys[j]].expiration) })
+	for _, k := range keys[:n] {
+		delete(m, k)
+	}
+	return n
+}
+
+// SetTTL changes the ttl, in seconds, messages inserted from now on are
+// cached for.
+func (c *Cache) SetTTL(ttl int) {
+	c.Lock()
+	c.ttl = time.Duration(ttl) * time.Second
+	c.Unlock()
+}
+
+// SetMinHits changes the number of lookups a message must have before it
+// is cached. The response inserted after the first lookup is held in
+// probation, a separate set of the same capacity, and moved to the cache
+// by the lookup that reaches n. Until then the lookups miss. Values below
+// 2 cache every message on insertion.
+func (c *Cache) SetMinHits(n int) {
+	c.Lock()
+	c.minHits = n
+	if n <= 1 {
+		c.probation = make(map[string]*elem)
+	}
+	c.Unlock()
+}
+
+// Len returns the number of messages currently held in the cache.
+func (c *Cache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m)
+}
+
+// Evictions returns the number of messages evicted to make room for new ones.
+func (c *Cache) Evictions() int64 { return atomic.LoadInt64(&c.evictions) }
 
 func (c *Cache) Remove(s string) {
 	c.Lock()
 	delete(c.m, s)
+	delete(c.probation, s)
 	c.Unlock()
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	clen := len(c.m)
-	if clen < c.capacity {
-		return
+// Flush removes the messages answering names at or below suffix, or all
+// messages if suffix is empty. It returns the number of messages removed.
+func (c *Cache) Flush(suffix string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for k, e := range c.m {
+		if suffix == "" || len(e.msg.Question) > 0 && dns.IsSubDomain(suffix, e.msg.Question[0].Name) {
+			delete(c.m, k)
+			n++
+		}
 	}
-	i := c.capacity - clen
-	for k, _ := range c.m {
-		delete(c.m, k)
-		i--
-		if i == 0 {
+	for k, e := range c.probation {
+		if suffix == "" || len(e.msg.Question) > 0 && dns.IsSubDomain(suffix, e.msg.Question[0].Name) {
+			delete(c.probation, k)
+		}
+	}
+	return n
+}
+
+// FlushNames removes the messages asking for one of names or having an
+// answer record owned by one of them, such as a CNAME chain passing through
+// it. It returns the number of messages removed.
+func (c *Cache) FlushNames(names ...string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for k, e := range c.m {
+		if mentionsName(e.msg, names) {
+			delete(c.m, k)
+			n++
+		}
+	}
+	for k, e := range c.probation {
+		if mentionsName(e.msg, names) {
+			delete(c.probation, k)
+		}
+	}
+	return n
+}
+
+func mentionsName(m *dns.Msg, names []string) bool {
+	for _, name := range names {
+		for _, q := range m.Question {
+			if strings.EqualFold(q.Name, name) {
+				return true
+			}
+		}
+		for _, rr := range m.Answer {
+			if strings.EqualFold(rr.Header().Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Entries returns the messages held in the cache, including expired ones
+// that have not been removed yet. The messages are shared with the cache
+// and must not be modified.
+func (c *Cache) Entries() []Entry {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make([]Entry, 0, len(c.m))
+	for _, e := range c.m {
+		entries = append(entries, Entry{Msg: e.msg, Inserted: e.inserted, Expiration: e.expiration})
+	}
+	return entries
+}
+
+// EvictRandom removes random members of the cache until it holds no more
+// than its capacity. Must be called under a write lock.
+func (c *Cache) EvictRandom() {
+	c.evictRandom("")
+}
+
+// evictRandom is EvictRandom, but never removes the message under keep,
+// e.g. the one just inserted.
+func (c *Cache) evictRandom(keep string) {
+	i := len(c.m) - c.capacity
+	for k := range c.m {
+		if i <= 0 {
 			break
 		}
+		if k == keep {
+			continue
+		}
+		delete(c.m, k)
+		atomic.AddInt64(&c.evictions, 1)
+		i--
 	}
 }
 
 // InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
-// should be a small (60...300) integer.
+// should be a small (60...300) integer. With SetMinHits the message is put on
+// probation instead.
 func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
+	c.Lock()
 	if c.capacity <= 0 {
+		c.Unlock()
+		return
+	}
+	if _, ok := c.m[s]; !ok && c.minHits > 1 {
+		if _, ok := c.probation[s]; !ok {
+			now := time.Now().UTC()
+			c.probation[s] = &elem{now.Add(c.ttl), msg.Copy(), now, 1}
+			for k := range c.probation {
+				if len(c.probation) <= c.capacity {
+					break
+				}
+				if k != s {
+					delete(c.probation, k)
+				}
+			}
+		}
+		c.Unlock()
 		return
 	}
-
-	c.Lock()
 	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy()}
+		now := time.Now().UTC()
+		c.m[s] = &elem{now.Add(c.ttl), msg.Copy(), now, 0}
 
 	}
-	c.EvictRandom()
+	c.evictRandom(s)
 	c.Unlock()
 }
 
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
+	c.RLock()
 	if c.capacity <= 0 {
+		c.RUnlock()
 		return nil, time.Time{}, false
 	}
-	c.RLock()
 	if e, ok := c.m[s]; ok {
 		e1 := e.msg.Copy()
 		c.RUnlock()
@@ -100,6 +280,30 @@ func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
 	return nil, time.Time{}, false
 }
 
+// lookupProbation counts a lookup of the message on probation under s. The
+// lookup reaching minHits moves the message to the cache, and returns it and
+// its expiration time like Search. Expired messages are removed.
+func (c *Cache) lookupProbation(s string) (*dns.Msg, time.Time, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.probation[s]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	if time.Since(e.expiration) >= 0 {
+		delete(c.probation, s)
+		return nil, time.Time{}, false
+	}
+	e.hits++
+	if e.hits < c.minHits {
+		return nil, time.Time{}, false
+	}
+	delete(c.probation, s)
+	c.m[s] = e
+	c.evictRandom(s)
+	return e.msg.Copy(), e.expiration, true
+}
+
 // Key creates a hash key from a question section. It creates a different key
 // for requests with DNSSEC.
 func Key(q dns.Question, dnssec, tcp bool) string {
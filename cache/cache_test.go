@@ -83,3 +83,195 @@ func TestExpireMessage(t *testing.T) {
 		t.Fatalf("bad Qtype, expected %s, got %s:", tc.m.Question[0].Name, m1.Question[0].Name)
 	}
 }
+
+func TestEvictRandom(t *testing.T) {
+	c := New(3, testTTL)
+
+	for _, name := range []string{"a.nl.", "b.nl.", "c.nl.", "d.nl."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+
+	if c.Len() != c.Capacity() {
+		t.Fatalf("bad cache length, expected %d, got %d", c.Capacity(), c.Len())
+	}
+	if c.Evictions() != 1 {
+		t.Fatalf("expected 1 eviction, got %d", c.Evictions())
+	}
+}
+
+func TestEvictKeepsInserted(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		c := New(1, testTTL)
+		for _, name := range []string{"a.nl.", "b.nl."} {
+			m := newMsg(name, dns.TypeA)
+			c.InsertMessage(Key(m.Question[0], false, false), m)
+			if c.Hit(m.Question[0], false, false, m.Id) == nil {
+				t.Fatalf("expected %s to be cached right after it was inserted", name)
+			}
+		}
+
+		c = New(1, testTTL)
+		c.SetMinHits(3)
+		for _, name := range []string{"a.nl.", "b.nl."} {
+			m := newMsg(name, dns.TypeA)
+			key := Key(m.Question[0], false, false)
+			c.InsertMessage(key, m)
+			if _, ok := c.probation[key]; !ok || len(c.probation) != 1 {
+				t.Fatalf("expected only %s to be on probation right after it was inserted, got %d", name, len(c.probation))
+			}
+		}
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	c := New(10, testTTL)
+	var msgs []*dns.Msg
+	for _, name := range []string{"a.nl.", "b.nl.", "c.nl.", "d.nl."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+		msgs = append(msgs, m)
+		time.Sleep(time.Millisecond)
+	}
+
+	c.SetCapacity(2)
+	if c.Len() != 2 || c.Capacity() != 2 || c.Evictions() != 2 {
+		t.Fatalf("expected 2 messages and 2 evictions, got %d and %d", c.Len(), c.Evictions())
+	}
+	for i, m := range msgs {
+		if hit := c.Hit(m.Question[0], false, false, m.Id) != nil; hit != (i >= 2) {
+			t.Errorf("%s: expected only the newest messages to be kept", m.Question[0].Name)
+		}
+	}
+
+	c.SetCapacity(10)
+	if c.Len() != 2 {
+		t.Errorf("expected raising the capacity to keep the messages, got %d", c.Len())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := New(10, testTTL)
+	for _, name := range []string{"a.example.com.", "B.Example.com.", "example.com.", "example.org."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+
+	if n := c.Flush("example.com."); n != 3 {
+		t.Errorf("expected 3 messages to be removed, got %d", n)
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected 1 message to be kept, got %d", c.Len())
+	}
+	if n := c.Flush(""); n != 1 || c.Len() != 0 {
+		t.Errorf("expected the cache to be emptied, removed %d, kept %d", n, c.Len())
+	}
+}
+
+func TestFlushNames(t *testing.T) {
+	c := New(10, testTTL)
+	for _, name := range []string{"web.local.", "a.web.local.", "example.org."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+	m := newMsg("www.example.com.", dns.TypeA)
+	cname, _ := dns.NewRR("www.example.com. 60 IN CNAME WEB.local.")
+	a, _ := dns.NewRR("WEB.local. 60 IN A 10.0.0.1")
+	m.Answer = []dns.RR{cname, a}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	if n := c.FlushNames("web.local.", "1.0.0.10.in-addr.arpa."); n != 2 {
+		t.Errorf("expected the message for the name and the CNAME chain through it to be removed, got %d", n)
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected 2 messages to be kept, got %d", c.Len())
+	}
+}
+
+func TestShards(t *testing.T) {
+	s := NewShards(2, testTTL, 2)
+	m := newMsg("miek.nl.", dns.TypeA)
+	key := Key(m.Question[0], false, false)
+
+	a := s.Get("10.0.0.0/24")
+	a.InsertMessage(key, m)
+	if s.Get("10.0.0.0/24") != a {
+		t.Fatal("expected the same cache for the same key")
+	}
+	if s.Get("10.0.1.0/24").Hit(m.Question[0], false, false, m.Id) != nil {
+		t.Error("expected no hit in the cache of another key")
+	}
+	if s.Count() != 2 || s.Capacity() != 4 || s.Len() != 1 {
+		t.Errorf("expected 2 caches of capacity 4 holding 1 message, got %d, %d, %d", s.Count(), s.Capacity(), s.Len())
+	}
+
+	// A third key drops one of the caches
+	s.Get("10.0.2.0/24")
+	if s.Count() != 2 {
+		t.Errorf("expected at most 2 caches, got %d", s.Count())
+	}
+	if s.Len() == 0 && s.Evictions() != 1 {
+		t.Errorf("expected the dropped message to be counted as evicted, got %d", s.Evictions())
+	}
+
+	s.Flush("")
+	if s.Len() != 0 {
+		t.Errorf("expected all messages to be flushed, %d left", s.Len())
+	}
+}
+
+func TestEntries(t *testing.T) {
+	c := New(10, testTTL)
+	m := newMsg("miek.nl.", dns.TypeA)
+	before := time.Now()
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Msg.Question[0].Name != "miek.nl." {
+		t.Errorf("expected the message for miek.nl., got %v", e.Msg)
+	}
+	if e.Inserted.Before(before) || e.Expiration.Sub(e.Inserted) != testTTL*time.Second {
+		t.Errorf("expected the entry to be inserted now and expire in %ds, got %s and %s", testTTL, e.Inserted, e.Expiration)
+	}
+}
+
+func TestMinHits(t *testing.T) {
+	c := New(10, testTTL)
+	c.SetMinHits(3)
+	m := newMsg("miek.nl.", dns.TypeA)
+	q := m.Question[0]
+
+	// The first lookup missed and inserted the message
+	c.InsertMessage(Key(q, false, false), m)
+	if c.Len() != 0 {
+		t.Fatalf("expected the message to be on probation, got %d cached", c.Len())
+	}
+	if c.Hit(q, false, false, m.Id) != nil {
+		t.Fatal("expected the second lookup to miss")
+	}
+	c.InsertMessage(Key(q, false, false), m)
+	if m1 := c.Hit(q, false, false, m.Id); m1 == nil || c.Len() != 1 {
+		t.Fatalf("expected the third lookup to hit and cache the message, got %v and %d cached", m1, c.Len())
+	}
+
+	// Flushed messages on probation start over
+	other := newMsg("example.org.", dns.TypeA)
+	c.InsertMessage(Key(other.Question[0], false, false), other)
+	c.Flush("")
+	for i := 0; i < 2; i++ {
+		if c.Hit(other.Question[0], false, false, other.Id) != nil {
+			t.Fatal("expected a flushed message to miss")
+		}
+	}
+
+	// Without a minimum the message is cached on insertion
+	c.SetMinHits(1)
+	c.InsertMessage(Key(other.Question[0], false, false), other)
+	if c.Len() != 1 {
+		t.Errorf("expected the message to be cached, got %d", c.Len())
+	}
+}
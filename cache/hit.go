@@ -15,6 +15,9 @@ import (
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
 	key := Key(question, dnssec, tcp)
 	m1, exp, hit := c.Search(key)
+	if !hit {
+		m1, exp, hit = c.lookupProbation(key)
+	}
 	if hit {
 		// Cache hit! \o/
 		if time.Since(exp) < 0 {
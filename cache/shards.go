@@ -0,0 +1,161 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+)
+
+// Shards holds a Cache per key, e.g. per client network, so that the
+// messages cached for one key are never returned for another. Every Cache
+// has the same capacity and ttl. At most max caches are kept, the cache of
+// a random key is dropped to make room for a new one.
+type Shards struct {
+	sync.Mutex
+
+	capacity int
+	ttl      int
+	max      int
+	minHits  int
+	m        map[string]*Cache
+	// Messages of dropped caches, along with their evictions
+	dropped int64
+}
+
+// NewShards returns a set of at most max caches with the capacity and the
+// ttl specified.
+func NewShards(capacity, ttl, max int) *Shards {
+	return &Shards{capacity: capacity, ttl: ttl, max: max, m: make(map[string]*Cache)}
+}
+
+// Get returns the cache of key, creating it if needed.
+func (s *Shards) Get(key string) *Cache {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.m[key]; ok {
+		return c
+	}
+	for k, c := range s.m {
+		if len(s.m) < s.max {
+			break
+		}
+		s.dropped += int64(c.Len()) + c.Evictions()
+		delete(s.m, k)
+	}
+	c := New(s.capacity, s.ttl)
+	c.SetMinHits(s.minHits)
+	s.m[key] = c
+	return c
+}
+
+// Count returns the number of caches.
+func (s *Shards) Count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.m)
+}
+
+// Capacity returns the total capacity of the caches.
+func (s *Shards) Capacity() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.capacity * len(s.m)
+}
+
+// Len returns the number of messages held in all caches.
+func (s *Shards) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, c := range s.m {
+		n += c.Len()
+	}
+	return n
+}
+
+// Evictions returns the number of messages evicted to make room for new
+// ones, including those of the caches dropped to make room for new keys.
+func (s *Shards) Evictions() int64 {
+	s.Lock()
+	defer s.Unlock()
+	n := s.dropped
+	for _, c := range s.m {
+		n += c.Evictions()
+	}
+	return n
+}
+
+// SetCapacity changes the capacity of all caches, see Cache.SetCapacity.
+func (s *Shards) SetCapacity(capacity int) {
+	s.Lock()
+	defer s.Unlock()
+	s.capacity = capacity
+	for _, c := range s.m {
+		c.SetCapacity(capacity)
+	}
+}
+
+// SetTTL changes the ttl, in seconds, of all caches.
+func (s *Shards) SetTTL(ttl int) {
+	s.Lock()
+	defer s.Unlock()
+	s.ttl = ttl
+	for _, c := range s.m {
+		c.SetTTL(ttl)
+	}
+}
+
+// SetMinHits changes the number of lookups a message must have before it is
+// cached in all caches, see Cache.SetMinHits.
+func (s *Shards) SetMinHits(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.minHits = n
+	for _, c := range s.m {
+		c.SetMinHits(n)
+	}
+}
+
+// Flush removes the messages answering names at or below suffix, or all
+// messages if suffix is empty, from all caches. It returns the number of
+// messages removed.
+func (s *Shards) Flush(suffix string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, c := range s.m {
+		n += c.Flush(suffix)
+	}
+	return n
+}
+
+// FlushNames removes the messages asking for or answering with one of
+// names from all caches, see Cache.FlushNames. It returns the number of
+// messages removed.
+func (s *Shards) FlushNames(names ...string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, c := range s.m {
+		n += c.FlushNames(names...)
+	}
+	return n
+}
+
+// Entries returns the messages held in the caches by key, see
+// Cache.Entries.
+func (s *Shards) Entries() map[string][]Entry {
+	s.Lock()
+	caches := make(map[string]*Cache, len(s.m))
+	for key, c := range s.m {
+		caches[key] = c
+	}
+	s.Unlock()
+	entries := make(map[string][]Entry, len(caches))
+	for key, c := range caches {
+		entries[key] = c.Entries()
+	}
+	return entries
+}
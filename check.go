@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/janeczku/go-dnsmasq/hostsfile"
+	"github.com/janeczku/go-dnsmasq/server"
+)
+
+// checkConfig validates the flags, environment variables and config file
+// of c the way they are on startup and prints every problem found. Files
+// are only read: no sockets are opened and resolv.conf is not changed. It
+// returns the exit code.
+func checkConfig(c *cli.Context, flags []cli.Flag) int {
+	var errs server.ConfigErrors
+
+	if path := c.String("config"); path != "" {
+		if err := loadConfigFile(c, flags, path); err != nil {
+			errs = append(errs, fmt.Errorf("Error loading config file: %s", err))
+		}
+	}
+
+	_, err := newConfig(c, nil)
+	errs = appendErrors(errs, err)
+
+	for _, path := range c.StringSlice("hostsfile") {
+		if path == "" {
+			continue
+		}
+		for _, err := range hosts.Check(path, c.Int("hostsfile-generate-max"), c.Bool("hostsfile-env-expand"), c.String("hostsfile-comment-char")) {
+			errs = append(errs, fmt.Errorf("Hostsfile: %s", err))
+		}
+	}
+
+	if err := hosts.CheckReloadErrorPolicy(hosts.ReloadErrorPolicy(c.String("hostsfile-reload-error-policy"))); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := logFormatter(c.String("log-format"), c.Bool("syslog")); err != nil {
+		errs = append(errs, err)
+	}
+	if c.String("statsd-address") != "" && c.Int("statsd-interval") < 1 {
+		errs = append(errs, fmt.Errorf("'statsd-interval' must be greater than 0"))
+	}
+	if user, group := c.String("user"), c.String("group"); user != "" || group != "" {
+		if _, _, err := lookupIDs(user, group); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		fmt.Println("Configuration OK")
+		return 0
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Fprintf(os.Stderr, "Found %d problem(s)\n", len(errs))
+	return 1
+}
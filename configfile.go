@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile applies the options in the YAML file at path to the
+// flags that were neither given on the command line nor through their
+// environment variable. Keys are the long flag names. Flags that take a
+// list accept a YAML sequence; repeatable flags get one value per entry.
+func loadConfigFile(c *cli.Context, flags []cli.Flag, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: line %d: expected a mapping of option names to values", path, root.Line)
+	}
+
+	byName := make(map[string]cli.Flag)
+	for _, f := range flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			byName[strings.TrimSpace(name)] = f
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		f, ok := byName[key.Value]
+		if !ok || key.Value == "config" {
+			return fmt.Errorf("%s: line %d: unknown option %q", path, key.Line, key.Value)
+		}
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if seen[name] {
+			return fmt.Errorf("%s: line %d: option %q is given more than once", path, key.Line, key.Value)
+		}
+		seen[name] = true
+
+		if c.IsSet(name) || envIsSet(f) {
+			continue
+		}
+
+		values, err := configValues(f, value)
+		if err != nil {
+			return fmt.Errorf("%s: line %d: option %q: %s", path, value.Line, key.Value, err)
+		}
+		for _, v := range values {
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("%s: line %d: option %q: invalid value %q", path, value.Line, key.Value, v)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues returns the values to set flag f to.
+func configValues(f cli.Flag, value *yaml.Node) ([]string, error) {
+	_, repeatable := f.(cli.StringSliceFlag)
+
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return []string{value.Value}, nil
+	case yaml.SequenceNode:
+		var values []string
+		for _, v := range value.Content {
+			if v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("expected a list of values")
+			}
+			values = append(values, v.Value)
+		}
+		if repeatable {
+			return values, nil
+		}
+		if _, ok := f.(cli.StringFlag); ok {
+			// Comma delimited lists such as nameservers
+			return []string{strings.Join(values, ",")}, nil
+		}
+		return nil, fmt.Errorf("expected a single value")
+	}
+	return nil, fmt.Errorf("expected a value or a list of values")
+}
+
+// envIsSet returns whether the environment variable of f is set.
+func envIsSet(f cli.Flag) bool {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	env := v.FieldByName("EnvVar")
+	if !env.IsValid() || env.Kind() != reflect.String {
+		return false
+	}
+	for _, name := range strings.Split(env.String(), ",") {
+		if _, ok := os.LookupEnv(strings.TrimSpace(name)); ok {
+			return true
+		}
+	}
+	return false
+}
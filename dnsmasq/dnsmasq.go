@@ -0,0 +1,403 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package dnsmasq runs the go-dnsmasq resolver inside another program. It
+// wires up the hostsfiles, the DNS server, the statistics and the
+// registration as the default nameserver the way the go-dnsmasq command
+// does, which is a thin wrapper around it. Errors are returned, the package
+// never exits the process.
+//
+// Log messages go to the standard logrus logger; configure it before calling
+// New. The statistics are kept per process, not per Server.
+package dnsmasq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/janeczku/go-dnsmasq/hostsfile"
+	"github.com/janeczku/go-dnsmasq/resolvconf"
+	"github.com/janeczku/go-dnsmasq/server"
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+// Config holds the options of a Server. The fields correspond to the
+// command line flags of go-dnsmasq; start from DefaultConfig to get their
+// defaults.
+type Config struct {
+	// The options of the DNS server. They are validated by New; use
+	// server.NewConfig to validate each option as it is set.
+	server.Config
+
+	// Maximum number of entries $GENERATE lines in a hostsfile may expand to
+	HostsfileGenerateMax int
+	// Replace $VAR and ${VAR} in the hostsfiles with environment variables
+	HostsfileEnvExpand bool
+	// Each of these characters starts a comment in a hostsfile. Empty disables comments.
+	HostsfileCommentChars string
+	// Process sent SIGHUP and shell command run when the content of a hostsfile changed
+	HostsfileNotifyPID int
+	HostsfileNotifyCmd string
+	// What the poller does when a changed hostsfile cannot be loaded
+	HostsfileReloadErrorPolicy hosts.ReloadErrorPolicy
+	// How often to refresh the network interface records, in seconds. Zero only refreshes them on Reload.
+	IfacePoll int
+
+	// The host:port of the statsd daemon to send metrics to. Empty disables statsd.
+	StatsdAddress string
+	// Prefix of the metric names sent to statsd
+	StatsdPrefix string
+	// How often to send metrics to statsd
+	StatsdInterval time.Duration
+	// Never resolve the host names of the statsd daemon and the graphite
+	// server through the operating system, which may consult /etc/hosts.
+	// They must be IP addresses instead.
+	NoHosts bool
+
+	// The backend DefaultResolver registers the server with, see the
+	// resolvconf.Backend constants. Empty detects it.
+	ResolvConfBackend string
+	// The resolver configuration DefaultResolver registers. Nil registers
+	// the one returned by ResolvConf.
+	ResolvConf *resolvconf.Config
+	// Path of the backups of resolv.conf, followed by the time of the
+	// backup. Empty uses resolvconf.RESOLVCONF_BACKUP_PATH.
+	ResolvBackupPath string
+
+	// The version answered to version.bind queries
+	Version string
+
+	// Middlewares every query passes through before the stages of the
+	// query path, the first being the outermost
+	Middlewares []server.Middleware
+	// Middlewares inserted next to the stages of the query path
+	StageMiddlewares []server.StageMiddleware
+
+	// ReloadConfig returns the configuration Reload applies. Nil only
+	// reloads the hostsfiles.
+	ReloadConfig func() (*server.Config, error)
+}
+
+// DefaultConfig returns a Config with the defaults of the command line
+// flags. It has no nameservers, which New requires unless NoRec is set.
+func DefaultConfig() Config {
+	return Config{
+		Config:                     *server.DefaultConfig(),
+		HostsfileGenerateMax:       hosts.DefaultGenerateMaxRecords,
+		HostsfileCommentChars:      hosts.DefaultCommentChars,
+		HostsfileReloadErrorPolicy: hosts.ReloadErrorWarn,
+		StatsdPrefix:               "go-dnsmasq",
+		StatsdInterval:             10 * time.Second,
+	}
+}
+
+// dnsServer is the server returned by server.New.
+type dnsServer interface {
+	Run() error
+	Stop()
+	Listening() <-chan struct{}
+	ListenAddrs() []string
+	Reload(config *server.Config)
+	SetReloadFunc(f func() error)
+	UseStages(middlewares ...server.StageMiddleware) error
+	SetResolvConfReady()
+	ReopenQueryLog() error
+	CacheSize() (int, int)
+	CacheEvictions() int64
+	AddHost(name string, ip net.IP, ttl int) error
+	AddCNAME(name, target string) error
+	RemoveHost(name string) error
+}
+
+// Server is a go-dnsmasq resolver. Create it with New, then call Start.
+type Server struct {
+	config Config
+	hosts  *hosts.Hostsfile
+	dns    dnsServer
+
+	started    int32
+	registered bool          // set by Start if registered as the default nameserver
+	done       chan struct{} // closed when the server stopped answering queries
+	err        error         // the error it stopped with, set before done is closed
+	stopOnce   sync.Once
+
+	hostsErr chan error // receives the hostsfile reload error under ReloadErrorFatal
+	failMu   sync.Mutex
+	failErr  error // the error the server was stopped with by fail
+}
+
+// New validates config and loads the hostsfiles. The server does not
+// answer queries until Start is called. All configuration problems found
+// are returned as server.ConfigErrors.
+func New(config Config) (*Server, error) {
+	if err := server.CheckConfig(&config.Config); err != nil {
+		return nil, err
+	}
+	if config.StatsdAddress != "" && config.StatsdInterval <= 0 {
+		return nil, server.ConfigErrors{errors.New("'statsd-interval' must be greater than 0")}
+	}
+	if err := hosts.CheckReloadErrorPolicy(config.HostsfileReloadErrorPolicy); err != nil {
+		return nil, server.ConfigErrors{err}
+	}
+
+	hostsErr := make(chan error, 1)
+	hf, err := hosts.NewHostsfile("", &hosts.Config{
+		Files:              config.Hostsfile,
+		Poll:               config.PollInterval,
+		Verbose:            config.Verbose,
+		GenerateMaxRecords: config.HostsfileGenerateMax,
+		EnvExpand:          config.HostsfileEnvExpand,
+		CommentChars:       config.HostsfileCommentChars,
+		NoComments:         config.HostsfileCommentChars == "",
+		IfaceDiscovery:     config.IfaceDomain != "",
+		IfaceDomain:        config.IfaceDomain,
+		IfacePoll:          config.IfacePoll,
+		TTL:                int(config.HostsTtl),
+		IfaceTTL:           int(config.IfaceTtl),
+		NotifyPID:          config.HostsfileNotifyPID,
+		NotifyCmd:          config.HostsfileNotifyCmd,
+		ReloadErrorPolicy:  config.HostsfileReloadErrorPolicy,
+		OnFatalError:       func(err error) { hostsErr <- err },
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", server.ErrHostsfileLoad, err)
+	}
+
+	s := &Server{
+		config: config,
+		hosts:  hf,
+		dns:    server.New(hf, &config.Config, config.Version, config.Middlewares...),
+		done:   make(chan struct{}),
+
+		hostsErr: hostsErr,
+	}
+	if err := s.dns.UseStages(config.StageMiddlewares...); err != nil {
+		hf.Close()
+		return nil, server.ConfigErrors{err}
+	}
+	s.dns.SetReloadFunc(s.Reload)
+	return s, nil
+}
+
+// Start starts answering queries and returns once the server listens on
+// all its addresses, or with the error binding them failed with. With
+// DefaultResolver it then registers the server as the default nameserver.
+// Cancelling ctx stops the server like Stop. Start may only be called once.
+func (s *Server) Start(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return errors.New("Server already started")
+	}
+	config := s.config
+
+	stats.NoHosts = config.NoHosts
+	stats.Collect()
+	if config.TrackTop > 0 {
+		stats.TrackTop(config.TrackTop)
+	}
+	if config.StatsdAddress != "" {
+		if err := stats.StartStatsd(config.StatsdAddress, config.StatsdPrefix, config.StatsdInterval); err != nil {
+			s.err = fmt.Errorf("Failed to set up statsd: %s", err)
+			close(s.done)
+			return s.err
+		}
+	}
+
+	go func() {
+		defer resolvconf.CleanOnPanic()
+		err := s.dns.Run()
+		s.failMu.Lock()
+		if err == nil {
+			err = s.failErr
+		}
+		s.failMu.Unlock()
+		s.err = err
+		close(s.done)
+	}()
+
+	select {
+	case <-s.dns.Listening():
+	case <-s.done:
+		if s.err == nil {
+			return errors.New("Server stopped while starting")
+		}
+		return s.err
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+
+	if config.DefaultResolver {
+		s.registerResolver()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case err := <-s.hostsErr:
+			s.fail(fmt.Errorf("%w: %w", server.ErrHostsfileLoad, err))
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// fail stops the server like Stop, but makes Wait return err.
+func (s *Server) fail(err error) {
+	s.failMu.Lock()
+	s.failErr = err
+	s.failMu.Unlock()
+	s.Stop()
+}
+
+// registerResolver registers the server as the default nameserver. A
+// failure is only logged, the server keeps answering queries.
+func (s *Server) registerResolver() {
+	backend := s.config.ResolvConfBackend
+	if backend == "" {
+		backend = resolvconf.Detect()
+	}
+	rc := s.config.ResolvConf
+	if rc == nil {
+		rc = ResolvConf(&s.config.Config)
+	}
+	if s.config.ResolvBackupPath != "" {
+		resolvconf.SetBackupPath(s.config.ResolvBackupPath)
+	}
+	log.Infof("Registering as the default nameserver using the %s backend", backend)
+	if err := resolvconf.StoreConfig(rc, backend); err != nil {
+		log.Warnf("Failed to register as default nameserver: %s", err)
+		return
+	}
+	s.registered = true
+	s.dns.SetResolvConfReady()
+}
+
+// Stop stops answering queries and waits until the listeners are closed.
+// It restores the resolver configuration replaced by Start and stops
+// polling the hostsfiles. Further calls are no-ops.
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		if s.registered {
+			resolvconf.Clean()
+		}
+		s.dns.Stop()
+		s.hosts.Close()
+	})
+	if atomic.LoadInt32(&s.started) == 1 {
+		<-s.done
+	}
+}
+
+// Wait blocks until the server stopped answering queries, and returns nil
+// if it was stopped by Stop or the cancelled context of Start, or the error
+// a listener failed with. With the ReloadErrorFatal hostsfile policy it
+// stops the server and returns the error a reload failed with, wrapping
+// server.ErrHostsfileLoad. It must only be called after Start succeeded.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Addrs returns the addresses the server answers queries on, with the
+// ports chosen by the system for a DnsAddr with port 0.
+func (s *Server) Addrs() []string {
+	return s.dns.ListenAddrs()
+}
+
+// Reload reads the hostsfiles again and applies the configuration returned
+// by ReloadConfig, if set. Options that are only read on startup keep
+// their values, see server.Config.
+func (s *Server) Reload() error {
+	if err := s.hosts.Reload(); err != nil {
+		return fmt.Errorf("%w: %w", server.ErrHostsfileLoad, err)
+	}
+	if s.config.ReloadConfig == nil {
+		return nil
+	}
+	config, err := s.config.ReloadConfig()
+	if err != nil {
+		return fmt.Errorf("Not reloading configuration: %w", err)
+	}
+	s.dns.Reload(config)
+	return nil
+}
+
+// ReopenQueryLog reopens the query log file, e.g. after it has been rotated.
+func (s *Server) ReopenQueryLog() error {
+	return s.dns.ReopenQueryLog()
+}
+
+// AddHost answers the A or AAAA queries for name with ip, in addition to
+// the addresses added for name before. They are served with a TTL of ttl
+// seconds, or HostsTtl if ttl is 0. The records shadow the entries of the
+// hostsfiles for name and are kept when they are reloaded. The cached
+// responses for name are removed, so the address is answered at once.
+func (s *Server) AddHost(name string, ip net.IP, ttl int) error {
+	return s.dns.AddHost(name, ip, ttl)
+}
+
+// AddCNAME answers the queries for name with a CNAME to target, followed
+// by the addresses of target from the hostsfiles or the nameservers. It
+// replaces a CNAME added for name before.
+func (s *Server) AddCNAME(name, target string) error {
+	return s.dns.AddCNAME(name, target)
+}
+
+// RemoveHost removes the addresses and the CNAME added for name. It returns
+// hosts.ErrNotFound if there are none.
+func (s *Server) RemoveHost(name string) error {
+	return s.dns.RemoveHost(name)
+}
+
+// DumpStats logs the statistics of the server.
+func (s *Server) DumpStats() {
+	stats.Dump(s.dns, s.hosts)
+}
+
+// ResolvConf returns the resolver configuration registering the address of
+// config.DnsAddr as the nameserver of the stub zones, search domains and
+// interface domain, and of all other names except with the resolver
+// backend of macOS. The search list and ndots of the host are kept.
+func ResolvConf(config *server.Config) *resolvconf.Config {
+	address, port, _ := net.SplitHostPort(config.DnsAddr)
+	if address == "" {
+		// Listening on all addresses, like 0.0.0.0
+		address = "0.0.0.0"
+	}
+	rc := &resolvconf.Config{Address: address}
+	rc.Port, _ = strconv.Atoi(port)
+
+	// The domains go-dnsmasq answers for, used for /etc/resolver on macOS
+	var domains []string
+	if config.Stub != nil {
+		for domain := range *config.Stub {
+			domains = append(domains, domain)
+		}
+	}
+	domains = append(domains, config.SearchDomains...)
+	if config.IfaceDomain != "" {
+		domains = append(domains, config.IfaceDomain)
+	}
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			rc.Domains = append(rc.Domains, domain)
+		}
+	}
+	sort.Strings(rc.Domains)
+	return rc
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package dnsmasq
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/hostsfile"
+	"github.com/janeczku/go-dnsmasq/server"
+)
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// testConfig returns a Config answering from a hostsfile with
+// printer.local on a free loopback port.
+func testConfig(t *testing.T) Config {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	f.WriteString("10.0.0.7 printer.local\n")
+	f.Close()
+
+	config := DefaultConfig()
+	config.DnsAddr = net.JoinHostPort("127.0.0.1", freePort(t))
+	config.NoRec = true
+	config.Hostsfile = []string{f.Name()}
+	return config
+}
+
+func query(addr, name string) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	c := &dns.Client{Timeout: time.Second}
+	resp, _, err := c.Exchange(m, addr)
+	return resp, err
+}
+
+func TestStartStop(t *testing.T) {
+	config := testConfig(t)
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := query(config.DnsAddr, "printer.local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.7" {
+		t.Errorf("expected 10.0.0.7, got %v", resp.Answer)
+	}
+	if addrs := s.Addrs(); len(addrs) != 2 {
+		t.Errorf("expected a TCP and a UDP address, got %v", addrs)
+	}
+
+	s.Stop()
+	if err := s.Wait(); err != nil {
+		t.Errorf("expected no error after Stop, got %s", err)
+	}
+	if _, err := query(config.DnsAddr, "printer.local."); err == nil {
+		t.Error("expected no answer after Stop")
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Error("expected a second Start to fail")
+	}
+	s.Stop()
+}
+
+func TestStartContext(t *testing.T) {
+	config := testConfig(t)
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	done := make(chan error)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error after cancelling, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop when the context was cancelled")
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	config := testConfig(t)
+	l, err := net.Listen("tcp", config.DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	err = s.Start(context.Background())
+	var lerr *server.ListenError
+	if !errors.As(err, &lerr) || lerr.Net != "tcp" {
+		t.Errorf("expected a TCP ListenError, got %v", err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	config := testConfig(t)
+	config.NoRec = false
+	if _, err := New(config); !errors.Is(err, server.ErrNoUpstreams) {
+		t.Errorf("expected ErrNoUpstreams, got %v", err)
+	}
+
+	config = testConfig(t)
+	config.Hostsfile = []string{"/nonexistent/hosts"}
+	if _, err := New(config); !errors.Is(err, server.ErrHostsfileLoad) {
+		t.Errorf("expected ErrHostsfileLoad, got %v", err)
+	}
+
+	config = testConfig(t)
+	config.StatsdAddress, config.StatsdInterval = "127.0.0.1:8125", 0
+	if _, err := New(config); !errors.Is(err, server.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestStageMiddlewares(t *testing.T) {
+	config := testConfig(t)
+	config.StageMiddlewares = []server.StageMiddleware{{
+		Stage: server.StageHostsfile,
+		Middleware: func(next server.Handler) server.Handler {
+			return server.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeRefused)
+				w.WriteMsg(m)
+			})
+		},
+	}}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	resp, err := query(config.DnsAddr, "printer.local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected the middleware to refuse the query, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	config.StageMiddlewares[0].Stage = "resolve"
+	if _, err := New(config); !errors.Is(err, server.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := testConfig(t)
+	config.ReloadConfig = func() (*server.Config, error) {
+		c := config.Config
+		c.RCacheTtl = 5
+		return &c, nil
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if err := ioutil.WriteFile(config.Hostsfile[0], []byte("10.0.0.8 printer.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := query(config.DnsAddr, "printer.local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.8" {
+		t.Errorf("expected the reloaded address 10.0.0.8, got %v", resp.Answer)
+	}
+
+	config.ReloadConfig = func() (*server.Config, error) { return nil, errors.New("bad flag") }
+	s.config.ReloadConfig = config.ReloadConfig
+	if err := s.Reload(); err == nil {
+		t.Error("expected the reload error to be returned")
+	}
+}
+
+func TestAddHost(t *testing.T) {
+	config := testConfig(t)
+	config.RCache = 10
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	expect := func(want string) {
+		t.Helper()
+		resp, err := query(config.DnsAddr, "printer.local.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("expected %s, got %v", want, resp.Answer)
+		}
+	}
+	expect("10.0.0.7")
+	if err := s.AddHost("printer.local", net.ParseIP("10.0.0.9"), 0); err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.9")
+	// A reload of the hostsfile keeps the added address
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.9")
+	if err := s.RemoveHost("printer.local"); err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.7")
+	if err := s.RemoveHost("printer.local"); !errors.Is(err, hosts.ErrNotFound) {
+		t.Errorf("expected hosts.ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	config := DefaultConfig()
+	config.DnsAddr = "127.0.0.2:5353"
+	config.SearchDomains = []string{"corp.example.", "Corp.Example."}
+	config.Stub = &map[string]*server.StubZone{"lab.example.": nil}
+	rc := ResolvConf(&config.Config)
+	if rc.Address != "127.0.0.2" || rc.Port != 5353 {
+		t.Errorf("unexpected address %s port %d", rc.Address, rc.Port)
+	}
+	if len(rc.Domains) != 2 || rc.Domains[0] != "corp.example" || rc.Domains[1] != "lab.example" {
+		t.Errorf("unexpected domains %v", rc.Domains)
+	}
+	if rc.Search != nil || rc.Ndots != 0 {
+		t.Errorf("expected the search list and ndots of the host to be kept, got %v %d", rc.Search, rc.Ndots)
+	}
+}
+
+func TestHostsfileReloadFatal(t *testing.T) {
+	config := testConfig(t)
+	config.PollInterval = 1
+	config.HostsfileReloadErrorPolicy = hosts.ReloadErrorFatal
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if err := ioutil.WriteFile(config.Hostsfile[0], []byte("1234.1.1.1 printer.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, server.ErrHostsfileLoad) {
+			t.Errorf("expected a hostsfile load error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to stop")
+	}
+}
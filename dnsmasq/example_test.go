@@ -0,0 +1,55 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package dnsmasq_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/janeczku/go-dnsmasq/dnsmasq"
+)
+
+// Answer queries on port 5353 of the loopback address, forwarding them to
+// public nameservers, until the program is interrupted.
+func Example() {
+	config := dnsmasq.DefaultConfig()
+	config.DnsAddr = "127.0.0.1:5353"
+	config.Nameservers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+	config.Hostsfile = []string{"/etc/hosts"}
+
+	s, err := dnsmasq.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := s.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Stop the server explicitly, e.g. when the program that embeds it shuts
+// down.
+func ExampleServer_Stop() {
+	config := dnsmasq.DefaultConfig()
+	config.DnsAddr = "127.0.0.1:5353"
+	config.NoRec = true
+
+	s, err := dnsmasq.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	// ... answer queries until the program shuts down ...
+	s.Stop()
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package dnstap emits dnstap messages to a Frame Streams collector
+// listening on a unix socket.
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Counter is the metric interface used by this package
+type Counter interface {
+	Inc(i int64)
+}
+
+type nopCounter struct{}
+
+func (nopCounter) Inc(_ int64) {}
+
+var (
+	StatsFramesSent    Counter = nopCounter{}
+	StatsFramesDropped Counter = nopCounter{}
+)
+
+const contentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+)
+
+const (
+	queueSize      = 1024
+	flushInterval  = time.Second
+	reconnectDelay = 5 * time.Second
+	writeTimeout   = 2 * time.Second
+)
+
+// Writer sends dnstap messages to a unix socket. Messages are queued and
+// written by a background goroutine. When the queue is full or the collector
+// is unavailable messages are dropped rather than blocking the caller.
+type Writer struct {
+	path     string
+	identity []byte
+	version  []byte
+	queue    chan *Message
+	done     chan struct{}
+}
+
+// NewWriter returns a Writer sending to the unix socket at path.
+// The connection is established (and re-established) in the background.
+func NewWriter(path, identity, version string) *Writer {
+	w := &Writer{
+		path:     path,
+		identity: []byte(identity),
+		version:  []byte(version),
+		queue:    make(chan *Message, queueSize),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues m for writing without blocking.
+func (w *Writer) Send(m *Message) {
+	select {
+	case w.queue <- m:
+	default:
+		StatsFramesDropped.Inc(1)
+	}
+}
+
+// Close stops the writer and closes the connection to the collector.
+func (w *Writer) Close() {
+	close(w.done)
+}
+
+func (w *Writer) run() {
+	for {
+		conn, err := w.connect()
+		if err != nil {
+			log.Debugf("Unable to connect to dnstap socket %s: %s", w.path, err)
+			if !w.discard(reconnectDelay) {
+				return
+			}
+			continue
+		}
+		log.Infof("Connected to dnstap socket %s", w.path)
+		err = w.serve(conn)
+		if err == nil {
+			return
+		}
+		log.Warnf("Lost connection to dnstap socket %s: %s", w.path, err)
+	}
+}
+
+// discard drops queued messages for the duration d. It returns false
+// if the writer was closed in the meantime.
+func (w *Writer) discard(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.queue:
+			StatsFramesDropped.Inc(1)
+		case <-timer.C:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+}
+
+// connect dials the collector and performs the bidirectional
+// Frame Streams handshake.
+func (w *Writer) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", w.path, writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := writeControl(conn, controlReady, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, err := readControl(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != controlAccept {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected control frame type %d", typ)
+	}
+	if err := writeControl(conn, controlStart, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serve writes queued messages to conn until an error occurs or
+// the writer is closed, in which case nil is returned.
+func (w *Writer) serve(conn net.Conn) error {
+	defer conn.Close()
+
+	buf := bufio.NewWriter(conn)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-w.queue:
+			frame := m.marshal(w.identity, w.version)
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeFrame(buf, frame); err != nil {
+				StatsFramesDropped.Inc(1)
+				return err
+			}
+			StatsFramesSent.Inc(1)
+		case <-ticker.C:
+			if buf.Buffered() == 0 {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+		case <-w.done:
+			conn.SetDeadline(time.Now().Add(writeTimeout))
+			buf.Flush()
+			if err := writeControl(conn, controlStop, false); err == nil {
+				readControl(conn)
+			}
+			return nil
+		}
+	}
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func writeControl(w io.Writer, typ uint32, withContentType bool) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, typ)
+	if withContentType {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[:4], controlFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(contentType)))
+		payload = append(payload, field[:]...)
+		payload = append(payload, contentType...)
+	}
+	// A control frame is escaped by a zero length data frame
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(payload)))
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+func readControl(r io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, errors.New("expected control frame")
+	}
+	length := binary.BigEndian.Uint32(hdr[4:])
+	if length < 4 || length > 512 {
+		return 0, fmt.Errorf("invalid control frame length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload[:4]), nil
+}
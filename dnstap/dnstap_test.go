@@ -0,0 +1,82 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w := NewWriter(path, "test", "1.0")
+	defer w.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if typ, err := readControl(conn); err != nil || typ != controlReady {
+		t.Fatalf("expected READY frame, got %d: %v", typ, err)
+	}
+	if err := writeControl(conn, controlAccept, true); err != nil {
+		t.Fatal(err)
+	}
+	if typ, err := readControl(conn); err != nil || typ != controlStart {
+		t.Fatalf("expected START frame, got %d: %v", typ, err)
+	}
+
+	m := &Message{
+		Type:      ClientQuery,
+		QueryAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353},
+		QueryTime: time.Now(),
+		Query:     []byte{0x12, 0x34},
+	}
+	w.Send(m)
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	if expected := m.marshal([]byte("test"), []byte("1.0")); string(frame) != string(expected) {
+		t.Fatalf("unexpected frame %x, expected %x", frame, expected)
+	}
+}
+
+func TestAppendVarint(t *testing.T) {
+	tests := map[uint64][]byte{
+		0:   {0x00},
+		1:   {0x01},
+		127: {0x7f},
+		128: {0x80, 0x01},
+		300: {0xac, 0x02},
+	}
+	for v, expected := range tests {
+		if b := appendVarint(nil, v); string(b) != string(expected) {
+			t.Errorf("varint %d: expected %x, got %x", v, expected, b)
+		}
+	}
+}
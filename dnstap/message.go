@@ -0,0 +1,154 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// MessageType is the dnstap Message.Type
+type MessageType uint64
+
+// Message types as defined in dnstap.proto
+const (
+	ResolverQuery    MessageType = 3
+	ResolverResponse MessageType = 4
+	ClientQuery      MessageType = 5
+	ClientResponse   MessageType = 6
+)
+
+const (
+	dnstapTypeMessage = 1
+
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	socketProtocolUDP = 1
+	socketProtocolTCP = 2
+)
+
+// Message describes a single DNS message observed by the server.
+type Message struct {
+	Type         MessageType
+	TCP          bool
+	QueryAddr    net.Addr
+	ResponseAddr net.Addr
+	QueryTime    time.Time
+	ResponseTime time.Time
+	// Wire format of the query and response messages
+	Query    []byte
+	Response []byte
+}
+
+// marshal encodes m as a dnstap.Dnstap protobuf message.
+func (m *Message) marshal(identity, version []byte) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(m.Type))
+
+	qip, qport := splitAddr(m.QueryAddr)
+	rip, rport := splitAddr(m.ResponseAddr)
+	family := ipFamily(qip)
+	if family == 0 {
+		family = ipFamily(rip)
+	}
+	if family != 0 {
+		msg = appendVarintField(msg, 2, family)
+	}
+	if m.TCP {
+		msg = appendVarintField(msg, 3, socketProtocolTCP)
+	} else {
+		msg = appendVarintField(msg, 3, socketProtocolUDP)
+	}
+	if qip != nil {
+		msg = appendBytesField(msg, 4, qip)
+		msg = appendVarintField(msg, 6, uint64(qport))
+	}
+	if rip != nil {
+		msg = appendBytesField(msg, 5, rip)
+		msg = appendVarintField(msg, 7, uint64(rport))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.Query != nil {
+		msg = appendBytesField(msg, 10, m.Query)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, 12, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.Response != nil {
+		msg = appendBytesField(msg, 14, m.Response)
+	}
+
+	var b []byte
+	if identity != nil {
+		b = appendBytesField(b, 1, identity)
+	}
+	if version != nil {
+		b = appendBytesField(b, 2, version)
+	}
+	b = appendBytesField(b, 14, msg)
+	b = appendVarintField(b, 15, dnstapTypeMessage)
+	return b
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return normalizeIP(a.IP), a.Port
+	case *net.TCPAddr:
+		return normalizeIP(a.IP), a.Port
+	}
+	return nil, 0
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func ipFamily(ip net.IP) uint64 {
+	switch len(ip) {
+	case net.IPv4len:
+		return socketFamilyINET
+	case net.IPv6len:
+		return socketFamilyINET6
+	}
+	return 0
+}
+
+// Minimal protobuf wire format encoding
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/server"
+)
+
+// healthCheckCommand queries a running server, for use as a container
+// HEALTHCHECK in images without dig or nslookup.
+var healthCheckCommand = cli.Command{
+	Name:  "healthcheck",
+	Usage: "Query the server listening on --listen and exit with status 0 if it answers, 1 otherwise",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "listen, l",
+			Value:  "127.0.0.1:53",
+			Usage:  "Address the server listens on `host[:port]`. Unspecified addresses are queried on loopback",
+			EnvVar: "DNSMASQ_LISTEN",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Value: server.HealthCheckName,
+			Usage: "Name to query",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Value: "A",
+			Usage: "Type of the query",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 2 * time.Second,
+			Usage: "How long to wait for the answer",
+		},
+		cli.BoolFlag{
+			Name:   "tcp-only",
+			Usage:  "Query over TCP",
+			EnvVar: "DNSMASQ_TCP_ONLY",
+		},
+	},
+	Action: func(c *cli.Context) {
+		if err := healthCheck(c); err != nil {
+			fmt.Fprintf(os.Stderr, "Health check failed: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func healthCheck(c *cli.Context) error {
+	addr, err := healthCheckAddr(c.String("listen"))
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %s", err)
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(c.String("type"))]
+	if !ok {
+		return fmt.Errorf("invalid query type %q", c.String("type"))
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(c.String("name")), qtype)
+	client := &dns.Client{Timeout: c.Duration("timeout")}
+	if c.Bool("tcp-only") {
+		client.Net = "tcp"
+	}
+	r, _, err := client.Exchange(m, addr)
+	if err != nil {
+		return fmt.Errorf("querying %s: %s", addr, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s answered %s for %s %s", addr, dns.RcodeToString[r.Rcode], m.Question[0].Name, dns.TypeToString[qtype])
+	}
+	return nil
+}
+
+// healthCheckAddr returns the address to query the server listening on
+// listen at.
+func healthCheckAddr(listen string) (string, error) {
+	listen, err := server.ParseListenAddr(listen)
+	if err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(listen)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package hosts
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultGenerateMaxRecords is the number of records $GENERATE lines may
+// expand to when Config.GenerateMaxRecords is not set.
+const DefaultGenerateMaxRecords = 4096
+
+// parseGenerate expands a BIND style $GENERATE line into host entries:
+//
+//	$GENERATE start-stop[/step] lhs [ttl] [class] type rhs
+//
+// Only A and AAAA records are supported. A '$' in lhs and rhs is replaced
+// by the iterator, '${offset,width,radix}' modifies it and '\$' is a
+// literal dollar sign. No more than max entries are returned. Comments
+// must be stripped already, except BIND's ';' comments.
+func parseGenerate(line string, max int) (hostlist, error) {
+	line = strings.Split(line, ";")[0]
+
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "$GENERATE" {
+		return nil, fmt.Errorf("expected '$GENERATE range lhs [ttl] [class] type rhs'")
+	}
+
+	start, stop, step, err := parseGenerateRange(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if n := (stop-start)/step + 1; n > max {
+		return nil, fmt.Errorf("%s would generate %d records, the limit is %d", fields[1], n, max)
+	}
+
+	lhs, rhs := fields[2], fields[len(fields)-1]
+	rrtype := strings.ToUpper(fields[len(fields)-2])
+	// Anything between lhs and type must be a ttl or class
+	for _, f := range fields[3 : len(fields)-2] {
+		if _, err := strconv.ParseUint(f, 10, 32); err != nil && strings.ToUpper(f) != "IN" {
+			return nil, fmt.Errorf("unexpected field %q", f)
+		}
+	}
+	if rrtype != "A" && rrtype != "AAAA" {
+		return nil, fmt.Errorf("unsupported record type %s", rrtype)
+	}
+
+	var hostnames hostlist
+	for i := start; i <= stop; i += step {
+		domain, err := generateSubstitute(lhs, i)
+		if err != nil {
+			return nil, err
+		}
+		address, err := generateSubstitute(rhs, i)
+		if err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil || (rrtype == "A") != (ip.To4() != nil) {
+			return nil, fmt.Errorf("invalid %s address %s", rrtype, address)
+		}
+
+		domain = strings.TrimSuffix(domain, ".")
+		wildcard := strings.HasPrefix(domain, "*.")
+		if wildcard {
+			domain = domain[2:]
+		}
+		hostnames = append(hostnames, newHostname(domain, ip, rrtype == "AAAA", wildcard))
+	}
+	return hostnames, nil
+}
+
+func parseGenerateRange(s string) (start, stop, step int, err error) {
+	step = 1
+	if i := strings.Index(s, "/"); i >= 0 {
+		if step, err = strconv.Atoi(s[i+1:]); err != nil || step < 1 {
+			return 0, 0, 0, fmt.Errorf("invalid step in range %s", s)
+		}
+		s = s[:i]
+	}
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid range %s", s)
+	}
+	if start, err = strconv.Atoi(bounds[0]); err == nil {
+		stop, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || start < 0 || stop < start {
+		return 0, 0, 0, fmt.Errorf("invalid range %s", s)
+	}
+	return start, stop, step, nil
+}
+
+// generateSubstitute replaces the iterator references in s with i.
+func generateSubstitute(s string, i int) (string, error) {
+	var b bytes.Buffer
+	for j := 0; j < len(s); j++ {
+		switch {
+		case s[j] == '\\' && j+1 < len(s) && s[j+1] == '$':
+			b.WriteByte('$')
+			j++
+		case s[j] != '$':
+			b.WriteByte(s[j])
+		case j+1 < len(s) && s[j+1] == '{':
+			end := strings.IndexByte(s[j:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated modifier in %s", s)
+			}
+			v, err := generateModifier(s[j+2:j+end], i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			j += end
+		default:
+			b.WriteString(strconv.Itoa(i))
+		}
+	}
+	return b.String(), nil
+}
+
+// generateModifier formats i according to 'offset[,width[,radix]]'.
+func generateModifier(mod string, i int) (string, error) {
+	parts := strings.Split(mod, ",")
+	if len(parts) > 3 {
+		return "", fmt.Errorf("invalid modifier ${%s}", mod)
+	}
+
+	offset, width, radix := 0, 0, "d"
+	var err error
+	if offset, err = strconv.Atoi(parts[0]); err != nil {
+		return "", fmt.Errorf("invalid offset in ${%s}", mod)
+	}
+	if len(parts) > 1 {
+		if width, err = strconv.Atoi(parts[1]); err != nil || width < 0 {
+			return "", fmt.Errorf("invalid width in ${%s}", mod)
+		}
+	}
+	if len(parts) > 2 {
+		radix = parts[2]
+	}
+
+	switch radix {
+	case "d", "o", "x", "X":
+		return fmt.Sprintf("%0*"+radix, width, i+offset), nil
+	}
+	return "", fmt.Errorf("invalid radix in ${%s}", mod)
+}
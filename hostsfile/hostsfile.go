@@ -6,10 +6,14 @@
 package hosts
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,33 +22,139 @@ import (
 
 // Config stores options for hostsfile
 type Config struct {
-	// Positive value enables polling
+	// The hostsfiles to load, in addition to the path given to
+	// NewHostsfile. A name in a later file shadows the same name in the
+	// files before it.
+	Files []string
+	// Positive value enables polling of all files
 	Poll    int
 	Verbose bool
+	// Maximum number of entries $GENERATE lines may expand to.
+	// Defaults to DefaultGenerateMaxRecords.
+	GenerateMaxRecords int
+	// Characters that start a comment, anywhere on a line. Defaults to
+	// DefaultCommentChars, unless NoComments is set.
+	CommentChars string
+	NoComments   bool
+	// Replace $VAR and ${VAR} with the value of the environment variable.
+	// Lines referring to an unset or empty variable are skipped.
+	EnvExpand bool
+	// Serve the addresses of the network interfaces as <name>.<IfaceDomain>
+	IfaceDiscovery bool
+	IfaceDomain    string
+	// Positive value enables polling of the network interfaces
+	IfacePoll int
+	// TTLs the entries are served with, as reported by LookupAll
+	TTL      int
+	IfaceTTL int
+	// Send SIGHUP to this process and run this command, through the
+	// shell, when a reload finds the content of a file changed.
+	NotifyPID int
+	NotifyCmd string
+	// What the poller does when a changed file cannot be read or has
+	// invalid lines. Defaults to ReloadErrorWarn.
+	ReloadErrorPolicy ReloadErrorPolicy
+	// Called with the error of the failed reload under ReloadErrorFatal.
+	// The files are no longer polled afterwards.
+	OnFatalError func(err error)
 }
 
-// Hostsfile represents a file containing hosts
-type Hostsfile struct {
-	config *Config
-	hosts  *hostlist
-	file   struct {
-		size  int64
-		path  string
-		mtime time.Time
+// ReloadErrorPolicy is what the poller does when a changed hostsfile cannot
+// be loaded. The entries loaded before are kept in any case.
+type ReloadErrorPolicy string
+
+const (
+	// Keep the entries loaded before
+	ReloadErrorIgnore ReloadErrorPolicy = "ignore"
+	// Log a warning and keep the entries loaded before
+	ReloadErrorWarn ReloadErrorPolicy = "warn"
+	// Stop polling and report the error to Config.OnFatalError
+	ReloadErrorFatal ReloadErrorPolicy = "fatal"
+)
+
+// CheckReloadErrorPolicy returns an error if policy is not one of the
+// ReloadErrorPolicy values or empty.
+func CheckReloadErrorPolicy(policy ReloadErrorPolicy) error {
+	switch policy {
+	case "", ReloadErrorIgnore, ReloadErrorWarn, ReloadErrorFatal:
+		return nil
 	}
-	hostMutex sync.RWMutex
+	return fmt.Errorf("'hostsfile-reload-error-policy' must be one of 'ignore', 'warn' or 'fatal'")
+}
+
+// maxDebugEntries is the number of entries up to which every entry is
+// logged at debug level.
+const maxDebugEntries = 1000
+
+// DefaultCommentChars are the characters that start a comment when
+// Config.CommentChars is not set.
+const DefaultCommentChars = "#"
+
+// commentChars returns the characters that start a comment.
+func (c *Config) commentChars() string {
+	switch {
+	case c.NoComments:
+		return ""
+	case c.CommentChars == "":
+		return DefaultCommentChars
+	}
+	return c.CommentChars
+}
+
+// HostsEntry is an address and the hostnames it is served for
+type HostsEntry struct {
+	IP        net.IP
+	Hostnames []string
+	TTL       int
+}
+
+// Hostsfile represents a file containing hosts. A reload builds new
+// indexes and swaps them in, lookups never wait for it. Records can be
+// added at runtime with AddHost and AddCNAME.
+type Hostsfile struct {
+	config  *Config
+	hosts   atomic.Value // *hostIndex
+	ifaces  atomic.Value // *hostIndex
+	runtime atomic.Value // *runtimeRecords
+	files   []hostsFile  // guarded by loadMutex
+	lastErr error        // of the last load, guarded by loadMutex
+
+	loadMutex    sync.Mutex // serializes loading the files
+	runtimeMutex sync.Mutex // serializes changes of the runtime records
+
+	stop      chan struct{} // closed by Close to end polling
+	closeOnce sync.Once
 }
 
-// NewHostsfile returns a new Hostsfile object
+// hostsFile is a loaded hostsfile and its metadata when it was read.
+type hostsFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+	sum   [sha256.Size]byte // of the content, zero before the first load
+}
+
+// NewHostsfile returns a new Hostsfile object serving the entries of the
+// file at path, if not empty, and config.Files.
 func NewHostsfile(path string, config *Config) (*Hostsfile, error) {
-	h := Hostsfile{config: config}
+	var paths []string
+	for _, p := range append([]string{path}, config.Files...) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
 	// when no hostfile is given we return an empty hostlist
-	if path == "" {
-		h.hosts = new(hostlist)
-		return &h, nil
+	if len(paths) == 0 {
+		return NewHostsfileFromReader(nil, config)
 	}
 
-	h.file.path = path
+	h, err := NewHostsfileFromReader(nil, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		h.files = append(h.files, hostsFile{path: p})
+	}
 	if err := h.loadHostEntries(); err != nil {
 		return nil, err
 	}
@@ -53,82 +163,343 @@ func NewHostsfile(path string, config *Config) (*Hostsfile, error) {
 		go h.monitorHostEntries(h.config.Poll)
 	}
 
-	log.Debugf("Found host:ip pairs in %s:", h.file.path)
-	for _, hostname := range *h.hosts {
-		log.Debugf("%s : %s",
-			hostname.domain,
-			hostname.ip.String())
+	hosts := h.hostIndex()
+	log.Debugf("Found %d host:ip pairs in %s", hosts.Len(), strings.Join(paths, ", "))
+	if log.GetLevel() >= log.DebugLevel && hosts.Len() <= maxDebugEntries {
+		for _, e := range hosts.entries {
+			log.Debugf("%s : %s", e.domain, hosts.ips[e.ip])
+		}
+	}
+
+	return h, nil
+}
+
+// NewHostsfileFromReader returns a Hostsfile with the entries read from r,
+// which may be nil for none. Unlike a file, the entries are never read
+// again: polling and Reload only apply to the network interface records.
+func NewHostsfileFromReader(r io.Reader, config *Config) (*Hostsfile, error) {
+	h := &Hostsfile{config: config, stop: make(chan struct{})}
+	h.hosts.Store(newHostIndex(0))
+	h.ifaces.Store(newHostIndex(0))
+	h.runtime.Store(newRuntimeRecords())
+	if r != nil {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		h.setHostEntries(data)
+	}
+
+	if err := h.RefreshInterfaces(); err != nil {
+		return nil, err
+	}
+	if config.IfaceDiscovery && config.IfacePoll > 0 {
+		go h.monitorInterfaces(config.IfacePoll)
+	}
+	return h, nil
+}
+
+// Close stops polling the hostsfiles and the network interfaces. Lookups
+// keep answering from the entries last loaded.
+func (h *Hostsfile) Close() {
+	h.closeOnce.Do(func() { close(h.stop) })
+}
+
+// Check parses the hostsfile at path and returns a problem for every line
+// that is ignored or only partly used when the file is loaded. A line is
+// cut at the first of commentChars.
+func Check(path string, generateMax int, envExpand bool, commentChars string) []error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	return checkHosts(path, data, generateMax, envExpand, commentChars, false)
+}
+
+// checkHosts returns the problems of the hostsfile data read from path, see
+// Check. With syntaxOnly, duplicate entries and lines referring to unset
+// environment variables, which are handled as documented, are not reported.
+func checkHosts(path string, data []byte, generateMax int, envExpand bool, commentChars string, syntaxOnly bool) []error {
+	var err error
+	if generateMax <= 0 {
+		generateMax = DefaultGenerateMaxRecords
+	}
+
+	var errs []error
+	seen := newHostIndex(0)
+	for i, v := range strings.Split(string(data), "\n") {
+		if envExpand {
+			if v, err = expandEnvLine(v, commentChars); err != nil {
+				if !syntaxOnly {
+					errs = append(errs, fmt.Errorf("%s:%d: %s", path, i+1, err))
+				}
+				continue
+			}
+		}
+		line := strings.TrimSpace(stripComment(v, commentChars))
+		if line == "" {
+			continue
+		}
+
+		var hostnames hostlist
+		if strings.HasPrefix(line, "$GENERATE") {
+			if hostnames, err = parseGenerate(line, generateMax); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s", path, i+1, err))
+				continue
+			}
+			generateMax -= len(hostnames)
+		} else {
+			fields := strings.Fields(line)
+			address := fields[0]
+			if j := strings.Index(address, "%"); j >= 0 {
+				ip := net.ParseIP(address[:j])
+				if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+					errs = append(errs, fmt.Errorf("%s:%d: zone ID is only supported for IPv6 link-local addresses: %s", path, i+1, address))
+					continue
+				}
+				address = address[:j]
+			}
+			if net.ParseIP(address) == nil {
+				errs = append(errs, fmt.Errorf("%s:%d: invalid IP address %s", path, i+1, address))
+				continue
+			}
+			if len(fields) < 2 {
+				errs = append(errs, fmt.Errorf("%s:%d: no hostname for %s", path, i+1, address))
+				continue
+			}
+			hostnames = parseLine(v, commentChars)
+		}
+
+		for _, hostname := range hostnames {
+			if err := seen.add(hostname); err != nil && !syntaxOnly {
+				errs = append(errs, fmt.Errorf("%s:%d: duplicate entry %s %s", path, i+1, hostname.ip, hostname.domain))
+			}
+		}
 	}
+	return errs
+}
 
-	return &h, nil
+// Reload reads the hostsfile again and refreshes the network interface
+// records.
+func (h *Hostsfile) Reload() error {
+	if len(h.files) > 0 {
+		if err := h.loadHostEntries(); err != nil {
+			return err
+		}
+	}
+	return h.RefreshInterfaces()
 }
 
+// FindHosts returns the addresses of name, which must be lower case. The
+// result must not be modified. A name with a CNAME added by AddCNAME has
+// no addresses.
 func (h *Hostsfile) FindHosts(name string) (addrs []net.IP, err error) {
 	name = strings.TrimSuffix(name, ".")
-	h.hostMutex.RLock()
-	defer h.hostMutex.RUnlock()
-	addrs = h.hosts.FindHosts(name);
+	r := h.runtimeRecords()
+	if _, ok := r.cnames[name]; ok {
+		return nil, nil
+	}
+	if addrs = r.hosts[name].ips; len(addrs) > 0 {
+		return
+	}
+	addrs = h.hostIndex().FindHosts(name)
+	if len(addrs) == 0 {
+		addrs = h.ifaceIndex().FindHosts(name)
+	}
 	return
 }
 
-func (h *Hostsfile) FindReverse(name string) (host string, err error) {
-	h.hostMutex.RLock()
-	defer h.hostMutex.RUnlock()
+// Len returns the number of host entries currently loaded
+func (h *Hostsfile) Len() int {
+	return h.hostIndex().Len() + h.ifaceIndex().Len() + h.runtimeRecords().len()
+}
+
+func (h *Hostsfile) hostIndex() *hostIndex {
+	return h.hosts.Load().(*hostIndex)
+}
 
-	for _, hostname := range *h.hosts {
-		if r, _ := dns.ReverseAddr(hostname.ip.String()); name == r {
-			host = dns.Fqdn(hostname.domain)
-			break
+func (h *Hostsfile) ifaceIndex() *hostIndex {
+	return h.ifaces.Load().(*hostIndex)
+}
+
+// LookupAll returns a copy of all entries, grouped by address in the order
+// they were loaded, followed by the addresses added with AddHost. Wildcard
+// hostnames are prefixed with '*.'.
+func (h *Hostsfile) LookupAll() []HostsEntry {
+	var entries []HostsEntry
+	for _, list := range []struct {
+		hosts *hostIndex
+		ttl   int
+	}{{h.hostIndex(), h.config.TTL}, {h.ifaceIndex(), h.config.IfaceTTL}} {
+		index := make(map[uint32]int)
+		for _, e := range list.hosts.entries {
+			name := e.domain
+			if e.wildcard {
+				name = "*." + name
+			}
+			i, ok := index[e.ip]
+			if !ok {
+				i = len(entries)
+				index[e.ip] = i
+				ip := make(net.IP, len(list.hosts.ips[e.ip]))
+				copy(ip, list.hosts.ips[e.ip])
+				entries = append(entries, HostsEntry{IP: ip, TTL: list.ttl})
+			}
+			entries[i].Hostnames = append(entries[i].Hostnames, name)
 		}
 	}
-	return
+	r := h.runtimeRecords()
+	for _, name := range r.names {
+		host := r.hosts[name]
+		ttl := host.ttl
+		if ttl == 0 {
+			ttl = h.config.TTL
+		}
+		for _, addr := range host.ips {
+			ip := make(net.IP, len(addr))
+			copy(ip, addr)
+			entries = append(entries, HostsEntry{IP: ip, Hostnames: []string{name}, TTL: ttl})
+		}
+	}
+	return entries
 }
 
-func (h *Hostsfile) loadHostEntries() error {
-	data, err := ioutil.ReadFile(h.file.path)
-	if err != nil {
-		return err
+// FindReverse returns the first name of the address of the in-addr.arpa.
+// or ip6.arpa. name, preferring the names added with AddHost.
+func (h *Hostsfile) FindReverse(name string) (host string, err error) {
+	if ip, ok := reverseAddr(name); ok {
+		if domain, ok := h.runtimeRecords().reverse[string(ip[:])]; ok {
+			return dns.Fqdn(domain), nil
+		}
 	}
+	for _, index := range []*hostIndex{h.hostIndex(), h.ifaceIndex()} {
+		if domain, ok := index.FindReverse(name); ok {
+			return dns.Fqdn(domain), nil
+		}
+	}
+	return
+}
 
-	h.hostMutex.Lock()
-	h.hosts = newHostlist(data)
-	h.hostMutex.Unlock()
+// loadHostEntries reads the hostsfiles and replaces the entries by theirs.
+// The entries are kept if a file cannot be read, or if a file that changed
+// since it was loaded has invalid lines, see Check. Invalid lines are
+// skipped when a file is first loaded. The error is kept for LastError.
+func (h *Hostsfile) loadHostEntries() error {
+	h.loadMutex.Lock()
+	defer h.loadMutex.Unlock()
+	h.lastErr = h.loadFiles()
+	return h.lastErr
+}
 
+// loadFiles implements loadHostEntries, h.loadMutex must be held.
+func (h *Hostsfile) loadFiles() error {
+	files := make([]hostsFile, len(h.files))
+	indexes := make([]*hostIndex, len(h.files))
+	changed := false
+	for i, f := range h.files {
+		mtime, size, err := hostsFileMetadata(f.path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		files[i] = hostsFile{path: f.path, size: size, mtime: mtime, sum: sha256.Sum256(data)}
+		if f.sum == ([sha256.Size]byte{}) || f.sum == files[i].sum {
+			indexes[i] = h.parse(data)
+			continue
+		}
+		if errs := checkHosts(f.path, data, h.config.GenerateMaxRecords, h.config.EnvExpand, h.config.commentChars(), true); len(errs) > 0 {
+			// Not tried again until the file changes again
+			h.files[i].mtime, h.files[i].size = mtime, size
+			if len(errs) > 1 {
+				return fmt.Errorf("%w, and %d more invalid lines", errs[0], len(errs)-1)
+			}
+			return errs[0]
+		}
+		indexes[i] = h.parse(data)
+		changed = true
+	}
+	h.files = files
+	h.hosts.Store(mergeHostIndexes(indexes))
+	if changed {
+		h.notify()
+	}
 	return nil
 }
 
-func (h *Hostsfile) monitorHostEntries(poll int) {
-	hf := h.file
+// LastError returns the error of the last load of the hostsfiles, on
+// startup, by Reload or by the poller, or nil if it succeeded.
+func (h *Hostsfile) LastError() error {
+	h.loadMutex.Lock()
+	defer h.loadMutex.Unlock()
+	return h.lastErr
+}
 
-	if hf.path == "" {
-		return
+// setHostEntries replaces the entries by those parsed from data.
+func (h *Hostsfile) setHostEntries(data []byte) {
+	h.hosts.Store(h.parse(data))
+}
+
+// parse returns the entries of the hostsfile data.
+func (h *Hostsfile) parse(data []byte) *hostIndex {
+	generateMax := h.config.GenerateMaxRecords
+	if generateMax <= 0 {
+		generateMax = DefaultGenerateMaxRecords
 	}
+	if h.config.EnvExpand {
+		data = expandEnv(data, h.config.commentChars())
+	}
+	return parseHosts(string(data), generateMax, h.config.commentChars())
+}
 
-	t := time.Duration(poll) * time.Second
+// monitorHostEntries reloads the hostsfiles when one of them changed.
+func (h *Hostsfile) monitorHostEntries(poll int) {
+	ticker := time.NewTicker(time.Duration(poll) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
 
-	for _ = range time.Tick(t) {
-		//log.Printf("go-dnsmasq: checking %q for updates…", hf.path)
+		h.loadMutex.Lock()
+		files := h.files
+		h.loadMutex.Unlock()
 
-		mtime, size, err := hostsFileMetadata(hf.path)
-		if err != nil {
-			log.Warnf("Error stating hostsfile: %s", err)
-			continue
+		changed := false
+		for _, f := range files {
+			mtime, size, err := hostsFileMetadata(f.path)
+			if err != nil {
+				log.Warnf("Error stating hostsfile: %s", err)
+				continue
+			}
+			if !f.mtime.Equal(mtime) || f.size != size {
+				changed = true
+			}
 		}
-
-		if hf.mtime.Equal(mtime) && hf.size == size {
+		if !changed {
 			continue // no updates
 		}
 
 		if err := h.loadHostEntries(); err != nil {
-			log.Warnf("Error parsing hostsfile: %s", err)
+			switch h.config.ReloadErrorPolicy {
+			case ReloadErrorIgnore:
+			case ReloadErrorFatal:
+				if h.config.OnFatalError == nil {
+					log.Errorf("Error reloading hostsfile, no longer polling: %s", err)
+				} else {
+					h.config.OnFatalError(err)
+				}
+				return
+			default:
+				log.Warnf("Error reloading hostsfile, keeping the previous entries: %s", err)
+			}
+			continue
 		}
 
 		log.Debug("Reloaded updated hostsfile")
-
-		h.hostMutex.Lock()
-		h.file.mtime = mtime
-		h.file.size = size
-		hf = h.file
-		h.hostMutex.Unlock()
 	}
 }
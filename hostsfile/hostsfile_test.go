@@ -2,8 +2,14 @@ package hosts
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 const ipv4Pass = `
@@ -82,40 +88,41 @@ func TestParseLine(t *testing.T) {
 	var hosts hostlist
 
 	// Blank line
-	hosts = parseLine("")
+	hosts = parseLine("", "#")
 	if len(hosts) > 0 {
 		t.Error("Expected to find zero hostnames")
 	}
 
 	// Comment
-	hosts = parseLine("# The following lines are desirable for IPv6 capable hosts")
+	hosts = parseLine("# The following lines are desirable for IPv6 capable hosts", "#")
 	if len(hosts) > 0 {
 		t.Error("Expected to find zero hostnames")
 	}
 
 	// Single word comment
-	hosts = parseLine("#blah")
+	hosts = parseLine("#blah", "#")
 	if len(hosts) > 0 {
 		t.Error("Expected to find zero hostnames")
 	}
 
-	hosts = parseLine("#66.33.99.11              test.domain.com")
+	hosts = parseLine("#66.33.99.11              test.domain.com", "#")
 	if len(hosts) > 0 {
 		t.Error("Expected to find zero hostnames when line is commented out")
 	}
 
 	var err error;
-	err = hosts.add(newHostname("aaa", net.ParseIP("192.168.0.1"), false, false));
+	index := newHostIndex(0)
+	err = index.add(newHostname("aaa", net.ParseIP("192.168.0.1"), false, false));
 	if err != nil {
 		t.Error("Did not expect error on first hostname");
 	}
-	err = hosts.add(newHostname("aaa", net.ParseIP("192.168.0.1"), false, false));
+	err = index.add(newHostname("aaa", net.ParseIP("192.168.0.1"), false, false));
 	if err == nil {
 		t.Error("Expected error on duplicate host");
 	}
 
 	// Not Commented stuff
-	hosts = parseLine("192.168.0.1 broadcasthost test.domain.com	domain.com")
+	hosts = parseLine("192.168.0.1 broadcasthost test.domain.com	domain.com", "#")
 	if !hosts.Contains(newHostname("broadcasthost", net.ParseIP("192.168.0.1"), false, false)) ||
 		!hosts.Contains(newHostname("test.domain.com", net.ParseIP("192.168.0.1"), false, false)) ||
 		!hosts.Contains(newHostname("domain.com", net.ParseIP("192.168.0.1"), false, false)) ||
@@ -124,7 +131,7 @@ func TestParseLine(t *testing.T) {
 	}
 
 	// Wildcard stuff
-	hosts = parseLine("192.168.0.1 *.domain.com mail.domain.com serenity")
+	hosts = parseLine("192.168.0.1 *.domain.com mail.domain.com serenity", "#")
 	if !hosts.Contains(newHostname("domain.com", net.ParseIP("192.168.0.1"), false, true)) ||
 		!hosts.Contains(newHostname("mail.domain.com", net.ParseIP("192.168.0.1"), false, false)) ||
 		!hosts.Contains(newHostname("serenity", net.ParseIP("192.168.0.1"), false, false)) ||
@@ -134,47 +141,51 @@ func TestParseLine(t *testing.T) {
 
 	var ip net.IP;
 
-	ip = hosts.FindHost("api.domain.com");
+	index = newHostIndex(0)
+	for _, h := range hosts {
+		index.add(h)
+	}
+	ip = index.FindHost("api.domain.com");
 	if !net.ParseIP("192.168.0.1").Equal(ip) {
 		t.Error("Can't match wildcard host api.domain.com");
 	}
 
-	ip = hosts.FindHost("google.com")
+	ip = index.FindHost("google.com")
 	if ip != nil {
 		t.Error("We shouldn't resolve google.com");
 	}
 
-	hosts = *newHostlistString(`192.168.0.1 *.domain.com mail.domain.com serenity
-				192.168.0.2	api.domain.com`);
+	index = parseHosts(`192.168.0.1 *.domain.com mail.domain.com serenity
+				192.168.0.2	api.domain.com`, DefaultGenerateMaxRecords, "#");
 
-	if (!net.ParseIP("192.168.0.2").Equal(hosts.FindHost("api.domain.com"))) {
+	if (!net.ParseIP("192.168.0.2").Equal(index.FindHost("api.domain.com"))) {
 		t.Error("Failed matching api.domain.com explicitly");
 	}
-	if (!net.ParseIP("192.168.0.1").Equal(hosts.FindHost("mail.domain.com"))) {
+	if (!net.ParseIP("192.168.0.1").Equal(index.FindHost("mail.domain.com"))) {
 		t.Error("Failed matching api.domain.com explicitly");
 	}
-	if (!net.ParseIP("192.168.0.1").Equal(hosts.FindHost("wildcard.domain.com"))) {
+	if (!net.ParseIP("192.168.0.1").Equal(index.FindHost("wildcard.domain.com"))) {
 		t.Error("Failed matching wildcard.domain.com explicitly");
 	}
-	if (net.ParseIP("192.168.0.1").Equal(hosts.FindHost("sub.wildcard.domain.com"))) {
+	if (net.ParseIP("192.168.0.1").Equal(index.FindHost("sub.wildcard.domain.com"))) {
 		t.Error("Failed not matching sub.wildcard.domain.com explicitly");
 	}
 
 	// IPv6 (not link-local)
-	hosts = parseLine("2a02:7a8:1:250::80:1		rtvslo.si img.rtvslo.si")
+	hosts = parseLine("2a02:7a8:1:250::80:1		rtvslo.si img.rtvslo.si", "#")
 	if !hosts.Contains(newHostname("img.rtvslo.si", net.ParseIP("2a02:7a8:1:250::80:1"), true, false)) ||
 		len(hosts) != 2 {
 		t.Error("Expected to find rtvslo.si ipv6, two hosts")
 	}
 
 	// Loopback addresses
-	hosts = parseLine("::1 blocked.domain")
+	hosts = parseLine("::1 blocked.domain", "#")
 	if !hosts.Contains(newHostname("blocked.domain", net.ParseIP("::1"), true, false)) ||
 		len(hosts) != 1 {
 		t.Error("Expected to find blocked.domain ipv6")
 	}
 
-	hosts = parseLine("127.0.0.1 blocked.domain")
+	hosts = parseLine("127.0.0.1 blocked.domain", "#")
 	if !hosts.Contains(newHostname("blocked.domain", net.ParseIP("127.0.0.1"), false, false)) ||
 		len(hosts) != 1 {
 		t.Error("Expected to find blocked.domain ipv4")
@@ -197,3 +208,628 @@ func TestHostname(t *testing.T) {
 		t.Errorf("Wildcard should be %t", wildcard)
 	}
 }
+
+func TestGenerate(t *testing.T) {
+	hosts := parseHosts(`$GENERATE 1-254 host-$ A 192.168.1.$
+$GENERATE 0-30/10 node${100,4,x}.example.com. 300 IN AAAA 2001:db8::${0,0,X}
+$GENERATE 1-2 \$weird-$ CNAME other`, DefaultGenerateMaxRecords, "#")
+
+	if hosts.Len() != 258 {
+		t.Fatalf("expected 258 entries, got %d", hosts.Len())
+	}
+	if !net.ParseIP("192.168.1.42").Equal(hosts.FindHost("host-42")) {
+		t.Error("Failed matching generated host-42")
+	}
+	if !net.ParseIP("2001:db8::1E").Equal(hosts.FindHost("node0082.example.com")) {
+		t.Error("Failed matching generated node0082.example.com")
+	}
+
+	hosts = parseHosts("$GENERATE 1-254 host-$ A 192.168.1.$", 100, "#")
+	if hosts.Len() != 0 {
+		t.Errorf("expected $GENERATE beyond the limit to be skipped, got %d entries", hosts.Len())
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	if name := interfaceHostname("veth1A2b.100@if5"); name != "veth1a2b-100-if5" {
+		t.Errorf("expected veth1a2b-100-if5, got %s", name)
+	}
+
+	h, err := NewHostsfileFromReader(nil, &Config{IfaceDiscovery: true, IfaceDomain: ".iface.local."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := h.FindHosts(interfaceHostname(iface.Name) + ".iface.local.")
+		if err != nil || len(addrs) == 0 {
+			t.Errorf("expected addresses for loopback interface %s", iface.Name)
+		}
+		return
+	}
+	t.Skip("no loopback interface found")
+}
+
+func TestLookupAll(t *testing.T) {
+	h, err := NewHostsfileFromReader(strings.NewReader("192.168.0.1 *.domain.com mail.domain.com\n192.168.0.2 api.domain.com\n192.168.0.1 serenity\n"), &Config{TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := h.LookupAll()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	e := entries[0]
+	if !e.IP.Equal(net.ParseIP("192.168.0.1")) || e.TTL != 10 ||
+		strings.Join(e.Hostnames, " ") != "*.domain.com mail.domain.com serenity" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	// The result is a copy
+	entries[1].IP[len(entries[1].IP)-1] = 99
+	if addrs, _ := h.FindHosts("api.domain.com"); !addrs[0].Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("LookupAll result shares memory with the hostsfile")
+	}
+}
+
+func TestParseLineZoneID(t *testing.T) {
+	for _, line := range []string{
+		"fe80::1%lo0 myhost.local", // macOS, interface name
+		"fe80::1%2	myhost.local",   // Linux, interface index
+		"fe80::1%eth0 myhost.local",
+	} {
+		hosts := parseLine(line, "#")
+		if len(hosts) != 1 || !hosts.Contains(newHostname("myhost.local", net.ParseIP("fe80::1"), true, false)) {
+			t.Errorf("%q: expected myhost.local with fe80::1, got %v", line, hosts)
+			continue
+		}
+		rr := &dns.AAAA{Hdr: dns.RR_Header{Name: "myhost.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 10}, AAAA: hosts[0].ip}
+		if want := "myhost.local.\t10\tIN\tAAAA\tfe80::1"; rr.String() != want {
+			t.Errorf("%q: expected %q, got %q", line, want, rr.String())
+		}
+	}
+
+	// Zone IDs are only valid for link-local addresses
+	if hosts := parseLine("2a02:7a8:1:250::80:1%eth0 myhost.local", "#"); len(hosts) != 0 {
+		t.Errorf("expected global address with zone ID to be skipped, got %v", hosts)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comment
+127.0.0.1 localhost
+192.168.0.1 api.domain.com
+192.168.0.1 api.domain.com
+1234.1.1.1 bad.ip
+192.168.0.2
+2a02:7a8:1:250::80:1%eth0 myhost.local
+fe80::1%eth0 myhost.local
+$GENERATE 1-2 \$weird-$ CNAME other
+`)
+	f.Close()
+
+	errs := Check(f.Name(), 0, false, "#")
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, strings.TrimPrefix(err.Error(), f.Name()+":"))
+	}
+	want := []string{
+		"4: duplicate entry 192.168.0.1 api.domain.com",
+		"5: invalid IP address 1234.1.1.1",
+		"6: no hostname for 192.168.0.2",
+		"7: zone ID is only supported for IPv6 link-local addresses: 2a02:7a8:1:250::80:1%eth0",
+		"9: unsupported record type CNAME",
+	}
+	if got := strings.Join(lines, "\n"); got != strings.Join(want, "\n") {
+		t.Error(Diff(strings.Join(want, "\n"), got))
+	}
+
+	if errs := Check(f.Name()+".missing", 0, false, "#"); len(errs) != 1 {
+		t.Errorf("expected an error for a missing file, got %v", errs)
+	}
+}
+
+const envHosts = `$HOSTS_TEST_POD_IP mypod.cluster.local # ${HOSTS_TEST_UNSET}
+${HOSTS_TEST_POD_IP} other.cluster.local
+$HOSTS_TEST_UNSET missing.cluster.local
+$GENERATE 1-2 host-$ A 192.168.1.$
+`
+
+func TestEnvExpand(t *testing.T) {
+	os.Setenv("HOSTS_TEST_POD_IP", "10.1.2.3")
+	defer os.Unsetenv("HOSTS_TEST_POD_IP")
+
+	h, err := NewHostsfileFromReader(strings.NewReader(envHosts), &Config{EnvExpand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"mypod.cluster.local":   "10.1.2.3",
+		"other.cluster.local":   "10.1.2.3",
+		"missing.cluster.local": "",
+		"host-2":                "192.168.1.2",
+	} {
+		addrs, _ := h.FindHosts(name)
+		if want == "" && len(addrs) != 0 || want != "" && (len(addrs) != 1 || !addrs[0].Equal(net.ParseIP(want))) {
+			t.Errorf("%s: expected %q, got %v", name, want, addrs)
+		}
+	}
+
+	// Without the option the variables are not expanded
+	h, err = NewHostsfileFromReader(strings.NewReader(envHosts), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("mypod.cluster.local"); len(addrs) != 0 {
+		t.Errorf("expected no expansion, got %v", addrs)
+	}
+}
+
+func TestEnvExpandFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(envHosts)
+	f.Close()
+	os.Setenv("HOSTS_TEST_POD_IP", "10.1.2.3")
+	defer os.Unsetenv("HOSTS_TEST_POD_IP")
+
+	h, err := NewHostsfile(f.Name(), &Config{EnvExpand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading picks up the current environment
+	os.Setenv("HOSTS_TEST_POD_IP", "10.1.2.4")
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("mypod.cluster.local"); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.1.2.4")) {
+		t.Errorf("expected the new address after reloading, got %v", addrs)
+	}
+
+	errs := Check(f.Name(), 0, true, "#")
+	if len(errs) != 1 || errs[0].Error() != f.Name()+":3: environment variable HOSTS_TEST_UNSET is not set" {
+		t.Errorf("expected the unset variable to be reported, got %v", errs)
+	}
+}
+
+func TestNewHostsfileFromReader(t *testing.T) {
+	h, err := NewHostsfileFromReader(strings.NewReader("10.0.0.1 a.local\n$GENERATE 1-3 host-$ A 10.0.1.$\n"), &Config{GenerateMaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("a.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected a.local, got %v", addrs)
+	}
+	if h.Len() != 1 {
+		t.Errorf("expected the $GENERATE line over the limit to be skipped, got %d entries", h.Len())
+	}
+	if err := h.Reload(); err != nil || h.Len() != 1 {
+		t.Errorf("expected Reload to keep the entries, got %v and %d entries", err, h.Len())
+	}
+
+	if h, err := NewHostsfileFromReader(nil, &Config{}); err != nil || h.Len() != 0 {
+		t.Errorf("expected an empty hostsfile, got %v", err)
+	}
+
+	if _, err := NewHostsfile("/nonexistent/hosts", &Config{}); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to fail, got %v", err)
+	}
+}
+
+func TestCommentChars(t *testing.T) {
+	const data = `; generated by deploy
+192.168.0.1 semi.local ; trailing
+// generated by other tool
+192.168.0.2 slash.local // trailing
+# hash comment
+192.168.0.3 hash.local # trailing
+192.168.0.4 after.local`
+
+	for _, test := range []struct {
+		config *Config
+		want   map[string]int // number of addresses by hostname
+	}{
+		// '#' by default, other comment lines are invalid and skipped
+		{&Config{}, map[string]int{"semi.local": 1, "slash.local": 1, "hash.local": 1, "after.local": 1, "trailing": 2}},
+		{&Config{CommentChars: ";"}, map[string]int{"semi.local": 1, "slash.local": 1, "hash.local": 1, "after.local": 1, "trailing": 2, "#": 1}},
+		{&Config{CommentChars: ";/#"}, map[string]int{"semi.local": 1, "slash.local": 1, "hash.local": 1, "after.local": 1, "trailing": 0}},
+		{&Config{NoComments: true}, map[string]int{"semi.local": 1, "slash.local": 1, "hash.local": 1, "after.local": 1, "trailing": 3, "#": 1, ";": 1}},
+	} {
+		h, err := NewHostsfileFromReader(strings.NewReader(data), test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range test.want {
+			if addrs, _ := h.FindHosts(name); len(addrs) != want {
+				t.Errorf("%+v: %s: expected %d addresses, got %v", test.config, name, want, addrs)
+			}
+		}
+	}
+}
+
+func TestCheckCommentChars(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("; comment\n192.168.0.1 host.local ; trailing\n")
+	f.Close()
+
+	if errs := Check(f.Name(), 0, false, ";"); len(errs) != 0 {
+		t.Errorf("expected no problems, got %v", errs)
+	}
+	if errs := Check(f.Name(), 0, false, ""); len(errs) != 1 {
+		t.Errorf("expected the comment line to be reported without comment characters, got %v", errs)
+	}
+}
+
+func TestHostIndex(t *testing.T) {
+	h, err := NewHostsfileFromReader(strings.NewReader(`192.168.0.1 one.local *.wild.local
+192.168.0.2 two.local one.local
+2001:db8::1 six.local
+192.168.0.1 other.local
+`), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second address does not change the list shared with other names
+	if addrs, _ := h.FindHosts("one.local."); len(addrs) != 2 || !addrs[1].Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("expected both addresses of one.local, got %v", addrs)
+	}
+	if addrs, _ := h.FindHosts("other.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("expected one address for other.local, got %v", addrs)
+	}
+
+	for name, want := range map[string]string{
+		"1.0.168.192.in-addr.arpa.":  "one.local.",
+		"2.0.168.192.IN-ADDR.ARPA.":  "two.local.",
+		"3.0.168.192.in-addr.arpa.":  "",
+		"01.0.168.192.in-addr.arpa.": "",
+		"0.168.192.in-addr.arpa.":    "",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "six.local.",
+		"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "",
+	} {
+		if host, _ := h.FindReverse(name); host != want {
+			t.Errorf("%s: expected %q, got %q", name, want, host)
+		}
+	}
+
+	// Lookups do not allocate, however large the hostsfile
+	if n := testing.AllocsPerRun(100, func() {
+		h.FindHosts("one.local.")
+		h.FindHosts("a.wild.local.")
+		h.FindHosts("missing.local.")
+	}); n != 0 {
+		t.Errorf("expected no allocations, got %v", n)
+	}
+}
+
+func TestReloadSwap(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.1 host.local\n")
+	f.Close()
+	h, err := NewHostsfile(f.Name(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "10.0.%d.%d host%d.local\n", i/256, i%256, i)
+	}
+	b.WriteString("10.0.0.2 host.local\n")
+	if err := ioutil.WriteFile(f.Name(), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups during the reload see either the old or the new entries
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := h.Reload(); err != nil {
+			t.Error(err)
+		}
+	}()
+	for reloading := true; reloading; {
+		select {
+		case <-done:
+			reloading = false
+		default:
+		}
+		addrs, _ := h.FindHosts("host.local.")
+		if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.1")) && !addrs[0].Equal(net.ParseIP("10.0.0.2")) {
+			t.Fatalf("expected the old or the new address, got %v", addrs)
+		}
+	}
+	if h.Len() != 10001 {
+		t.Errorf("expected 10001 entries after the reload, got %d", h.Len())
+	}
+}
+
+func TestMultipleFiles(t *testing.T) {
+	var paths []string
+	for _, data := range []string{
+		"10.0.0.1 static.local shared.local\n10.0.0.2 shared.local\n10.0.0.9 *.wild.local\n",
+		"10.0.1.1 registry.local shared.local\n10.0.1.9 *.wild.local\n",
+	} {
+		f, err := ioutil.TempFile("", "hosts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(data)
+		f.Close()
+		paths = append(paths, f.Name())
+	}
+
+	h, err := NewHostsfile("", &Config{Files: paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]string{
+		"static.local.":   {"10.0.0.1"},
+		"registry.local.": {"10.0.1.1"},
+		// Both addresses of the first file are shadowed
+		"shared.local.": {"10.0.1.1"},
+		"a.wild.local.": {"10.0.1.9"},
+	} {
+		addrs, _ := h.FindHosts(name)
+		var got []string
+		for _, ip := range addrs {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+	if h.Len() != 4 {
+		t.Errorf("expected 4 entries without the shadowed ones, got %d", h.Len())
+	}
+
+	// A missing file fails the reload and keeps the entries
+	os.Remove(paths[1])
+	if err := h.Reload(); err == nil {
+		t.Error("expected the reload to fail without the second file")
+	}
+	if addrs, _ := h.FindHosts("registry.local."); len(addrs) != 1 {
+		t.Errorf("expected the entries to be kept, got %v", addrs)
+	}
+
+	// The path argument is loaded first
+	h, err = NewHostsfile(paths[0], &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("shared.local."); len(addrs) != 2 {
+		t.Errorf("expected both addresses of shared.local, got %v", addrs)
+	}
+}
+
+func TestRuntimeRecords(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.1 web.local db.local\n")
+	f.Close()
+	h, err := NewHostsfile(f.Name(), &Config{TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Added addresses shadow the hostsfile
+	if err := h.AddHost("Web.local.", net.ParseIP("10.0.1.1"), 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddHost("web.local", net.ParseIP("fd00::1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddHost("web.local", net.ParseIP("10.0.1.1"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("web.local."); len(addrs) != 2 || !addrs[0].Equal(net.ParseIP("10.0.1.1")) {
+		t.Errorf("expected the added addresses of web.local, got %v", addrs)
+	}
+	if ttl, ok := h.HostTTL("web.local."); !ok || ttl != 60 {
+		t.Errorf("expected the TTL 60 of the last AddHost, got %d", ttl)
+	}
+	if _, ok := h.HostTTL("db.local."); ok {
+		t.Error("expected no TTL for a hostsfile entry")
+	}
+	if host, _ := h.FindReverse("1.1.0.10.in-addr.arpa."); host != "web.local." {
+		t.Errorf("expected the reverse name of the added address, got %q", host)
+	}
+	if h.Len() != 4 {
+		t.Errorf("expected 4 entries, got %d", h.Len())
+	}
+	if entries := h.LookupAll(); len(entries) != 3 || entries[2].TTL != 60 || entries[2].Hostnames[0] != "web.local" {
+		t.Errorf("expected the added addresses to be listed with their TTL, got %v", entries)
+	}
+
+	// A reload keeps them
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.2 web.local db.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("web.local."); len(addrs) != 2 {
+		t.Errorf("expected the added addresses to survive a reload, got %v", addrs)
+	}
+
+	if err := h.AddCNAME("www.local", "web.local."); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddCNAME("alias.local", "www.local"); err != nil {
+		t.Fatal(err)
+	}
+	if chain := h.FindCNAMEChain("alias.local."); len(chain) != 2 || chain[0] != "www.local." || chain[1] != "web.local." {
+		t.Errorf("expected the CNAME chain to web.local, got %v", chain)
+	}
+	for _, err := range []error{
+		h.AddCNAME("web.local", "db.local"),
+		h.AddCNAME("web.local", "alias.local"),
+		h.AddCNAME("www.local", "www.local"),
+		h.AddHost("www.local", net.ParseIP("10.0.1.2"), 0),
+		h.AddHost("bad..local", net.ParseIP("10.0.1.2"), 0),
+		h.AddHost("new.local", nil, 0),
+		h.AddHost("new.local", net.ParseIP("10.0.1.2"), -1),
+	} {
+		if err == nil {
+			t.Error("expected an error")
+		}
+	}
+	// A loop through an existing chain is rejected
+	if err := h.AddCNAME("web2.local", "alias.local"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddCNAME("www.local", "web2.local"); err == nil {
+		t.Error("expected a CNAME loop to be rejected")
+	}
+
+	// Removing web.local serves the hostsfile entry again
+	if err := h.RemoveHost("web.local"); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, _ := h.FindHosts("web.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the hostsfile address of web.local, got %v", addrs)
+	}
+	if host, _ := h.FindReverse("1.1.0.10.in-addr.arpa."); host != "" {
+		t.Errorf("expected no reverse name for the removed address, got %q", host)
+	}
+	if err := h.RemoveHost("web.local"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRuntimeRecordsConcurrent(t *testing.T) {
+	h, err := NewHostsfileFromReader(nil, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			name := fmt.Sprintf("host%d.local", i%10)
+			h.AddHost(name, net.IPv4(10, 0, 0, byte(i)), 0)
+			if i%3 == 0 {
+				h.RemoveHost(name)
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		h.FindHosts("host1.local.")
+		h.FindReverse("1.0.0.10.in-addr.arpa.")
+		h.LookupAll()
+	}
+}
+
+func TestReloadErrorPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.1 host.local\n")
+	f.Close()
+	h, err := NewHostsfile(f.Name(), &Config{Poll: 1, ReloadErrorPolicy: ReloadErrorWarn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	waitFor := func(cond func() bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A malformed update keeps the previous entries
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.2 host.local\n1234.1.1.1 bad.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return h.LastError() != nil }) {
+		t.Fatal("expected the poller to report the invalid line")
+	}
+	if !strings.Contains(h.LastError().Error(), ":2: invalid IP address 1234.1.1.1") {
+		t.Errorf("expected the invalid line to be reported, got %v", h.LastError())
+	}
+	if addrs, _ := h.FindHosts("host.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the previous entries to be served, got %v", addrs)
+	}
+
+	// Loaded once it is fixed
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.2 host.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return h.LastError() == nil }) {
+		t.Fatalf("expected the fixed file to be loaded, got %v", h.LastError())
+	}
+	if addrs, _ := h.FindHosts("host.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the new entries to be served, got %v", addrs)
+	}
+
+	// Reported to OnFatalError, after which the file is no longer polled
+	fatal := make(chan error, 1)
+	h, err = NewHostsfile(f.Name(), &Config{
+		Poll:              1,
+		ReloadErrorPolicy: ReloadErrorFatal,
+		OnFatalError:      func(err error) { fatal <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := ioutil.WriteFile(f.Name(), []byte("1234.1.1.1 bad.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-fatal:
+		if !strings.Contains(err.Error(), "invalid IP address 1234.1.1.1") {
+			t.Errorf("expected the invalid line to be reported, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reload error to be reported")
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.3 host.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if addrs, _ := h.FindHosts("host.local."); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the file to be no longer polled, got %v", addrs)
+	}
+
+	if err := CheckReloadErrorPolicy("retry"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
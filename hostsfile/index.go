@@ -0,0 +1,215 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package hosts
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostIndex holds host entries indexed for lookups. It is built once and
+// not modified after it is published, so that it can be read without
+// locking. Every address is stored once however many names it has, and
+// the names share the memory of the parsed file.
+type hostIndex struct {
+	entries   []hostEntry         // in the order they were added
+	ips       []net.IP            // interned addresses, by hostEntry.ip
+	ipLists   [][]net.IP          // a list with only ips[i], shared by the names of a single address
+	ipIndex   map[string]uint32   // index in ips by 16 byte address
+	reverse   []uint32            // the first entry of ips[i]
+	names     map[string][]net.IP // addresses by name
+	wildcards map[string][]net.IP // addresses by the domain below a wildcard
+}
+
+// hostEntry is a name and address of a hostIndex.
+type hostEntry struct {
+	domain   string
+	ip       uint32
+	wildcard bool
+}
+
+// newHostIndex returns an empty index with room for about size entries.
+func newHostIndex(size int) *hostIndex {
+	return &hostIndex{
+		entries:   make([]hostEntry, 0, size),
+		ipIndex:   make(map[string]uint32),
+		names:     make(map[string][]net.IP, size),
+		wildcards: make(map[string][]net.IP),
+	}
+}
+
+// add adds hostname to the index. It fails if the index has the same name
+// and address already.
+func (x *hostIndex) add(h *hostname) error {
+	key := h.ip.To16()
+	if key == nil {
+		return fmt.Errorf("Invalid address for hostname entry %#v", h)
+	}
+	i, ok := x.ipIndex[string(key)]
+	if !ok {
+		i = uint32(len(x.ips))
+		x.ipIndex[string(key)] = i
+		x.ips = append(x.ips, h.ip)
+		x.ipLists = append(x.ipLists, []net.IP{h.ip})
+		x.reverse = append(x.reverse, uint32(len(x.entries)))
+	}
+
+	m := x.names
+	if h.wildcard {
+		m = x.wildcards
+	}
+	addrs := m[h.domain]
+	for _, ip := range addrs {
+		if ip.Equal(h.ip) {
+			return fmt.Errorf("Duplicate hostname entry for %#v", h)
+		}
+	}
+	if addrs == nil {
+		// Most names have a single address, they share its list. The
+		// capacity of one makes append copy it for a second address.
+		m[h.domain] = x.ipLists[i]
+	} else {
+		m[h.domain] = append(addrs, x.ips[i])
+	}
+	x.entries = append(x.entries, hostEntry{domain: h.domain, ip: i, wildcard: h.wildcard})
+	return nil
+}
+
+// mergeHostIndexes returns an index with the entries of indexes, in
+// order. A name in a later index shadows the same name in the ones before
+// it.
+func mergeHostIndexes(indexes []*hostIndex) *hostIndex {
+	if len(indexes) == 1 {
+		return indexes[0]
+	}
+	size := 0
+	for _, x := range indexes {
+		size += x.Len()
+	}
+	merged := newHostIndex(size)
+	for i, x := range indexes {
+	entries:
+		for _, e := range x.entries {
+			for _, later := range indexes[i+1:] {
+				m := later.names
+				if e.wildcard {
+					m = later.wildcards
+				}
+				if _, ok := m[e.domain]; ok {
+					continue entries
+				}
+			}
+			ip := x.ips[e.ip]
+			merged.add(&hostname{domain: e.domain, ip: ip, ipv6: ip.To4() == nil, wildcard: e.wildcard})
+		}
+	}
+	return merged
+}
+
+// Len returns the number of entries.
+func (x *hostIndex) Len() int {
+	return len(x.entries)
+}
+
+// FindHosts returns the addresses of name, or if there are none the
+// addresses of a wildcard matching a single label in front of its domain.
+// name must be lower case without the trailing dot. The result must not be
+// modified.
+func (x *hostIndex) FindHosts(name string) []net.IP {
+	if addrs := x.names[name]; len(addrs) > 0 {
+		return addrs
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return x.wildcards[name[i+1:]]
+	}
+	return nil
+}
+
+// FindHost returns the first address of name, see FindHosts.
+func (x *hostIndex) FindHost(name string) net.IP {
+	if addrs := x.FindHosts(name); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return nil
+}
+
+// FindReverse returns the first name added for the address of the
+// in-addr.arpa. or ip6.arpa. name, without the trailing dot.
+func (x *hostIndex) FindReverse(name string) (string, bool) {
+	ip, ok := reverseAddr(name)
+	if !ok {
+		return "", false
+	}
+	i, ok := x.ipIndex[string(ip[:])]
+	if !ok {
+		return "", false
+	}
+	return x.entries[x.reverse[i]].domain, true
+}
+
+// reverseAddr returns the 16 byte address of the in-addr.arpa. or ip6.arpa.
+// name, the reverse of dns.ReverseAddr.
+func reverseAddr(name string) (ip [16]byte, ok bool) {
+	const v4Suffix, v6Suffix = ".in-addr.arpa.", ".ip6.arpa."
+	switch {
+	case len(name) > len(v4Suffix) && strings.EqualFold(name[len(name)-len(v4Suffix):], v4Suffix):
+		labels := name[:len(name)-len(v4Suffix)]
+		ip[10], ip[11] = 0xff, 0xff
+		for i := 15; i >= 12; i-- {
+			label := labels
+			if j := strings.IndexByte(labels, '.'); j >= 0 {
+				label, labels = labels[:j], labels[j+1:]
+			} else if i != 12 {
+				return ip, false
+			} else {
+				labels = ""
+			}
+			n, err := strconv.Atoi(label)
+			// Only the canonical form, as written by dns.ReverseAddr
+			if err != nil || n < 0 || n > 255 || label[0] == '+' || len(label) > 1 && label[0] == '0' {
+				return ip, false
+			}
+			ip[i] = byte(n)
+		}
+		return ip, labels == ""
+	case len(name) > len(v6Suffix) && strings.EqualFold(name[len(name)-len(v6Suffix):], v6Suffix):
+		labels := name[:len(name)-len(v6Suffix)]
+		if len(labels) != 63 {
+			return ip, false
+		}
+		for i := 0; i < 32; i++ {
+			if i > 0 && labels[2*i-1] != '.' {
+				return ip, false
+			}
+			n, ok := hexNibble(labels[2*i])
+			if !ok {
+				return ip, false
+			}
+			// The last nibble comes first
+			b := 15 - i/2
+			if i%2 == 0 {
+				ip[b] |= n
+			} else {
+				ip[b] |= n << 4
+			}
+		}
+		return ip, true
+	}
+	return ip, false
+}
+
+func hexNibble(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package hosts
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RefreshInterfaces replaces the interface entries with the addresses
+// currently assigned to the network interfaces of the host. It is a
+// no-op unless interface discovery is enabled.
+func (h *Hostsfile) RefreshInterfaces() error {
+	if !h.config.IfaceDiscovery {
+		return nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	suffix := "." + strings.ToLower(strings.Trim(h.config.IfaceDomain, "."))
+	index := newHostIndex(0)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Warnf("Failed to get addresses of interface %s: %s", iface.Name, err)
+			continue
+		}
+		domain := interfaceHostname(iface.Name) + suffix
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !(ipnet.IP.IsGlobalUnicast() || ipnet.IP.IsLoopback()) {
+				continue
+			}
+			// An address listed twice is added once
+			index.add(newHostname(domain, ipnet.IP, ipnet.IP.To4() == nil, false))
+		}
+	}
+
+	h.ifaces.Store(index)
+
+	log.Debugf("Found %d interface addresses", index.Len())
+	return nil
+}
+
+func (h *Hostsfile) monitorInterfaces(poll int) {
+	ticker := time.NewTicker(time.Duration(poll) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := h.RefreshInterfaces(); err != nil {
+			log.Warnf("Error listing network interfaces: %s", err)
+		}
+	}
+}
+
+// interfaceHostname turns an interface name into a valid DNS label.
+func interfaceHostname(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package hosts
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// notify sends SIGHUP to Config.NotifyPID and starts Config.NotifyCmd
+// after the content of a hostsfile changed. Failures are logged.
+func (h *Hostsfile) notify() {
+	if pid := h.config.NotifyPID; pid > 0 {
+		if err := signalProcess(pid, syscall.SIGHUP); err != nil {
+			log.Warnf("Error notifying process %d of the hostsfile change: %s", pid, err)
+		} else {
+			log.Debugf("Sent SIGHUP to process %d", pid)
+		}
+	}
+	if command := h.config.NotifyCmd; command != "" {
+		go runNotifyCmd(command)
+	}
+}
+
+func signalProcess(pid int, sig os.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// runNotifyCmd runs command through the shell and logs its output if it
+// fails.
+func runNotifyCmd(command string) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf("Error running hostsfile notify command %q: %s: %s", command, err, out)
+		return
+	}
+	log.Debugf("Ran hostsfile notify command %q", command)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	marker := filepath.Join(dir, "notified")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1 host.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	h, err := NewHostsfile(path, &Config{NotifyPID: os.Getpid(), NotifyCmd: "echo >> " + marker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	notified := func() bool {
+		select {
+		case <-sig:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	// Neither the initial load nor a reload of the same content notify
+	if notified() {
+		t.Error("expected no SIGHUP after the initial load")
+	}
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1 host.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if notified() {
+		t.Error("expected no SIGHUP after reloading an unchanged file")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("expected the command not to run for an unchanged file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("10.0.0.2 host.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !notified() {
+		t.Error("expected a SIGHUP after reloading a changed file")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(marker); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the command to run after reloading a changed file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package hosts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNotFound is returned by RemoveHost for a name that has no records
+// added with AddHost or AddCNAME.
+var ErrNotFound = errors.New("No records were added for the name")
+
+// maxCNAMEChain is the number of CNAMEs FindCNAMEChain follows.
+const maxCNAMEChain = 8
+
+// runtimeRecords are the records added with AddHost and AddCNAME. Like a
+// hostIndex it is not modified after it is published, a change copies it.
+// The records are kept apart from the hostsfiles so that reloading them
+// does not drop the records.
+type runtimeRecords struct {
+	names   []string               // with addresses, in the order they were added
+	hosts   map[string]runtimeHost // by name, lower case without the trailing dot
+	cnames  map[string]string      // target by name, both without the trailing dot
+	reverse map[string]string      // the first name of an address, by 16 byte address
+}
+
+type runtimeHost struct {
+	ips []net.IP
+	ttl int
+}
+
+func newRuntimeRecords() *runtimeRecords {
+	return &runtimeRecords{
+		hosts:   make(map[string]runtimeHost),
+		cnames:  make(map[string]string),
+		reverse: make(map[string]string),
+	}
+}
+
+// clone returns a copy of r that can be modified.
+func (r *runtimeRecords) clone() *runtimeRecords {
+	c := newRuntimeRecords()
+	c.names = append(c.names, r.names...)
+	for name, host := range r.hosts {
+		c.hosts[name] = runtimeHost{ips: append([]net.IP(nil), host.ips...), ttl: host.ttl}
+	}
+	for name, target := range r.cnames {
+		c.cnames[name] = target
+	}
+	return c
+}
+
+// index builds the reverse lookups of r.
+func (r *runtimeRecords) index() {
+	r.reverse = make(map[string]string)
+	for _, name := range r.names {
+		for _, ip := range r.hosts[name].ips {
+			if _, ok := r.reverse[string(ip.To16())]; !ok {
+				r.reverse[string(ip.To16())] = name
+			}
+		}
+	}
+}
+
+func (r *runtimeRecords) len() int {
+	n := 0
+	for _, host := range r.hosts {
+		n += len(host.ips)
+	}
+	return n + len(r.cnames)
+}
+
+// runtimeName returns name in the form the runtime records are keyed by.
+func runtimeName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.Contains(name, "*") {
+		return "", fmt.Errorf("Invalid hostname %q", name)
+	}
+	return name, nil
+}
+
+func (h *Hostsfile) runtimeRecords() *runtimeRecords {
+	return h.runtime.Load().(*runtimeRecords)
+}
+
+// updateRuntime applies f to a copy of the runtime records and publishes
+// it unless f fails.
+func (h *Hostsfile) updateRuntime(f func(r *runtimeRecords) error) error {
+	h.runtimeMutex.Lock()
+	defer h.runtimeMutex.Unlock()
+	r := h.runtimeRecords().clone()
+	if err := f(r); err != nil {
+		return err
+	}
+	r.index()
+	h.runtime.Store(r)
+	return nil
+}
+
+// AddHost adds ip to the addresses of name, which are served with ttl
+// seconds, or the TTL of the hostsfile entries if ttl is 0. The addresses
+// shadow those of the hostsfiles and are kept when they are reloaded.
+// Adding an address name has already updates its TTL.
+func (h *Hostsfile) AddHost(name string, ip net.IP, ttl int) error {
+	name, err := runtimeName(name)
+	if err != nil {
+		return err
+	}
+	if ip.To16() == nil {
+		return fmt.Errorf("Invalid address for hostname %s", name)
+	}
+	if ttl < 0 {
+		return fmt.Errorf("Invalid TTL %d for hostname %s", ttl, name)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return h.updateRuntime(func(r *runtimeRecords) error {
+		if _, ok := r.cnames[name]; ok {
+			return fmt.Errorf("Hostname %s has a CNAME", name)
+		}
+		host, ok := r.hosts[name]
+		if !ok {
+			r.names = append(r.names, name)
+		}
+		found := false
+		for _, addr := range host.ips {
+			found = found || addr.Equal(ip)
+		}
+		if !found {
+			host.ips = append(host.ips, ip)
+		}
+		host.ttl = ttl
+		r.hosts[name] = host
+		return nil
+	})
+}
+
+// AddCNAME makes name an alias of target, replacing a CNAME added for name
+// before. It fails if name has addresses added with AddHost or if the
+// CNAME would create a loop.
+func (h *Hostsfile) AddCNAME(name, target string) error {
+	name, err := runtimeName(name)
+	if err != nil {
+		return err
+	}
+	if target, err = runtimeName(target); err != nil {
+		return err
+	}
+	return h.updateRuntime(func(r *runtimeRecords) error {
+		if _, ok := r.hosts[name]; ok {
+			return fmt.Errorf("Hostname %s has addresses", name)
+		}
+		for t, i := target, 0; i <= maxCNAMEChain; i++ {
+			if t == name {
+				return fmt.Errorf("CNAME %s -> %s creates a loop", name, target)
+			}
+			next, ok := r.cnames[t]
+			if !ok {
+				break
+			}
+			t = next
+		}
+		r.cnames[name] = target
+		return nil
+	})
+}
+
+// RemoveHost removes the addresses and the CNAME added for name. The
+// entries of the hostsfiles for name are served again.
+func (h *Hostsfile) RemoveHost(name string) error {
+	name, err := runtimeName(name)
+	if err != nil {
+		return err
+	}
+	return h.updateRuntime(func(r *runtimeRecords) error {
+		_, isHost := r.hosts[name]
+		_, isCNAME := r.cnames[name]
+		if !isHost && !isCNAME {
+			return ErrNotFound
+		}
+		delete(r.hosts, name)
+		delete(r.cnames, name)
+		for i, n := range r.names {
+			if n == name {
+				r.names = append(r.names[:i], r.names[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// FindCNAMEChain returns the targets of the CNAMEs added for name, which
+// must be lower case, each target being the name of the next CNAME. It
+// returns nil if name has no CNAME.
+func (h *Hostsfile) FindCNAMEChain(name string) []string {
+	r := h.runtimeRecords()
+	name = strings.TrimSuffix(name, ".")
+	var chain []string
+	for len(chain) < maxCNAMEChain {
+		target, ok := r.cnames[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, dns.Fqdn(target))
+		name = target
+	}
+	return chain
+}
+
+// HostTTL returns the TTL the addresses of name, which must be lower case,
+// were added with. It returns false if they are served with the TTL of the
+// hostsfile entries.
+func (h *Hostsfile) HostTTL(name string) (int, bool) {
+	host := h.runtimeRecords().hosts[strings.TrimSuffix(name, ".")]
+	return host.ttl, host.ttl > 0
+}
@@ -16,6 +16,9 @@ import (
 
 type hostlist []*hostname
 
+// ipv6LocalNet is the fe00::0 ip6-localnet entry of common hostsfiles
+var ipv6LocalNet = net.ParseIP("fe00::")
+
 type hostname struct {
 	domain   string
 	ip       net.IP
@@ -23,22 +26,32 @@ type hostname struct {
 	wildcard bool
 }
 
-// newHostlist creates a hostlist by parsing a file
-func newHostlist(data []byte) *hostlist {
-	return newHostlistString(string(data));
-}
-
-func newHostlistString(data string) *hostlist {
-	hostlist := hostlist{}
-	for _, v := range strings.Split(data, "\n") {
-		for _, hostname := range parseLine(v) {
-			err := hostlist.add(hostname)
+// parseHosts parses a hostsfile into a new index. $GENERATE lines may
+// expand to at most generateMax entries in total. Each of commentChars
+// starts a comment.
+func parseHosts(data string, generateMax int, commentChars string) *hostIndex {
+	lines := strings.Split(data, "\n")
+	index := newHostIndex(len(lines))
+	for _, v := range lines {
+		var hostnames hostlist
+		if line := strings.TrimSpace(stripComment(v, commentChars)); strings.HasPrefix(line, "$GENERATE") {
+			var err error
+			if hostnames, err = parseGenerate(line, generateMax); err != nil {
+				log.Warnf("Bad formatted hostsfile line: %s: %s", v, err)
+				continue
+			}
+			generateMax -= len(hostnames)
+		} else {
+			hostnames = parseLine(v, commentChars)
+		}
+		for _, hostname := range hostnames {
+			err := index.add(hostname)
 			if err != nil {
 				log.Warnf("Bad formatted hostsfile line: %s", err)
 			}
 		}
 	}
-	return &hostlist
+	return index
 }
 
 func (h *hostname) Equal(hostnamev *hostname) bool {
@@ -54,54 +67,6 @@ func (h *hostname) Equal(hostnamev *hostname) bool {
 	return true
 }
 
-// return first match
-func (h *hostlist) FindHost(name string) (addr net.IP) {
-	var ips []net.IP;
-	ips = h.FindHosts(name)
-	if len(ips) > 0 {
-		addr = ips[0];
-	}
-	return
-}
-
-// return exact matches, if existing -> else, return wildcard
-func (h *hostlist) FindHosts(name string) (addrs []net.IP) {
-	for _, hostname := range *h {
-		if hostname.wildcard == false && hostname.domain == name {
-			addrs = append(addrs, hostname.ip)
-		}
-	}
-
-	if len(addrs) == 0 {
-		var domain_match string;
-		for _, hostname := range *h {
-			if hostname.wildcard == true && len(hostname.domain) < len(name) {
-				domain_match = strings.Join([]string{".", hostname.domain}, "");
-				if name[len(name)-len(domain_match):] == domain_match {
-					var left string;
-					left = name[0:len(name)-len(domain_match)]
-					if !strings.Contains(left, ".") {
-						addrs = append(addrs, hostname.ip)
-					}
-				}
-			}
-		}
-	}
-
-	return
-}
-
-func (h *hostlist) add(hostnamev *hostname) error {
-	hostname := newHostname(hostnamev.domain, hostnamev.ip, hostnamev.ipv6, hostnamev.wildcard)
-	for _, found := range *h {
-		if found.Equal(hostname) {
-			return fmt.Errorf("Duplicate hostname entry for %#v", hostname)
-		}
-	}
-	*h = append(*h, hostname)
-	return nil
-}
-
 // newHostname creates a new Hostname struct
 func newHostname(domain string, ip net.IP, ipv6 bool, wildcard bool) (host *hostname) {
 	domain = strings.ToLower(domain)
@@ -113,51 +78,48 @@ func newHostname(domain string, ip net.IP, ipv6 bool, wildcard bool) (host *host
 // (un)commented ip and one or more hostnames. For example
 //
 //	127.0.0.1 localhost mysite1 mysite2
-func parseLine(line string) hostlist {
+//
+// Each of commentChars starts a comment, which disables the whole line if
+// it comes first.
+func parseLine(line string, commentChars string) hostlist {
 	var hostnames hostlist
 
-	if len(line) == 0 {
+	line = stripComment(line, commentChars)
+	if strings.TrimSpace(line) == "" {
 		return hostnames
 	}
 
-	// Parse leading # for disabled lines
-	if line[0:1] == "#" {
-		return hostnames
-	}
-
-	// Parse other #s for actual comments
-	line = strings.Split(line, "#")[0]
-
-	// Replace tabs and multispaces with single spaces throughout
-	line = strings.Replace(line, "\t", " ", -1)
-	for strings.Contains(line, "  ") {
-		line = strings.Replace(line, "  ", " ", -1)
-	}
-
-	line = strings.TrimSpace(line)
-
 	// Break line into words
-	words := strings.Split(line, " ")
-	for idx, word := range words {
-		words[idx] = strings.TrimSpace(word)
-	}
+	words := strings.Fields(line)
 
 	// Separate the first bit (the ip) from the other bits (the domains)
 	address := words[0]
 	domains := words[1:]
 
-	if strings.Contains(address, "%") {
-		return hostnames
+	// IPv6 link-local addresses may carry a zone ID, either an interface
+	// name (fe80::1%lo0) or index (fe80::1%2). It has no meaning in DNS
+	// responses so it is dropped.
+	var zone string
+	if i := strings.Index(address, "%"); i >= 0 {
+		address, zone = address[:i], address[i+1:]
 	}
 
 	ip := net.ParseIP(address)
 
+	if zone != "" {
+		if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+			log.Warnf("Zone ID is only supported for IPv6 link-local addresses: %s%%%s", address, zone)
+			return hostnames
+		}
+		log.Debugf("Dropped zone ID %s of hostsfile address %s", zone, address)
+	}
+
 	var isIPv6 bool
 
 	switch {
-	case !ip.IsGlobalUnicast() && !ip.IsLoopback():
+	case !ip.IsGlobalUnicast() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast():
 		return hostnames
-	case ip.Equal(net.ParseIP("fe00::")):
+	case ip.Equal(ipv6LocalNet):
 		return hostnames
 	case ip.To4() != nil:
 		isIPv6 = false
@@ -171,7 +133,7 @@ func parseLine(line string) hostlist {
 	var isWildcard bool
 	for _, v := range domains {
 		isWildcard = false
-		if v[0:2] == "*." {
+		if strings.HasPrefix(v, "*.") {
 			v = v[2:]
 			isWildcard = true
 		}
@@ -182,6 +144,50 @@ func parseLine(line string) hostlist {
 	return hostnames
 }
 
+// expandEnv expands the environment variables in every line of data with
+// expandEnvLine. Lines that fail to expand are emptied.
+func expandEnv(data []byte, commentChars string) []byte {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		expanded, err := expandEnvLine(line, commentChars)
+		if err != nil {
+			log.Debugf("Skipping hostsfile line %q: %s", line, err)
+		}
+		lines[i] = expanded
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// expandEnvLine strips the comment from a hostsfile line and replaces $VAR
+// and ${VAR} with the value of the environment variable. It fails if a
+// variable is unset or empty. $GENERATE lines are returned unchanged as
+// they use '$' themselves. Each of commentChars starts a comment.
+func expandEnvLine(line string, commentChars string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(line), "$GENERATE") {
+		return line, nil
+	}
+	var unset []string
+	line = os.Expand(stripComment(line, commentChars), func(name string) string {
+		v := os.Getenv(name)
+		if v == "" {
+			unset = append(unset, name)
+		}
+		return v
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(unset, ", "))
+	}
+	return line, nil
+}
+
+// stripComment returns line up to the first of the characters in chars.
+func stripComment(line string, chars string) string {
+	if i := strings.IndexAny(line, chars); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
 // hostsFileMetadata returns metadata about the hosts file.
 func hostsFileMetadata(path string) (time.Time, int64, error) {
 	fi, err := os.Stat(path)
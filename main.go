@@ -5,22 +5,23 @@
 package main // import "github.com/janeczku/go-dnsmasq"
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log/syslog"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
 	"github.com/codegangsta/cli"
-	"github.com/miekg/dns"
 
+	"github.com/janeczku/go-dnsmasq/dnsmasq"
 	"github.com/janeczku/go-dnsmasq/hostsfile"
 	"github.com/janeczku/go-dnsmasq/resolvconf"
 	"github.com/janeczku/go-dnsmasq/server"
@@ -30,15 +31,6 @@ import (
 // var Version string
 const Version = "1.0.5"
 
-var (
-	nameservers   = []string{}
-	searchDomains = []string{}
-	hostPort      = ""
-	listen        = ""
-)
-
-var exitErr error
-
 func init() {
 	log.SetOutput(os.Stdout)
 }
@@ -50,32 +42,131 @@ func main() {
 	app.Version = Version
 	app.Author, app.Email = "", ""
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			Value:  "",
+			Usage:  "Read options from the YAML file at `path`. Command line flags and environment variables take precedence",
+			EnvVar: "DNSMASQ_CONFIG",
+		},
 		cli.StringFlag{
 			Name:   "listen, l",
 			Value:  "127.0.0.1:53",
-			Usage:  "Address to listen on `host[:port]`",
+			Usage:  "Address to listen on `host[:port]`, IPv6 addresses as [host]:port. A hostname is resolved on startup, an empty host such as :53 listens on all IPv4 and IPv6 addresses. An IPv6 address such as [::] only accepts IPv6 queries",
 			EnvVar: "DNSMASQ_LISTEN",
 		},
+		cli.IntFlag{
+			Name:   "additional-port",
+			Value:  0,
+			Usage:  "Also answer queries on this `port` of the --listen address, e.g. 53 next to an unprivileged --listen port (‘0‘ to disable)",
+			EnvVar: "DNSMASQ_ADDITIONAL_PORT",
+		},
+		cli.IntFlag{
+			Name:   "bind-retries",
+			Value:  0,
+			Usage:  "Try binding the listen sockets again this many `times` on startup while one of them is in use, e.g. during a cutover from another DNS server",
+			EnvVar: "DNSMASQ_BIND_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "bind-retry-interval",
+			Value:  time.Second,
+			Usage:  "Wait this `duration` between the --bind-retries attempts",
+			EnvVar: "DNSMASQ_BIND_RETRY_INTERVAL",
+		},
 		cli.BoolFlag{
 			Name:   "default-resolver, d",
 			Usage:  "Update resolv.conf to make go-dnsmasq the host's nameserver",
 			EnvVar: "DNSMASQ_DEFAULT",
 		},
+		cli.StringFlag{
+			Name:   "resolvconf-backend",
+			Value:  "auto",
+			Usage:  "How --default-resolver registers go-dnsmasq: ‘file‘ rewrites resolv.conf, ‘resolved‘ configures systemd-resolved over D-Bus, ‘resolvconf‘ calls resolvconf(8) or openresolv, ‘resolver‘ creates a file in /etc/resolver for each stub zone, search and interface domain (macOS), ‘netsh‘ sets the DNS servers of the network adapters (Windows), ‘auto‘ uses netsh on Windows, the resolver directory on macOS, else systemd-resolved if resolv.conf points at its stub listener, else resolvconf if it is installed, else the file",
+			EnvVar: "DNSMASQ_RESOLVCONF_BACKEND",
+		},
+		cli.StringFlag{
+			Name:   "resolv-backup-path",
+			Value:  resolvconf.RESOLVCONF_BACKUP_PATH,
+			Usage:  "`path` of the backups of resolv.conf written by --default-resolver with the file backend, followed by the time of the backup",
+			EnvVar: "DNSMASQ_RESOLV_BACKUP_PATH",
+		},
+		cli.StringFlag{
+			Name:   "user",
+			Value:  "",
+			Usage:  "Switch to this `user` (name or ID) once the listeners are bound",
+			EnvVar: "DNSMASQ_USER",
+		},
+		cli.StringFlag{
+			Name:   "group",
+			Value:  "",
+			Usage:  "Switch to this `group` (name or ID) once the listeners are bound (defaults to the primary group of --user)",
+			EnvVar: "DNSMASQ_GROUP",
+		},
 		cli.StringFlag{
 			Name:   "nameservers, n",
 			Value:  "",
-			Usage:  "Comma delimited list of nameservers `host[:port]` (defaults to /etc/resolv.conf)",
+			Usage:  "Comma delimited list of nameservers `host[:port]` (defaults to the space delimited $NAMESERVER, then /etc/resolv.conf)",
 			EnvVar: "DNSMASQ_SERVERS",
 		},
+		cli.StringFlag{
+			Name:   "extra-resolv-conf",
+			Usage:  "Merge the nameservers and search domains of the resolv.conf(5) file at `path`, e.g. one injected by Kubernetes, with --nameservers, --search-domains and those of /etc/resolv.conf",
+			EnvVar: "DNSMASQ_EXTRA_RESOLV_CONF",
+		},
+		cli.IntFlag{
+			Name:   "min-answers",
+			Value:  0,
+			Usage:  "Query all nameservers in parallel and fail unless at least `N` of them answer, without retries, --upstream-strategy or stub zones applying (‘0‘ to disable)",
+			EnvVar: "DNSMASQ_MIN_ANSWERS",
+		},
+		cli.IntFlag{
+			Name:   "edns-buffer-size",
+			Value:  0,
+			Usage:  "EDNS0 UDP payload size in `bytes` (512-65535) announced in queries to upstream nameservers (‘0‘ to leave queries unchanged)",
+			EnvVar: "DNSMASQ_EDNS_BUFFER_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "no-tcp-retry",
+			Usage:  "Return truncated UDP responses of the nameservers instead of retrying the query over TCP",
+			EnvVar: "DNSMASQ_NO_TCP_RETRY",
+		},
+		cli.IntFlag{
+			Name:   "upstream-pool-size",
+			Value:  0,
+			Usage:  "Number of sockets kept open per upstream nameserver and protocol and shared by the forwarded queries (‘0‘ to open a socket per query)",
+			EnvVar: "DNSMASQ_UPSTREAM_POOL_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "upstream-strategy",
+			Value:  "first",
+			Usage:  "Order the nameservers are tried in for each query: 'first' in the order given, 'round-robin', 'random' or 'fastest' by average response time",
+			EnvVar: "DNSMASQ_UPSTREAM_STRATEGY",
+		},
+		cli.IntFlag{
+			Name:   "upstream-rtt-window",
+			Value:  10,
+			Usage:  "Number of responses the average response time of a nameserver mostly reflects with --upstream-strategy fastest",
+			EnvVar: "DNSMASQ_UPSTREAM_RTT_WINDOW",
+		},
+		cli.IntFlag{
+			Name:   "upstream-retries",
+			Value:  1,
+			Usage:  "Number of times a query is sent to the next nameserver after an error, a timeout or SERVFAIL before SERVFAIL is returned (‘0‘ to send it once)",
+			EnvVar: "DNSMASQ_UPSTREAM_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "upstream-source-ip",
+			Value:  "",
+			Usage:  "Send the queries to the upstream and stub zone nameservers from the local address `ip`, which must be of the same IP version as the nameservers",
+			EnvVar: "DNSMASQ_UPSTREAM_SOURCE_IP",
+		},
 		cli.StringSliceFlag{
 			Name:   "stubzones, z",
-			Usage:  "Use a different nameservers for specific domains. Flag can be passed multiple times. `domain[,domain]/host[:port]`",
+			Usage:  "Use a different nameservers for specific domains. Flag can be passed multiple times. `domain[,domain]/host[:port][,host[:port]]`",
 			EnvVar: "DNSMASQ_STUB",
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:   "hostsfile, f",
-			Value:  "",
-			Usage:  "Path to a hostsfile (e.g. ‘/etc/hosts‘)",
+			Usage:  "Path to a hostsfile (e.g. ‘/etc/hosts‘). Flag can be passed multiple times, a name in a later file shadows the same name in the files before it",
 			EnvVar: "DNSMASQ_HOSTSFILE",
 		},
 		cli.IntFlag{
@@ -84,10 +175,71 @@ func main() {
 			Usage:  "How frequently to poll hostsfile for changes (seconds, ‘0‘ to disable)",
 			EnvVar: "DNSMASQ_POLL",
 		},
+		cli.IntFlag{
+			Name:   "hostsfile-generate-max",
+			Value:  hosts.DefaultGenerateMaxRecords,
+			Usage:  "Maximum number of entries `$GENERATE` lines in the hostsfile may expand to",
+			EnvVar: "DNSMASQ_HOSTSFILE_GENERATE_MAX",
+		},
+		cli.BoolFlag{
+			Name:   "hostsfile-env-expand",
+			Usage:  "Replace $VAR and ${VAR} in the hostsfile with the value of the environment variable. Lines referring to unset variables are skipped",
+			EnvVar: "DNSMASQ_HOSTSFILE_ENV_EXPAND",
+		},
+		cli.StringFlag{
+			Name:   "hostsfile-comment-char",
+			Value:  hosts.DefaultCommentChars,
+			Usage:  "Each of these `CHARS` starts a comment in the hostsfile, e.g. ‘#;‘ (empty for none)",
+			EnvVar: "DNSMASQ_HOSTSFILE_COMMENT_CHAR",
+		},
+		cli.IntFlag{
+			Name:   "hostsfile-notify-pid",
+			Usage:  "Send SIGHUP to the process with this `PID` when the content of the hostsfile changed",
+			EnvVar: "DNSMASQ_HOSTSFILE_NOTIFY_PID",
+		},
+		cli.StringFlag{
+			Name:   "hostsfile-notify-cmd",
+			Usage:  "Run this shell `COMMAND` when the content of the hostsfile changed",
+			EnvVar: "DNSMASQ_HOSTSFILE_NOTIFY_CMD",
+		},
+		cli.StringFlag{
+			Name:   "hostsfile-reload-error-policy",
+			Value:  string(hosts.ReloadErrorWarn),
+			Usage:  "When a changed hostsfile cannot be read or has invalid lines, keep the previous entries (‘ignore‘), also log a warning (‘warn‘) or exit (‘fatal‘)",
+			EnvVar: "DNSMASQ_HOSTSFILE_RELOAD_ERROR_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "no-hosts",
+			Usage:  "Never resolve names through the operating system (which may consult ‘/etc/hosts‘). Metrics server addresses must be IP addresses",
+			EnvVar: "DNSMASQ_NO_HOSTS",
+		},
+		cli.BoolFlag{
+			Name:   "iface-discovery",
+			Usage:  "Serve the addresses of the host's network interfaces as <interface>.<iface-domain>",
+			EnvVar: "DNSMASQ_IFACE_DISCOVERY",
+		},
+		cli.StringFlag{
+			Name:   "iface-domain",
+			Value:  "iface.local",
+			Usage:  "Domain of the network interface records",
+			EnvVar: "DNSMASQ_IFACE_DOMAIN",
+		},
+		cli.IntFlag{
+			Name:   "iface-poll",
+			Value:  0,
+			Usage:  "How frequently to refresh the network interface records (seconds, ‘0‘ to only refresh on SIGHUP)",
+			EnvVar: "DNSMASQ_IFACE_POLL",
+		},
+		cli.IntFlag{
+			Name:   "iface-ttl",
+			Value:  10,
+			Usage:  "TTL of the network interface records (seconds)",
+			EnvVar: "DNSMASQ_IFACE_TTL",
+		},
 		cli.StringFlag{
 			Name:   "search-domains, s",
 			Value:  "",
-			Usage:  "Comma delimited list of search domains `domain[,domain]` (defaults to /etc/resolv.conf)",
+			Usage:  "Comma delimited list of search domains `domain[,domain]` (defaults to the space delimited $SEARCH, then /etc/resolv.conf)",
 			EnvVar: "DNSMASQ_SEARCH",
 		},
 		cli.BoolFlag{
@@ -95,6 +247,11 @@ func main() {
 			Usage:  "Resolve queries using search domains",
 			EnvVar: "DNSMASQ_APPEND",
 		},
+		cli.BoolFlag{
+			Name:   "parallel-lookup",
+			Usage:  "Send the A and AAAA queries for each search domain expansion of an A or AAAA query at once, moving on to the next search domain as soon as either says the name does not exist",
+			EnvVar: "DNSMASQ_PARALLEL_LOOKUP",
+		},
 		cli.IntFlag{
 			Name:   "rcache, r",
 			Value:  0,
@@ -107,11 +264,57 @@ func main() {
 			Usage:  "TTL for entries in the response cache",
 			EnvVar: "DNSMASQ_RCACHE_TTL",
 		},
+		cli.IntFlag{
+			Name:   "cache-min-hit-count",
+			Value:  1,
+			Usage:  "Only cache a response from its `N`th lookup on, e.g. ‘2‘ to skip names queried once",
+			EnvVar: "DNSMASQ_CACHE_MIN_HIT_COUNT",
+		},
+		cli.BoolFlag{
+			Name:   "cache-by-client-ip",
+			Usage:  "Keep a separate response cache of --rcache capacity for each client network",
+			EnvVar: "DNSMASQ_CACHE_BY_CLIENT_IP",
+		},
+		cli.IntFlag{
+			Name:   "cache-ip-prefix-len-v4",
+			Value:  24,
+			Usage:  "Prefix length of the IPv4 client networks with --cache-by-client-ip",
+			EnvVar: "DNSMASQ_CACHE_IP_PREFIX_LEN_V4",
+		},
+		cli.IntFlag{
+			Name:   "cache-ip-prefix-len-v6",
+			Value:  48,
+			Usage:  "Prefix length of the IPv6 client networks with --cache-by-client-ip",
+			EnvVar: "DNSMASQ_CACHE_IP_PREFIX_LEN_V6",
+		},
+		cli.IntFlag{
+			Name:   "cache-max-clients",
+			Value:  1024,
+			Usage:  "Maximum number of client networks to keep a response cache for with --cache-by-client-ip",
+			EnvVar: "DNSMASQ_CACHE_MAX_CLIENTS",
+		},
+		cli.DurationFlag{
+			Name:   "cache-dump-interval",
+			Value:  0,
+			Usage:  "Write the contents of the response cache to --cache-dump-file as JSON every `duration` (‘0‘ to disable)",
+			EnvVar: "DNSMASQ_CACHE_DUMP_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "cache-dump-file",
+			Value:  "",
+			Usage:  "File to write the contents of the response cache to with --cache-dump-interval",
+			EnvVar: "DNSMASQ_CACHE_DUMP_FILE",
+		},
 		cli.BoolFlag{
 			Name:   "no-rec",
 			Usage:  "Disable recursion",
 			EnvVar: "DNSMASQ_NOREC",
 		},
+		cli.BoolFlag{
+			Name:   "forwarders-only",
+			Usage:  "Forward every query as is, ignoring the hostsfile, stub zones, aliases and search domains",
+			EnvVar: "DNSMASQ_FORWARDERS_ONLY",
+		},
 		cli.IntFlag{
 			Name:   "fwd-ndots",
 			Value:  0,
@@ -124,11 +327,61 @@ func main() {
 			Usage:  "Number of dots a name must have before an initial absolute query will be made (defaults to /etc/resolv.conf)",
 			EnvVar: "DNSMASQ_NDOTS",
 		},
+		cli.IntFlag{
+			Name:   "append-ndots",
+			Usage:  "Names with fewer than `N` dots are qualified with the search domains before they are queried as-is (defaults to --ndots)",
+			EnvVar: "DNSMASQ_APPEND_NDOTS",
+		},
 		cli.StringSliceFlag{
 			Name:   "alias",
 			Usage:  "Allows the ability to alias a domain to a stubzone.  (--alias mydomain.local/realdomain.com)",
 			EnvVar: "DNSMASQ_ALIAS",
 		},
+		cli.StringSliceFlag{
+			Name:   "local-domain",
+			Usage:  "Answer queries for names under `domain` from the hosts file or with NXDOMAIN, never forwarding them. Can be passed multiple times",
+			EnvVar: "DNSMASQ_LOCAL_DOMAIN",
+		},
+		cli.BoolFlag{
+			Name:   "no-private-reverse",
+			Usage:  "Answer PTR queries for private and link-local addresses that are not in the hosts file with NXDOMAIN instead of forwarding them",
+			EnvVar: "DNSMASQ_NO_PRIVATE_REVERSE",
+		},
+		cli.StringSliceFlag{
+			Name:   "answer-ttl-rewrite",
+			Usage:  "Set the TTL of upstream records whose name matches `pattern:ttl`, e.g. '*.amazonaws.com:300'. Only a leading '*' is supported. Can be passed multiple times, the first matching rule applies",
+			EnvVar: "DNSMASQ_ANSWER_TTL_REWRITE",
+		},
+		cli.StringSliceFlag{
+			Name:   "ip-rewrite",
+			Usage:  "Map the addresses of upstream A and AAAA records in `src_cidr:dst_cidr`, e.g. '10.0.0.0/16:172.17.0.0/16', keeping the host bits. Both networks must have the same prefix length. Can be passed multiple times, the first matching rule applies",
+			EnvVar: "DNSMASQ_IP_REWRITE",
+		},
+		cli.StringSliceFlag{
+			Name:   "response-rewrite",
+			Usage:  "Replace an address in the upstream A and AAAA answers given as `from_ip:to_ip`, e.g. '1.2.3.4:10.0.0.1' or '[2001:db8::1]:[fd00::1]'. Can be passed multiple times, the first matching rule applies",
+			EnvVar: "DNSMASQ_RESPONSE_REWRITE",
+		},
+		cli.BoolFlag{
+			Name:   "stop-dns-rebind",
+			Usage:  "Refuse upstream answers with private, link-local or loopback addresses to protect against DNS rebinding",
+			EnvVar: "DNSMASQ_STOP_DNS_REBIND",
+		},
+		cli.BoolFlag{
+			Name:   "rebind-localhost-ok",
+			Usage:  "Exempt 127.0.0.0/8 and ::1 from --stop-dns-rebind. Lets upstream answers reach services on this host",
+			EnvVar: "DNSMASQ_REBIND_LOCALHOST_OK",
+		},
+		cli.StringSliceFlag{
+			Name:   "rebind-domain-ok",
+			Usage:  "Exempt names at or below `domain` from --stop-dns-rebind. Can be passed multiple times",
+			EnvVar: "DNSMASQ_REBIND_DOMAIN_OK",
+		},
+		cli.StringFlag{
+			Name:   "qtype-filter",
+			Usage:  "Answer queries of the types in the comma delimited list `type[,type]` with NODATA unless the hostsfile has records of the type, e.g. 'AAAA' on IPv4-only networks",
+			EnvVar: "DNSMASQ_QTYPE_FILTER",
+		},
 		cli.BoolFlag{
 			Name:   "round-robin",
 			Usage:  "Enable round robin of A/AAAA records",
@@ -139,6 +392,84 @@ func main() {
 			Usage:  "Bind to socket(s) activated by Systemd (ignores --listen)",
 			EnvVar: "DNSMASQ_SYSTEMD",
 		},
+		cli.BoolFlag{
+			Name:   "tcp-only",
+			Usage:  "Only accept queries over TCP and use TCP for upstream queries. With --systemd the socket unit must not supply UDP sockets",
+			EnvVar: "DNSMASQ_TCP_ONLY",
+		},
+		cli.StringSliceFlag{
+			Name:   "interface",
+			Usage:  "Listen on the addresses of network interface `name` on the port of --listen. Can be passed multiple times",
+			EnvVar: "DNSMASQ_INTERFACE",
+		},
+		cli.StringSliceFlag{
+			Name:   "except-interface",
+			Usage:  "Do not listen on network interface `name`. Listens on all other interfaces unless --interface is given. Can be passed multiple times",
+			EnvVar: "DNSMASQ_EXCEPT_INTERFACE",
+		},
+		cli.BoolFlag{
+			Name:   "bind-dynamic",
+			Usage:  "Start and stop listening as addresses are added to and removed from the interfaces of --interface and --except-interface",
+			EnvVar: "DNSMASQ_BIND_DYNAMIC",
+		},
+		cli.IntFlag{
+			Name:   "max-tcp-connections",
+			Value:  100,
+			Usage:  "Maximum number of concurrent TCP client connections (‘0‘ for no limit)",
+			EnvVar: "DNSMASQ_MAX_TCP_CONNECTIONS",
+		},
+		cli.DurationFlag{
+			Name:   "tcp-idle-timeout",
+			Value:  10 * time.Second,
+			Usage:  "Close TCP client connections that have been idle for `duration`",
+			EnvVar: "DNSMASQ_TCP_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "max-tcp-pipeline",
+			Value:  16,
+			Usage:  "Maximum number of queries answered at once on one TCP connection, in the order they complete (‘1‘ answers them in order)",
+			EnvVar: "DNSMASQ_MAX_TCP_PIPELINE",
+		},
+		cli.IntFlag{
+			Name:   "reuseport",
+			Usage:  "Bind `N` UDP sockets to each address with SO_REUSEPORT to spread the load over several read loops (‘0‘ for one socket). Linux only",
+			EnvVar: "DNSMASQ_REUSEPORT",
+		},
+		cli.IntFlag{
+			Name:   "max-concurrency",
+			Value:  server.DefaultMaxConcurrency(),
+			Usage:  "Maximum number of queries handled at once (‘0‘ for no limit). UDP queries beyond it wait briefly and are dropped, TCP queries wait",
+			EnvVar: "DNSMASQ_MAX_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "min-free-memory-mb",
+			Usage:  "Answer queries with SERVFAIL and halve the cache while less than `N` MB of memory are free (‘0‘ to disable). Linux and macOS only",
+			EnvVar: "DNSMASQ_MIN_FREE_MEMORY_MB",
+		},
+		cli.StringFlag{
+			Name:   "health-listen",
+			Value:  "",
+			Usage:  "Address to serve the HTTP /healthz and /readyz endpoints on <host:port>",
+			EnvVar: "DNSMASQ_HEALTH_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "debug-listen",
+			Value:  "",
+			Usage:  "Loopback address to serve the pprof and expvar debug endpoints on <host:port> (e.g. ‘127.0.0.1:6060‘)",
+			EnvVar: "DNSMASQ_DEBUG_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "admin-socket",
+			Value:  "",
+			Usage:  "Serve the admin API on the unix socket at `path` (e.g. ‘/run/go-dnsmasq.sock‘)",
+			EnvVar: "DNSMASQ_ADMIN_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "debug-domain",
+			Value:  "",
+			Usage:  "Log debug messages for queries of names under `domain` even without --verbose",
+			EnvVar: "DNSMASQ_DEBUG_DOMAIN",
+		},
 		cli.BoolFlag{
 			Name:   "verbose",
 			Usage:  "Enable verbose logging",
@@ -146,213 +477,608 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:   "syslog",
-			Usage:  "Enable syslog logging",
+			Usage:  "Enable syslog logging (the event log on Windows)",
 			EnvVar: "DNSMASQ_SYSLOG",
 		},
+		cli.StringFlag{
+			Name:   "dnstap-socket",
+			Value:  "",
+			Usage:  "Send dnstap messages to the unix socket at `path`",
+			EnvVar: "DNSMASQ_DNSTAP_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			Value:  "",
+			Usage:  "Send traces of queries and upstream exchanges to the OTLP/gRPC collector at `host:port`",
+			EnvVar: "DNSMASQ_OTLP_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "log-queries",
+			Usage:  "Log every query (reopen the log file on SIGHUP)",
+			EnvVar: "DNSMASQ_LOG_QUERIES",
+		},
+		cli.StringFlag{
+			Name:   "log-queries-file",
+			Value:  "",
+			Usage:  "Write the query log to `path` instead of stdout",
+			EnvVar: "DNSMASQ_LOG_QUERIES_FILE",
+		},
+		cli.StringFlag{
+			Name:   "log-queries-format",
+			Value:  "text",
+			Usage:  "Format of the query log (‘text‘ or ‘json‘)",
+			EnvVar: "DNSMASQ_LOG_QUERIES_FORMAT",
+		},
+		cli.DurationFlag{
+			Name:   "log-slow-queries, log-query-slow-threshold",
+			Value:  0,
+			Usage:  "Log queries that take longer than `duration` (e.g. ‘500ms‘) to answer, with a breakdown of where the time went (‘0‘ to disable)",
+			EnvVar: "DNSMASQ_LOG_SLOW_QUERIES,DNSMASQ_LOG_QUERY_SLOW_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "track-top",
+			Value:  0,
+			Usage:  "Track the `N` most queried domains and busiest clients of the last minutes and include them in the stats dump (‘0‘ to disable)",
+			EnvVar: "DNSMASQ_TRACK_TOP",
+		},
+		cli.StringFlag{
+			Name:   "statsd-address",
+			Value:  "",
+			Usage:  "Send metrics to the statsd daemon at `host:port`. Metrics: " + stats.StatsdMetrics,
+			EnvVar: "DNSMASQ_STATSD_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "statsd-prefix",
+			Value:  "go-dnsmasq",
+			Usage:  "Prefix of the metric names sent to statsd",
+			EnvVar: "DNSMASQ_STATSD_PREFIX",
+		},
+		cli.IntFlag{
+			Name:   "statsd-interval",
+			Value:  10,
+			Usage:  "How frequently to send metrics to statsd (seconds)",
+			EnvVar: "DNSMASQ_STATSD_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "Log format: ‘text‘, ‘json‘ for log aggregators, or ‘syslog‘, which sends text without timestamps to syslog like --syslog",
+			EnvVar: "DNSMASQ_LOG_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "check-config",
+			Usage:  "Validate the configuration, print every problem found and exit. Does not open sockets or change resolv.conf",
+			EnvVar: "DNSMASQ_CHECK_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "service",
+			Value: "",
+			Usage: "Windows only: ‘install‘, ‘uninstall‘, ‘start‘ or ‘stop‘ the go-dnsmasq service. The other flags given with ‘install‘ are passed to the service",
+		},
 		cli.BoolFlag{
 			Name:   "multithreading",
-			Usage:  "Enable multithreading",
+			Usage:  "Deprecated, has no effect. All CPUs are used, see --max-concurrency",
 			EnvVar: "DNSMASQ_MULTITHREADING",
 		},
 	}
+	app.Commands = []cli.Command{healthCheckCommand, queryCommand}
 	app.Action = func(c *cli.Context) {
-		exitReason := make(chan error)
-		go func() {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-			sig := <-c
-			log.Infoln("Application exit requested by signal:", sig)
-			exitReason <- nil
-		}()
-
-		if c.Bool("multithreading") {
-			runtime.GOMAXPROCS(runtime.NumCPU() + 1)
+		if action := c.String("service"); action != "" {
+			if err := controlService(action); err != nil {
+				log.Fatalf("Failed to %s the service: %s", action, err)
+			}
+			return
 		}
 
-		if c.Bool("verbose") {
-			log.SetLevel(log.DebugLevel)
+		if c.Bool("check-config") {
+			os.Exit(checkConfig(c, app.Flags))
 		}
 
-		if c.Bool("syslog") {
-			log.SetFormatter(&log.TextFormatter{DisableTimestamp: true, DisableColors: true})
-			hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_DAEMON|syslog.LOG_INFO, "go-dnsmasq")
-			if err != nil {
-				log.Error("Unable to connect to local syslog daemon")
-			} else {
-				log.AddHook(hook)
-			}
-		} else {
-			log.SetFormatter(&log.TextFormatter{})
+		exit(runServer(app, c))
+	}
+
+	app.Run(os.Args)
+}
+
+// shutdownTimeout is how long the server may take to stop after a signal
+// asked it to exit.
+const shutdownTimeout = 10 * time.Second
+
+// runServer answers queries until the server fails or a signal or the
+// service control manager asks it to exit. It returns nil on a requested
+// exit, otherwise why the server could not be started or stopped
+// answering queries. The server is stopped before it returns.
+func runServer(app *cli.App, c *cli.Context) error {
+	if path := c.String("config"); path != "" {
+		if err := loadConfigFile(c, app.Flags, path); err != nil {
+			return fmt.Errorf("Error loading config file: %s", err)
 		}
+	}
 
-		if ns := c.String("nameservers"); ns != "" {
-			for _, hostPort := range strings.Split(ns, ",") {
-				hostPort = strings.TrimSpace(hostPort)
-				if strings.HasSuffix(hostPort, "]") {
-					hostPort += ":53"
-				} else if !strings.Contains(hostPort, ":") {
-					hostPort += ":53"
-				}
-				if err := validateHostPort(hostPort); err != nil {
-					log.Fatalf("Nameserver is invalid: %s", err)
-				}
+	exitReason := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		sig := <-c
+		log.Infoln("Application exit requested by signal:", sig)
+		// exit restores resolv.conf, also if the shutdown hangs
+		time.AfterFunc(shutdownTimeout, func() {
+			exit(fmt.Errorf("Shutdown did not complete within %s", shutdownTimeout))
+		})
+		cancel()
+		exitReason <- nil
+	}()
 
-				nameservers = append(nameservers, hostPort)
-			}
+	serviceStopped, err := runService(exitReason)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the service control manager: %s", err)
+	}
+	defer serviceStopped()
+
+	if c.Bool("verbose") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	formatter, err := logFormatter(c.String("log-format"), c.Bool("syslog"))
+	if err != nil {
+		return err
+	}
+	log.SetFormatter(formatter)
+
+	if c.Bool("syslog") || c.String("log-format") == "syslog" {
+		if err := addSyslogHook(); err != nil {
+			log.Errorf("Unable to set up system logging: %s", err)
 		}
+	}
+
+	resolvconf.SetBackupPath(c.String("resolv-backup-path"))
+	if err := resolvconf.Repair(); err != nil {
+		log.Warnf("Failed to repair /etc/resolv.conf: %s", err)
+	}
+
+	config, err := newConfig(c, nil)
+	if err != nil {
+		return err
+	}
 
-		if sd := c.String("search-domains"); sd != "" {
-			for _, domain := range strings.Split(sd, ",") {
-				if dns.CountLabel(domain) < 2 {
-					log.Fatalf("Search domain must have at least one dot in name: %s", domain)
+	log.Infof("Starting go-dnsmasq server %s", Version)
+	if c.Bool("multithreading") {
+		log.Warnf("--multithreading is deprecated and has no effect, all CPUs are used. See --max-concurrency")
+	}
+	log.Infof("Upstream nameservers: %v", config.Nameservers)
+	if config.ForwardersOnly {
+		warnForwardersOnly(c)
+	} else if config.AppendDomain {
+		log.Infof("Search domains: %v", config.SearchDomains)
+	}
+
+	backend, _ := resolvConfBackend(c)
+	s, err := dnsmasq.New(dnsmasq.Config{
+		Config:                     *config,
+		HostsfileGenerateMax:       c.Int("hostsfile-generate-max"),
+		HostsfileEnvExpand:         c.Bool("hostsfile-env-expand"),
+		HostsfileCommentChars:      c.String("hostsfile-comment-char"),
+		HostsfileNotifyPID:         c.Int("hostsfile-notify-pid"),
+		HostsfileNotifyCmd:         c.String("hostsfile-notify-cmd"),
+		HostsfileReloadErrorPolicy: hosts.ReloadErrorPolicy(c.String("hostsfile-reload-error-policy")),
+		IfacePoll:                  c.Int("iface-poll"),
+		StatsdAddress:              c.String("statsd-address"),
+		StatsdPrefix:               c.String("statsd-prefix"),
+		StatsdInterval:             time.Duration(c.Int("statsd-interval")) * time.Second,
+		NoHosts:                    c.Bool("no-hosts"),
+		ResolvConfBackend:          backend,
+		ResolvConf:                 resolvConfConfig(c, config),
+		Version:                    Version,
+		ReloadConfig: func() (*server.Config, error) {
+			return reloadConfig(app, config)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if config.LogQueries {
+				log.Info("Reopening query log")
+				if err := s.ReopenQueryLog(); err != nil {
+					log.Errorf("Failed to reopen query log: %s", err)
 				}
-				domain = strings.TrimSpace(domain)
-				domain = dns.Fqdn(strings.ToLower(domain))
-				searchDomains = append(searchDomains, domain)
 			}
-		}
 
-		listen = c.String("listen")
-		if strings.HasSuffix(listen, "]") {
-			listen += ":53"
-		} else if !strings.Contains(listen, ":") {
-			listen += ":53"
+			log.Info("Reloading configuration")
+			if err := s.Reload(); err != nil {
+				log.Error(err)
+			}
 		}
+	}()
 
-		if err := validateHostPort(listen); err != nil {
-			log.Fatalf("Listen address is invalid: %s", err)
+	go func() {
+		c := make(chan os.Signal, 1)
+		notifyStatsDump(c)
+		for range c {
+			go s.DumpStats()
 		}
+	}()
 
-		config := &server.Config{
-			DnsAddr:         listen,
-			DefaultResolver: c.Bool("default-resolver"),
-			Nameservers:     nameservers,
-			Systemd:         c.Bool("systemd"),
-			SearchDomains:   searchDomains,
-			AppendDomain:    c.Bool("append-search-domains"),
-			Hostsfile:       c.String("hostsfile"),
-			PollInterval:    c.Int("hostsfile-poll"),
-			RoundRobin:      c.Bool("round-robin"),
-			NoRec:           c.Bool("no-rec"),
-			FwdNdots:        c.Int("fwd-ndots"),
-			Ndots:           c.Int("ndots"),
-			ReadTimeout:     2 * time.Second,
-			RCache:          c.Int("rcache"),
-			RCacheTtl:       c.Int("rcache-ttl"),
-			Verbose:         c.Bool("verbose"),
+	if err := s.Start(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
 		}
+		return fmt.Errorf("Server error: %w", err)
+	}
+	defer s.Stop()
 
-		if err := server.ResolvConf(config, c); err != nil {
-			if !os.IsNotExist(err) {
-				log.Warnf("Error parsing resolv.conf: %s", err.Error())
-			}
+	if user, group := c.String("user"), c.String("group"); user != "" || group != "" {
+		if err := dropPrivileges(user, group); err != nil {
+			return fmt.Errorf("Failed to drop privileges: %s", err)
 		}
+		log.Infof("Dropped privileges to uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
 
-		if err := server.CheckConfig(config); err != nil {
-			log.Fatal(err.Error())
+	go func() {
+		exitReason <- s.Wait()
+	}()
+	if err := <-exitReason; err != nil {
+		return fmt.Errorf("Server error: %w", err)
+	}
+	return nil
+}
+
+// exit restores the resolver configuration and ends the process after
+// runServer returned err: with status 0 if err is nil, otherwise with
+// status 1 after logging err, each problem on its own line for
+// server.ConfigErrors.
+func exit(err error) {
+	resolvconf.Clean()
+	if err == nil {
+		os.Exit(0)
+	}
+	if errs, ok := err.(server.ConfigErrors); ok {
+		for _, err := range errs {
+			log.Error(errorMessage(err))
 		}
+		log.Errorf("Found %d problem(s) in the configuration", len(errs))
+	} else {
+		log.Error(errorMessage(err))
+	}
+	os.Exit(1)
+}
 
-		if aliases := c.StringSlice("alias"); len(aliases) > 0 {
-			aliasmap := make(map[string]string)
-			for _, a := range aliases {
-				segments := strings.Split(a, "/")
-				if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
-					log.Fatalf("The --alias argument is invalid")
-				}
-				aliasmap[segments[0]] = segments[1]
-			}
-			config.Alias = &aliasmap
+// warnForwardersOnly logs the options that have no effect with
+// --forwarders-only.
+func warnForwardersOnly(c *cli.Context) {
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"hostsfile", len(c.StringSlice("hostsfile")) > 0},
+		{"iface-discovery", c.Bool("iface-discovery")},
+		{"stubzones", len(c.StringSlice("stubzones")) > 0},
+		{"alias", len(c.StringSlice("alias")) > 0},
+		{"local-domain", len(c.StringSlice("local-domain")) > 0},
+		{"no-private-reverse", c.Bool("no-private-reverse")},
+		{"append-search-domains", c.Bool("append-search-domains")},
+	} {
+		if o.set {
+			log.Warnf("--%s has no effect with --forwarders-only", o.name)
 		}
+	}
+}
 
-		if stubzones := c.StringSlice("stubzones"); len(stubzones) > 0 {
-			stubmap := make(map[string][]string)
-			for _, stubzone := range stubzones {
-				segments := strings.Split(stubzone, "/")
-				if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
-					log.Fatalf("The --stubzones argument is invalid")
-				}
+// newConfig builds the server configuration from the flags, environment
+// variables and config file options of c. When reloading, current is the
+// configuration of the running server, otherwise nil. All problems found
+// are returned as server.ConfigErrors.
+func newConfig(c *cli.Context, current *server.Config) (*server.Config, error) {
+	var errs server.ConfigErrors
 
-				hosts := strings.Split(segments[1], ",")
-				for _, hostPort := range hosts {
-					hostPort = strings.TrimSpace(hostPort)
-					if strings.HasSuffix(hostPort, "]") {
-						hostPort += ":53"
-					} else if !strings.Contains(hostPort, ":") {
-						hostPort += ":53"
-					}
-
-					if err := validateHostPort(hostPort); err != nil {
-						log.Fatalf("This stubzones server address invalid: %s", err)
-					}
-
-					for _, sdomain := range strings.Split(segments[0], ",") {
-						if dns.CountLabel(sdomain) < 1 {
-							log.Fatalf("This stubzones domain is not a FQDN: %s", sdomain)
-						}
-						sdomain = strings.TrimSpace(sdomain)
-						sdomain = dns.Fqdn(sdomain)
-						stubmap[sdomain] = append(stubmap[sdomain], hostPort)
-					}
-				}
-			}
-			config.Stub = &stubmap
+	nameservers, err := server.ParseNameservers(c.String("nameservers"))
+	errs = appendErrors(errs, err)
+	searchDomains, err := server.ParseSearchDomains(c.String("search-domains"))
+	errs = appendErrors(errs, err)
+
+	opts := []server.Option{
+		server.WithAdditionalPort(c.Int("additional-port")),
+		server.WithBindRetries(c.Int("bind-retries"), c.Duration("bind-retry-interval")),
+		server.WithDefaultResolver(c.Bool("default-resolver")),
+		server.WithNameservers(nameservers...),
+		server.WithMinAnswers(c.Int("min-answers")),
+		server.WithEdnsBufferSize(c.Int("edns-buffer-size")),
+		server.WithNoTCPRetry(c.Bool("no-tcp-retry")),
+		server.WithUpstreamPoolSize(c.Int("upstream-pool-size")),
+		server.WithUpstreamStrategy(c.String("upstream-strategy")),
+		server.WithUpstreamRTTWindow(c.Int("upstream-rtt-window")),
+		server.WithUpstreamRetries(c.Int("upstream-retries")),
+		server.WithUpstreamSourceIP(c.String("upstream-source-ip")),
+		server.WithSystemd(c.Bool("systemd")),
+		server.WithTCPOnly(c.Bool("tcp-only")),
+		server.WithExtraResolvConf(c.String("extra-resolv-conf")),
+		server.WithSearchDomains(searchDomains...),
+		server.WithAppendSearchDomains(c.Bool("append-search-domains")),
+		server.WithParallelLookup(c.Bool("parallel-lookup")),
+		server.WithHostsfile(c.StringSlice("hostsfile"), c.Int("hostsfile-poll")),
+		server.WithRoundRobin(c.Bool("round-robin")),
+		server.WithNoRec(c.Bool("no-rec")),
+		server.WithFwdNdots(c.Int("fwd-ndots")),
+		server.WithNdots(c.Int("ndots")),
+		server.WithAppendNdots(c.Int("append-ndots")),
+		server.WithRCache(c.Int("rcache")),
+		server.WithRCacheTTL(c.Int("rcache-ttl")),
+		server.WithCacheMinHitCount(c.Int("cache-min-hit-count")),
+		server.WithVerbose(c.Bool("verbose")),
+		server.WithMaxTCPConnections(c.Int("max-tcp-connections")),
+		server.WithTCPIdleTimeout(c.Duration("tcp-idle-timeout")),
+		server.WithMaxTCPPipeline(c.Int("max-tcp-pipeline")),
+		server.WithMaxConcurrency(c.Int("max-concurrency")),
+		server.WithReusePort(c.Int("reuseport")),
+		server.WithMinFreeMemoryMB(c.Int("min-free-memory-mb")),
+		server.WithInterfaces(c.StringSlice("interface")...),
+		server.WithExceptInterfaces(c.StringSlice("except-interface")...),
+		server.WithBindDynamic(c.Bool("bind-dynamic")),
+		server.WithForwardersOnly(c.Bool("forwarders-only")),
+		server.WithNoPrivateReverse(c.Bool("no-private-reverse")),
+		server.WithStopRebind(c.Bool("stop-dns-rebind")),
+		server.WithRebindLocalhostOk(c.Bool("rebind-localhost-ok")),
+		server.WithAdminSocket(c.String("admin-socket")),
+		server.WithDnstapSocket(c.String("dnstap-socket")),
+		server.WithTrackTop(c.Int("track-top")),
+		server.WithLogSlowQueries(c.Duration("log-slow-queries")),
+		server.WithCacheDump(c.String("cache-dump-file"), c.Duration("cache-dump-interval")),
+	}
+	if listen, err := server.ParseListenAddr(c.String("listen")); err != nil {
+		errs = append(errs, fmt.Errorf("'listen' is invalid: %s", err))
+	} else {
+		opts = append(opts, server.WithListen(listen))
+	}
+	if d := c.String("debug-domain"); d != "" {
+		opts = append(opts, server.WithDebugDomain(d))
+	}
+	if addr := c.String("health-listen"); addr != "" {
+		opts = append(opts, server.WithHealthListen(addr))
+	}
+	if addr := c.String("debug-listen"); addr != "" {
+		opts = append(opts, server.WithDebugListen(addr))
+	}
+	if addr := c.String("otlp-endpoint"); addr != "" {
+		opts = append(opts, server.WithOtlpEndpoint(addr))
+	}
+	if c.Bool("log-queries") {
+		opts = append(opts, server.WithQueryLog(c.String("log-queries-file"), c.String("log-queries-format")))
+	}
+	if c.Bool("cache-by-client-ip") {
+		opts = append(opts, server.WithCacheByClientIP(c.Int("cache-ip-prefix-len-v4"), c.Int("cache-ip-prefix-len-v6"), c.Int("cache-max-clients")))
+	}
+	if c.Bool("iface-discovery") {
+		opts = append(opts, server.WithIfaceDiscovery(c.String("iface-domain"), uint32(c.Int("iface-ttl"))))
+	}
+
+	if args := c.StringSlice("alias"); len(args) > 0 {
+		aliases, err := server.ParseAliases(args)
+		errs = appendErrors(errs, err)
+		opts = append(opts, server.WithAliases(aliases))
+	}
+
+	if domains := c.StringSlice("local-domain"); len(domains) > 0 {
+		opts = append(opts, server.WithLocalDomains(domains...))
+	}
+
+	if domains := c.StringSlice("rebind-domain-ok"); len(domains) > 0 {
+		opts = append(opts, server.WithRebindDomainOk(domains...))
+	}
+
+	if types := c.String("qtype-filter"); types != "" {
+		opts = append(opts, server.WithQtypeFilter(strings.Split(types, ",")...))
+	}
+
+	var ttlRewrites []server.TTLRewriteRule
+	for _, r := range c.StringSlice("answer-ttl-rewrite") {
+		rule, err := server.ParseTTLRewriteRule(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("The --answer-ttl-rewrite argument is invalid: %s", err))
+			continue
 		}
+		ttlRewrites = append(ttlRewrites, rule)
+	}
+	opts = append(opts, server.WithTTLRewrites(ttlRewrites...))
 
-		log.Infof("Starting go-dnsmasq server %s", Version)
-		log.Infof("Upstream nameservers: %v", config.Nameservers)
-		if config.AppendDomain {
-			log.Infof("Search domains: %v", config.SearchDomains)
+	var ipRewrites []server.IPRewriteRule
+	for _, r := range c.StringSlice("ip-rewrite") {
+		rule, err := server.ParseIPRewriteRule(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("The --ip-rewrite argument is invalid: %s", err))
+			continue
 		}
+		ipRewrites = append(ipRewrites, rule)
+	}
+	opts = append(opts, server.WithIPRewrites(ipRewrites...))
 
-		hf, err := hosts.NewHostsfile(config.Hostsfile, &hosts.Config{
-			Poll:    config.PollInterval,
-			Verbose: config.Verbose,
-		})
+	var responseRewrites []server.ResponseRewriteRule
+	for _, r := range c.StringSlice("response-rewrite") {
+		rule, err := server.ParseResponseRewriteRule(r)
 		if err != nil {
-			log.Fatalf("Error loading hostsfile: %s", err)
+			errs = append(errs, fmt.Errorf("The --response-rewrite argument is invalid: %s", err))
+			continue
 		}
+		responseRewrites = append(responseRewrites, rule)
+	}
+	opts = append(opts, server.WithResponseRewrites(responseRewrites...))
 
-		s := server.New(hf, config, Version)
+	if args := c.StringSlice("stubzones"); len(args) > 0 {
+		zones, err := server.ParseStubZones(args)
+		errs = appendErrors(errs, err)
+		opts = append(opts, server.WithStubZones(zones))
+	}
 
-		defer s.Stop()
+	backend, err := resolvConfBackend(c)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	// Applied last, as it depends on the options above
+	opts = append(opts, func(config *server.Config) error {
+		var errs server.ConfigErrors
+		if config.DefaultResolver && backend == resolvconf.BackendResolved && len(config.Nameservers) == 0 && os.Getenv("NAMESERVER") == "" {
+			// resolv.conf points at systemd-resolved, which forwards to us
+			host := listenHost(config.DnsAddr)
+			if ns, err := resolvconf.ResolvedNameservers(host); err != nil {
+				log.Warnf("Error reading the nameservers of systemd-resolved: %s", err)
+			} else {
+				config.Nameservers = ns
+			}
+		}
+		if config.DefaultResolver && backend == resolvconf.BackendNetsh && len(config.Nameservers) == 0 && os.Getenv("NAMESERVER") == "" {
+			// The network adapters are about to point to us
+			host := listenHost(config.DnsAddr)
+			if ns, err := resolvconf.NetshNameservers(host); err != nil {
+				log.Warnf("Error reading the DNS servers of the network adapters: %s", err)
+			} else {
+				config.Nameservers = ns
+			}
+		}
 
-		stats.Collect()
+		// While we are the default resolver /etc/resolv.conf points to ourselves
+		if current != nil && current.DefaultResolver && len(config.Nameservers) == 0 {
+			config.Nameservers = current.Nameservers
+		}
+		if err := server.ResolvConf(config, c); errors.Is(err, server.ErrNoUpstreams) {
+			errs = append(errs, err)
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Error parsing resolv.conf: %s", err.Error())
+		}
 
-		if config.DefaultResolver {
-			address, _, _ := net.SplitHostPort(config.DnsAddr)
-			err := resolvconf.StoreAddress(address)
-			if err != nil {
-				log.Warnf("Failed to register as default nameserver: %s", err)
-			}
-			defer resolvconf.Clean()
+		if runtime.GOOS == "windows" && config.Systemd {
+			errs = append(errs, fmt.Errorf("--systemd is not supported on Windows"))
 		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
 
-		go func() {
-			if err := s.Run(); err != nil {
-				exitReason <- err
-			}
-		}()
+	config, err := server.NewConfig(opts...)
+	if errs = appendErrors(errs, err); len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// listenHost returns the host of the listen address addr, 0.0.0.0 if it
+// listens on all addresses.
+func listenHost(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		return "0.0.0.0"
+	}
+	return host
+}
+
+// appendErrors appends err, or each of its errors if it is
+// server.ConfigErrors, to errs.
+func appendErrors(errs server.ConfigErrors, err error) server.ConfigErrors {
+	if cerrs, ok := err.(server.ConfigErrors); ok {
+		return append(errs, cerrs...)
+	} else if err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
 
-		exitErr = <-exitReason
-		if exitErr != nil {
-			log.Fatalf("Server error: %s", err)
+// reloadConfig evaluates the command line, the environment variables and
+// the config file again to build a new server configuration to replace
+// current with.
+func reloadConfig(app *cli.App, current *server.Config) (*server.Config, error) {
+	set := flag.NewFlagSet(app.Name, flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	for _, f := range app.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	c := cli.NewContext(app, set, nil)
+	if path := c.String("config"); path != "" {
+		if err := loadConfigFile(c, app.Flags, path); err != nil {
+			return nil, fmt.Errorf("Error loading config file: %s", err)
 		}
 	}
+	return newConfig(c, current)
+}
 
-	app.Run(os.Args)
+// resolvConfConfig returns the resolver configuration to register as the
+// default nameserver. The host's search list and ndots are only replaced
+// if they were set explicitly.
+func resolvConfConfig(c *cli.Context, config *server.Config) *resolvconf.Config {
+	rc := dnsmasq.ResolvConf(config)
+	if c.String("search-domains") != "" {
+		for _, domain := range config.SearchDomains {
+			rc.Search = append(rc.Search, strings.TrimSuffix(domain, "."))
+		}
+	}
+	if c.IsSet("ndots") {
+		rc.Ndots = config.Ndots
+	}
+	return rc
 }
 
-func validateHostPort(hostPort string) error {
-	host, port, err := net.SplitHostPort(hostPort)
-	if err != nil {
-		return err
+// resolvConfBackend returns the backend --default-resolver registers
+// go-dnsmasq with.
+func resolvConfBackend(c *cli.Context) (string, error) {
+	switch b := c.String("resolvconf-backend"); b {
+	case "auto":
+		return resolvconf.Detect(), nil
+	case resolvconf.BackendFile, resolvconf.BackendResolved, resolvconf.BackendResolvconf:
+		return b, nil
+	case resolvconf.BackendResolver:
+		if runtime.GOOS != "darwin" {
+			return "", fmt.Errorf("--resolvconf-backend resolver is only supported on macOS")
+		}
+		return b, nil
+	case resolvconf.BackendNetsh:
+		if runtime.GOOS != "windows" {
+			return "", fmt.Errorf("--resolvconf-backend netsh is only supported on Windows")
+		}
+		return b, nil
+	default:
+		return "", fmt.Errorf("--resolvconf-backend must be one of auto, file, resolved, resolvconf, resolver or netsh")
 	}
-	if ip := net.ParseIP(host); ip == nil {
-		return fmt.Errorf("Bad IP address: %s", host)
+}
+
+// errorMessage returns the message to exit with for err, adding a hint on
+// how to fix the problems users commonly run into.
+func errorMessage(err error) string {
+	var lerr *server.ListenError
+	switch {
+	case errors.As(err, &lerr) && errors.Is(lerr, syscall.EADDRINUSE):
+		return fmt.Sprintf("%s. Another process is already listening on %s, stop it, choose a different --listen address or wait for it to exit with --bind-retries", err, lerr.Addr)
+	case errors.As(err, &lerr) && errors.Is(lerr, os.ErrPermission):
+		return fmt.Sprintf("%s. Listening on ports below 1024 requires root or the CAP_NET_BIND_SERVICE capability", err)
+	case errors.Is(err, server.ErrNoUpstreams):
+		return fmt.Sprintf("%s. Pass the nameservers to forward queries to with --nameservers", err)
+	case errors.Is(err, server.ErrHostsfileLoad) && errors.Is(err, os.ErrNotExist):
+		return fmt.Sprintf("%s. Pass an existing file to --hostsfile", err)
 	}
+	return err.Error()
+}
 
-	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
-		return fmt.Errorf("Bad port number %s", port)
+// logFormatter returns the formatter of the log format 'text', 'json' or
+// 'syslog'. Text sent to syslog, with --syslog or the syslog format, has
+// no timestamps since syslog adds its own.
+func logFormatter(format string, syslog bool) (log.Formatter, error) {
+	switch format {
+	case "json":
+		return &log.JSONFormatter{}, nil
+	case "text":
+		if syslog {
+			return &log.TextFormatter{DisableTimestamp: true, DisableColors: true}, nil
+		}
+		return &log.TextFormatter{}, nil
+	case "syslog":
+		return &log.TextFormatter{DisableTimestamp: true, DisableColors: true}, nil
 	}
-	return nil
+	return nil, fmt.Errorf("Log format must be one of 'text', 'json' or 'syslog': %s", format)
 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestLogFormatter(t *testing.T) {
+	logTo := func(format string, syslog bool) string {
+		f, err := logFormatter(format, syslog)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		var buf bytes.Buffer
+		logger := log.New()
+		logger.Out, logger.Formatter, logger.Level = &buf, f, log.DebugLevel
+		logger.WithFields(log.Fields{"name": "example.com.", "ns": "8.8.8.8:53"}).Debug("Sending query")
+		return buf.String()
+	}
+
+	// JSON, also when sent to syslog
+	for _, syslog := range []bool{false, true} {
+		var entry map[string]interface{}
+		out := logTo("json", syslog)
+		if err := json.Unmarshal([]byte(out), &entry); err != nil {
+			t.Fatalf("expected a JSON object, got %q: %s", out, err)
+		}
+		for field, want := range map[string]string{"level": "debug", "msg": "Sending query", "name": "example.com.", "ns": "8.8.8.8:53"} {
+			if entry[field] != want {
+				t.Errorf("expected %s %q, got %v", field, want, entry[field])
+			}
+		}
+		if _, ok := entry["time"]; !ok {
+			t.Errorf("expected a time field, got %v", entry)
+		}
+	}
+
+	if out := logTo("text", false); !strings.Contains(out, "time=") || !strings.Contains(out, `msg="Sending query"`) {
+		t.Errorf("expected text with a timestamp, got %q", out)
+	}
+	for _, out := range []string{logTo("text", true), logTo("syslog", false)} {
+		if strings.Contains(out, "time=") || !strings.Contains(out, "name=example.com.") {
+			t.Errorf("expected text without a timestamp for syslog, got %q", out)
+		}
+	}
+
+	if _, err := logFormatter("xml", false); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+}
+
+func TestHealthCheckAddr(t *testing.T) {
+	for listen, want := range map[string]string{
+		"10.0.0.1":     "10.0.0.1:53",
+		"0.0.0.0:5300": "127.0.0.1:5300",
+		"[::]":         "[::1]:53",
+		":53":          "127.0.0.1:53",
+		"::1":          "[::1]:53",
+	} {
+		if addr, err := healthCheckAddr(listen); err != nil || addr != want {
+			t.Errorf("%s: expected %s, got %q, %v", listen, want, addr, err)
+		}
+	}
+}
+
+// TestServerErrorExit runs go-dnsmasq in a child process, with the
+// arguments in $GO_DNSMASQ_TEST_ARGS, on an address that is already in use.
+func TestServerErrorExit(t *testing.T) {
+	if args := os.Getenv("GO_DNSMASQ_TEST_ARGS"); args != "" {
+		os.Args = append([]string{"go-dnsmasq"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServerErrorExit$")
+	cmd.Env = append(os.Environ(), "GO_DNSMASQ_TEST_ARGS=--listen "+addr+" --nameservers 192.0.2.1 --no-hosts --tcp-only")
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit status 1, got %v: %s", err, out)
+	}
+	for _, want := range []string{"Server error:", addr, "address already in use", "Another process is already listening on " + addr} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q in the output, got %s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "%!") {
+		t.Errorf("expected no formatting errors in the output, got %s", out)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+)
+
+// addSyslogHook sends the log to the local syslog daemon as well.
+func addSyslogHook() error {
+	hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_DAEMON|syslog.LOG_INFO, "go-dnsmasq")
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	return nil
+}
+
+// notifyStatsDump relays the signals requesting a stats dump to c.
+func notifyStatsDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// runService connects to the Windows service control manager when
+// started by it. Elsewhere it does nothing.
+func runService(exitReason chan<- error) (stopped func(), err error) {
+	return func() {}, nil
+}
+
+func controlService(action string) error {
+	return fmt.Errorf("--service is only supported on Windows")
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogHook writes log entries to the Windows event log.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (h *eventLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *eventLogHook) Fire(entry *log.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return h.elog.Error(1, msg)
+	case log.WarnLevel:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Info(1, msg)
+	}
+}
+
+// addSyslogHook sends the log to the Windows event log as well. The event
+// source is registered when the service is installed.
+func addSyslogHook() error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	log.AddHook(&eventLogHook{elog})
+	return nil
+}
+
+// notifyStatsDump does nothing, Windows has no signal to request a stats
+// dump. The admin API serves the statistics instead.
+func notifyStatsDump(c chan<- os.Signal) {}
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupIDs returns the IDs of the given user and group, given by name or
+// numeric ID. If group is empty, the primary group of the user is used.
+// IDs that are not given are returned as -1.
+func lookupIDs(username, groupname string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return -1, -1, fmt.Errorf("Unknown user %s", username)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return -1, -1, fmt.Errorf("Unknown group %s", groupname)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the given user and group, see
+// lookupIDs. It fails unless the change took effect and cannot be undone.
+func dropPrivileges(username, groupname string) error {
+	uid, gid, err := lookupIDs(username, groupname)
+	if err != nil {
+		return err
+	}
+
+	// The group must be changed while we are still allowed to
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %s", err)
+		}
+		if syscall.Getgid() != gid || syscall.Getegid() != gid {
+			return fmt.Errorf("group ID is still %d", syscall.Getegid())
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %s", err)
+		}
+		if syscall.Getuid() != uid || syscall.Geteuid() != uid {
+			return fmt.Errorf("user ID is still %d", syscall.Geteuid())
+		}
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return fmt.Errorf("root privileges could be regained")
+		}
+	}
+	return nil
+}
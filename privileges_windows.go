@@ -0,0 +1,17 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "fmt"
+
+var errPrivilegesUnsupported = fmt.Errorf("--user and --group are not supported on Windows, configure the account of the service instead")
+
+func lookupIDs(username, groupname string) (uid, gid int, err error) {
+	return -1, -1, errPrivilegesUnsupported
+}
+
+func dropPrivileges(username, groupname string) error {
+	return errPrivilegesUnsupported
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/server"
+)
+
+// queryCommand resolves a name through a running server and prints the
+// answer along with where the server got it from.
+var queryCommand = cli.Command{
+	Name:      "query",
+	Usage:     "Resolve a name through the server listening on --listen and print the response, including whether it came from the cache and which upstream answered",
+	ArgsUsage: "<name> [type]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "listen, l",
+			Value:  "127.0.0.1:53",
+			Usage:  "Address the server listens on `host[:port]`. Unspecified addresses are queried on loopback",
+			EnvVar: "DNSMASQ_LISTEN",
+		},
+		cli.StringFlag{
+			Name:  "server",
+			Usage: "Query this `host[:port]` instead of the --listen address",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 2 * time.Second,
+			Usage: "How long to wait for the answer",
+		},
+		cli.BoolFlag{
+			Name:   "tcp-only",
+			Usage:  "Query over TCP",
+			EnvVar: "DNSMASQ_TCP_ONLY",
+		},
+	},
+	Action: func(c *cli.Context) {
+		if err := query(c, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Query failed: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func query(c *cli.Context, out io.Writer) error {
+	args := c.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected <name> [type]")
+	}
+	listen := c.String("listen")
+	if c.String("server") != "" {
+		listen = c.String("server")
+	}
+	addr, err := healthCheckAddr(listen)
+	if err != nil {
+		return fmt.Errorf("invalid server address: %s", err)
+	}
+
+	name, qtype := dns.Fqdn(args[0]), dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			return fmt.Errorf("invalid query type %q", args[1])
+		}
+		qtype = t
+	} else if net.ParseIP(args[0]) != nil {
+		// Like dig -x
+		name, _ = dns.ReverseAddr(args[0])
+		qtype = dns.TypePTR
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: server.QueryInfoOption})
+
+	client := &dns.Client{Timeout: c.Duration("timeout")}
+	if c.Bool("tcp-only") {
+		client.Net = "tcp"
+	}
+	r, rtt, err := client.Exchange(m, addr)
+	if err != nil {
+		return fmt.Errorf("querying %s: %s", addr, err)
+	}
+	printResponse(out, r, addr, rtt)
+	return nil
+}
+
+// printResponse writes r in a form similar to dig, with the source of the
+// answer reported by the server.
+func printResponse(out io.Writer, r *dns.Msg, addr string, rtt time.Duration) {
+	q := r.Question[0]
+	fmt.Fprintf(out, "%s %s: %s from %s in %s\n", q.Name, dns.TypeToString[q.Qtype], dns.RcodeToString[r.Rcode], addr, rtt.Round(10*time.Microsecond))
+	if source, upstream, ok := server.ParseQueryInfo(r); ok {
+		line := "Source: " + source
+		if upstream != "" {
+			line += ", upstream " + upstream
+		}
+		fmt.Fprintln(out, line)
+	} else {
+		fmt.Fprintln(out, "Source: not reported by the server")
+	}
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{r.Authoritative, "aa"}, {r.Truncated, "tc"}, {r.RecursionAvailable, "ra"}, {r.AuthenticatedData, "ad"}} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) > 0 {
+		fmt.Fprintf(out, "Flags: %s\n", strings.Join(flags, " "))
+	}
+
+	for _, section := range []struct {
+		name string
+		rrs  []dns.RR
+	}{{"Answer", r.Answer}, {"Authority", r.Ns}, {"Additional", r.Extra}} {
+		var rrs []dns.RR
+		for _, rr := range section.rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s:\n", section.name)
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, rr := range rrs {
+			h := rr.Header()
+			data := strings.TrimPrefix(rr.String(), h.String())
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", h.Name, h.Ttl, dns.ClassToString[h.Class], dns.TypeToString[h.Rrtype], data)
+		}
+		tw.Flush()
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RESOLVCONF_INTERFACE is the interface record go-dnsmasq registers with
+// resolvconf(8). Records of lo.* are ordered first by Debian's resolvconf.
+const RESOLVCONF_INTERFACE = "lo.go-dnsmasq"
+
+// RESOLVCONF_STATE_PATH holds the PID of the process that registered
+// RESOLVCONF_INTERFACE. It is used to remove the record after the process
+// died without removing it.
+const RESOLVCONF_STATE_PATH = "/run/go-dnsmasq.resolvconf"
+
+// registered is whether storeCommand added the record. Guarded by mu.
+var registered bool
+
+// resolvconfCommand returns the path of the resolvconf(8) or openresolv
+// utility, or an empty string if none is installed.
+func resolvconfCommand() string {
+	path, err := exec.LookPath("resolvconf")
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// isOpenresolv reports whether the resolvconf utility at path is openresolv,
+// which takes options Debian's resolvconf does not know.
+func isOpenresolv(path string) bool {
+	out, _ := exec.Command(path, "--version").CombinedOutput()
+	return bytes.Contains(bytes.ToLower(out), []byte("openresolv"))
+}
+
+// storeCommand registers config as the record of RESOLVCONF_INTERFACE,
+// which resolvconf lists before the nameservers of the network interfaces.
+func storeCommand(config *Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	path := resolvconfCommand()
+	if path == "" {
+		return fmt.Errorf("resolvconf is not installed")
+	}
+
+	args := []string{"-a", RESOLVCONF_INTERFACE}
+	if isOpenresolv(path) {
+		// Exclusive, so that the other nameservers are not used
+		args = append(args, "-x")
+	}
+	if err := ioutil.WriteFile(RESOLVCONF_STATE_PATH, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return fmt.Errorf("writing %s: %s", RESOLVCONF_STATE_PATH, err)
+	}
+	log.Debugf("Registering nameserver %s with %s", config.Address, path)
+	if err := runResolvconf(path, commandRecord(config), args...); err != nil {
+		os.Remove(RESOLVCONF_STATE_PATH)
+		return err
+	}
+	registered = true
+	return nil
+}
+
+// commandRecord returns the resolv.conf lines registered for config.
+func commandRecord(config *Config) string {
+	record := fmt.Sprintf("nameserver %s\n", config.Address)
+	if len(config.Search) > 0 {
+		record += fmt.Sprintf("search %s\n", strings.Join(config.Search, " "))
+	}
+	if config.Ndots > 0 {
+		record += fmt.Sprintf("options ndots:%d\n", config.Ndots)
+	}
+	return record
+}
+
+// cleanCommand removes the record added by storeCommand. mu must be held.
+func cleanCommand() {
+	if !registered {
+		return
+	}
+	registered = false
+	log.Infof("Removing %s from resolvconf", RESOLVCONF_INTERFACE)
+	// Fails once privileges have been dropped. The record is removed by
+	// Repair on the next start.
+	if err := runResolvconf(resolvconfCommand(), "", "-d", RESOLVCONF_INTERFACE); err != nil {
+		log.Errorf("Failed to remove %s from resolvconf: %s", RESOLVCONF_INTERFACE, err)
+		return
+	}
+	os.Remove(RESOLVCONF_STATE_PATH)
+}
+
+// repairCommand removes the record left registered by a go-dnsmasq process
+// that is no longer running.
+func repairCommand() error {
+	b, err := ioutil.ReadFile(RESOLVCONF_STATE_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid > 0 && pid != os.Getpid() && processAlive(pid) {
+		log.Debugf("resolvconf record %s belongs to running go-dnsmasq process %d", RESOLVCONF_INTERFACE, pid)
+		return nil
+	}
+	if path := resolvconfCommand(); path != "" {
+		if err := runResolvconf(path, "", "-d", RESOLVCONF_INTERFACE); err != nil {
+			return err
+		}
+	}
+	log.Warnf("Removed resolvconf record %s left behind by go-dnsmasq process %d", RESOLVCONF_INTERFACE, pid)
+	os.Remove(RESOLVCONF_STATE_PATH)
+	return nil
+}
+
+func runResolvconf(path, stdin string, args ...string) error {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s %s: %s: %s", path, strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("%s %s: %s", path, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package resolvconf
+
+import "fmt"
+
+func storeNetsh(config *Config) error {
+	return fmt.Errorf("netsh is only supported on Windows")
+}
+
+func cleanNetsh() {}
+
+func repairNetsh() error {
+	return nil
+}
+
+// NetshNameservers is only supported on Windows.
+func NetshNameservers(self string) ([]string, error) {
+	return nil, fmt.Errorf("netsh is only supported on Windows")
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// NETSH_STATE_FILE, in the ProgramData directory, holds the original DNS
+// servers of the network adapters configured by storeNetsh. It is used to
+// restore them after the process died without restoring them.
+const NETSH_STATE_FILE = `go-dnsmasq\netsh.json`
+
+// netshAdapter is a network adapter and its original DNS servers.
+type netshAdapter struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+	GUID  string `json:"guid"`
+	// Whether the DNS servers were assigned by DHCP
+	DHCP    bool     `json:"dhcp"`
+	Servers []string `json:"servers"`
+}
+
+// netshState is the adapters configured by storeNetsh.
+type netshState struct {
+	Pid      int            `json:"pid"`
+	IPv6     bool           `json:"ipv6"`
+	Address  string         `json:"address"`
+	Adapters []netshAdapter `json:"adapters"`
+}
+
+// netsh is the state of the adapters configured by storeNetsh. Guarded by
+// mu.
+var netsh *netshState
+
+func netshStatePath() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = `C:\ProgramData`
+	}
+	return filepath.Join(dir, NETSH_STATE_FILE)
+}
+
+// storeNetsh sets config.Address as the only DNS server of the network
+// adapters that are up, saving their original configuration. The search
+// list and ndots have no per-adapter equivalent and are not applied.
+func storeNetsh(config *Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	ip := net.ParseIP(config.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", config.Address)
+	}
+	if ip.IsUnspecified() {
+		if ip.To4() != nil {
+			ip = net.IPv4(127, 0, 0, 1)
+		} else {
+			ip = net.IPv6loopback
+		}
+	}
+	s := &netshState{Pid: os.Getpid(), IPv6: ip.To4() == nil, Address: ip.String()}
+	adapters, err := activeAdapters(s.IPv6)
+	if err != nil {
+		return err
+	}
+	if len(adapters) == 0 {
+		return fmt.Errorf("no network adapter is up")
+	}
+	for _, a := range adapters {
+		a.DHCP, a.Servers, err = adapterServers(a.GUID, s.IPv6)
+		if err != nil {
+			return fmt.Errorf("reading the DNS servers of %s: %s", a.Name, err)
+		}
+		if len(a.Servers) == 1 && a.Servers[0] == s.Address {
+			// Left behind by an instance that is still running
+			return fmt.Errorf("%s is the DNS server of %s already", s.Address, a.Name)
+		}
+		s.Adapters = append(s.Adapters, a)
+	}
+	if err := writeNetshState(s); err != nil {
+		return err
+	}
+
+	for i, a := range s.Adapters {
+		log.Debugf("Setting DNS server %s on network adapter %s", s.Address, a.Name)
+		err := runNetsh(s.IPv6, "set", "dnsservers", "name="+strconv.Itoa(int(a.Index)), "source=static", "address="+s.Address, "validate=no")
+		if err != nil {
+			for _, a := range s.Adapters[:i] {
+				restoreAdapter(s, a)
+			}
+			os.Remove(netshStatePath())
+			return fmt.Errorf("setting the DNS server of %s: %s", a.Name, err)
+		}
+	}
+	netsh = s
+	return nil
+}
+
+func writeNetshState(s *netshState) error {
+	path := netshStatePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(s)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// cleanNetsh restores the adapters configured by storeNetsh. mu must be
+// held.
+func cleanNetsh() {
+	if netsh == nil {
+		return
+	}
+	log.Infof("Restoring the DNS servers of the network adapters")
+	ok := true
+	for _, a := range netsh.Adapters {
+		if !restoreAdapter(netsh, a) {
+			ok = false
+		}
+	}
+	if ok {
+		os.Remove(netshStatePath())
+	}
+	netsh = nil
+}
+
+// repairNetsh restores the adapters left configured by a go-dnsmasq
+// process that is no longer running.
+func repairNetsh() error {
+	b, err := ioutil.ReadFile(netshStatePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	s := new(netshState)
+	if err := json.Unmarshal(b, s); err != nil {
+		os.Remove(netshStatePath())
+		return fmt.Errorf("removed invalid %s: %s", netshStatePath(), err)
+	}
+	if s.Pid > 0 && s.Pid != os.Getpid() && processAlive(s.Pid) {
+		log.Debugf("The network adapters are managed by running go-dnsmasq process %d", s.Pid)
+		return nil
+	}
+	ok := true
+	for _, a := range s.Adapters {
+		if !restoreAdapter(s, a) {
+			ok = false
+		}
+	}
+	if !ok {
+		return fmt.Errorf("failed to restore the DNS servers of the network adapters")
+	}
+	log.Warnf("Restored the DNS servers of the network adapters left behind by go-dnsmasq process %d", s.Pid)
+	os.Remove(netshStatePath())
+	return nil
+}
+
+// restoreAdapter sets the DNS servers of a back to the original ones,
+// unless they were changed since storeNetsh set them. It reports whether
+// the adapter was restored or left alone.
+func restoreAdapter(s *netshState, a netshAdapter) bool {
+	dhcp, servers, err := adapterServers(a.GUID, s.IPv6)
+	if err != nil {
+		// The adapter was removed
+		log.Debugf("Not restoring the DNS servers of %s: %s", a.Name, err)
+		return true
+	}
+	if dhcp || len(servers) != 1 || servers[0] != s.Address {
+		log.Warnf("Not restoring the DNS servers of %s, they were changed by someone else", a.Name)
+		return true
+	}
+
+	name := "name=" + strconv.Itoa(int(a.Index))
+	if a.DHCP {
+		err = runNetsh(s.IPv6, "set", "dnsservers", name, "source=dhcp")
+	} else if len(a.Servers) == 0 {
+		err = runNetsh(s.IPv6, "set", "dnsservers", name, "source=static", "address=none")
+	} else {
+		err = runNetsh(s.IPv6, "set", "dnsservers", name, "source=static", "address="+a.Servers[0], "validate=no")
+		for i, server := range a.Servers[1:] {
+			if err != nil {
+				break
+			}
+			err = runNetsh(s.IPv6, "add", "dnsservers", name, "address="+server, "index="+strconv.Itoa(i+2), "validate=no")
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to restore the DNS servers of %s: %s", a.Name, err)
+		return false
+	}
+	return true
+}
+
+// activeAdapters returns the network adapters that are up and have an
+// address of the family, except loopback and tunnel adapters.
+func activeAdapters(ipv6 bool) ([]netshAdapter, error) {
+	family := uint32(windows.AF_INET)
+	if ipv6 {
+		family = windows.AF_INET6
+	}
+	size := uint32(15000)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := windows.GetAdaptersAddresses(family, 0, 0, (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW {
+			return nil, fmt.Errorf("listing the network adapters: %s", err)
+		}
+	}
+
+	var adapters []netshAdapter
+	for aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])); aa != nil; aa = aa.Next {
+		if aa.OperStatus != windows.IfOperStatusUp || aa.FirstUnicastAddress == nil {
+			continue
+		}
+		if aa.IfType == windows.IF_TYPE_SOFTWARE_LOOPBACK || aa.IfType == windows.IF_TYPE_TUNNEL {
+			continue
+		}
+		index := aa.IfIndex
+		if ipv6 {
+			index = aa.Ipv6IfIndex
+		}
+		adapters = append(adapters, netshAdapter{
+			Index: index,
+			Name:  windows.UTF16PtrToString(aa.FriendlyName),
+			GUID:  windows.BytePtrToString(aa.AdapterName),
+		})
+	}
+	return adapters, nil
+}
+
+// adapterServers returns the DNS servers of the adapter with guid and
+// whether they were assigned by DHCP, from the TCP/IP settings in the
+// registry.
+func adapterServers(guid string, ipv6 bool) (bool, []string, error) {
+	service := "Tcpip"
+	if ipv6 {
+		service = "Tcpip6"
+	}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+service+`\Parameters\Interfaces\`+guid, registry.QUERY_VALUE)
+	if err != nil {
+		return false, nil, err
+	}
+	defer k.Close()
+	static, _, err := k.GetStringValue("NameServer")
+	if err != nil && err != registry.ErrNotExist {
+		return false, nil, err
+	}
+	if servers := splitServers(static); len(servers) > 0 {
+		return false, servers, nil
+	}
+	dhcp, _, err := k.GetStringValue("DhcpNameServer")
+	if err != nil && err != registry.ErrNotExist {
+		return false, nil, err
+	}
+	// An adapter without static servers gets them from DHCP, if any
+	return true, splitServers(dhcp), nil
+}
+
+// splitServers splits a list of DNS servers separated by commas or spaces.
+func splitServers(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// NetshNameservers returns the DNS servers of the network adapters that
+// are up as host:port, except self, the address go-dnsmasq listens on.
+// Loopback addresses are skipped as well if self is unspecified.
+func NetshNameservers(self string) ([]string, error) {
+	ip := net.ParseIP(self)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", self)
+	}
+	ipv6 := ip.To4() == nil
+	adapters, err := activeAdapters(ipv6)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, a := range adapters {
+		_, list, err := adapterServers(a.GUID, ipv6)
+		if err != nil {
+			continue
+		}
+		for _, s := range list {
+			sip := net.ParseIP(s)
+			if sip == nil || sip.Equal(ip) || ip.IsUnspecified() && sip.IsLoopback() {
+				continue
+			}
+			if hostPort := net.JoinHostPort(s, "53"); !containsString(servers, hostPort) {
+				servers = append(servers, hostPort)
+			}
+		}
+	}
+	return servers, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runNetsh(ipv6 bool, args ...string) error {
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	args = append([]string{"interface", family}, args...)
+	if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("netsh %s: %s: %s", strings.Join(args, " "), err, msg)
+		}
+		return fmt.Errorf("netsh %s: %s", strings.Join(args, " "), err)
+	}
+	return nil
+}
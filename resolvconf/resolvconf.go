@@ -8,11 +8,18 @@
 package resolvconf
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -21,66 +28,367 @@ const RESOLVCONF_COMMENT_ADD = "# added by go-dnsmasq"
 const RESOLVCONF_COMMENT_OUT = "# disabled by go-dnsmasq #"
 const RESOLVCONF_PATH = "/etc/resolv.conf"
 
-var resolvConfPattern = regexp.MustCompile("(?m:^.*" + regexp.QuoteMeta(RESOLVCONF_COMMENT_ADD) + ")(?:$|\n)")
+// RESOLVCONF_BACKUP_PATH is the default path of the backups of the
+// original resolv.conf, followed by the time of the backup. They are kept
+// while go-dnsmasq is the default nameserver and used to repair
+// resolv.conf after the process died without restoring it.
+const RESOLVCONF_BACKUP_PATH = RESOLVCONF_PATH + ".go-dnsmasq"
 
-func StoreAddress(address string) error {
-	log.Debugf("Configuring nameserver in /etc/resolv.conf")
-	resolveConfEntry := fmt.Sprintf("nameserver %s %s\n", address, RESOLVCONF_COMMENT_ADD)
-	return updateResolvConf(resolveConfEntry, RESOLVCONF_PATH)
+// backupTimeFormat is the suffix of the backup files. It sorts in
+// chronological order.
+const backupTimeFormat = "20060102T150405.000000000"
+
+var resolvConfPattern = regexp.MustCompile("(?m:^.*" + regexp.QuoteMeta(RESOLVCONF_COMMENT_ADD) + ".*)(?:$|\n)")
+
+// pidPattern matches the PID of the process that added the nameserver.
+// Entries written by older versions have none.
+var pidPattern = regexp.MustCompile(regexp.QuoteMeta(RESOLVCONF_COMMENT_ADD) + ` \(pid (\d+)\)`)
+
+var (
+	mu sync.Mutex
+	// file is the resolv.conf opened by StoreConfig. It is kept open so
+	// that Clean can restore it after privileges have been dropped.
+	file *os.File
+	// original is the content file is restored to
+	original []byte
+)
+
+// The resolv.conf paths, variables for testing
+var (
+	resolvConfPath       = RESOLVCONF_PATH
+	resolvConfBackupPath = RESOLVCONF_BACKUP_PATH
+)
+
+// Config is what StoreConfig registers as the host's resolver
+// configuration.
+type Config struct {
+	// Address of the nameserver
+	Address string
+	// Search list replacing the one of the host if not empty
+	Search []string
+	// Written as 'options ndots' if greater than 0
+	Ndots int
+	// Port of the nameserver, only used by BackendResolver
+	Port int
+	// Domains resolved by the nameserver, only used by BackendResolver
+	Domains []string
+}
+
+// StoreConfig makes config.Address the nameserver of the host using
+// backend, either by rewriting /etc/resolv.conf or by registering it with
+// systemd-resolved or resolvconf(8). The search list and ndots are set
+// along with it. On macOS BackendResolver makes it the nameserver of
+// config.Domains only; on Windows BackendNetsh makes it the DNS server of
+// the network adapters.
+func StoreConfig(config *Config, backend string) error {
+	switch backend {
+	case BackendResolved:
+		return storeResolved(config)
+	case BackendResolvconf:
+		return storeCommand(config)
+	case BackendResolver:
+		if runtime.GOOS != "darwin" {
+			return fmt.Errorf("the %s backend is only supported on macOS", BackendResolver)
+		}
+		return storeResolver(config)
+	case BackendNetsh:
+		return storeNetsh(config)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	log.Debugf("Configuring nameserver in %s", resolvConfPath)
+	f, err := os.OpenFile(resolvConfPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	orig, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if !resolvConfPattern.Match(orig) {
+		if err := writeBackup(orig); err != nil {
+			f.Close()
+			return fmt.Errorf("writing backup: %s", err)
+		}
+	} else if backup, err := latestBackup(); err == nil {
+		// Keep the backup of the instance whose entry is being replaced
+		orig = backup
+	} else {
+		orig = restore(orig)
+	}
+	if err := writeResolvConf(f, takeover(orig, config, os.Getpid())); err != nil {
+		f.Close()
+		return err
+	}
+	file, original = f, orig
+	return nil
 }
 
+// Clean restores the host's resolver configuration changed by
+// StoreConfig. It is safe to call more than once and from any goroutine.
 func Clean() {
-	log.Info("Restoring /etc/resolv.conf")
-	updateResolvConf("", RESOLVCONF_PATH)
+	mu.Lock()
+	defer mu.Unlock()
+	cleanResolved()
+	cleanCommand()
+	cleanResolver()
+	cleanNetsh()
+	if file == nil {
+		return
+	}
+	log.Infof("Restoring %s", resolvConfPath)
+	// The file kept open by StoreConfig can be written after privileges
+	// have been dropped, the backup is likely still readable
+	b, err := latestBackup()
+	if err != nil {
+		b = original
+	}
+	if err := restoreFile(file, b); err != nil {
+		log.Errorf("Failed to restore %s: %s", resolvConfPath, err)
+	}
+	file.Close()
+	file, original = nil, nil
+}
+
+// SetBackupPath sets the path of the backups of resolv.conf, which is
+// followed by the time of the backup. It must be called before
+// StoreConfig, Repair, Backup and Restore.
+func SetBackupPath(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+	resolvConfBackupPath = path
+}
+
+// Backup saves the content of the resolv.conf at path to a new backup
+// file. StoreConfig backs up resolv.conf before changing it.
+func Backup(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return writeBackup(b)
 }
 
-func updateResolvConf(insert, path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+// Restore replaces the content of the resolv.conf at path with the most
+// recent backup and removes the backups. Clean restores resolv.conf the
+// same way.
+func Restore(path string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	b, err := latestBackup()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	return restoreFile(f, b)
+}
 
-	orig, err := ioutil.ReadAll(f)
+// restoreFile replaces the content of f with b and removes the backups.
+// Removing them fails once privileges have been dropped; the stale
+// backups are removed by Repair on the next start.
+func restoreFile(f *os.File, b []byte) error {
+	if err := writeResolvConf(f, b); err != nil {
+		return err
+	}
+	removeBackups()
+	return nil
+}
+
+func writeBackup(b []byte) error {
+	path := resolvConfBackupPath + "." + time.Now().UTC().Format(backupTimeFormat)
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// backups returns the paths of the backup files, the most recent last. A
+// backup without time, written by older versions, comes first.
+func backups() []string {
+	dir, base := filepath.Split(resolvConfBackupPath)
+	files, _ := ioutil.ReadDir(filepath.Clean(dir))
+	var found []string
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), base) {
+			continue
+		}
+		suffix := strings.TrimPrefix(fi.Name(), base)
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(suffix, ".")); suffix == "" || strings.HasPrefix(suffix, ".") && err == nil {
+			found = append(found, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// latestBackup returns the content of the most recent backup.
+func latestBackup() ([]byte, error) {
+	paths := backups()
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no backup of %s found at %s", resolvConfPath, resolvConfBackupPath)
+	}
+	return ioutil.ReadFile(paths[len(paths)-1])
+}
+
+func removeBackups() {
+	for _, path := range backups() {
+		if err := os.Remove(path); err != nil {
+			log.Debugf("Failed to remove %s: %s", path, err)
+		}
+	}
+}
+
+// CleanOnPanic calls Clean if the goroutine is panicking and then
+// continues panicking. It must be deferred directly.
+func CleanOnPanic() {
+	if r := recover(); r != nil {
+		Clean()
+		panic(r)
+	}
+}
+
+// Repair restores resolv.conf, the systemd-resolved link settings, the
+// resolvconf(8) record, the files in /etc/resolver or the DNS servers of
+// the Windows network adapters if they still point to a go-dnsmasq process
+// that is no longer running, e.g. after it was killed with SIGKILL.
+func Repair() error {
+	if err := repairResolved(); err != nil {
+		log.Warnf("Failed to repair the systemd-resolved link settings: %s", err)
+	}
+	if err := repairCommand(); err != nil {
+		log.Warnf("Failed to remove the stale resolvconf record: %s", err)
+	}
+	if err := repairResolver(); err != nil {
+		log.Warnf("Failed to remove the stale files in %s: %s", resolverDir, err)
+	}
+	if err := repairNetsh(); err != nil {
+		log.Warnf("Failed to restore the DNS servers of the network adapters: %s", err)
+	}
+	return repairFile()
+}
+
+// repairFile restores resolv.conf. The backup is restored if there is one;
+// otherwise the entry is removed and the nameservers commented out by it
+// are enabled again.
+func repairFile() error {
+	orig, err := ioutil.ReadFile(resolvConfPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
+	if !resolvConfPattern.Match(orig) {
+		if stale := backups(); len(stale) > 0 {
+			log.Debugf("Removing stale backups %s", strings.Join(stale, ", "))
+			removeBackups()
+		}
+		return nil
+	}
 
-	orig = resolvConfPattern.ReplaceAllLiteral(orig, []byte{})
+	pid := 0
+	if m := pidPattern.FindSubmatch(orig); m != nil {
+		pid, _ = strconv.Atoi(string(m[1]))
+	}
+	if pid > 0 && pid != os.Getpid() && processAlive(pid) {
+		log.Debugf("/etc/resolv.conf is managed by running go-dnsmasq process %d", pid)
+		return nil
+	}
 
-	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+	f, err := os.OpenFile(resolvConfPath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	backup, err := latestBackup()
+	if err != nil {
+		backup = restore(orig)
+	}
+	if err := restoreFile(f, backup); err != nil {
 		return err
 	}
+	log.Warnf("Restored %s left behind by go-dnsmasq process %d", resolvConfPath, pid)
+	return nil
+}
 
-	if _, err = f.WriteString(insert); err != nil {
+// writeResolvConf replaces the contents of f in place, as resolv.conf may
+// be a bind mount that cannot be replaced by renaming.
+func writeResolvConf(f *os.File, b []byte) error {
+	if _, err := f.WriteAt(b, 0); err != nil {
 		return err
 	}
+	return f.Truncate(int64(len(b)))
+}
 
-	lines := strings.SplitAfter(string(orig), "\n")
-	for _, line := range lines {
-		switch insert {
-		case "":
-			// Uncomment lines we commented
-			if strings.Contains(line, RESOLVCONF_COMMENT_OUT) {
-				line = strings.Replace(line, RESOLVCONF_COMMENT_OUT, "", -1)
-				line = strings.TrimLeft(line, " ")
-			}
-		default:
-			// Comment out active nameservers only
-			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "nameserver") {
-				line = fmt.Sprintf("%s %s", RESOLVCONF_COMMENT_OUT, line)
-			}
-		}			
+// takeover returns resolv.conf orig with config.Address as the only
+// nameserver, marked with pid. The other nameservers are commented out, as
+// are the search and domain lines if config has a search list and the
+// options lines if it has ndots; their other options are kept.
+//
+// The search line goes first as glibc would read a trailing marker as a
+// domain. restore recognizes it by the marked line that follows.
+func takeover(orig []byte, config *Config, pid int) []byte {
+	var head, body bytes.Buffer
+	if len(config.Search) > 0 {
+		fmt.Fprintf(&head, "search %s\n", strings.Join(config.Search, " "))
+	}
+	fmt.Fprintf(&head, "nameserver %s %s (pid %d)\n", config.Address, RESOLVCONF_COMMENT_ADD, pid)
 
-		if _, err = f.WriteString(line); err != nil {
-			return err
+	var options []string
+	for _, line := range strings.SplitAfter(string(orig), "\n") {
+		fields := strings.Fields(line)
+		disable := false
+		if len(fields) > 0 {
+			switch strings.ToLower(fields[0]) {
+			case "nameserver":
+				disable = true
+			case "search", "domain":
+				disable = len(config.Search) > 0
+			case "options":
+				if config.Ndots > 0 {
+					disable = true
+					for _, o := range fields[1:] {
+						if !strings.HasPrefix(o, "ndots:") {
+							options = append(options, o)
+						}
+					}
+				}
+			}
+		}
+		if disable {
+			line = RESOLVCONF_COMMENT_OUT + " " + line
 		}
+		body.WriteString(line)
 	}
+	if config.Ndots > 0 {
+		options = append(options, fmt.Sprintf("ndots:%d", config.Ndots))
+		fmt.Fprintf(&head, "options %s %s\n", strings.Join(options, " "), RESOLVCONF_COMMENT_ADD)
+	}
+	head.Write(body.Bytes())
+	return head.Bytes()
+}
 
-	// contents may have been shortened, so truncate where we are
-	pos, err := f.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		return err
+// restore returns resolv.conf b without the lines added by takeover and
+// with the lines it commented out enabled again. Restoring the backup is
+// exact, this is the fallback when there is none.
+func restore(b []byte) []byte {
+	lines := strings.SplitAfter(string(b), "\n")
+	if len(lines) > 1 && strings.HasPrefix(lines[0], "search") && strings.Contains(lines[1], RESOLVCONF_COMMENT_ADD) {
+		lines = lines[1:]
+	}
+	var out bytes.Buffer
+	for _, line := range lines {
+		if strings.Contains(line, RESOLVCONF_COMMENT_ADD) {
+			continue
+		}
+		if strings.HasPrefix(line, RESOLVCONF_COMMENT_OUT) {
+			line = strings.TrimPrefix(line[len(RESOLVCONF_COMMENT_OUT):], " ")
+		}
+		out.WriteString(line)
 	}
-	return f.Truncate(pos)
+	return out.Bytes()
 }
@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTakeover(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		orig   string
+		config Config
+		want   string
+	}{
+		{
+			"nameserver only",
+			"# Generated by NetworkManager\nsearch corp.example\nnameserver 10.0.0.1\nnameserver 10.0.0.2\n",
+			Config{Address: "127.0.0.1"},
+			"nameserver 127.0.0.1 # added by go-dnsmasq (pid 42)\n" +
+				"# Generated by NetworkManager\nsearch corp.example\n" +
+				"# disabled by go-dnsmasq # nameserver 10.0.0.1\n# disabled by go-dnsmasq # nameserver 10.0.0.2\n",
+		},
+		{
+			"search and ndots",
+			"; comment\ndomain corp.example\nsearch a.example\nsearch b.example\nnameserver 10.0.0.1\noptions ndots:2 timeout:1\noptions rotate\n",
+			Config{Address: "127.0.0.1", Search: []string{"svc.example", "example"}, Ndots: 5},
+			"search svc.example example\n" +
+				"nameserver 127.0.0.1 # added by go-dnsmasq (pid 42)\n" +
+				"options timeout:1 rotate ndots:5 # added by go-dnsmasq\n" +
+				"; comment\n" +
+				"# disabled by go-dnsmasq # domain corp.example\n" +
+				"# disabled by go-dnsmasq # search a.example\n" +
+				"# disabled by go-dnsmasq # search b.example\n" +
+				"# disabled by go-dnsmasq # nameserver 10.0.0.1\n" +
+				"# disabled by go-dnsmasq # options ndots:2 timeout:1\n" +
+				"# disabled by go-dnsmasq # options rotate\n",
+		},
+		{
+			"no trailing newline",
+			"nameserver 10.0.0.1",
+			Config{Address: "::1", Ndots: 1},
+			"nameserver ::1 # added by go-dnsmasq (pid 42)\n" +
+				"options ndots:1 # added by go-dnsmasq\n" +
+				"# disabled by go-dnsmasq # nameserver 10.0.0.1",
+		},
+		{
+			"empty",
+			"",
+			Config{Address: "127.0.0.1", Search: []string{"example"}},
+			"search example\nnameserver 127.0.0.1 # added by go-dnsmasq (pid 42)\n",
+		},
+	} {
+		got := string(takeover([]byte(tc.orig), &tc.config, 42))
+		if got != tc.want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tc.name, tc.want, got)
+		}
+		if restored := string(restore([]byte(got))); restored != tc.orig {
+			t.Errorf("%s: expected restore to return\n%s\ngot\n%s", tc.name, tc.orig, restored)
+		}
+	}
+
+	// A search line of the host that follows the entry is kept
+	orig := "search corp.example\nnameserver 10.0.0.1\n"
+	got := takeover([]byte(orig), &Config{Address: "127.0.0.1"}, 42)
+	if restored := string(restore(got)); restored != orig {
+		t.Errorf("expected restore to keep the host's search line, got\n%s", restored)
+	}
+}
+
+// testPaths points resolv.conf and its backup to a temporary directory.
+// It returns the path of resolv.conf and a function undoing it.
+func testPaths(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldBackup := resolvConfPath, resolvConfBackupPath
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	resolvConfBackupPath = resolvConfPath + ".go-dnsmasq"
+	return resolvConfPath, func() {
+		resolvConfPath, resolvConfBackupPath = oldPath, oldBackup
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStoreConfigClean(t *testing.T) {
+	for _, orig := range []string{
+		"# comment\n\nsearch a.example\nsearch b.example\nnameserver 10.0.0.1\n",
+		"nameserver 10.0.0.1\n  # indented comment\noptions  ndots:3",
+		"# disabled by go-dnsmasq # nameserver 10.0.0.9\r\nnameserver 10.0.0.1\r\n",
+	} {
+		path, cleanup := testPaths(t)
+		defer cleanup()
+		if err := ioutil.WriteFile(path, []byte(orig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{Address: "127.0.0.1", Search: []string{"example"}, Ndots: 2}
+		if err := StoreConfig(config, BackendFile); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadFile(path)
+		if string(b) == orig || !resolvConfPattern.Match(b) {
+			t.Errorf("expected resolv.conf to be rewritten, got\n%s", b)
+		}
+		if backup, _ := latestBackup(); string(backup) != orig {
+			t.Errorf("expected the backup to hold the original, got\n%s", backup)
+		}
+
+		Clean()
+		if b, _ := ioutil.ReadFile(path); string(b) != orig {
+			t.Errorf("expected\n%q\nto be restored, got\n%q", orig, b)
+		}
+		if stale := backups(); len(stale) > 0 {
+			t.Errorf("expected the backup to be removed, got %v", stale)
+		}
+	}
+}
+
+func TestRepairFile(t *testing.T) {
+	path, cleanup := testPaths(t)
+	defer cleanup()
+	orig := "search corp.example\nnameserver 10.0.0.1"
+	// Entry of a process that is not running, without backup
+	stale := takeover([]byte(orig), &Config{Address: "127.0.0.1", Ndots: 3}, 0)
+	if err := ioutil.WriteFile(path, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != orig {
+		t.Errorf("expected\n%q\nto be restored, got\n%q", orig, b)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	path, cleanup := testPaths(t)
+	defer cleanup()
+	orig := "# written by dhclient\r\nsearch corp.example\nnameserver 10.0.0.1\n\noptions rotate"
+	if err := ioutil.WriteFile(path, []byte(orig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// An unrelated file next to the backups is kept
+	other := resolvConfBackupPath + "-old"
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Backup(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreConfig(&Config{Address: "127.0.0.1", Search: []string{"example"}}, BackendFile); err != nil {
+		t.Fatal(err)
+	}
+	defer Clean()
+	if b, _ := ioutil.ReadFile(path); string(b) == orig {
+		t.Fatal("expected resolv.conf to be rewritten")
+	}
+	if n := len(backups()); n != 2 {
+		t.Errorf("expected 2 backups, got %d", n)
+	}
+
+	if err := Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != orig {
+		t.Errorf("expected\n%q\nto be restored, got\n%q", orig, b)
+	}
+	if stale := backups(); len(stale) > 0 {
+		t.Errorf("expected the backups to be removed, got %v", stale)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected %s to be kept, got %s", other, err)
+	}
+	if err := Restore(path); err == nil {
+		t.Error("expected an error restoring without backup")
+	}
+}
+
+func TestRestoreLatest(t *testing.T) {
+	path, cleanup := testPaths(t)
+	defer cleanup()
+	// Written by an older version
+	if err := ioutil.WriteFile(resolvConfBackupPath, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"nameserver 10.0.0.2\n", "nameserver 10.0.0.3\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Backup(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte("nameserver 127.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "nameserver 10.0.0.3\n" {
+		t.Errorf("expected the most recent backup to be restored, got %q", b)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/miekg/dns"
+)
+
+// Backends StoreConfig registers the nameserver with.
+const (
+	// BackendFile rewrites /etc/resolv.conf.
+	BackendFile = "file"
+	// BackendResolved configures systemd-resolved over D-Bus.
+	BackendResolved = "resolved"
+	// BackendResolvconf registers with the resolvconf(8) or openresolv
+	// utility.
+	BackendResolvconf = "resolvconf"
+	// BackendResolver creates a file in /etc/resolver for each domain
+	// resolved by go-dnsmasq, macOS only.
+	BackendResolver = "resolver"
+	// BackendNetsh sets the DNS servers of the network adapters with
+	// netsh, Windows only.
+	BackendNetsh = "netsh"
+)
+
+// RESOLVED_STUB_ADDRESS is the address of the stub listener of
+// systemd-resolved.
+const RESOLVED_STUB_ADDRESS = "127.0.0.53"
+
+// RESOLVED_UPSTREAM_PATH lists the nameservers systemd-resolved forwards
+// queries to.
+const RESOLVED_UPSTREAM_PATH = "/run/systemd/resolve/resolv.conf"
+
+// RESOLVED_STATE_PATH holds the original settings of the link configured
+// while go-dnsmasq is registered with systemd-resolved. It is used to
+// repair the link after the process died without restoring it.
+const RESOLVED_STATE_PATH = "/run/go-dnsmasq.resolved"
+
+// Detect returns BackendNetsh on Windows, BackendResolver on macOS,
+// BackendResolved if /etc/resolv.conf points at the stub listener of
+// systemd-resolved, BackendResolvconf if the resolvconf utility is
+// installed and BackendFile otherwise. Rewriting a resolv.conf that is managed by one of them would
+// either break it or be reverted.
+func Detect() string {
+	switch runtime.GOOS {
+	case "windows":
+		return BackendNetsh
+	case "darwin":
+		return BackendResolver
+	}
+	if conf, err := dns.ClientConfigFromFile(RESOLVCONF_PATH); err == nil {
+		for _, s := range conf.Servers {
+			if s == RESOLVED_STUB_ADDRESS {
+				return BackendResolved
+			}
+		}
+	}
+	if resolvconfCommand() != "" {
+		return BackendResolvconf
+	}
+	return BackendFile
+}
+
+// ResolvedNameservers returns the nameservers systemd-resolved forwards
+// to as host:port, except self, the address go-dnsmasq registers, which
+// is still listed if a previous instance was not unregistered.
+func ResolvedNameservers(self string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(RESOLVED_UPSTREAM_PATH)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, s := range conf.Servers {
+		if s == self || s == RESOLVED_STUB_ADDRESS {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(s, conf.Port))
+	}
+	return servers, nil
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/godbus/dbus"
+)
+
+const (
+	resolvedBusName   = "org.freedesktop.resolve1"
+	resolvedPath      = "/org/freedesktop/resolve1"
+	resolvedManager   = "org.freedesktop.resolve1.Manager"
+	resolvedLinkIface = "org.freedesktop.resolve1.Link"
+)
+
+// resolvedAddress is the (iay) D-Bus representation of a nameserver.
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+// resolvedDomain is the (sb) D-Bus representation of a search or routing
+// domain.
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// resolvedState is the link configured by storeResolved and its original
+// settings.
+type resolvedState struct {
+	Pid     int               `json:"pid"`
+	Link    int32             `json:"link"`
+	DNS     []resolvedAddress `json:"dns"`
+	Domains []resolvedDomain  `json:"domains"`
+}
+
+var (
+	// conn is the system bus connection opened by storeResolved. It is
+	// kept open so that Clean is still authorized to restore the link
+	// after privileges have been dropped. Guarded by mu.
+	conn  *dbus.Conn
+	state *resolvedState
+)
+
+// storeResolved makes systemd-resolved forward every query to
+// config.Address by setting it as the only nameserver of the link with the
+// default route, with '~.' as routing domain. The search list replaces the
+// search domains of the link; ndots has no equivalent in systemd-resolved.
+func storeResolved(config *Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	ip := net.ParseIP(config.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", config.Address)
+	}
+	if ip.IsUnspecified() {
+		if ip.To4() != nil {
+			ip = net.IPv4(127, 0, 0, 1)
+		} else {
+			ip = net.IPv6loopback
+		}
+	}
+	iface, err := resolvedInterface(ip)
+	if err != nil {
+		return err
+	}
+
+	c, err := systemBus()
+	if err != nil {
+		return err
+	}
+	s := &resolvedState{Pid: os.Getpid(), Link: int32(iface.Index)}
+	link := c.Object(resolvedBusName, linkPath(s.Link))
+	if err := getProperty(link, "DNS", &s.DNS); err != nil {
+		c.Close()
+		return fmt.Errorf("reading the nameservers of link %s: %s", iface.Name, err)
+	}
+	if err := getProperty(link, "Domains", &s.Domains); err != nil {
+		c.Close()
+		return fmt.Errorf("reading the domains of link %s: %s", iface.Name, err)
+	}
+	// Keep the state of the instance whose registration is being replaced
+	if _, err := os.Stat(RESOLVED_STATE_PATH); os.IsNotExist(err) {
+		b, _ := json.Marshal(s)
+		if err := ioutil.WriteFile(RESOLVED_STATE_PATH, b, 0644); err != nil {
+			c.Close()
+			return fmt.Errorf("writing %s: %s", RESOLVED_STATE_PATH, err)
+		}
+	}
+
+	log.Debugf("Registering nameserver %s on link %s with systemd-resolved", ip, iface.Name)
+	domains := []resolvedDomain{{".", true}}
+	for _, d := range config.Search {
+		domains = append(domains, resolvedDomain{d, false})
+	}
+	for _, d := range s.Domains {
+		if d.Domain != "." && (d.RoutingOnly || len(config.Search) == 0) {
+			domains = append(domains, d)
+		}
+	}
+	if err := setLink(c, s.Link, []resolvedAddress{toResolvedAddress(ip)}, domains); err != nil {
+		setLink(c, s.Link, s.DNS, s.Domains)
+		os.Remove(RESOLVED_STATE_PATH)
+		c.Close()
+		return err
+	}
+	conn, state = c, s
+	return nil
+}
+
+// cleanResolved restores the link configured by storeResolved. mu must be
+// held.
+func cleanResolved() {
+	if conn == nil {
+		return
+	}
+	log.Info("Restoring the systemd-resolved link settings")
+	if err := setLink(conn, state.Link, state.DNS, state.Domains); err != nil {
+		log.Errorf("Failed to restore the systemd-resolved link settings: %s", err)
+	}
+	conn.Close()
+	conn, state = nil, nil
+	// Fails once privileges have been dropped. The stale state is
+	// removed by Repair on the next start.
+	if err := os.Remove(RESOLVED_STATE_PATH); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Failed to remove %s: %s", RESOLVED_STATE_PATH, err)
+	}
+}
+
+// repairResolved restores the link left configured by a go-dnsmasq
+// process that is no longer running.
+func repairResolved() error {
+	b, err := ioutil.ReadFile(RESOLVED_STATE_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	s := new(resolvedState)
+	if err := json.Unmarshal(b, s); err != nil {
+		os.Remove(RESOLVED_STATE_PATH)
+		return fmt.Errorf("removed invalid %s: %s", RESOLVED_STATE_PATH, err)
+	}
+	if s.Pid > 0 && s.Pid != os.Getpid() && processAlive(s.Pid) {
+		log.Debugf("systemd-resolved is configured by running go-dnsmasq process %d", s.Pid)
+		return nil
+	}
+
+	c, err := systemBus()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := setLink(c, s.Link, s.DNS, s.Domains); err != nil {
+		return err
+	}
+	log.Warnf("Restored the systemd-resolved link settings left behind by go-dnsmasq process %d", s.Pid)
+	os.Remove(RESOLVED_STATE_PATH)
+	return nil
+}
+
+func systemBus() (*dbus.Conn, error) {
+	c, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the system bus: %s", err)
+	}
+	if err := c.Auth(nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("connecting to the system bus: %s", err)
+	}
+	if err := c.Hello(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("connecting to the system bus: %s", err)
+	}
+	return c, nil
+}
+
+func setLink(c *dbus.Conn, link int32, servers []resolvedAddress, domains []resolvedDomain) error {
+	m := c.Object(resolvedBusName, resolvedPath)
+	if err := m.Call(resolvedManager+".SetLinkDNS", 0, link, servers).Err; err != nil {
+		return fmt.Errorf("setting the nameservers of link %d: %s", link, err)
+	}
+	if err := m.Call(resolvedManager+".SetLinkDomains", 0, link, domains).Err; err != nil {
+		return fmt.Errorf("setting the domains of link %d: %s", link, err)
+	}
+	return nil
+}
+
+func getProperty(o dbus.BusObject, name string, v interface{}) error {
+	p, err := o.GetProperty(resolvedLinkIface + "." + name)
+	if err != nil {
+		return err
+	}
+	return dbus.Store([]interface{}{p.Value()}, v)
+}
+
+// linkPath returns the object path of a link. It ends in the link index
+// with the leading digit escaped, e.g. _32 for link 2.
+func linkPath(link int32) dbus.ObjectPath {
+	return dbus.ObjectPath(fmt.Sprintf("%s/link/_3%d", resolvedPath, link))
+}
+
+func toResolvedAddress(ip net.IP) resolvedAddress {
+	if ip4 := ip.To4(); ip4 != nil {
+		return resolvedAddress{syscall.AF_INET, ip4}
+	}
+	return resolvedAddress{syscall.AF_INET6, ip.To16()}
+}
+
+// resolvedInterface returns the link to register ip on: the interface
+// holding ip, or for loopback addresses the interface of the default
+// route, as systemd-resolved ignores the nameservers of loopback links.
+func resolvedInterface(ip net.IP) (*net.Interface, error) {
+	if !ip.IsLoopback() {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range ifaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+					return &iface, nil
+				}
+			}
+		}
+	}
+
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return net.InterfaceByName(fields[0])
+		}
+	}
+	return nil, fmt.Errorf("no default route to register the nameserver on")
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package resolvconf
+
+import "fmt"
+
+func storeResolved(config *Config) error {
+	return fmt.Errorf("systemd-resolved is only supported on Linux")
+}
+
+func cleanResolved() {}
+
+func repairResolved() error {
+	return nil
+}
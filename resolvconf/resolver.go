@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RESOLVER_DIR holds the per-domain resolver configurations of macOS, see
+// resolver(5).
+const RESOLVER_DIR = "/etc/resolver"
+
+// RESOLVER_STATE_PATH lists the files created in RESOLVER_DIR and the PID
+// of the process that created them. It is used to remove them after the
+// process died without removing them.
+const RESOLVER_STATE_PATH = "/var/run/go-dnsmasq.resolver"
+
+// The resolver paths, variables for testing
+var (
+	resolverDir       = RESOLVER_DIR
+	resolverStatePath = RESOLVER_STATE_PATH
+)
+
+// resolverState is the list of files created by storeResolver.
+type resolverState struct {
+	Pid   int      `json:"pid"`
+	Files []string `json:"files"`
+}
+
+// resolverFiles are the files created by storeResolver. Guarded by mu.
+var resolverFiles []string
+
+// resolverMarker returns the first line of the files created by process
+// pid.
+func resolverMarker(pid int) []byte {
+	return []byte(fmt.Sprintf("%s (pid %d)\n", RESOLVCONF_COMMENT_ADD, pid))
+}
+
+// storeResolver creates a file in RESOLVER_DIR for each of config.Domains
+// pointing at config.Address and config.Port. Existing files are left
+// alone.
+func storeResolver(config *Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(config.Domains) == 0 {
+		return fmt.Errorf("no domains to register, configure stub zones, search domains or interface discovery")
+	}
+	ip := net.ParseIP(config.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", config.Address)
+	}
+	if ip.IsUnspecified() {
+		if ip.To4() != nil {
+			ip = net.IPv4(127, 0, 0, 1)
+		} else {
+			ip = net.IPv6loopback
+		}
+	}
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return err
+	}
+
+	var content bytes.Buffer
+	content.Write(resolverMarker(os.Getpid()))
+	fmt.Fprintf(&content, "nameserver %s\n", ip)
+	if config.Port != 0 && config.Port != 53 {
+		fmt.Fprintf(&content, "port %d\n", config.Port)
+	}
+
+	s := &resolverState{Pid: os.Getpid()}
+	for _, domain := range config.Domains {
+		path := filepath.Join(resolverDir, domain)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			log.Warnf("Not registering domain %s, %s already exists", domain, path)
+			continue
+		}
+		if err == nil {
+			// Record the file before writing it so that it is removed
+			// even if writing fails
+			s.Files = append(s.Files, path)
+			if err = writeResolverState(s); err == nil {
+				_, err = f.Write(content.Bytes())
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			resolverFiles = s.Files
+			cleanResolver()
+			return err
+		}
+		log.Debugf("Registered domain %s in %s", domain, path)
+	}
+	resolverFiles = s.Files
+	if len(s.Files) == 0 {
+		os.Remove(resolverStatePath)
+		return fmt.Errorf("all domains are registered in %s already", resolverDir)
+	}
+	return nil
+}
+
+func writeResolverState(s *resolverState) error {
+	b, _ := json.Marshal(s)
+	if err := ioutil.WriteFile(resolverStatePath, b, 0644); err != nil {
+		return fmt.Errorf("writing %s: %s", resolverStatePath, err)
+	}
+	return nil
+}
+
+// cleanResolver removes the files created by storeResolver. mu must be
+// held.
+func cleanResolver() {
+	if len(resolverFiles) == 0 {
+		return
+	}
+	log.Infof("Removing the files created in %s", resolverDir)
+	// Fails once privileges have been dropped. The files are removed by
+	// Repair on the next start.
+	if removeResolverFiles(resolverFiles, os.Getpid()) {
+		os.Remove(resolverStatePath)
+	}
+	resolverFiles = nil
+}
+
+// repairResolver removes the files left behind by a go-dnsmasq process
+// that is no longer running.
+func repairResolver() error {
+	b, err := ioutil.ReadFile(resolverStatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	s := new(resolverState)
+	if err := json.Unmarshal(b, s); err != nil {
+		os.Remove(resolverStatePath)
+		return fmt.Errorf("removed invalid %s: %s", resolverStatePath, err)
+	}
+	if s.Pid > 0 && s.Pid != os.Getpid() && processAlive(s.Pid) {
+		log.Debugf("%s is managed by running go-dnsmasq process %d", resolverDir, s.Pid)
+		return nil
+	}
+	if !removeResolverFiles(s.Files, s.Pid) {
+		return fmt.Errorf("failed to remove the files in %s", resolverDir)
+	}
+	log.Warnf("Removed the files in %s left behind by go-dnsmasq process %d", resolverDir, s.Pid)
+	os.Remove(resolverStatePath)
+	return nil
+}
+
+// removeResolverFiles removes the files in paths that were created by
+// process pid. Files changed since are left alone. It reports whether
+// all files were removed or left alone.
+func removeResolverFiles(paths []string, pid int) bool {
+	ok := true
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && !bytes.HasPrefix(b, resolverMarker(pid)) {
+			log.Warnf("Not removing %s, it was changed by someone else", path)
+			continue
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			log.Errorf("Failed to remove %s: %s", path, err)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package resolvconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testResolverPaths points /etc/resolver and the state file to a temporary
+// directory. It returns the directory and a function undoing it.
+func testResolverPaths(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldState := resolverDir, resolverStatePath
+	resolverDir = filepath.Join(dir, "resolver")
+	resolverStatePath = filepath.Join(dir, "go-dnsmasq.resolver")
+	return resolverDir, func() {
+		resolverDir, resolverStatePath = oldDir, oldState
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStoreResolverClean(t *testing.T) {
+	dir, cleanup := testResolverPaths(t)
+	defer cleanup()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(dir, "corp.example")
+	if err := ioutil.WriteFile(existing, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Address: "0.0.0.0", Port: 5353, Domains: []string{"corp.example", "svc.example", "local"}}
+	if err := storeResolver(config); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("# added by go-dnsmasq (pid %d)\nnameserver 127.0.0.1\nport 5353\n", os.Getpid())
+	for _, domain := range []string{"svc.example", "local"} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, domain)); string(b) != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", domain, want, b)
+		}
+	}
+	// A file changed by someone else is not removed
+	changed := filepath.Join(dir, "local")
+	if err := ioutil.WriteFile(changed, []byte("nameserver 10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Clean()
+	if _, err := os.Stat(filepath.Join(dir, "svc.example")); !os.IsNotExist(err) {
+		t.Errorf("expected the created file to be removed, got %v", err)
+	}
+	for _, path := range []string{existing, changed} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept, got %s", path, err)
+		}
+	}
+	if _, err := os.Stat(resolverStatePath); !os.IsNotExist(err) {
+		t.Errorf("expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestStoreResolverNoDomains(t *testing.T) {
+	dir, cleanup := testResolverPaths(t)
+	defer cleanup()
+	if err := storeResolver(&Config{Address: "127.0.0.1"}); err == nil {
+		t.Error("expected an error without domains")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "example"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeResolver(&Config{Address: "127.0.0.1", Domains: []string{"example"}}); err == nil {
+		t.Error("expected an error if all domains are registered already")
+	}
+}
+
+func TestRepairResolver(t *testing.T) {
+	dir, cleanup := testResolverPaths(t)
+	defer cleanup()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Files of a process that is not running
+	stale := filepath.Join(dir, "example")
+	if err := ioutil.WriteFile(stale, append(resolverMarker(0), "nameserver ::1\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeResolverState(&resolverState{Files: []string{stale, filepath.Join(dir, "gone")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repairResolver(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(resolverStatePath); !os.IsNotExist(err) {
+		t.Errorf("expected the state file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-systemd/activation"
+)
+
+// systemdSockets returns all sockets passed by systemd socket activation.
+// It fails if one of them is neither a UDP socket nor a listening TCP
+// socket.
+func systemdSockets() ([]activatedSocket, error) {
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return activatedSockets(activation.Files(true), names)
+}
+
+// activatedSockets returns the sockets for the files passed by systemd,
+// named by names in the same order, and closes the files. On error the
+// sockets returned so far are closed as well.
+func activatedSockets(files []*os.File, names []string) ([]activatedSocket, error) {
+	var sockets []activatedSocket
+	for i, f := range files {
+		name := fmt.Sprintf("fd %d", f.Fd())
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name += " (" + names[i] + ")"
+		}
+		sock, err := newActivatedSocket(name, f)
+		// The sockets use a duplicate of the descriptor
+		f.Close()
+		if err != nil {
+			for _, f := range files[i+1:] {
+				f.Close()
+			}
+			closeSockets(sockets)
+			return nil, err
+		}
+		sockets = append(sockets, sock)
+	}
+	return sockets, nil
+}
+
+// newActivatedSocket classifies the socket f as UDP or TCP.
+func newActivatedSocket(name string, f *os.File) (activatedSocket, error) {
+	sock := activatedSocket{name: name}
+	fd := int(f.Fd())
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return sock, fmt.Errorf("Socket %s supplied by systemd is not a socket: %s", name, err)
+	}
+
+	switch sotype {
+	case syscall.SOCK_DGRAM:
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return sock, fmt.Errorf("Socket %s supplied by systemd: %s", name, err)
+		}
+		if sock.packetConn, _ = pc.(*net.UDPConn); sock.packetConn == nil {
+			pc.Close()
+			return sock, fmt.Errorf("Socket %s supplied by systemd is a %s socket, only UDP and TCP sockets are supported", name, pc.LocalAddr().Network())
+		}
+	case syscall.SOCK_STREAM:
+		if accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err == nil && accepting == 0 {
+			return sock, fmt.Errorf("Socket %s supplied by systemd is not listening. Set Accept=no in the socket unit", name)
+		}
+		l, err := net.FileListener(f)
+		if err != nil {
+			return sock, fmt.Errorf("Socket %s supplied by systemd: %s", name, err)
+		}
+		if sock.listener, _ = l.(*net.TCPListener); sock.listener == nil {
+			l.Close()
+			return sock, fmt.Errorf("Socket %s supplied by systemd is a %s socket, only UDP and TCP sockets are supported", name, l.Addr().Network())
+		}
+	default:
+		return sock, fmt.Errorf("Socket %s supplied by systemd has unsupported type %d, only UDP and TCP sockets are supported", name, sotype)
+	}
+	return sock, nil
+}
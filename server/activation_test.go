@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewActivatedSocket(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unix, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	for _, tc := range []struct {
+		name string
+		file func() (*os.File, error)
+		err  string
+	}{
+		{"udp", udp.File, ""},
+		{"tcp", tcp.File, ""},
+		{"connected", conn.(*net.TCPConn).File, "is not listening"},
+		{"unixgram", unix.File, "is a unixgram socket"},
+		{"file", func() (*os.File, error) { return os.Open(dir) }, "is not a socket"},
+	} {
+		f, err := tc.file()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sock, err := newActivatedSocket(tc.name, f)
+		f.Close()
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), "Socket "+tc.name+" ") || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected an error naming the socket and containing %q, got %v", tc.name, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", tc.name, err)
+		case tc.name == "udp" && (sock.packetConn == nil || sock.packetConn.LocalAddr().String() != udp.LocalAddr().String()):
+			t.Errorf("udp: expected a UDP socket on %s, got %+v", udp.LocalAddr(), sock)
+		case tc.name == "tcp" && (sock.listener == nil || sock.listener.Addr().String() != tcp.Addr().String()):
+			t.Errorf("tcp: expected a TCP listener on %s, got %+v", tcp.Addr(), sock)
+		}
+		if sock.packetConn != nil {
+			sock.packetConn.Close()
+		}
+		if sock.listener != nil {
+			sock.listener.Close()
+		}
+	}
+}
+
+func TestActivatedSocketsError(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files []*os.File
+	for _, open := range []func() (*os.File, error){
+		udp.File,
+		func() (*os.File, error) { return os.Open(dir) },
+		udp.File,
+	} {
+		f, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	sockets, err := activatedSockets(files, []string{"dns", "dir", "dns"})
+	if err == nil || !strings.Contains(err.Error(), "(dir) supplied by systemd is not a socket") {
+		t.Errorf("expected the second file to be rejected, got %v", err)
+	}
+	if sockets != nil {
+		t.Errorf("expected no sockets, got %+v", sockets)
+	}
+	for i, f := range files {
+		if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected file %d to be closed, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "fmt"
+
+func systemdSockets() ([]activatedSocket, error) {
+	return nil, fmt.Errorf("Socket activation by systemd is not supported on Windows")
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/cache"
+	"github.com/janeczku/go-dnsmasq/hostsfile"
+	"github.com/janeczku/go-dnsmasq/stats"
+	"github.com/miekg/dns"
+)
+
+// SetReloadFunc sets the function the admin API calls to reload the
+// hostsfile and the configuration. It must be called before Run.
+func (s *server) SetReloadFunc(f func() error) {
+	s.reload = f
+}
+
+// startAdmin starts the HTTP server answering the admin API on a unix
+// socket. Access is controlled by the socket's permissions, which only
+// allow the user running the server.
+func (s *server) startAdmin() error {
+	path := s.conf().AdminSocket
+	// Remove the socket left behind by a previous run
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	l, err := listenAdmin(path)
+	if err != nil {
+		return err
+	}
+
+	s.adminServer = &http.Server{Handler: s.adminHandler()}
+	go func() {
+		if err := s.adminServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin API failed: %s", err)
+		}
+	}()
+	log.Infof("Serving admin API on unix://%s", path)
+	return nil
+}
+
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", adminMethod("GET", s.serveAdminConfig))
+	mux.HandleFunc("/stats", adminMethod("GET", s.serveAdminStats))
+	mux.HandleFunc("/cache/lookup", adminMethod("GET", s.serveAdminLookup))
+	mux.HandleFunc("/cache/flush", adminMethod("POST", s.serveAdminFlush))
+	mux.HandleFunc("/reload", adminMethod("POST", s.serveAdminReload))
+	mux.HandleFunc("/hosts/add", adminMethod("POST", s.serveAdminHostsAdd))
+	mux.HandleFunc("/hosts/cname", adminMethod("POST", s.serveAdminHostsCNAME))
+	mux.HandleFunc("/hosts/remove", adminMethod("POST", s.serveAdminHostsRemove))
+	return mux
+}
+
+// adminMethod rejects requests to h that do not use method.
+func adminMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serveAdminConfig returns the effective configuration.
+func (s *server) serveAdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.conf())
+}
+
+type adminStats struct {
+	stats.Stats
+	CacheSize      int   `json:"cache_size"`
+	CacheCapacity  int   `json:"cache_capacity"`
+	CacheEvictions int64 `json:"cache_evictions"`
+	// The error of the last hostsfile load, if it failed
+	HostsfileError string `json:"hostsfile_error,omitempty"`
+}
+
+// lastErrorHostfile is a Hostfile that reports the error of its last load,
+// such as *hosts.Hostsfile.
+type lastErrorHostfile interface {
+	LastError() error
+}
+
+// serveAdminStats returns the query totals, the state of the cache and
+// the error of the last hostsfile load.
+func (s *server) serveAdminStats(w http.ResponseWriter, r *http.Request) {
+	size, capacity := s.CacheSize()
+	st := adminStats{
+		Stats:          stats.Snapshot(),
+		CacheSize:      size,
+		CacheCapacity:  capacity,
+		CacheEvictions: s.CacheEvictions(),
+	}
+	if h, ok := s.hosts.(lastErrorHostfile); ok {
+		if err := h.LastError(); err != nil {
+			st.HostsfileError = err.Error()
+		}
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// serveAdminFlush removes the cached responses for the names at or below
+// the 'domain' parameter, or all cached responses without it.
+func (s *server) serveAdminFlush(w http.ResponseWriter, r *http.Request) {
+	domain := r.FormValue("domain")
+	if domain != "" {
+		domain = dns.Fqdn(strings.ToLower(domain))
+		if _, ok := dns.IsDomainName(domain); !ok {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid domain"})
+			return
+		}
+	}
+
+	n := s.rcache.Flush(domain)
+	if s.rcacheShards != nil {
+		n += s.rcacheShards.Flush(domain)
+	}
+	if domain == "" {
+		log.Infof("Admin API: flushed %d cached responses", n)
+	} else {
+		log.Infof("Admin API: flushed %d cached responses for %s", n, domain)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Flushed int `json:"flushed"`
+	}{n})
+}
+
+// serveAdminReload reloads the hostsfile and the configuration, including
+// nameservers and search domains from resolv.conf.
+func (s *server) serveAdminReload(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeJSON(w, http.StatusNotImplemented, adminError{"reloading is not supported"})
+		return
+	}
+	if err := s.reload(); err != nil {
+		log.Errorf("Admin API: reload failed: %s", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+		return
+	}
+	log.Info("Admin API: reloaded")
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// serveAdminHostsAdd adds the address 'ip' to the hostname 'name', served
+// with the TTL 'ttl' if given, see AddHost.
+func (s *server) serveAdminHostsAdd(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid ip"})
+		return
+	}
+	ttl := 0
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		if ttl, err = strconv.Atoi(v); err != nil || ttl < 0 {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid ttl"})
+			return
+		}
+	}
+	if err := s.AddHost(name, ip, ttl); err != nil {
+		writeHostsError(w, err)
+		return
+	}
+	log.Infof("Admin API: added host %s %s", name, ip)
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// serveAdminHostsCNAME makes the hostname 'name' an alias of 'target', see
+// AddCNAME.
+func (s *server) serveAdminHostsCNAME(w http.ResponseWriter, r *http.Request) {
+	name, target := r.FormValue("name"), r.FormValue("target")
+	if err := s.AddCNAME(name, target); err != nil {
+		writeHostsError(w, err)
+		return
+	}
+	log.Infof("Admin API: added CNAME %s -> %s", name, target)
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// serveAdminHostsRemove removes the records added for the hostname 'name'.
+func (s *server) serveAdminHostsRemove(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if err := s.RemoveHost(name); err != nil {
+		writeHostsError(w, err)
+		return
+	}
+	log.Infof("Admin API: removed host %s", name)
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+func writeHostsError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errNoRuntimeHosts:
+		writeJSON(w, http.StatusNotImplemented, adminError{err.Error()})
+	case err == hosts.ErrNotFound:
+		writeJSON(w, http.StatusNotFound, adminError{err.Error()})
+	default:
+		writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+	}
+}
+
+// adminLookup describes how a query would be answered.
+type adminLookup struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// One of the Source constants. SourceLocal means the query is refused.
+	Source      string   `json:"source"`
+	CacheTTL    int      `json:"cache_ttl,omitempty"`
+	Answer      []string `json:"answer,omitempty"`
+	Alias       string   `json:"alias,omitempty"`
+	StubZone    string   `json:"stub_zone,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// serveAdminLookup reports whether the 'name' and 'type' parameters are
+// answered from the cache or the hostsfile, and otherwise which
+// nameservers the query would be forwarded to. Nothing is forwarded.
+func (s *server) serveAdminLookup(w http.ResponseWriter, r *http.Request) {
+	name := dns.Fqdn(strings.ToLower(r.FormValue("name")))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid name"})
+		return
+	}
+	qtype := dns.TypeA
+	if t := r.FormValue("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid type"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.lookup(name, qtype))
+}
+
+func (s *server) lookup(name string, qtype uint16) *adminLookup {
+	q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	res := &adminLookup{Name: name, Type: dns.TypeToString[qtype]}
+
+	if m, exp, ok := s.rcache.Search(cache.Key(q, false, false)); ok && exp.After(time.Now()) {
+		res.Source = SourceCache
+		res.CacheTTL = int(exp.Sub(time.Now()) / time.Second)
+		res.Answer = rrStrings(m.Answer)
+		return res
+	}
+
+	config := s.conf()
+	var records []dns.RR
+	cnames, target := s.cnameRecords(q)
+	switch {
+	case config.ForwardersOnly:
+	case len(cnames) > 0:
+		records = cnames
+		if qtype == dns.TypeA || qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+			addrs, _ := s.AddressRecords(dns.Question{Name: target, Qtype: qtype, Qclass: dns.ClassINET}, target)
+			records = append(records, addrs...)
+		}
+	case qtype == dns.TypeA, qtype == dns.TypeAAAA, qtype == dns.TypeANY:
+		records, _ = s.AddressRecords(q, name)
+	case qtype == dns.TypePTR:
+		records, _ = s.PTRRecords(q)
+	}
+	if len(records) > 0 {
+		res.Source = SourceHostsfile
+		res.Answer = rrStrings(records)
+		return res
+	}
+
+	// Decided like ServeDNSForward and forwardQuery do
+	if refuseReason(config, name) != "" {
+		res.Source = SourceLocal
+		return res
+	}
+	target, zone, stub := route(config, name)
+	if target != name {
+		res.Alias = target
+	}
+	if stub != nil {
+		res.Source = SourceStub
+		res.StubZone = zone
+		res.Nameservers = stub.Nameservers
+		return res
+	}
+	res.Source = SourceForward
+	res.Nameservers = config.Nameservers
+	return res
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	s := make([]string, len(rrs))
+	for i, rr := range rrs {
+		s[i] = rr.String()
+	}
+	return s
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/cache"
+	"github.com/miekg/dns"
+)
+
+// adminRequest sends a request to the admin API of s and decodes the JSON
+// response into v.
+func adminRequest(t *testing.T, s *server, method, target string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %s: %s", method, target, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminConfig(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, Nameservers: []string{"127.0.0.1:53"}})
+	defer s.Stop()
+
+	var config map[string]interface{}
+	if code := adminRequest(t, s, "GET", "/config", &config); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if config["dns_addr"] != s.conf().DnsAddr || config["no_rec"] != true {
+		t.Errorf("expected the effective configuration, got %v", config)
+	}
+
+	if code := adminRequest(t, s, "POST", "/config", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", code)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, RCache: 10})
+	defer s.Stop()
+
+	var st adminStats
+	if code := adminRequest(t, s, "GET", "/stats", &st); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if st.CacheCapacity != 10 {
+		t.Errorf("expected cache capacity 10, got %d", st.CacheCapacity)
+	}
+	if st.HostsfileError != "" {
+		t.Errorf("expected no hostsfile error, got %q", st.HostsfileError)
+	}
+
+	s = startHostsTestServer(t, lastErrorTestHostfile{err: errors.New("/etc/hosts:3: invalid IP address 1234.1.1.1")},
+		&Config{NoRec: true, RCache: 10})
+	defer s.Stop()
+	st = adminStats{}
+	adminRequest(t, s, "GET", "/stats", &st)
+	if st.HostsfileError != "/etc/hosts:3: invalid IP address 1234.1.1.1" {
+		t.Errorf("expected the hostsfile error, got %q", st.HostsfileError)
+	}
+}
+
+type lastErrorTestHostfile struct {
+	testHostfile
+	err error
+}
+
+func (h lastErrorTestHostfile) LastError() error { return h.err }
+
+func TestAdminCacheFlush(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, RCache: 10})
+	defer s.Stop()
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "example.org."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		s.rcache.InsertMessage(cache.Key(m.Question[0], false, false), m)
+	}
+
+	var res struct{ Flushed int }
+	if code := adminRequest(t, s, "POST", "/cache/flush?domain=Example.COM", &res); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if res.Flushed != 2 {
+		t.Errorf("expected 2 responses flushed, got %d", res.Flushed)
+	}
+	if code := adminRequest(t, s, "POST", "/cache/flush", &res); code != http.StatusOK || res.Flushed != 1 {
+		t.Errorf("expected the remaining response flushed, got status %d and %d", code, res.Flushed)
+	}
+	if code := adminRequest(t, s, "POST", "/cache/flush?domain=a..b", nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", code)
+	}
+	if code := adminRequest(t, s, "GET", "/cache/flush", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true})
+	defer s.Stop()
+
+	if code := adminRequest(t, s, "POST", "/reload", nil); code != http.StatusNotImplemented {
+		t.Errorf("expected status 501 without a reload function, got %d", code)
+	}
+
+	out := new(syncBuffer)
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	reloaded := 0
+	s.SetReloadFunc(func() error {
+		reloaded++
+		return nil
+	})
+	if code := adminRequest(t, s, "POST", "/reload", nil); code != http.StatusOK || reloaded != 1 {
+		t.Errorf("expected a reload, got status %d and %d reloads", code, reloaded)
+	}
+
+	s.SetReloadFunc(func() error { return errors.New("bad config") })
+	var res adminError
+	if code := adminRequest(t, s, "POST", "/reload", &res); code != http.StatusInternalServerError || res.Error != "bad config" {
+		t.Errorf("expected the reload error, got status %d and %q", code, res.Error)
+	}
+	if !strings.Contains(out.String(), "reload failed: bad config") {
+		t.Errorf("expected the failed reload to be logged, got %q", out.String())
+	}
+}
+
+func TestAdminCacheLookup(t *testing.T) {
+	good := startTestUpstream(t)
+	stubs := map[string]*StubZone{"stub.local.": NewStubZone([]string{"127.0.0.1:5353"})}
+	aliases := map[string]string{"alias.local.": "stub.local.", "deep.alias.local.": "other.local."}
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local"),
+		&Config{Nameservers: []string{good}, RCache: 10, Stub: &stubs, Alias: &aliases})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("cached.example.com.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]adminLookup{
+		"/cache/lookup?name=cached.example.com": {Source: SourceCache},
+		"/cache/lookup?name=host.local&type=a":  {Source: SourceHostsfile},
+		"/cache/lookup?name=a.example.com":      {Source: SourceForward, Nameservers: []string{good}},
+		"/cache/lookup?name=x.stub.local&type=MX": {Source: SourceStub, StubZone: "stub.local.",
+			Nameservers: []string{"127.0.0.1:5353"}},
+		"/cache/lookup?name=x.alias.local": {Source: SourceStub, Alias: "x.stub.local.", StubZone: "stub.local.",
+			Nameservers: []string{"127.0.0.1:5353"}},
+		// The longest alias wins
+		"/cache/lookup?name=x.deep.alias.local": {Source: SourceForward, Alias: "x.other.local.",
+			Nameservers: []string{good}},
+	} {
+		var res adminLookup
+		if code := adminRequest(t, s, "GET", target, &res); code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", target, code)
+			continue
+		}
+		if res.Source != want.Source || res.Alias != want.Alias || res.StubZone != want.StubZone ||
+			strings.Join(res.Nameservers, ",") != strings.Join(want.Nameservers, ",") {
+			t.Errorf("%s: expected %+v, got %+v", target, want, res)
+		}
+		if (res.Source == SourceCache || res.Source == SourceHostsfile) && len(res.Answer) != 1 {
+			t.Errorf("%s: expected one answer, got %v", target, res.Answer)
+		}
+	}
+
+	for _, target := range []string{"/cache/lookup", "/cache/lookup?name=a.example.com&type=BOGUS"} {
+		if code := adminRequest(t, s, "GET", target, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, code)
+		}
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	s := startTestServer(t, &Config{NoRec: true, AdminSocket: path})
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected socket mode 0600, got %s", fi.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://admin/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	s.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on shutdown, got %v", err)
+	}
+}
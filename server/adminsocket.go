@@ -0,0 +1,21 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenAdmin listens on the unix socket at path. The socket is created
+// with mode 0600, there is no moment at which other users can connect.
+func listenAdmin(path string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "net"
+
+// listenAdmin listens on the unix socket at path. Windows has no file
+// modes, access is governed by the ACL of the directory.
+func listenAdmin(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/cache"
+)
+
+// cacheDumpEntry is a cached response as written by dumpCache.
+type cacheDumpEntry struct {
+	// The client network of the cache with CacheByClientIP
+	Client       string    `json:"client,omitempty"`
+	Qname        string    `json:"qname"`
+	Qtype        string    `json:"qtype"`
+	Rcode        string    `json:"rcode"`
+	TTLRemaining int       `json:"ttl_remaining"`
+	Rdata        []string  `json:"rdata"`
+	CachedAt     time.Time `json:"cached_at"`
+}
+
+// startCacheDump starts writing the response cache to 'cache-dump-file'
+// every 'cache-dump-interval' until the server is stopped.
+func (s *server) startCacheDump() {
+	config := s.conf()
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		t := time.NewTicker(config.CacheDumpInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				if err := s.dumpCache(config.CacheDumpFile); err != nil {
+					log.Warnf("Failed to dump the response cache: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// dumpCache writes the unexpired responses of the cache to file as a JSON
+// array. The file is replaced at once, readers never see a partial dump.
+func (s *server) dumpCache(file string) error {
+	caches := map[string][]cache.Entry{"": s.rcache.Entries()}
+	if s.rcacheShards != nil {
+		caches = s.rcacheShards.Entries()
+	}
+
+	now := time.Now()
+	entries := []cacheDumpEntry{}
+	for client, cached := range caches {
+		for _, e := range cached {
+			remaining := int(e.Expiration.Sub(now) / time.Second)
+			if remaining <= 0 || len(e.Msg.Question) == 0 {
+				continue
+			}
+			q := e.Msg.Question[0]
+			rdata := make([]string, 0, len(e.Msg.Answer))
+			for _, rr := range e.Msg.Answer {
+				rdata = append(rdata, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+			entries = append(entries, cacheDumpEntry{
+				Client:       client,
+				Qname:        q.Name,
+				Qtype:        dns.TypeToString[q.Qtype],
+				Rcode:        dns.RcodeToString[e.Msg.Rcode],
+				TTLRemaining: remaining,
+				Rdata:        rdata,
+				CachedAt:     e.Inserted,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Qname != b.Qname {
+			return a.Qname < b.Qname
+		}
+		if a.Qtype != b.Qtype {
+			return a.Qtype < b.Qtype
+		}
+		return a.Client < b.Client
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(data, '\n'))
+}
+
+// writeFileAtomic replaces file with data by renaming a temporary file
+// written next to it.
+func writeFileAtomic(file string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rcache.json")
+
+	good := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{good}, RCache: 10, RCacheTtl: 30,
+		CacheDumpFile: path, CacheDumpInterval: 10 * time.Millisecond})
+	defer s.Stop()
+
+	before := time.Now().Add(-time.Second)
+	m := new(dns.Msg)
+	m.SetQuestion("cached.example.com.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dumps written before the query are empty
+	var entries []cacheDumpEntry
+	for deadline := time.Now().Add(2 * time.Second); len(entries) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the cached response to be dumped")
+		}
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatalf("expected a JSON array, got %q: %s", data, err)
+		}
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %+v", entries)
+	}
+	e := entries[0]
+	if e.Qname != "cached.example.com." || e.Qtype != "A" || e.Rcode != "NOERROR" {
+		t.Errorf("expected cached.example.com. A NOERROR, got %+v", e)
+	}
+	if len(e.Rdata) != 1 || e.Rdata[0] != "127.0.0.1" {
+		t.Errorf("expected rdata [127.0.0.1], got %v", e.Rdata)
+	}
+	if e.TTLRemaining < 1 || e.TTLRemaining > 30 {
+		t.Errorf("expected ttl_remaining between 1 and 30, got %d", e.TTLRemaining)
+	}
+	if e.CachedAt.Before(before) || e.CachedAt.After(time.Now()) {
+		t.Errorf("expected cached_at to be the time of the query, got %s", e.CachedAt)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientNetwork(t *testing.T) {
+	config := &Config{CacheIPPrefixLenV4: 24, CacheIPPrefixLenV6: 48}
+	for addr, network := range map[net.Addr]string{
+		&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53}:        "10.1.2.0/24",
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.200"), Port: 53}:      "10.1.2.0/24",
+		&net.UDPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 53}: "2001:db8:1::/48",
+		&net.UDPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 53}: "10.1.2.0/24",
+		&net.UnixAddr{Name: "/run/dns.sock", Net: "unix"}:          "",
+	} {
+		if got := clientNetwork(addr, config); got != network {
+			t.Errorf("%s: expected %q, got %q", addr, network, got)
+		}
+	}
+}
+
+func TestCacheByClientIP(t *testing.T) {
+	// Answers every query with a different address
+	var n int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.0.%d", req.Question[0].Name, atomic.AddInt32(&n, 1)))
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	s := startTestServer(t, &Config{
+		Nameservers:        []string{pc.LocalAddr().String()},
+		RCache:             10,
+		CacheByClientIP:    true,
+		CacheIPPrefixLenV4: 24,
+		CacheIPPrefixLenV6: 48,
+		CacheMaxClients:    10,
+	})
+	defer s.Stop()
+
+	query := func(client string) string {
+		c := &dns.Client{Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(client)}}}
+		m := new(dns.Msg)
+		m.SetQuestion("geo.example.com.", dns.TypeA)
+		r, _, err := c.Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v", r)
+		}
+		return r.Answer[0].(*dns.A).A.String()
+	}
+
+	first := query("127.0.0.1")
+	if got := query("127.0.0.2"); got != first {
+		t.Errorf("expected the cached answer %s for a client of the same network, got %s", first, got)
+	}
+	if got := query("127.0.1.1"); got == first {
+		t.Errorf("expected a separate answer for a client of another network, got the cached %s", got)
+	}
+	if size, capacity := s.CacheSize(); size != 2 || capacity != 20 {
+		t.Errorf("expected 2 cached messages and a capacity of 20, got %d and %d", size, capacity)
+	}
+}
+
+func TestCacheMinHitCount(t *testing.T) {
+	e := &fakeExchanger{answer: func(m *dns.Msg, u Upstream) (*dns.Msg, error) {
+		return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.1"), nil
+	}}
+	s := startTestServer(t, &Config{Nameservers: []string{"192.0.2.1:53"}, Exchanger: e, RCache: 10, CacheMinHitCount: 2})
+	defer s.Stop()
+
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("once.example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v", r)
+		}
+	}
+
+	query()
+	if size, _ := s.CacheSize(); size != 0 || len(e.sent()) != 1 {
+		t.Fatalf("expected the response to be forwarded and not cached after one query, got %d cached and %d sent", size, len(e.sent()))
+	}
+	query()
+	if size, _ := s.CacheSize(); size != 1 || len(e.sent()) != 1 {
+		t.Fatalf("expected the second query to be answered and cached from probation, got %d cached and %d sent", size, len(e.sent()))
+	}
+	query()
+	if len(e.sent()) != 1 {
+		t.Errorf("expected the third query to be answered from the cache, got %d sent", len(e.sent()))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// cnameTarget follows the CNAME records in the answer section of m from
+// the name of its question and returns the name the chain ends at, or ""
+// if m has no CNAME for the question. resolved reports whether the answer
+// has records of the query type for that name.
+func cnameTarget(m *dns.Msg) (target string, resolved bool) {
+	q := m.Question[0]
+	name := strings.ToLower(q.Name)
+	// Bounded, the answer may loop
+	for i := 0; i < len(m.Answer); i++ {
+		next := ""
+		for _, rr := range m.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.ToLower(c.Hdr.Name) == name {
+				next = strings.ToLower(c.Target)
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name, target = next, next
+	}
+	if target == "" {
+		return "", true
+	}
+	for _, rr := range m.Answer {
+		if strings.ToLower(rr.Header().Name) == target && (rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			return target, true
+		}
+	}
+	return target, false
+}
+
+// chaseCNAME completes the response m to req if its answer ends with a
+// CNAME whose target has no records of the query type. The target is
+// looked up in the CNAMEs added by AddCNAME and in the hostsfile, and
+// forwarded if it is under a stub zone. Targets of local CNAMEs are
+// forwarded to the upstream nameservers as well; upstream responses are
+// not, the recursive nameservers already followed their CNAMEs. The chain
+// is followed up to maxCNAMEChain records and a loop is answered with
+// SERVFAIL. Queries for CNAME records are not chased.
+func (s *server) chaseCNAME(w dns.ResponseWriter, req, m *dns.Msg, local bool) *dns.Msg {
+	config := s.confFor(w)
+	q := m.Question[0]
+	if config.ForwardersOnly || q.Qtype == dns.TypeCNAME || q.Qclass != dns.ClassINET ||
+		m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return m
+	}
+
+	seen := make(map[string]bool)
+	for {
+		target, resolved := cnameTarget(m)
+		if resolved {
+			return m
+		}
+		if seen[target] || validateCNAMEChain(m) != nil {
+			logFor(w).WithField("target", target).Warn("Not following a CNAME loop or overlong chain")
+			fail := new(dns.Msg)
+			s.ServerFailure(fail, req)
+			return fail
+		}
+		seen[target] = true
+
+		if cnames, _ := s.cnameRecords(dns.Question{Name: target}); len(cnames) > 0 {
+			m.Answer = append(m.Answer, cnames...)
+			local = true
+			continue
+		}
+
+		if addrs, _ := s.hosts.FindHosts(target); len(addrs) > 0 {
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+				records, _ := s.AddressRecords(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, target)
+				m.Answer = append(m.Answer, records...)
+			}
+			m.Rcode = dns.RcodeSuccess
+			m.Ns = nil
+			return m
+		}
+
+		stub := config.inStubZone(target)
+		if config.NoRec || !stub && (!local || len(config.Nameservers) == 0) {
+			return m
+		}
+		logFor(w).WithField("target", target).Debug("Following CNAME")
+		r, err := s.forwardQuery(w, searchQuery(req, target))
+		if err != nil {
+			logFor(w).WithError(err).Debug("Failed to resolve the target of a CNAME")
+			fail := new(dns.Msg)
+			s.ServerFailure(fail, req)
+			return fail
+		}
+		m.Answer = append(m.Answer, r.Answer...)
+		m.Ns = r.Ns
+		m.Rcode = r.Rcode
+		// The records of the target are not ours
+		m.Authoritative = false
+		local = false
+	}
+}
+
+// inStubZone reports whether name is forwarded to the nameservers of a
+// stub zone.
+func (c *Config) inStubZone(name string) bool {
+	if c.Stub == nil || c.ForwardersOnly {
+		return false
+	}
+	for zone := range *c.Stub {
+		if strings.HasSuffix(name, zone) {
+			return true
+		}
+	}
+	return false
+}
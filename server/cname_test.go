@@ -0,0 +1,94 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaseCNAME(t *testing.T) {
+	const upstream, stubNS = "192.0.2.1:53", "192.0.2.53:53"
+	e := &fakeExchanger{answer: func(m *dns.Msg, u Upstream) (*dns.Msg, error) {
+		name := m.Question[0].Name
+		switch {
+		case u.Addr == stubNS && name == "db.corp.":
+			return reply(m, dns.RcodeSuccess, "db.corp. 60 IN A 10.0.0.7"), nil
+		case u.Addr == stubNS && name == "loop.corp.":
+			return reply(m, dns.RcodeSuccess, "loop.corp. 60 IN CNAME loop.example.com."), nil
+		case name == "www.example.com.":
+			return reply(m, dns.RcodeSuccess, "www.example.com. 60 IN CNAME app.internal."), nil
+		case name == "gone.example.com.":
+			// The recursive nameserver found no target
+			return reply(m, dns.RcodeNameError, "gone.example.com. 60 IN CNAME app.example.net."), nil
+		case name == "svc.example.com.":
+			return reply(m, dns.RcodeSuccess, "svc.example.com. 60 IN CNAME db.corp."), nil
+		case name == "loop.example.com.":
+			return reply(m, dns.RcodeSuccess, "loop.example.com. 60 IN CNAME loop.corp."), nil
+		}
+		return reply(m, dns.RcodeNameError), nil
+	}}
+	stubs := map[string]*StubZone{"corp.": NewStubZone([]string{stubNS})}
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.5 app.internal\n"),
+		&Config{Nameservers: []string{upstream}, Stub: &stubs, Exchanger: e, RCache: 100})
+	defer s.Stop()
+
+	exchange := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	answer := func(r *dns.Msg) []string {
+		var a []string
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				a = append(a, rr.A.String())
+			case *dns.CNAME:
+				a = append(a, rr.Target)
+			}
+		}
+		return a
+	}
+
+	for _, tc := range []struct {
+		name  string
+		rcode int
+		want  []string
+		sent  []string
+	}{
+		// Into the hostsfile, the address is added without asking again
+		{"www.example.com.", dns.RcodeSuccess, []string{"app.internal.", "10.0.0.5"}, []string{upstream}},
+		// Into a stub zone
+		{"svc.example.com.", dns.RcodeSuccess, []string{"db.corp.", "10.0.0.7"}, []string{upstream, stubNS}},
+		// Elsewhere, the upstream answer is final
+		{"gone.example.com.", dns.RcodeNameError, []string{"app.example.net."}, []string{upstream}},
+		// Back and forth between the upstream and a stub zone
+		{"loop.example.com.", dns.RcodeServerFailure, nil, []string{upstream, stubNS}},
+	} {
+		before := len(e.sent())
+		for i := 0; i < 2; i++ {
+			r := exchange(tc.name)
+			if r.Rcode != tc.rcode || fmt.Sprint(answer(r)) != fmt.Sprint(tc.want) {
+				t.Errorf("%s: expected %s with %v, got %s with %v", tc.name, dns.RcodeToString[tc.rcode], tc.want,
+					dns.RcodeToString[r.Rcode], answer(r))
+			}
+		}
+		var sent []string
+		for _, u := range e.sent()[before:] {
+			sent = append(sent, u.Addr)
+		}
+		// The second answer is the one from the cache
+		if fmt.Sprint(sent) != fmt.Sprint(tc.sent) {
+			t.Errorf("%s: expected the queries to be sent to %v, got %v", tc.name, tc.sent, sent)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+// concurrencyPerCPU is the number of queries handled at once per CPU by
+// default. Most of the time of a query is spent waiting for upstream
+// nameservers, so it is well above the number of CPUs.
+const concurrencyPerCPU = 256
+
+// concurrencyQueueWait is how long a UDP query waits for a handler to
+// become free before it is dropped. A variable for testing.
+var concurrencyQueueWait = 200 * time.Millisecond
+
+// DefaultMaxConcurrency returns the default of 'max-concurrency', derived
+// from the number of CPUs.
+func DefaultMaxConcurrency() int {
+	return concurrencyPerCPU * runtime.NumCPU()
+}
+
+// handlerLimit caps the number of queries handled at once. UDP queries
+// arriving while all handlers are busy wait briefly in a queue as long as
+// the limit; TCP queries wait until a handler is free, which stops reading
+// from the connection.
+type handlerLimit struct {
+	slots   chan struct{}
+	waiting int32
+}
+
+func newHandlerLimit(n int) *handlerLimit {
+	return &handlerLimit{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a free handler and reports whether one was acquired.
+// It gives up when stop is closed, and for UDP queries when the queue is
+// full or concurrencyQueueWait passed.
+func (l *handlerLimit) acquire(tcp bool, stop <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+		stats.ActiveQueries.Inc(1)
+		return true
+	default:
+	}
+	if !tcp && l.queued() >= cap(l.slots) {
+		return false
+	}
+
+	atomic.AddInt32(&l.waiting, 1)
+	stats.QueuedQueries.Inc(1)
+	defer func() {
+		atomic.AddInt32(&l.waiting, -1)
+		stats.QueuedQueries.Inc(-1)
+	}()
+	var timeout <-chan time.Time
+	if !tcp {
+		t := time.NewTimer(concurrencyQueueWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		stats.ActiveQueries.Inc(1)
+		return true
+	case <-timeout:
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+// queued returns the number of queries waiting for a handler.
+func (l *handlerLimit) queued() int {
+	return int(atomic.LoadInt32(&l.waiting))
+}
+
+// release frees a handler acquired with acquire.
+func (l *handlerLimit) release() {
+	<-l.slots
+	stats.ActiveQueries.Inc(-1)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerLimitUDP(t *testing.T) {
+	defer func(d time.Duration) { concurrencyQueueWait = d }(concurrencyQueueWait)
+	concurrencyQueueWait = 50 * time.Millisecond
+
+	stop := make(chan struct{})
+	l := newHandlerLimit(1)
+	if !l.acquire(false, stop) {
+		t.Fatal("expected a free handler")
+	}
+
+	// Queued until the wait is over
+	start := time.Now()
+	if l.acquire(false, stop) {
+		t.Fatal("expected the query to be dropped while the handler is busy")
+	}
+	if d := time.Since(start); d < concurrencyQueueWait {
+		t.Errorf("expected the query to wait %s, dropped after %s", concurrencyQueueWait, d)
+	}
+
+	// Takes the handler released while waiting
+	got := make(chan bool)
+	go func() { got <- l.acquire(false, stop) }()
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	if !<-got {
+		t.Fatal("expected the queued query to get the released handler")
+	}
+	l.release()
+}
+
+func TestHandlerLimitUDPQueueFull(t *testing.T) {
+	stop := make(chan struct{})
+	l := newHandlerLimit(1)
+	l.acquire(false, stop)
+	defer l.release()
+
+	waiting := make(chan bool)
+	go func() { waiting <- l.acquire(false, stop) }()
+	for i := 0; i < 100 && l.queued() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is as long as the limit, the next query is dropped at once
+	start := time.Now()
+	if l.acquire(false, stop) {
+		t.Fatal("expected the query to be dropped with a full queue")
+	}
+	if d := time.Since(start); d >= concurrencyQueueWait {
+		t.Errorf("expected the query to be dropped at once, took %s", d)
+	}
+	close(stop)
+	<-waiting
+}
+
+func TestHandlerLimitTCP(t *testing.T) {
+	defer func(d time.Duration) { concurrencyQueueWait = d }(concurrencyQueueWait)
+	concurrencyQueueWait = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	l := newHandlerLimit(1)
+	l.acquire(true, stop)
+
+	got := make(chan bool)
+	go func() { got <- l.acquire(true, stop) }()
+	select {
+	case <-got:
+		t.Fatal("expected the TCP query to wait for the busy handler")
+	case <-time.After(5 * concurrencyQueueWait):
+	}
+	l.release()
+	if !<-got {
+		t.Fatal("expected the TCP query to get the released handler")
+	}
+
+	// Stop ends the wait
+	go func() { got <- l.acquire(true, stop) }()
+	close(stop)
+	if <-got {
+		t.Fatal("expected no handler after stop")
+	}
+}
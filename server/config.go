@@ -8,116 +8,466 @@ package server
 import (
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/miekg/dns"
 )
 
-// Config provides options to the go-dnsmasq resolver
+// Config provides options to the go-dnsmasq resolver. It is created with
+// NewConfig; setting the fields directly and validating them with
+// CheckConfig is deprecated. Its JSON form is described by MarshalJSON.
 type Config struct {
 	// The ip:port go-dnsmasq should be listening on for incoming DNS requests.
 	DnsAddr string `json:"dns_addr,omitempty"`
+	// Second port to answer queries on, on the host of DnsAddr. Zero
+	// disables it.
+	AdditionalPort int `json:"additional_port,omitempty"`
 	// bind to port(s) activated by systemd. If set to true, this overrides DnsAddr.
 	Systemd bool `json:"systemd,omitempty"`
+	// Only listen on TCP and use TCP for all queries sent upstream
+	TcpOnly bool `json:"tcp_only,omitempty"`
+	// Listen on the addresses of these network interfaces instead of the
+	// host of DnsAddr. Only its port is used.
+	Interfaces []string `json:"interfaces,omitempty"`
+	// Network interfaces not to listen on. Implies all others if Interfaces is empty.
+	ExceptInterfaces []string `json:"except_interfaces,omitempty"`
+	// Follow the addresses of the network interfaces as they are added and removed
+	BindDynamic bool `json:"bind_dynamic,omitempty"`
+	// Maximum number of open TCP client connections. Zero means unlimited.
+	MaxTCPConnections int `json:"max_tcp_connections,omitempty"`
+	// How long a TCP client connection may be idle before it is closed. Zero means 10s.
+	TCPIdleTimeout time.Duration `json:"tcp_idle_timeout,omitempty"`
+	// Maximum number of queries answered at once on one TCP connection, further
+	// queries are read as they are answered. One answers them in order, zero means 16.
+	MaxTCPPipeline int `json:"max_tcp_pipeline,omitempty"`
+	// Number of UDP sockets bound to each address with SO_REUSEPORT, each
+	// with its own read loop. Zero or one binds a single socket. Linux only.
+	ReusePort int `json:"reuseport,omitempty"`
+	// Number of times to try binding the listen sockets again on startup,
+	// every BindRetryInterval, while one of them cannot be bound.
+	BindRetries       int           `json:"bind_retries,omitempty"`
+	BindRetryInterval time.Duration `json:"bind_retry_interval,omitempty"`
+	// Maximum number of queries handled at once. Zero means unlimited.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	// Answer queries with SERVFAIL and halve the cache while less memory is free, in MB. Zero disables it.
+	MinFreeMemoryMB int `json:"min_free_memory_mb,omitempty"`
+	// The ip:port to serve the /healthz and /readyz endpoints on. Empty disables them.
+	HealthListen string `json:"health_listen,omitempty"`
+	// The loopback ip:port to serve pprof and expvar on. Empty disables them.
+	DebugListen string `json:"debug_listen,omitempty"`
+	// Path of the unix socket to serve the admin API on. Empty disables it.
+	AdminSocket string `json:"admin_socket,omitempty"`
 	// Rewrite host's network config making go-dnsmasq the default resolver
 	DefaultResolver bool `json:"default_resolver,omitempty"`
+	// Resolver configuration whose nameservers and search domains are
+	// merged with the configured ones and those of /etc/resolv.conf, see
+	// ResolvConf. Empty disables it.
+	ExtraResolvConf string `json:"extra_resolv_conf,omitempty"`
 	// Domain to append to query names that are not FQDN
 	// Replicates the SEARCH keyword in /etc/resolv.conf
 	SearchDomains []string `json:"search_domains,omitempty"`
 	// Replicates the SEARCH keyword in /etc/resolv.conf
 	AppendDomain bool `json:"append_domain,omitempty"`
-	// Path to the hostfile
-	Hostsfile string `json:"hostfile,omitempty"`
+	// Send the A and AAAA queries for each search domain expansion of an A
+	// or AAAA query at once
+	ParallelLookup bool `json:"parallel_lookup,omitempty"`
+	// Paths to the hostfiles. A name in a later file shadows the same
+	// name in the files before it.
+	Hostsfile []string `json:"hostfile,omitempty"`
 	// Hostfile Polling
 	PollInterval int `json:"poll_interval,omitempty"`
-	// Round robin A/AAAA replies. Default is true.
+	// Rotate the A and AAAA records of every response, including cached
+	// ones.
 	RoundRobin bool `json:"round_robin,omitempty"`
 	// List of ip:port, seperated by commas of recursive nameservers to forward queries to.
 	Nameservers []string `json:"nameservers,omitempty"`
+	// Minimum number of nameservers that must answer a forwarded query.
+	// When set, queries are sent to all nameservers in parallel, once each:
+	// UpstreamRetries and UpstreamStrategy are ignored. Stub zones are not
+	// affected.
+	MinAnswers int `json:"min_answers,omitempty"`
+	// UDP payload size announced in the OPT record of queries sent upstream.
+	// Zero leaves queries untouched.
+	EdnsBufferSize int `json:"edns_buffer_size,omitempty"`
+	// Return truncated UDP responses of the nameservers as they are instead
+	// of retrying the query over TCP.
+	NoTCPRetry bool `json:"no_tcp_retry,omitempty"`
+	// Number of sockets kept open per upstream nameserver and protocol,
+	// shared by the queries forwarded to it. Zero opens a socket per query.
+	UpstreamPoolSize int `json:"upstream_pool_size,omitempty"`
+	// Order the upstream nameservers are tried in for each query. Empty
+	// means StrategyFirst.
+	UpstreamStrategy UpstreamStrategy `json:"upstream_strategy,omitempty"`
+	// Number of responses the average response time of a nameserver
+	// mostly reflects with StrategyFastest. Zero means 10.
+	UpstreamRTTWindow int `json:"upstream_rtt_window,omitempty"`
+	// Number of times a query is sent to the next nameserver after an
+	// error, a timeout or SERVFAIL before SERVFAIL is returned to the
+	// client. Zero sends it once.
+	UpstreamRetries int `json:"upstream_retries,omitempty"`
+	// Local address the queries to the upstream and stub zone nameservers
+	// are sent from. Nil lets the system choose it.
+	UpstreamSourceIP net.IP `json:"upstream_source_ip,omitempty"`
 	// Never provide a recursive service.
 	NoRec       bool          `json:"no_rec,omitempty"`
 	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// Forward every query as is. Disables the hostsfile, stub zones,
+	// aliases, local domains and search domains.
+	ForwardersOnly bool `json:"forwarders_only,omitempty"`
 	// Default TTL, in seconds. Defaults to 360.
 	Ttl uint32 `json:"ttl,omitempty"`
 	// Default TTL for Hostfile records, in seconds. Defaults to 30.
 	HostsTtl uint32 `json:"hostfile_ttl,omitempty"`
+	// Domains the server is authoritative for. Queries for names under them
+	// are answered from the hostsfile or with NXDOMAIN, never forwarded.
+	// Lower case FQDNs.
+	LocalDomains []string `json:"local_domains,omitempty"`
+	// Answer PTR queries for private and link-local addresses that are not
+	// in the hostsfile with NXDOMAIN instead of forwarding them.
+	NoPrivateReverse bool `json:"no_private_reverse,omitempty"`
+	// Domain under which network interface addresses are served, lower case
+	// without leading or trailing dot. Empty when interface discovery is disabled.
+	IfaceDomain string `json:"iface_domain,omitempty"`
+	// TTL for network interface records, in seconds.
+	IfaceTtl uint32 `json:"iface_ttl,omitempty"`
 	// RCache, capacity of response cache in resource records stored.
 	RCache int `json:"rcache,omitempty"`
 	// RCacheTtl, how long to cache in seconds.
 	RCacheTtl int `json:"rcache_ttl,omitempty"`
+	// Number of lookups a response must have before it is cached. Until
+	// then it is held in a probation cache of RCache capacity. Values
+	// below 2 cache every response.
+	CacheMinHitCount int `json:"cache_min_hit_count,omitempty"`
+	// Keep a response cache of RCache capacity per client network, for
+	// upstreams that answer differently depending on the client.
+	CacheByClientIP bool `json:"cache_by_client_ip,omitempty"`
+	// Prefix lengths of the client networks with CacheByClientIP
+	CacheIPPrefixLenV4 int `json:"cache_ip_prefix_len_v4,omitempty"`
+	CacheIPPrefixLenV6 int `json:"cache_ip_prefix_len_v6,omitempty"`
+	// Maximum number of client networks to keep a response cache for
+	CacheMaxClients int `json:"cache_max_clients,omitempty"`
+	// File to write the contents of the response cache to as JSON every
+	// CacheDumpInterval. Zero CacheDumpInterval disables it.
+	CacheDumpFile     string        `json:"cache_dump_file,omitempty"`
+	CacheDumpInterval time.Duration `json:"cache_dump_interval,omitempty"`
 	// How many dots a name must have before we allow to forward the query as-is. Defaults to 1.
 	FwdNdots int `json:"fwd_ndots,omitempty"`
 	// How many dots a name must have before we do an initial absolute query. Defaults to 1.
 	Ndots int `json:"ndots,omitempty"`
+	// Names with fewer dots are qualified with the search domains before
+	// they are queried as-is. Zero means Ndots.
+	AppendNdots int `json:"append_ndots,omitempty"`
 
 	Verbose bool `json:"-"`
+	// Log debug messages for queries of names under this domain even when
+	// verbose logging is off. Lower case FQDN, empty disables tracing.
+	DebugDomain string `json:"debug_domain,omitempty"`
 
-	// Stub zones support. Map contains domainname -> nameserver:port
-	Stub *map[string][]string
+	// Unix socket of a dnstap collector to send query and response messages to
+	DnstapSocket string `json:"dnstap_socket,omitempty"`
+
+	// host:port of an OTLP/gRPC collector to send query traces to. Empty disables tracing.
+	OtlpEndpoint string `json:"otlp_endpoint,omitempty"`
+
+	// Number of most queried domains and busiest clients to track. Zero disables tracking.
+	TrackTop int `json:"track_top,omitempty"`
+
+	// Log queries that take longer than this to answer, checked just before
+	// the response is written. Zero disables logging.
+	LogSlowQueries time.Duration `json:"log_slow_queries,omitempty"`
+
+	// Log every query handled by the server
+	LogQueries bool `json:"log_queries,omitempty"`
+	// File to write the query log to. Defaults to stdout.
+	LogQueriesFile string `json:"log_queries_file,omitempty"`
+	// Format of the query log, either 'text' or 'json'
+	LogQueriesFormat string `json:"log_queries_format,omitempty"`
+
+	// Rules overriding the TTL of records received from upstream
+	// nameservers. The first matching rule applies.
+	TTLRewrites []TTLRewriteRule `json:"ttl_rewrites,omitempty"`
+	// Rules mapping the addresses of upstream A and AAAA records into
+	// another network. The first matching rule applies.
+	IPRewrites []IPRewriteRule `json:"ip_rewrites,omitempty"`
+	// Rules replacing single addresses of upstream A and AAAA answers. The
+	// first matching rule applies.
+	ResponseRewrites []ResponseRewriteRule `json:"response_rewrites,omitempty"`
+
+	// Refuse upstream answers containing private, link-local or loopback
+	// addresses, which could be used to reach internal hosts through a
+	// rebinding attack.
+	StopRebind bool `json:"stop_dns_rebind,omitempty"`
+	// Allow loopback addresses in upstream answers despite StopRebind
+	RebindLocalhostOk bool `json:"rebind_localhost_ok,omitempty"`
+	// Domains whose answers are not checked by StopRebind. Lower case FQDNs.
+	RebindDomainOk []string `json:"rebind_domain_ok,omitempty"`
+
+	// Query types answered with NODATA without consulting the cache or the
+	// upstream nameservers, unless the hostsfile has records of the type.
+	QtypeFilter []uint16 `json:"qtype_filter,omitempty"`
+
+	// Stub zones support. Map contains domainname -> nameservers
+	Stub *map[string]*StubZone `json:"-"`
 
 	// Alias support - source domain : target domain
-	Alias *map[string]string
+	Alias *map[string]string `json:"-"`
+
+	// Sends the forwarded queries instead of the default exchanger when
+	// the server is used as a library. Read when the server is created.
+	Exchanger Exchanger `json:"-"`
 }
 
+// ConfigErrors lists all problems found in a configuration. It matches
+// ErrInvalidConfig with errors.Is.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// resolvConfPath is the resolver configuration nameservers and search
+// domains are read from when they are not configured otherwise.
+var resolvConfPath = "/etc/resolv.conf"
+
+// ResolvConf sets the nameservers, search domains and ndots that were not
+// configured on the command line. Nameservers are taken from the space
+// separated NAMESERVER environment variable and search domains from the
+// SEARCH environment variable as injected by some container runtimes,
+// otherwise from /etc/resolv.conf. With ExtraResolvConf, the nameservers
+// and search domains of that file are merged with the configured ones
+// and those of /etc/resolv.conf, in this order, leaving out duplicates.
+// Nameservers that are addresses the server listens on are skipped; if
+// that leaves none, an error wrapping ErrNoUpstreams is returned. An error
+// reading ExtraResolvConf or /etc/resolv.conf is returned after the other
+// sources have been applied.
 func ResolvConf(config *Config, ctx *cli.Context) error {
 	// Get host resolv config
-	resolvConf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-	if err != nil {
-		return err
+	resolvConf, err := dns.ClientConfigFromFile(resolvConfPath)
+
+	var extra *dns.ClientConfig
+	var extraErr error
+	if config.ExtraResolvConf != "" {
+		if extra, extraErr = dns.ClientConfigFromFile(config.ExtraResolvConf); extraErr != nil {
+			extraErr = fmt.Errorf("Error reading 'extra-resolv-conf': %w", extraErr)
+		}
 	}
 
-	if len(config.Nameservers) == 0 {
-		for _, s := range resolvConf.Servers {
-			config.Nameservers = append(config.Nameservers, net.JoinHostPort(s, resolvConf.Port))
+	var loopErr error
+	if len(config.Nameservers) == 0 || extra != nil {
+		type source struct {
+			name    string
+			servers []string
+		}
+		var sources []source
+		if extra != nil {
+			var servers []string
+			for _, s := range extra.Servers {
+				servers = append(servers, net.JoinHostPort(s, extra.Port))
+			}
+			sources = append(sources, source{config.ExtraResolvConf, servers})
+		}
+		if env := os.Getenv("NAMESERVER"); env != "" {
+			var servers []string
+			for _, s := range strings.Fields(env) {
+				if net.ParseIP(strings.Trim(s, "[]")) != nil {
+					s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+				} else if _, _, err := net.SplitHostPort(s); err != nil {
+					return fmt.Errorf("Invalid nameserver in NAMESERVER: %s", s)
+				}
+				servers = append(servers, s)
+			}
+			sources = append(sources, source{"NAMESERVER", servers})
+		} else if resolvConf != nil {
+			var servers []string
+			for _, s := range resolvConf.Servers {
+				servers = append(servers, net.JoinHostPort(s, resolvConf.Port))
+			}
+			sources = append(sources, source{resolvConfPath, servers})
+		}
+
+		// A nameserver left by a previous go-dnsmasq is ourselves
+		listen := configListenAddrs(config)
+		var found, names []string
+		for _, src := range sources {
+			if len(src.servers) > 0 {
+				names = append(names, src.name)
+			}
+			for _, s := range src.servers {
+				found = append(found, s)
+				if selfAddress(s, listen) {
+					log.Warnf("Ignoring nameserver %s from %s, it is an address go-dnsmasq listens on", s, src.name)
+					continue
+				}
+				if !containsString(config.Nameservers, s) {
+					config.Nameservers = append(config.Nameservers, s)
+				}
+			}
+		}
+		if len(found) > 0 && len(config.Nameservers) == 0 && !config.NoRec {
+			loopErr = fmt.Errorf("%w: the nameservers in %s are addresses go-dnsmasq listens on, forwarding to them would loop", ErrNoUpstreams, strings.Join(names, " and "))
 		}
 	}
 
-	if !ctx.IsSet("ndots") {
+	if !ctx.IsSet("ndots") && resolvConf != nil {
 		config.Ndots = resolvConf.Ndots
 	}
 
-	if config.AppendDomain && len(config.SearchDomains) == 0 {
-		for _, s := range resolvConf.Search {
+	if config.AppendDomain && (len(config.SearchDomains) == 0 || extra != nil) {
+		var search []string
+		if extra != nil {
+			search = extra.Search
+		}
+		primary := strings.Fields(os.Getenv("SEARCH"))
+		if len(primary) == 0 && resolvConf != nil {
+			primary = resolvConf.Search
+		}
+		for _, s := range append(search, primary...) {
 			s = dns.Fqdn(strings.ToLower(s))
-			config.SearchDomains = append(config.SearchDomains, s)
+			if !containsString(config.SearchDomains, s) {
+				config.SearchDomains = append(config.SearchDomains, s)
+			}
 		}
 	}
 
-	return nil
+	if loopErr != nil {
+		return loopErr
+	}
+	if extraErr != nil {
+		return extraErr
+	}
+	return err
 }
 
+// CheckConfig validates config and sets the defaults of the options that
+// cannot be configured. All problems found are returned as ConfigErrors.
+//
+// Deprecated: Use NewConfig, which validates every option as it is set
+// and calls CheckConfig for the options that depend on each other.
 func CheckConfig(config *Config) error {
+	var errs ConfigErrors
 	if config.DnsAddr == "" {
-		return fmt.Errorf("'listen' cannot be empty")
+		errs = append(errs, fmt.Errorf("'listen' cannot be empty"))
 	}
 	if !config.NoRec && len(config.Nameservers) == 0 {
-		return fmt.Errorf("You need to specify some nameservers or disable recursion")
+		errs = append(errs, ErrNoUpstreams)
+	}
+	if config.AppendDomain && !config.ForwardersOnly && len(config.SearchDomains) == 0 {
+		errs = append(errs, fmt.Errorf("You need to specify some search domains"))
+	}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
-	if config.AppendDomain && len(config.SearchDomains) == 0 {
-		return fmt.Errorf("You need to specify some search domains")
+	check(checkNonNegative("rcache", config.RCache))
+	if config.CacheByClientIP {
+		check(checkRange("cache-ip-prefix-len-v4", config.CacheIPPrefixLenV4, 0, 32))
+		check(checkRange("cache-ip-prefix-len-v6", config.CacheIPPrefixLenV6, 0, 128))
+		check(checkPositive("cache-max-clients", config.CacheMaxClients))
 	}
-	if config.RCache < 0 {
-		return fmt.Errorf("'rcache' must be equal or greater than 0")
+	check(checkPositive("rcache-ttl", config.RCacheTtl))
+	check(checkNonNegative("cache-min-hit-count", config.CacheMinHitCount))
+	check(checkCacheDump(config.CacheDumpFile, config.CacheDumpInterval))
+	check(checkNonNegative("ndots", config.Ndots))
+	check(checkNonNegative("fwd-ndots", config.FwdNdots))
+	check(checkNonNegative("append-ndots", config.AppendNdots))
+	if config.DebugListen != "" {
+		check(checkDebugListen(config.DebugListen))
 	}
-	if config.RCacheTtl <= 0 {
-		return fmt.Errorf("'rcache-ttl' must be greater than 0")
+	if config.BindDynamic && !config.bindsInterfaces() {
+		errs = append(errs, fmt.Errorf("'bind-dynamic' requires 'interface' or 'except-interface'"))
 	}
-	if config.Ndots <= 0 {
-		return fmt.Errorf("'ndots' must be greater than 0")
+	if config.Systemd && config.bindsInterfaces() {
+		errs = append(errs, fmt.Errorf("'interface' and 'except-interface' cannot be used with 'systemd'"))
 	}
-	if config.FwdNdots < 0 {
-		return fmt.Errorf("'fwd-ndots' must be equal or greater than 0")
+	if config.Systemd && config.ReusePort > 1 {
+		errs = append(errs, fmt.Errorf("'reuseport' cannot be used with 'systemd'"))
+	}
+	if config.AdditionalPort != 0 {
+		check(checkRange("additional-port", config.AdditionalPort, 1, 65535))
+		if config.Systemd || config.bindsInterfaces() {
+			errs = append(errs, fmt.Errorf("'additional-port' cannot be used with 'systemd', 'interface' or 'except-interface'"))
+		}
+		if _, port, err := net.SplitHostPort(config.DnsAddr); err == nil && port == strconv.Itoa(config.AdditionalPort) {
+			errs = append(errs, fmt.Errorf("'additional-port' must differ from the port of 'listen'"))
+		}
+	}
+	check(checkNonNegative("max-tcp-connections", config.MaxTCPConnections))
+	if config.TCPIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("'tcp-idle-timeout' must be equal or greater than 0"))
+	}
+	check(checkNonNegative("max-tcp-pipeline", config.MaxTCPPipeline))
+	check(checkNonNegative("max-concurrency", config.MaxConcurrency))
+	check(checkNonNegative("reuseport", config.ReusePort))
+	check(checkBindRetries(config.BindRetries, config.BindRetryInterval))
+	check(checkNonNegative("upstream-pool-size", config.UpstreamPoolSize))
+	check(checkUpstreamStrategy(config.UpstreamStrategy))
+	check(checkNonNegative("upstream-rtt-window", config.UpstreamRTTWindow))
+	check(checkNonNegative("upstream-retries", config.UpstreamRetries))
+	if config.Stub != nil {
+		var empty []string
+		for zone, z := range *config.Stub {
+			if z == nil || len(z.Nameservers) == 0 {
+				empty = append(empty, zone)
+			}
+		}
+		sort.Strings(empty)
+		for _, zone := range empty {
+			errs = append(errs, fmt.Errorf("'stubzones' is invalid: the stub zone %s has no nameservers", zone))
+		}
+	}
+	if ip := config.UpstreamSourceIP; ip != nil {
+		nameservers := append([]string(nil), config.Nameservers...)
+		if config.Stub != nil {
+			for _, z := range *config.Stub {
+				nameservers = append(nameservers, z.Nameservers...)
+			}
+		}
+		for _, ns := range nameservers {
+			host, _, _ := net.SplitHostPort(ns)
+			if nsIP := net.ParseIP(host); nsIP != nil && (nsIP.To4() == nil) != (ip.To4() == nil) {
+				errs = append(errs, fmt.Errorf("'upstream-source-ip' %s cannot reach the nameserver %s of the other IP version", ip, ns))
+			}
+		}
+	}
+	check(checkNonNegative("min-free-memory-mb", config.MinFreeMemoryMB))
+	check(checkNonNegative("min-answers", config.MinAnswers))
+	if config.MinAnswers > len(config.Nameservers) {
+		errs = append(errs, fmt.Errorf("'min-answers' cannot exceed the number of nameservers"))
+	}
+	if config.LogSlowQueries < 0 {
+		errs = append(errs, fmt.Errorf("'log-slow-queries' must be equal or greater than 0"))
+	}
+	check(checkNonNegative("track-top", config.TrackTop))
+	if config.EdnsBufferSize != 0 {
+		check(checkRange("edns-buffer-size", config.EdnsBufferSize, 512, 65535))
+	}
+	check(checkLogQueriesFormat(config.LogQueriesFormat))
+
+	if len(errs) > 0 {
+		return errs
 	}
 
 	// Set defaults
 	config.Ttl = 360
 	config.HostsTtl = 10
 
-	stubmap := make(map[string][]string)
-	config.Stub = &stubmap
-	config.Alias = &map[string]string{}
+	if config.Stub == nil {
+		config.Stub = &map[string]*StubZone{}
+	}
+	if config.Alias == nil {
+		config.Alias = &map[string]string{}
+	}
 	return nil
 }
 
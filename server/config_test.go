@@ -0,0 +1,136 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+func TestResolvConfEnv(t *testing.T) {
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(os.TempDir(), "go-dnsmasq-missing-resolv.conf")
+
+	os.Setenv("NAMESERVER", "10.0.0.1 10.0.0.2:5353 fe80::1")
+	os.Setenv("SEARCH", "Svc.Cluster.Local cluster.local")
+	defer os.Unsetenv("NAMESERVER")
+	defer os.Unsetenv("SEARCH")
+
+	ctx := cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	config := &Config{AppendDomain: true}
+	if err := ResolvConf(config, ctx); !os.IsNotExist(err) {
+		t.Errorf("expected missing resolv.conf to be reported, got %v", err)
+	}
+	if want := []string{"10.0.0.1:53", "10.0.0.2:5353", "[fe80::1]:53"}; !reflect.DeepEqual(config.Nameservers, want) {
+		t.Errorf("expected nameservers %v, got %v", want, config.Nameservers)
+	}
+	if want := []string{"svc.cluster.local.", "cluster.local."}; !reflect.DeepEqual(config.SearchDomains, want) {
+		t.Errorf("expected search domains %v, got %v", want, config.SearchDomains)
+	}
+
+	// Configured values take precedence
+	config = &Config{AppendDomain: true, Nameservers: []string{"8.8.8.8:53"}, SearchDomains: []string{"example.com."}}
+	ResolvConf(config, ctx)
+	if want := []string{"8.8.8.8:53"}; !reflect.DeepEqual(config.Nameservers, want) {
+		t.Errorf("expected nameservers %v, got %v", want, config.Nameservers)
+	}
+	if want := []string{"example.com."}; !reflect.DeepEqual(config.SearchDomains, want) {
+		t.Errorf("expected search domains %v, got %v", want, config.SearchDomains)
+	}
+
+	os.Setenv("NAMESERVER", "not-an-address")
+	if err := ResolvConf(new(Config), ctx); err == nil {
+		t.Error("expected invalid NAMESERVER to be rejected")
+	}
+}
+
+func TestExtraResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	extra := filepath.Join(dir, "k8s-resolv.conf")
+	ctx := cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	ioutil.WriteFile(resolvConfPath, []byte("nameserver 10.0.0.1\nnameserver 10.0.0.2\nsearch example.com corp.example\n"), 0644)
+	ioutil.WriteFile(extra, []byte("nameserver 10.96.0.10\nnameserver 10.0.0.2\nsearch default.svc.cluster.local example.com\n"), 0644)
+
+	for _, tc := range []struct {
+		config      *Config
+		nameservers []string
+		search      []string
+	}{
+		// The extra file comes before /etc/resolv.conf
+		{
+			&Config{AppendDomain: true, ExtraResolvConf: extra},
+			[]string{"10.96.0.10:53", "10.0.0.2:53", "10.0.0.1:53"},
+			[]string{"default.svc.cluster.local.", "example.com.", "corp.example."},
+		},
+		// The configured ones come first
+		{
+			&Config{AppendDomain: true, ExtraResolvConf: extra, Nameservers: []string{"10.0.0.1:53"}, SearchDomains: []string{"corp.example."}},
+			[]string{"10.0.0.1:53", "10.96.0.10:53", "10.0.0.2:53"},
+			[]string{"corp.example.", "default.svc.cluster.local.", "example.com."},
+		},
+		// Without the extra file the configured ones replace /etc/resolv.conf
+		{
+			&Config{AppendDomain: true, Nameservers: []string{"10.0.0.3:53"}, SearchDomains: []string{"corp.example."}},
+			[]string{"10.0.0.3:53"},
+			[]string{"corp.example."},
+		},
+	} {
+		if err := ResolvConf(tc.config, ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.config.Nameservers, tc.nameservers) {
+			t.Errorf("expected nameservers %v, got %v", tc.nameservers, tc.config.Nameservers)
+		}
+		if !reflect.DeepEqual(tc.config.SearchDomains, tc.search) {
+			t.Errorf("expected search domains %v, got %v", tc.search, tc.config.SearchDomains)
+		}
+	}
+
+	// A missing extra file is reported, /etc/resolv.conf is still used
+	config := &Config{ExtraResolvConf: filepath.Join(dir, "missing.conf")}
+	if err := ResolvConf(config, ctx); err == nil {
+		t.Error("expected the missing extra file to be reported")
+	}
+	if want := []string{"10.0.0.1:53", "10.0.0.2:53"}; !reflect.DeepEqual(config.Nameservers, want) {
+		t.Errorf("expected nameservers %v, got %v", want, config.Nameservers)
+	}
+}
+
+func TestCheckConfigErrors(t *testing.T) {
+	err := CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: -1, RCacheTtl: 60, TrackTop: -1, LogQueriesFormat: "xml"})
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("expected 4 problems, got %d: %s", len(errs), err)
+	}
+
+	if err := CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: 1, RCacheTtl: 60, NoRec: true}); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	// A stub zone without nameservers
+	stubs := map[string]*StubZone{"stub.local.": NewStubZone(nil)}
+	err = CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: 1, RCacheTtl: 60, NoRec: true, Stub: &stubs})
+	if err == nil || !strings.Contains(err.Error(), "stub zone stub.local. has no nameservers") {
+		t.Errorf("expected the empty stub zone to be rejected, got %v", err)
+	}
+}
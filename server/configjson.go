@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// redacted replaces the value of Config fields tagged `redact:"true"` in
+// the JSON form, e.g. secrets.
+const redacted = "[redacted]"
+
+// plainConfig is Config without its JSON methods.
+type plainConfig Config
+
+// configJSON holds the fields of Config whose JSON form differs from what
+// encoding/json would produce. Being less deeply nested, they shadow the
+// fields of the same name in plainConfig.
+type configJSON struct {
+	*plainConfig
+	ReadTimeout       string `json:"read_timeout,omitempty"`
+	TCPIdleTimeout    string `json:"tcp_idle_timeout,omitempty"`
+	LogSlowQueries    string `json:"log_slow_queries,omitempty"`
+	CacheDumpInterval string `json:"cache_dump_interval,omitempty"`
+	Verbose           bool   `json:"verbose,omitempty"`
+	// Nameservers by zone
+	Stub *map[string][]string `json:"stub_zones,omitempty"`
+	// Target domain by source domain
+	Alias *map[string]string `json:"aliases,omitempty"`
+}
+
+// MarshalJSON encodes the configuration with durations such as "2s",
+// rewrite rules in their command line syntax, the stub zones as lists of
+// nameservers by zone and the aliases as target domains by source domain.
+// The fields holding secrets are "[redacted]". UnmarshalJSON decodes it
+// back into an equivalent Config.
+func (c Config) MarshalJSON() ([]byte, error) {
+	plain := plainConfig(c)
+	redact(reflect.ValueOf(&plain).Elem())
+	v := configJSON{
+		plainConfig:       &plain,
+		ReadTimeout:       formatDuration(c.ReadTimeout),
+		TCPIdleTimeout:    formatDuration(c.TCPIdleTimeout),
+		LogSlowQueries:    formatDuration(c.LogSlowQueries),
+		CacheDumpInterval: formatDuration(c.CacheDumpInterval),
+		Verbose:           c.Verbose,
+	}
+	if c.Stub != nil {
+		stub := make(map[string][]string, len(*c.Stub))
+		for zone, z := range *c.Stub {
+			stub[zone] = z.Nameservers
+		}
+		v.Stub = &stub
+	}
+	v.Alias = c.Alias
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the JSON form written by MarshalJSON. Fields that
+// are absent keep their value. The values are not validated, see
+// CheckConfig.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	v := configJSON{
+		plainConfig:       (*plainConfig)(c),
+		ReadTimeout:       formatDuration(c.ReadTimeout),
+		TCPIdleTimeout:    formatDuration(c.TCPIdleTimeout),
+		LogSlowQueries:    formatDuration(c.LogSlowQueries),
+		CacheDumpInterval: formatDuration(c.CacheDumpInterval),
+		Verbose:           c.Verbose,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{v.ReadTimeout, &c.ReadTimeout},
+		{v.TCPIdleTimeout, &c.TCPIdleTimeout},
+		{v.LogSlowQueries, &c.LogSlowQueries},
+		{v.CacheDumpInterval, &c.CacheDumpInterval},
+	} {
+		var err error
+		if *d.d, err = parseDuration(d.s); err != nil {
+			return err
+		}
+	}
+	c.Verbose = v.Verbose
+	if v.Stub != nil {
+		stub := make(map[string]*StubZone, len(*v.Stub))
+		for zone, nameservers := range *v.Stub {
+			stub[zone] = NewStubZone(nameservers)
+		}
+		c.Stub = &stub
+	}
+	if v.Alias != nil {
+		c.Alias = v.Alias
+	}
+	return nil
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// redact replaces the non-empty string and string slice fields of the
+// struct v that are tagged `redact:"true"`.
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("redact") != "true" {
+			continue
+		}
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.String && f.Len() > 0:
+			f.SetString(redacted)
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String && f.Len() > 0:
+			s := make([]string, f.Len())
+			for j := range s {
+				s[j] = redacted
+			}
+			f.Set(reflect.ValueOf(s).Convert(f.Type()))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fullConfig returns a Config with every field set.
+func fullConfig(t *testing.T) *Config {
+	ipRule, err := ParseIPRewriteRule("10.1.0.0/16:192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip6Rule, err := ParseIPRewriteRule("fd00::/64:2001:db8::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respRule, err := ParseResponseRewriteRule("[fd00::1]:[fd00::2]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := map[string]*StubZone{"lab.example.": NewStubZone([]string{"10.0.0.1:53", "10.0.0.2:53"})}
+	alias := map[string]string{"www.example.": "example."}
+	return &Config{
+		DnsAddr:            "127.0.0.1:53",
+		AdditionalPort:     5353,
+		Systemd:            true,
+		TcpOnly:            true,
+		Interfaces:         []string{"eth0"},
+		ExceptInterfaces:   []string{"docker0"},
+		BindDynamic:        true,
+		MaxTCPConnections:  10,
+		TCPIdleTimeout:     3 * time.Second,
+		BindRetries:        3,
+		BindRetryInterval:  2 * time.Second,
+		MaxTCPPipeline:     4,
+		ReusePort:          2,
+		MaxConcurrency:     100,
+		MinFreeMemoryMB:    64,
+		HealthListen:       "127.0.0.1:8080",
+		DebugListen:        "127.0.0.1:6060",
+		AdminSocket:        "/run/go-dnsmasq.sock",
+		DefaultResolver:    true,
+		ExtraResolvConf:    "/etc/k8s-resolv.conf",
+		SearchDomains:      []string{"corp.example."},
+		AppendDomain:       true,
+		ParallelLookup:     true,
+		Hostsfile:          []string{"/etc/hosts", "/etc/hosts.d/block"},
+		PollInterval:       5,
+		RoundRobin:         true,
+		Nameservers:        []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"},
+		MinAnswers:         2,
+		EdnsBufferSize:     1232,
+		UpstreamRetries:    3,
+		NoTCPRetry:         true,
+		UpstreamPoolSize:   4,
+		UpstreamStrategy:   StrategyFastest,
+		UpstreamRTTWindow:  20,
+		UpstreamSourceIP:   net.ParseIP("192.0.2.53"),
+		NoRec:              true,
+		ReadTimeout:        1500 * time.Millisecond,
+		ForwardersOnly:     true,
+		Ttl:                360,
+		HostsTtl:           10,
+		LocalDomains:       []string{"example.internal."},
+		NoPrivateReverse:   true,
+		IfaceDomain:        "iface.local",
+		IfaceTtl:           20,
+		RCache:             1000,
+		RCacheTtl:          60,
+		CacheMinHitCount:   2,
+		CacheByClientIP:    true,
+		CacheIPPrefixLenV4: 24,
+		CacheIPPrefixLenV6: 48,
+		CacheMaxClients:    1024,
+		CacheDumpFile:      "/tmp/rcache.json",
+		CacheDumpInterval:  time.Minute,
+		FwdNdots:           2,
+		Ndots:              1,
+		AppendNdots:        3,
+		Verbose:            true,
+		DebugDomain:        "debug.example.",
+		DnstapSocket:       "/run/dnstap.sock",
+		OtlpEndpoint:       "127.0.0.1:4317",
+		TrackTop:           10,
+		LogSlowQueries:     500 * time.Millisecond,
+		LogQueries:         true,
+		LogQueriesFile:     "/var/log/queries.log",
+		LogQueriesFormat:   "json",
+		TTLRewrites:        []TTLRewriteRule{{Pattern: "*.example.", TTL: 30}},
+		IPRewrites:         []IPRewriteRule{ipRule, ip6Rule},
+		ResponseRewrites:   []ResponseRewriteRule{respRule},
+		StopRebind:         true,
+		RebindLocalhostOk:  true,
+		RebindDomainOk:     []string{"lan."},
+		QtypeFilter:        []uint16{dns.TypeAAAA},
+		Stub:               &stub,
+		Alias:              &alias,
+		Exchanger:          &fakeExchanger{},
+	}
+}
+
+func TestConfigJSONRoundTrip(t *testing.T) {
+	config := fullConfig(t)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("fullConfig does not set %s", v.Type().Field(i).Name)
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Config
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// Not part of the JSON form
+	decoded.Exchanger = config.Exchanger
+	if !reflect.DeepEqual(config, &decoded) {
+		t.Errorf("round trip changed the configuration:\n%+v\n%+v", config, &decoded)
+	}
+}
+
+func TestConfigJSONForm(t *testing.T) {
+	data, err := json.Marshal(fullConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"read_timeout":        "1.5s",
+		"tcp_idle_timeout":    "3s",
+		"log_slow_queries":    "500ms",
+		"cache_dump_interval": "1m0s",
+		"verbose":             true,
+	} {
+		if m[key] != want {
+			t.Errorf("expected %s to be %v, got %v", key, want, m[key])
+		}
+	}
+	for _, want := range []string{
+		`"ip_rewrites":["10.1.0.0/16:192.168.0.0/16","fd00::/64:2001:db8::/64"]`,
+		`"response_rewrites":["[fd00::1]:[fd00::2]"]`,
+		`"stub_zones":{"lab.example.":["10.0.0.1:53","10.0.0.2:53"]}`,
+		`"aliases":{"www.example.":"example."}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in %s", want, data)
+		}
+	}
+	for _, key := range []string{"Stub", "Alias", "Verbose"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("unexpected key %s", key)
+		}
+	}
+}
+
+func TestConfigJSONErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"read_timeout": "soon"}`,
+		`{"ip_rewrites": ["10.0.0.0/8"]}`,
+		`{"response_rewrites": ["10.0.0.1:fd00::1"]}`,
+		`{"stub_zones": ["lab.example."]}`,
+	} {
+		var config Config
+		if err := json.Unmarshal([]byte(data), &config); err == nil {
+			t.Errorf("expected an error decoding %s", data)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var v struct {
+		Name    string
+		Secret  string   `redact:"true"`
+		Secrets []string `redact:"true"`
+		Empty   string   `redact:"true"`
+	}
+	v.Name, v.Secret, v.Secrets = "tsig.", "c2VjcmV0", []string{"a", "b"}
+	redact(reflect.ValueOf(&v).Elem())
+	if v.Name != "tsig." || v.Secret != redacted || len(v.Secrets) != 2 || v.Secrets[1] != redacted || v.Empty != "" {
+		t.Errorf("unexpected redaction %+v", v)
+	}
+}
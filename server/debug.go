@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// startDebug starts the HTTP server exposing pprof and expvar. It uses
+// its own mux so the handlers never leak onto another listener.
+func (s *server) startDebug() error {
+	l, err := net.Listen("tcp", s.conf().DebugListen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.debugServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.debugServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Debug endpoint failed: %s", err)
+		}
+	}()
+	log.Warnf("Serving pprof and expvar debug endpoints on http://%s/debug/", s.conf().DebugListen)
+	return nil
+}
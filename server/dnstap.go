@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/dnstap"
+)
+
+// tapClient emits the CLIENT_QUERY and CLIENT_RESPONSE messages for a
+// query, with the query as the client sent it.
+func (s *server) tapClient(qw *queryWriter) {
+	tcp := isTCP(qw)
+	query := qw.query
+	if query == nil {
+		return
+	}
+	s.tap.Send(&dnstap.Message{
+		Type:         dnstap.ClientQuery,
+		TCP:          tcp,
+		QueryAddr:    qw.RemoteAddr(),
+		ResponseAddr: qw.LocalAddr(),
+		QueryTime:    qw.start,
+		Query:        query,
+	})
+
+	if qw.msg == nil {
+		return
+	}
+	response, err := qw.msg.Pack()
+	if err != nil {
+		return
+	}
+	s.tap.Send(&dnstap.Message{
+		Type:         dnstap.ClientResponse,
+		TCP:          tcp,
+		QueryAddr:    qw.RemoteAddr(),
+		ResponseAddr: qw.LocalAddr(),
+		QueryTime:    qw.start,
+		ResponseTime: time.Now(),
+		Query:        query,
+		Response:     response,
+	})
+}
+
+// tapResolver emits the RESOLVER_QUERY and RESOLVER_RESPONSE messages for
+// an exchange with an upstream nameserver. resp is nil if the exchange failed.
+func (s *server) tapResolver(req, resp *dns.Msg, nameserver string, tcp bool, qtime time.Time) {
+	if s.tap == nil {
+		return
+	}
+	query, err := req.Pack()
+	if err != nil {
+		return
+	}
+
+	var addr net.Addr
+	if host, port, err := net.SplitHostPort(nameserver); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			p, _ := net.LookupPort("udp", port)
+			addr = &net.UDPAddr{IP: ip, Port: p}
+		}
+	}
+
+	s.tap.Send(&dnstap.Message{
+		Type:         dnstap.ResolverQuery,
+		TCP:          tcp,
+		ResponseAddr: addr,
+		QueryTime:    qtime,
+		Query:        query,
+	})
+
+	if resp == nil {
+		return
+	}
+	response, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	s.tap.Send(&dnstap.Message{
+		Type:         dnstap.ResolverResponse,
+		TCP:          tcp,
+		ResponseAddr: addr,
+		QueryTime:    qtime,
+		ResponseTime: time.Now(),
+		Query:        query,
+		Response:     response,
+	})
+}
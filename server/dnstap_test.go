@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTapClientQueryAsReceived(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	query := make(chan []byte, 1)
+	capture := func(next Handler) Handler {
+		return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			next.ServeDNS(w, r)
+			query <- w.(*queryWriter).query
+		})
+	}
+	aliases := map[string]string{"alias.local.": "example.com."}
+	s := startTestServer(t, &Config{Nameservers: []string{startTestUpstream(t)}, Alias: &aliases,
+		DnstapSocket: filepath.Join(dir, "dnstap.sock")}, capture)
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("x.alias.local.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	tapped := new(dns.Msg)
+	if err := tapped.Unpack(<-query); err != nil {
+		t.Fatal(err)
+	}
+	if tapped.Question[0].Name != "x.alias.local." || tapped.Id != m.Id {
+		t.Errorf("expected the query as sent by the client, got %v", tapped)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Errors callers can test for with errors.Is. The errors returned by the
+// server package wrap them together with the details of the problem.
+var (
+	// ErrInvalidConfig matches the ConfigErrors returned by CheckConfig.
+	ErrInvalidConfig = errors.New("Invalid configuration")
+	// ErrNoUpstreams is reported by CheckConfig when recursion is enabled
+	// but no nameservers are configured.
+	ErrNoUpstreams = errors.New("You need to specify some nameservers or disable recursion")
+	// ErrListenFailed matches the ListenError returned by Run.
+	ErrListenFailed = errors.New("Failed to listen")
+	// ErrHostsfileLoad matches errors loading or reloading the hostsfile.
+	ErrHostsfileLoad = errors.New("Failed to load hostsfile")
+)
+
+// Is reports whether target is ErrInvalidConfig. The individual problems
+// are matched through Unwrap.
+func (e ConfigErrors) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// Unwrap returns the individual problems.
+func (e ConfigErrors) Unwrap() []error {
+	return e
+}
+
+// ListenError is returned by Run when a socket to answer queries on cannot
+// be bound. Err is usually a *net.OpError. The message names the errno of
+// the failed system call, if any.
+type ListenError struct {
+	Net  string // "tcp" or "udp"
+	Addr string
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	err := e.Err
+	if oe, ok := err.(*net.OpError); ok {
+		// Addr and Net are part of our own message
+		err = oe.Err
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return fmt.Sprintf("Failed to listen on %s://%s: %s (errno %d)", e.Net, e.Addr, err, int(errno))
+	}
+	return fmt.Sprintf("Failed to listen on %s://%s: %s", e.Net, e.Addr, err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrListenFailed.
+func (e *ListenError) Is(target error) bool {
+	return target == ErrListenFailed
+}
+
+// ListenErrors is returned by Run when the sockets of more than one
+// address cannot be bound, one ListenError per address.
+type ListenErrors []error
+
+func (e ListenErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the ListenError of each address.
+func (e ListenErrors) Unwrap() []error {
+	return e
+}
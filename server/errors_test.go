@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckConfigErrorTypes(t *testing.T) {
+	err := CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: 1, RCacheTtl: 60})
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+	if !errors.Is(err, ErrNoUpstreams) {
+		t.Errorf("expected ErrNoUpstreams, got %v", err)
+	}
+	if errors.Is(err, ErrListenFailed) {
+		t.Errorf("expected no ErrListenFailed, got %v", err)
+	}
+
+	err = CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: -1, RCacheTtl: 60, NoRec: true})
+	if !errors.Is(err, ErrInvalidConfig) || errors.Is(err, ErrNoUpstreams) {
+		t.Errorf("expected ErrInvalidConfig without ErrNoUpstreams, got %v", err)
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := &Config{DnsAddr: l.Addr().String(), NoRec: true, Ndots: 1, RCacheTtl: 60}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(testHostfile{}, config, "test")
+	defer s.Stop()
+
+	err = s.Run()
+	if !errors.Is(err, ErrListenFailed) {
+		t.Fatalf("expected ErrListenFailed, got %v", err)
+	}
+	var lerr *ListenError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("expected a ListenError, got %T", err)
+	}
+	if lerr.Net != "tcp" || lerr.Addr != config.DnsAddr {
+		t.Errorf("expected tcp://%s, got %s://%s", config.DnsAddr, lerr.Net, lerr.Addr)
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) {
+		t.Errorf("expected the net.Error to be wrapped, got %v", lerr.Err)
+	}
+}
+
+func TestRunListenErrors(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_, port, _ := net.SplitHostPort(udp.LocalAddr().String())
+	udpPort, _ := strconv.Atoi(port)
+
+	// Both addresses fail, the TCP socket of one and the UDP socket of the other
+	config := &Config{DnsAddr: tcp.Addr().String(), AdditionalPort: udpPort, NoRec: true, Ndots: 1, RCacheTtl: 60}
+	s := New(testHostfile{}, config, "test")
+	defer s.Stop()
+	err = s.Run()
+	var lerrs ListenErrors
+	if !errors.As(err, &lerrs) || len(lerrs) != 2 || !errors.Is(err, ErrListenFailed) {
+		t.Fatalf("expected a ListenError for each address, got %v", err)
+	}
+	for i, want := range []string{"tcp://" + config.DnsAddr, "udp://" + udp.LocalAddr().String()} {
+		if msg := lerrs[i].Error(); !strings.Contains(msg, want) || !strings.Contains(msg, "(errno ") {
+			t.Errorf("expected the error to name %s and the errno, got %q", want, msg)
+		}
+	}
+
+	// One address fails, the sockets of the other are closed again
+	free := net.JoinHostPort("127.0.0.1", freePort(t))
+	config = &Config{DnsAddr: free, AdditionalPort: tcp.Addr().(*net.TCPAddr).Port, NoRec: true, Ndots: 1, RCacheTtl: 60}
+	s = New(testHostfile{}, config, "test")
+	defer s.Stop()
+	var lerr *ListenError
+	if err := s.Run(); !errors.As(err, &lerr) || lerr.Net != "tcp" || lerr.Addr == free {
+		t.Fatalf("expected a ListenError for the additional port, got %v", err)
+	}
+	l, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("expected the TCP socket of %s to be closed: %s", free, err)
+	}
+	l.Close()
+	p, err := net.ListenPacket("udp", free)
+	if err != nil {
+		t.Fatalf("expected the UDP socket of %s to be closed: %s", free, err)
+	}
+	p.Close()
+}
+
+func TestBindRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{DnsAddr: l.Addr().String(), NoRec: true, Ndots: 1, RCacheTtl: 60,
+		BindRetries: 50, BindRetryInterval: 20 * time.Millisecond}
+	s := New(testHostfile{}, config, "test")
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+
+	// Released by the previous server while go-dnsmasq retries
+	time.Sleep(100 * time.Millisecond)
+	l.Close()
+	select {
+	case <-s.Listening():
+	case err := <-done:
+		t.Fatalf("expected the bind to be retried, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not listen after the address was released")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network, Timeout: time.Second}
+		if _, _, err := c.Exchange(m, config.DnsAddr); err != nil {
+			t.Fatalf("%s query failed: %s", network, err)
+		}
+	}
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Errorf("expected Run to return nil once stopped, got %v", err)
+	}
+
+	// Without retries the first failure is returned
+	l, err = net.Listen("tcp", config.DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	config.BindRetries = 0
+	s = New(testHostfile{}, config, "test")
+	defer s.Stop()
+	if err := s.Run(); !errors.Is(err, ErrListenFailed) {
+		t.Errorf("expected ErrListenFailed, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+// Upstream is a nameserver queries are forwarded to.
+type Upstream struct {
+	// host:port of the nameserver
+	Addr string
+	// "udp" or "tcp"
+	Net string
+}
+
+// Exchanger sends queries to the upstream and stub zone nameservers. Set
+// Config.Exchanger to replace the default, which opens a socket per query
+// or uses the connections of 'upstream-pool-size'. It must be safe for
+// concurrent use.
+type Exchanger interface {
+	// Exchange sends m to upstream and returns the response and the round
+	// trip time. It must not modify m and should give up once ctx is
+	// done. A response that cannot be parsed is returned as an error.
+	Exchange(ctx context.Context, m *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error)
+}
+
+// clientExchanger sends each query over a new socket.
+type clientExchanger struct {
+	udp *dns.Client
+	tcp *dns.Client
+}
+
+func newClientExchanger(config *Config) *clientExchanger {
+	e := &clientExchanger{
+		udp: &dns.Client{Net: "udp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, UDPSize: uint16(config.EdnsBufferSize), SingleInflight: true},
+		tcp: &dns.Client{Net: "tcp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
+	}
+	if ip := config.UpstreamSourceIP; ip != nil {
+		e.udp.Dialer = upstreamDialer("udp", ip, 2*config.ReadTimeout)
+		e.tcp.Dialer = upstreamDialer("tcp", ip, 2*config.ReadTimeout)
+	}
+	return e
+}
+
+// upstreamDialer returns the dialer of the sockets of network, "udp" or
+// "tcp", to the nameservers, sending from the source ip unless it is nil.
+func upstreamDialer(network string, ip net.IP, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	switch {
+	case ip == nil:
+	case network == "tcp":
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	default:
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	}
+	return d
+}
+
+func (e *clientExchanger) Exchange(ctx context.Context, m *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	client := e.udp
+	if upstream.Net == "tcp" {
+		client = e.tcp
+	}
+	return client.ExchangeContext(ctx, m, upstream.Addr)
+}
+
+// exchange sends m to the upstream nameserver ns over TCP if tcp is set,
+// UDP otherwise. A truncated UDP response is retried over TCP with the same
+// nameserver unless NoTCPRetry is set; if that fails, the truncated
+// response is returned.
+func (s *server) exchange(ctx context.Context, m *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	upstream := Upstream{Addr: ns, Net: "udp"}
+	if tcp {
+		upstream.Net = "tcp"
+	}
+	r, _, err := s.exchanger.Exchange(ctx, m, upstream)
+	if err != nil || tcp || !r.Truncated || s.conf().NoTCPRetry {
+		return r, err
+	}
+
+	stats.TCPRetryCount.Inc(1)
+	upstream.Net = "tcp"
+	full, _, err := s.exchanger.Exchange(ctx, m, upstream)
+	if err != nil {
+		log.WithField("ns", ns).WithError(err).Debug("Failed to retry a truncated response over TCP")
+		return r, nil
+	}
+	return full, nil
+}
+
+// queryContext returns the context of the query answered through w. It
+// carries the span of the query if it is traced.
+func queryContext(w dns.ResponseWriter) context.Context {
+	if qw, ok := w.(*queryWriter); ok && qw.ctx != nil {
+		return qw.ctx
+	}
+	return context.Background()
+}
+
+// withQueryContext makes ctx the context of the query answered through w,
+// a copy of a writer returned by forkWriter.
+func withQueryContext(w dns.ResponseWriter, ctx context.Context) dns.ResponseWriter {
+	if qw, ok := w.(*queryWriter); ok {
+		qw.ctx = ctx
+	}
+	return w
+}
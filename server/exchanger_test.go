@@ -0,0 +1,313 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+// fakeExchanger answers the forwarded queries in memory with answer and
+// records the upstreams they were sent to. If delay is set, each answer is
+// held back for as long as it returns; an exchange whose context is
+// cancelled meanwhile fails and is counted in cancelled.
+type fakeExchanger struct {
+	answer func(m *dns.Msg, upstream Upstream) (*dns.Msg, error)
+	delay  func(m *dns.Msg, upstream Upstream) time.Duration
+
+	mu        sync.Mutex
+	upstreams []Upstream
+	cancelled int
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, m *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	e.mu.Lock()
+	e.upstreams = append(e.upstreams, upstream)
+	e.mu.Unlock()
+	if ctx == nil {
+		return nil, 0, errors.New("no context")
+	}
+	if e.delay != nil {
+		select {
+		case <-time.After(e.delay(m, upstream)):
+		case <-ctx.Done():
+			e.mu.Lock()
+			e.cancelled++
+			e.mu.Unlock()
+			return nil, 0, ctx.Err()
+		}
+	}
+	r, err := e.answer(m, upstream)
+	return r, time.Millisecond, err
+}
+
+func (e *fakeExchanger) sent() []Upstream {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Upstream(nil), e.upstreams...)
+}
+
+func (e *fakeExchanger) cancelledCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cancelled
+}
+
+// reply returns a response to m with rcode and the records rrs.
+func reply(m *dns.Msg, rcode int, rrs ...string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetRcode(m, rcode)
+	for _, s := range rrs {
+		rr, _ := dns.NewRR(s)
+		r.Answer = append(r.Answer, rr)
+	}
+	return r
+}
+
+var errTimeout = errors.New("i/o timeout")
+
+func TestExchanger(t *testing.T) {
+	const first, second = "192.0.2.1:53", "192.0.2.2:53"
+	for _, tc := range []struct {
+		name    string
+		answer  func(m *dns.Msg, upstream Upstream) (*dns.Msg, error)
+		rcode   int
+		answers int
+		tc      bool
+		sent    []string
+	}{
+		{
+			name: "answer",
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.1"), nil
+			},
+			rcode: dns.RcodeSuccess, answers: 1, sent: []string{first},
+		},
+		{
+			name: "timeout",
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				if upstream.Addr == first {
+					return nil, errTimeout
+				}
+				return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.2"), nil
+			},
+			rcode: dns.RcodeSuccess, answers: 1, sent: []string{first, second},
+		},
+		{
+			name: "all-timeout",
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				return nil, errTimeout
+			},
+			rcode: dns.RcodeServerFailure, sent: []string{first, second},
+		},
+		{
+			name: "servfail",
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				if upstream.Addr == first {
+					return reply(m, dns.RcodeServerFailure), nil
+				}
+				return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.2"), nil
+			},
+			rcode: dns.RcodeSuccess, answers: 1, sent: []string{first, second},
+		},
+		{
+			name: "malformed",
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				return nil, dns.ErrShortRead
+			},
+			rcode: dns.RcodeServerFailure, sent: []string{first, second},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &fakeExchanger{answer: tc.answer}
+			s := startTestServer(t, &Config{Nameservers: []string{first, second}, Exchanger: e})
+			defer s.Stop()
+
+			m := new(dns.Msg)
+			m.SetQuestion(tc.name+".example.com.", dns.TypeA)
+			r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tc.rcode || len(r.Answer) != tc.answers || r.Truncated != tc.tc {
+				t.Errorf("expected rcode %s with %d answers and truncated %v, got %v",
+					dns.RcodeToString[tc.rcode], tc.answers, tc.tc, r)
+			}
+			var sent []string
+			for _, upstream := range e.sent() {
+				if upstream.Net != "udp" {
+					t.Errorf("expected the query to be sent over UDP, got %s", upstream.Net)
+				}
+				sent = append(sent, upstream.Addr)
+			}
+			if len(sent) != len(tc.sent) {
+				t.Fatalf("expected the query to be sent to %v, got %v", tc.sent, sent)
+			}
+			for i := range sent {
+				if sent[i] != tc.sent[i] {
+					t.Errorf("expected the query to be sent to %v, got %v", tc.sent, sent)
+				}
+			}
+		})
+	}
+}
+
+func TestExchangerTCP(t *testing.T) {
+	e := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.1"), nil
+	}}
+	s := startTestServer(t, &Config{Nameservers: []string{"192.0.2.1:53"}, Exchanger: e})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("tcp.example.com.", dns.TypeA)
+	c := &dns.Client{Net: "tcp"}
+	if _, _, err := c.Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+	if sent := e.sent(); len(sent) != 1 || sent[0].Net != "tcp" {
+		t.Errorf("expected the query of a TCP client to be sent over TCP, got %v", sent)
+	}
+}
+
+func TestTCPRetry(t *testing.T) {
+	// Truncates the UDP responses
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := reply(req, dns.RcodeSuccess)
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			m = reply(req, dns.RcodeSuccess, req.Question[0].Name+" 60 IN A 10.0.0.1", req.Question[0].Name+" 60 IN A 10.0.0.2")
+		} else {
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, tc := range []struct {
+		noRetry bool
+		answers int
+		tc      bool
+		retries int64
+	}{
+		{false, 2, false, 1},
+		{true, 0, true, 0},
+	} {
+		s := startTestServer(t, &Config{Nameservers: []string{upstream}, NoTCPRetry: tc.noRetry})
+		retries := stats.TCPRetryCount.(metrics.Counter).Count()
+
+		m := new(dns.Msg)
+		m.SetQuestion("large.example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != tc.answers || r.Truncated != tc.tc {
+			t.Errorf("no-tcp-retry %v: expected %d answers and truncated %v, got %v", tc.noRetry, tc.answers, tc.tc, r)
+		}
+		if n := stats.TCPRetryCount.(metrics.Counter).Count() - retries; n != tc.retries {
+			t.Errorf("no-tcp-retry %v: expected %d retries, got %d", tc.noRetry, tc.retries, n)
+		}
+		s.Stop()
+	}
+
+	// The retry goes to the nameserver that truncated the response, the
+	// truncated response is returned if it fails
+	e := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		if upstream.Net == "tcp" {
+			return nil, errTimeout
+		}
+		r := reply(m, dns.RcodeSuccess)
+		r.Truncated = true
+		return r, nil
+	}}
+	s := startTestServer(t, &Config{Nameservers: []string{"192.0.2.1:53", "192.0.2.2:53"}, Exchanger: e})
+	defer s.Stop()
+	m := new(dns.Msg)
+	m.SetQuestion("large.example.com.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || !r.Truncated {
+		t.Errorf("expected the truncated response, got %v", r)
+	}
+	want := []Upstream{{"192.0.2.1:53", "udp"}, {"192.0.2.1:53", "tcp"}}
+	if sent := e.sent(); len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Errorf("expected the query to be sent to %v, got %v", want, sent)
+	}
+}
+
+func TestUpstreamSourceIP(t *testing.T) {
+	// Any 127/8 address is local on Linux, but not on every system
+	if pc, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 is not a local address: %s", err)
+	} else {
+		pc.Close()
+	}
+
+	var mu sync.Mutex
+	var sources []string
+	addr, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		mu.Lock()
+		sources = append(sources, host)
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	// A socket per query and pooled sockets, over UDP and TCP
+	for _, poolSize := range []int{0, 1} {
+		s := startTestServer(t, &Config{Nameservers: []string{addr}, UpstreamSourceIP: net.ParseIP("127.0.0.2"), UpstreamPoolSize: poolSize})
+		for _, network := range []string{"udp", "tcp"} {
+			m := new(dns.Msg)
+			m.SetQuestion(network+".example.com.", dns.TypeA)
+			r, _, err := (&dns.Client{Net: network}).Exchange(m, s.conf().DnsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+				t.Errorf("pool size %d, %s: expected the upstream answer, got %v", poolSize, network, r)
+			}
+		}
+		s.Stop()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sources) != 4 {
+		t.Fatalf("expected 4 queries upstream, got %v", sources)
+	}
+	for _, source := range sources {
+		if source != "127.0.0.2" {
+			t.Errorf("expected the queries to be sent from 127.0.0.2, got %v", sources)
+			break
+		}
+	}
+}
+
+func TestUpstreamSourceIPVersion(t *testing.T) {
+	_, err := NewConfig(WithNameservers("8.8.8.8:53", "[2001:4860:4860::8888]:53"), WithUpstreamSourceIP("192.0.2.53"))
+	if err == nil || !strings.Contains(err.Error(), "[2001:4860:4860::8888]:53 of the other IP version") {
+		t.Errorf("expected an error for the IPv6 nameserver, got %v", err)
+	}
+	if _, err := NewConfig(WithNameservers("8.8.8.8:53"), WithUpstreamSourceIP("bogus")); err == nil {
+		t.Error("expected an error for a bad address")
+	}
+}
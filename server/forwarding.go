@@ -6,266 +6,416 @@
 package server
 
 import (
+	"context"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/stats"
 )
 
 // ServeDNSForward resolves a query by forwarding to a recursive nameserver
 func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	config := s.confFor(w)
 	name := req.Question[0].Name
 	nameDots := dns.CountLabel(name)-1
-	refuse := false
+	appendDomain := config.AppendDomain && !config.ForwardersOnly
+	qlog := logFor(w)
 
-	switch {
-	case s.config.NoRec:
-		log.Debugf("Refused query '%s', recursion disabled", name)
-		refuse = true
-	case len(s.config.Nameservers) == 0:
-		log.Debugf("Refused query '%s', no nameservers configured", name)
-		refuse = true
-	case nameDots < s.config.FwdNdots && !s.config.AppendDomain:
-		log.Debugf("Refused query '%s', name too short", name)
-		refuse = true
-	}
-
-	if refuse {
+	if reason := refuseReason(config, name); reason != "" {
+		qlog.Debugf("Refused query, %s", reason)
+		setSource(w, SourceLocal)
 		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeRefused)
+		m.RecursionAvailable = !config.NoRec
 		w.WriteMsg(m)
 		return m
 	}
 
-	StatsForwardCount.Inc(1)
-
-	var didAbsolute bool
-	var didSearch bool
-	var res1, res2 *dns.Msg
-	var err1, err2 error
-
-	tcp := isTCP(w)
+	stats.Inc(stats.Forwarded)
 
-	// If there are enough dots in the name, let's first give it a
-	// try as absolute name
-	if nameDots >= s.config.Ndots {
-		if nameDots >= s.config.FwdNdots {
-			log.Debugf("Doing initial absolute query for qname '%s'", name)
-			res1, err1 = s.forwardQuery(req, tcp)
-			if err1 != nil {
-				log.Errorf("Error forwarding absolute query for qname '%s': %q", name, err1)
-			}
-
-			if err1 == nil && res1.Rcode == dns.RcodeSuccess {
-				log.Debugf("Sent reply: qname '%s', rcode %s",
-					name, dns.RcodeToString[res1.Rcode])
-				res1.Compress = true
-				res1.Id = req.Id
-				w.WriteMsg(res1)
-				return res1
-			}
-			didAbsolute = true
-		} else {
-			log.Debugf("Not forwarding initial query, name too short: '%s'", name)
-		}
+	// Like the glibc resolver, names with at least 'ndots' dots are
+	// queried as-is before they are qualified with the search domains,
+	// other names after. Names below 'append-ndots' are qualified with
+	// the search domains first.
+	q := req.Question[0]
+	steps := []string{"absolute", "search"}
+	if appendDomain && (nameDots < config.Ndots || nameDots < config.appendNdots()) {
+		steps = []string{"search", "absolute"}
 	}
 
-	// We do at least one level of search if AppendDomain is set
-	// and forwarding did not previously fail
-	if err1 == nil && s.config.AppendDomain {
-		log.Debugf("Doing search query for qname '%s'", name)
-		res2, err2 = s.forwardSearch(req, tcp)
-		if err2 != nil {
-			log.Errorf("Error forwarding search query for qname '%s': %q", name, err2)
+	// The response of the absolute query, or of the last search query
+	var absolute, last *dns.Msg
+	for _, step := range steps {
+		var r *dns.Msg
+		var err error
+		switch {
+		case step == "search" && !appendDomain:
+			continue
+		case step == "search":
+			qlog.Debug("Doing search query")
+			r, err = s.forwardSearch(w, req, q)
+		case nameDots < config.FwdNdots:
+			qlog.Debug("Not forwarding query as-is, name too short")
+			continue
+		default:
+			qlog.Debug("Doing absolute query")
+			r, err = s.forwardQuery(w, req)
 		}
-
-		if err2 == nil && res2.Rcode == dns.RcodeSuccess {
-			log.Debugf("Sent reply: qname '%s', rcode %s",
-				name, dns.RcodeToString[res2.Rcode])
-			res2.Compress = true
-			res2.Id = req.Id
-			w.WriteMsg(res2)
-			return res2
+		if err != nil {
+			// Forwarding failed, give up. The name may exist, so an
+			// NXDOMAIN answer of the other step must not be returned
+			qlog.WithError(err).Errorf("Error forwarding %s query", step)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+			return m
 		}
-		didSearch = true
-	}
-
-	// If the query has not already been tried as is then try it
-	// if there are enough dots in the name and searching did not
-	// previously fail
-	if err2 == nil && !didAbsolute {
-		if nameDots >= s.config.FwdNdots {
-			log.Debugf("Doing absolute query for qname '%s'", name)
-			res1, err1 = s.forwardQuery(req, tcp)
-			if err1 != nil {
-				log.Errorf("Error forwarding absolute query for qname '%s': %q", name, err1)
-			}
-
-			if err1 == nil && res1.Rcode == dns.RcodeSuccess {
-				log.Debugf("Sent reply: qname '%s', rcode %s",
-					name, dns.RcodeToString[res1.Rcode])
-				res1.Compress = true
-				res1.Id = req.Id
-				w.WriteMsg(res1)
-				return res1
-			}
-			didAbsolute = true
-		} else {
-			log.Debugf("Not forwarding query, name too short: `%s'", name)
+		r = s.chaseCNAME(w, req, r, false)
+		if step == "absolute" {
+			absolute = r
+		}
+		last = r
+		// Stop at the first answer that is not NXDOMAIN, including NODATA.
+		// A SERVFAIL is returned as well, the name may exist
+		if r.Rcode != dns.RcodeNameError {
+			r.Compress = true
+			r.Id = req.Id
+			w.WriteMsg(r)
+			return r
 		}
 	}
 
-	// If we got here, we didn't get a positive result for the query.
-	// If we did an initial absolute query, return that query's result.
-	// else return a no-data response with the rcode from the last search we did.
-	if didAbsolute && err1 == nil {
-		log.Debugf("Sent reply: qname '%s', rcode %s",
-					name, dns.RcodeToString[res1.Rcode])
-		res1.Compress = true
-		res1.Id = req.Id
-		w.WriteMsg(res1)
-		return res1
+	// If we got here, every name tried does not exist. If we did an
+	// absolute query, return that query's result, else return a response
+	// with the rcode from the last search we did.
+	if absolute != nil {
+		absolute.Compress = true
+		absolute.Id = req.Id
+		w.WriteMsg(absolute)
+		return absolute
 	}
 
-	if didSearch && err2 == nil {
-		log.Debugf("Sent reply: qname '%s', rcode %s", name, dns.RcodeToString[res2.Rcode])
+	if last != nil {
 		m := new(dns.Msg)
-		m.SetRcode(req, res2.Rcode)
+		m.SetRcode(req, last.Rcode)
 		w.WriteMsg(m)
 		return m
 	}
 
-	// If we got here, we encountered an error while forwarding (which we already logged)
-	log.Debugf("Sent reply: qname '%s', rcode SRVFAIL", name)
+	// If we got here, no name was tried
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeServerFailure)
 	w.WriteMsg(m)
 	return m
 }
 
-// forwardSearch resolves a query by suffixing with search paths
-func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+// appendNdots returns how many dots a name must have to be queried as-is
+// before it is qualified with the search domains.
+func (c *Config) appendNdots() int {
+	if c.AppendNdots > 0 {
+		return c.AppendNdots
+	}
+	return c.Ndots
+}
+
+// forwardSearch resolves the query for q, the question of req before it
+// was forwarded, by suffixing its name with each of the search domains in
+// turn. Like the glibc resolver, it stops at the first answer that is not
+// NXDOMAIN, including NODATA. Unlike it, it stops at SERVFAIL too: the
+// nameservers failed, and NXDOMAIN for the next name would hide that.
+// Search domains the name already ends with are skipped.
+func (s *server) forwardSearch(w dns.ResponseWriter, req *dns.Msg, q dns.Question) (*dns.Msg, error) {
+	config := s.confFor(w)
 	var r *dns.Msg
-	var nodata *dns.Msg // stores the copy of a NODATA reply
 	var searchName string // stores the current name suffixed with search domain
 	var err error
-	var didSearch bool
-	name := req.Question[0].Name // original qname
-	reqCopy := req.Copy()
 
-	for _, domain := range s.config.SearchDomains {
-		if strings.HasSuffix(name, domain) {
+	// A name already ending with a search domain is not suffixed with
+	// it again, and a search domain listed twice is tried once
+	var searchNames []string
+	name := strings.ToLower(q.Name)
+	seen := make(map[string]bool)
+	for _, domain := range config.SearchDomains {
+		domain = strings.ToLower(dns.Fqdn(domain))
+		if seen[domain] || dns.IsSubDomain(domain, name) {
 			continue
 		}
+		seen[domain] = true
+		searchNames = append(searchNames, appendDomain(name, domain))
+	}
+	if len(searchNames) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Question[0] = q
+		return m, nil
+	}
 
-		searchName = strings.ToLower(appendDomain(name, domain))
-		reqCopy.Question[0] = dns.Question{searchName, reqCopy.Question[0].Qtype, reqCopy.Question[0].Qclass}
-		didSearch = true
-		r, err = s.forwardQuery(reqCopy, tcp)
+	lookup := s.forwardQuery
+	if config.ParallelLookup && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		lookup = s.lookupParallel
+	}
+
+	for _, searchName = range searchNames {
+		r, err = lookup(w, searchQuery(req, searchName))
 		if err != nil {
 			// No server currently available, give up
+			return nil, err
+		}
+		if r.Rcode != dns.RcodeNameError {
 			break
 		}
+	}
 
-		switch r.Rcode {
-		case dns.RcodeSuccess:
-			// In case of NO_DATA keep searching, otherwise a wildcard entry 
-			// could keep us from finding the answer higher in the search list
-			if len(r.Answer) == 0 && !r.MsgHdr.Truncated {
-				nodata = r.Copy()
-				continue
-			}
-		case dns.RcodeNameError:
-			fallthrough
-		case dns.RcodeServerFailure:
-			// try next search element if any
-			continue
-		}
-		// anything else implies that we are done searching
-		break
+	if r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
+		cname := new(dns.CNAME)
+		cname.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 360}
+		cname.Target = searchName
+		r.Answer = append([]dns.RR{cname}, r.Answer...)
 	}
+	// Restore original question
+	r.Question[0] = q
+	return r, nil
+}
 
-	if !didSearch {
-		m := new(dns.Msg)
-		m.SetRcode(req, dns.RcodeNameError)
-		return m, nil
+// searchQuery returns a copy of req asking for name.
+func searchQuery(req *dns.Msg, name string) *dns.Msg {
+	m := req.Copy()
+	m.Question[0].Name = name
+	return m
+}
+
+// lookupParallel forwards the A or AAAA query req for a search name, for
+// 'parallel-lookup'. The A and AAAA queries for the name are sent at once
+// and the first response that settles the search step is returned: the
+// response for the type asked for, or NXDOMAIN for the other type, as a
+// name that does not exist has no records of any type. The other query is
+// then cancelled. Both must complete within ReadTimeout.
+func (s *server) lookupParallel(w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, error) {
+	config := s.confFor(w)
+	ctx, cancel := context.WithTimeout(queryContext(w), config.ReadTimeout)
+	defer cancel()
+	type result struct {
+		qtype uint16
+		w     dns.ResponseWriter
+		r     *dns.Msg
+		err   error
 	}
 
-	if err == nil {
-		if r.Rcode == dns.RcodeSuccess {
-			if len(r.Answer) > 0 {
-				cname := new(dns.CNAME)
-				cname.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 360}
-				cname.Target = searchName
-				answers := []dns.RR{cname}
-				for _, rr := range r.Answer {
-					answers = append(answers, rr)
-				}
-				r.Answer = answers
-			}
-		// If we ever got a NODATA return this instead of a negative result
-		} else if nodata != nil {
-			r = nodata
+	// Buffered so that the other query never blocks once we returned
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := req.Copy()
+		m.Question[0].Qtype = qtype
+		go func(qtype uint16, fw dns.ResponseWriter, m *dns.Msg) {
+			r, err := s.forwardQuery(fw, m)
+			results <- result{qtype, fw, r, err}
+		}(qtype, withQueryContext(forkWriter(w), ctx), m)
+	}
+
+	for i := 0; i < 2; i++ {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if res.qtype == req.Question[0].Qtype {
+			joinWriter(w, res.w)
+			return res.r, res.err
+		}
+		if res.err == nil && res.r.Rcode == dns.RcodeNameError {
+			joinWriter(w, res.w)
+			r := res.r.Copy()
+			r.Question[0].Qtype = req.Question[0].Qtype
+			return r, nil
 		}
-		// Restore original question
-		r.Question[0] = req.Question[0]
 	}
+	// Not reached, the query for the type asked for returns above
+	return nil, ctx.Err()
+}
 
-	if err != nil && nodata != nil {
-		r = nodata
-		r.Question[0] = req.Question[0]
-		err = nil
+// refuseReason returns why a query for name is refused instead of being
+// forwarded, or "" if it is forwarded.
+func refuseReason(config *Config, name string) string {
+	nameDots := dns.CountLabel(name) - 1
+	appendDomain := config.AppendDomain && !config.ForwardersOnly
+	switch {
+	case config.NoRec:
+		return "recursion disabled"
+	case len(config.Nameservers) == 0:
+		return "no nameservers configured"
+	case nameDots < config.FwdNdots && !appendDomain:
+		return "name too short"
 	}
+	return ""
+}
 
-	return r, err
+// route returns the name a query for name is forwarded for, with the
+// longest alias it ends with replaced by its target, and the longest stub
+// zone the target falls into, if any. Neither applies with ForwardersOnly.
+func route(config *Config, name string) (target, zone string, stub *StubZone) {
+	target = name
+	if config.ForwardersOnly {
+		return target, "", nil
+	}
+	alias := ""
+	for a := range *config.Alias {
+		if strings.HasSuffix(name, a) && len(a) > len(alias) {
+			alias = a
+		}
+	}
+	if alias != "" {
+		target = name[:len(name)-len(alias)] + (*config.Alias)[alias]
+	}
+	for z, s := range *config.Stub {
+		if strings.HasSuffix(target, z) && len(z) > len(zone) {
+			zone, stub = z, s
+		}
+	}
+	return target, zone, stub
 }
 
-// forwardQuery sends the query to nameservers retrying once on error
-func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+// forwardQuery sends the query to the nameservers, retrying with the next
+// one up to UpstreamRetries times on error, timeout or SERVFAIL. The last
+// error or SERVFAIL response is returned if all attempts fail.
+func (s *server) forwardQuery(w dns.ResponseWriter, req *dns.Msg) (r *dns.Msg, err error) {
+	config := s.confFor(w)
 	var nservers []string // Nameservers to use for this query
 	var nsIdx int
-	var r *dns.Msg
-	var err error
 
-	nservers = s.config.Nameservers
 	origin := req.Question[0].Name
+	tcp := isTCP(w) || config.TcpOnly
+	qlog := logFor(w)
+	setSource(w, SourceForward)
+
+	// Neither cache nor return responses with a CNAME loop
+	defer func() {
+		if r == nil || err != nil {
+			return
+		}
+		if verr := validateCNAMEChain(r); verr != nil {
+			qlog.Warnf("Discarding upstream response: %s", verr)
+			r, err = nil, verr
+		}
+	}()
 
-	// check to see if we have an alias and modify it for the target
-	for alias, target := range *s.config.Alias {
-		log.Debugf("Looking for %s against alias: %s", req.Question[0].Name, alias)
-		if strings.HasSuffix(req.Question[0].Name, alias) {
-			log.Debugf("Query - Alias: %s has  match for %s", req.Question[0].Name, target)
-			req.Question[0].Name = strings.Replace(req.Question[0].Name, alias, target, 1)
-			log.Debugf("Query - Alias: final %s", req)
-			break
+	target, stubName, stub := route(config, req.Question[0].Name)
+	if target != req.Question[0].Name {
+		qlog.WithFields(log.Fields{"name": req.Question[0].Name, "target": target}).Debug("Query matches alias")
+		req.Question[0].Name = target
+	}
+	if stub != nil {
+		nservers = stub.servers()
+		qlog.WithFields(log.Fields{"zone": stubName, "servers": nservers}).Debug("Query matches stub zone")
+		stats.StubForwardCount.Inc(1)
+		stats.StubZoneCount.With(stubName).Inc(1)
+		setSource(w, SourceStub)
+	} else {
+		nservers = s.upstreams.order(config)
+	}
+
+	if len(config.TTLRewrites) > 0 {
+		defer func() {
+			if r != nil {
+				rewriteTTLs(config.TTLRewrites, r)
+			}
+		}()
+	}
+
+	if len(config.IPRewrites) > 0 {
+		defer func() {
+			if r != nil {
+				rewriteIPs(config.IPRewrites, r)
+			}
+		}()
+	}
+
+	// Deferred after the IP rewrites so that the rules see the addresses
+	// of the upstream
+	if len(config.ResponseRewrites) > 0 {
+		defer func() {
+			if r != nil {
+				rewriteResponse(config.ResponseRewrites, r)
+			}
+		}()
+	}
+
+	// Deferred last so that it judges what the upstream returned, not the
+	// rewritten addresses
+	if config.StopRebind {
+		defer func() {
+			if r != nil {
+				suppressRebind(w, config, origin, r)
+			}
+		}()
+	}
+
+	if config.EdnsBufferSize > 0 {
+		// Don't modify the client's message
+		req = req.Copy()
+		if setEdnsBufferSize(req, uint16(config.EdnsBufferSize)) {
+			// The client did not ask for EDNS0, don't return it the upstream's OPT record
+			defer func() {
+				if r != nil {
+					stripOPT(r)
+				}
+			}()
 		}
 	}
 
-	// Check whether the name matches a stub zone
-	for zone, srv := range *s.config.Stub {
-		log.Debugf("Looking for stub: %s against zone: %s", req.Question[0].Name, zone)
-		if strings.HasSuffix(req.Question[0].Name, zone) {
-			log.Debugf("Has suffix for zone:%s, servers: %s", req.Question[0].Name, srv)
-			nservers = srv
-			StatsStubForwardCount.Inc(1)
-			break
+	req = withoutQueryInfo(req)
+
+	// Stub zones keep their own nameservers and are not held to the quorum
+	if config.MinAnswers > 0 && stub == nil {
+		r, err = s.forwardParallel(w, req, nservers)
+		if r != nil {
+			r.Question[0].Name = origin
 		}
+		return r, err
 	}
 
-	for try := 1; try <= 2; try++ {
-		log.Debugf("Sending query: ns '%s', qname '%s'",
-			nservers[nsIdx], req.Question[0].Name)
+	ctx := queryContext(w)
+	for try := 0; try <= config.UpstreamRetries; try++ {
+		nslog := qlog.WithFields(log.Fields{"ns": nservers[nsIdx], "name": req.Question[0].Name})
+		nslog.Debug("Sending query")
 
-		switch tcp {
-		case false:
-			r, _, err = s.dnsUDPclient.Exchange(req, nservers[nsIdx])
-		case true:
-			r, _, err = s.dnsTCPclient.Exchange(req, nservers[nsIdx])
+		r, err = nil, s.checkLoop(nservers[nsIdx])
+		if err != nil {
+			nslog.Warn(err)
+		} else {
+			qtime := time.Now()
+			stats.UpstreamSockets.Inc(1)
+			r, err = s.exchange(ctx, req, nservers[nsIdx], tcp)
+			stats.UpstreamSockets.Inc(-1)
+			if ctx.Err() != nil {
+				// The answer is no longer wanted, see lookupParallel
+				return nil, ctx.Err()
+			}
+			if stub == nil && config.UpstreamStrategy == StrategyFastest {
+				rtt := time.Since(qtime)
+				if err != nil {
+					// Count a failure as a timeout
+					rtt = config.ReadTimeout
+				}
+				s.upstreams.observe(nservers[nsIdx], rtt, config.UpstreamRTTWindow)
+			}
+			s.tapResolver(req, r, nservers[nsIdx], tcp, qtime)
+			s.traceExchange(w, nservers[nsIdx], r, qtime, err)
+			addExchange(w, nservers[nsIdx], time.Since(qtime), err)
+			stats.UpstreamCount.With(nservers[nsIdx]).Inc(1)
 		}
 
 		if err == nil {
-			log.Debugf("Got reply: ns '%s', qname '%s', rcode %s",
-				nservers[nsIdx],req.Question[0].Name, dns.RcodeToString[r.Rcode])
+			if stub != nil {
+				stub.markUp(nservers[nsIdx])
+			} else {
+				s.health.upstreamSuccess()
+			}
+			setUpstream(w, nservers[nsIdx])
+			nslog.WithField("rcode", dns.RcodeToString[r.Rcode]).Debug("Got reply")
 			switch r.Rcode {
 			// SUCCESS
 			case dns.RcodeSuccess:
@@ -286,8 +436,12 @@ func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 		}
 
 		if err != nil {
-			log.Debugf("Query failed: ns '%s', qname '%s', error: %s",
-				nservers[nsIdx], req.Question[0].Name, err.Error())
+			stats.UpstreamErrorCount.With(nservers[nsIdx]).Inc(1)
+			if stub != nil {
+				stub.markDown(nservers[nsIdx])
+				stats.StubZoneErrorCount.With(stubName).Inc(1)
+			}
+			nslog.WithError(err).Debug("Query failed")
 		}
 
 		// Continue with next available server
@@ -301,21 +455,113 @@ func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
-// ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
-// locally the request is forwarded to the forwarder for resolution.
-func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
-	m := new(dns.Msg)
-	m.SetReply(req)
-	m.Compress = true
-	m.Authoritative = false
-	m.RecursionAvailable = true
-	if records, err := s.PTRRecords(req.Question[0]); err == nil && len(records) > 0 {
-		m.Answer = records
-		if err := w.WriteMsg(m); err != nil {
-			log.Errorf("Failed to send reply: %q", err)
+// forwardParallel sends the query to all nameservers at once and waits for
+// at least MinAnswers of them to reply. If fewer reply within ReadTimeout
+// a SERVFAIL response is returned, even if some of the nameservers answered.
+// The queries still in flight are cancelled once it returns.
+func (s *server) forwardParallel(w dns.ResponseWriter, req *dns.Msg, nservers []string) (*dns.Msg, error) {
+	config := s.confFor(w)
+	ctx, cancel := context.WithCancel(queryContext(w))
+	defer cancel()
+	type result struct {
+		ns  string
+		r   *dns.Msg
+		rtt time.Duration
+		err error
+	}
+
+	tcp := isTCP(w) || config.TcpOnly
+
+	// Buffered so that stragglers never block after we stopped listening
+	results := make(chan result, len(nservers))
+	for _, ns := range nservers {
+		go func(ns string, m *dns.Msg) {
+			if err := s.checkLoop(ns); err != nil {
+				logFor(w).Warn(err)
+				results <- result{ns, nil, 0, err}
+				return
+			}
+			qtime := time.Now()
+			stats.UpstreamSockets.Inc(1)
+			r, err := s.exchange(ctx, m, ns, tcp)
+			stats.UpstreamSockets.Inc(-1)
+			s.tapResolver(m, r, ns, tcp, qtime)
+			s.traceExchange(w, ns, r, qtime, err)
+			stats.UpstreamCount.With(ns).Inc(1)
+			if err != nil {
+				stats.UpstreamErrorCount.With(ns).Inc(1)
+			} else {
+				s.health.upstreamSuccess()
+			}
+			results <- result{ns, r, time.Since(qtime), err}
+		}(ns, req.Copy())
+	}
+
+	var answer *dns.Msg
+	var lastErr error
+	answers := 0
+	timeout := time.After(config.ReadTimeout)
+
+collect:
+	for i := 0; i < len(nservers); i++ {
+		select {
+		case res := <-results:
+			addExchange(w, res.ns, res.rtt, res.err)
+			if res.err != nil {
+				logFor(w).WithField("ns", res.ns).WithError(res.err).Debug("Query failed")
+				lastErr = res.err
+				continue
+			}
+			if res.r.Rcode == dns.RcodeServerFailure {
+				logFor(w).WithField("ns", res.ns).Debug("Got SERVFAIL")
+				continue
+			}
+			answers++
+			if answer == nil {
+				answer = res.r
+				setUpstream(w, res.ns)
+			}
+			if answers >= config.MinAnswers {
+				break collect
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+	cancel()
+
+	if answers < config.MinAnswers {
+		logFor(w).WithFields(log.Fields{"answers": answers, "nameservers": len(nservers)}).Warnf(
+			"Not enough nameservers answered the query (min-answers %d)", config.MinAnswers)
+		if answers == 0 && lastErr != nil {
+			return nil, lastErr
+		}
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		return m, nil
+	}
+
+	return answer, nil
+}
+
+// setEdnsBufferSize announces size as the UDP payload size in the OPT record
+// of m, adding an OPT record if m has none. It returns true if a record was added.
+func setEdnsBufferSize(m *dns.Msg, size uint16) bool {
+	if o := m.IsEdns0(); o != nil {
+		o.SetUDPSize(size)
+		return false
+	}
+	m.SetEdns0(size, false)
+	return true
+}
+
+// stripOPT removes the OPT record from the additional section of m.
+func stripOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
 		}
-		return m
 	}
-	// Always forward if not found locally.
-	return s.ServeDNSForward(w, req)
+	m.Extra = extra
 }
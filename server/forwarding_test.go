@@ -0,0 +1,421 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+func TestSetEdnsBufferSize(t *testing.T) {
+	for _, size := range []uint16{512, 1232, 4096} {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if !setEdnsBufferSize(m, size) {
+			t.Fatal("expected OPT record to be added")
+		}
+
+		// Check the OPT record that goes out on the wire
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire := new(dns.Msg)
+		if err := wire.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		o := wire.IsEdns0()
+		if o == nil {
+			t.Fatal("expected OPT record in packed message")
+		}
+		if o.UDPSize() != size {
+			t.Fatalf("bad UDP size, expected %d, got %d", size, o.UDPSize())
+		}
+
+		stripOPT(wire)
+		if wire.IsEdns0() != nil {
+			t.Fatal("expected OPT record to be stripped")
+		}
+	}
+
+	// An existing OPT record is rewritten, not duplicated
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	if setEdnsBufferSize(m, 512) {
+		t.Fatal("expected existing OPT record to be reused")
+	}
+	if len(m.Extra) != 1 || m.IsEdns0().UDPSize() != 512 || !m.IsEdns0().Do() {
+		t.Fatalf("bad OPT record: %v", m.Extra)
+	}
+}
+
+func TestParallelLookup(t *testing.T) {
+	// Names below found.example. have an A record, all others do not
+	// exist. A queries take longer to answer than AAAA queries.
+	const slow, fast = 300 * time.Millisecond, 50 * time.Millisecond
+	ex := &fakeExchanger{
+		answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+			q := m.Question[0]
+			switch {
+			case !dns.IsSubDomain("found.example.", q.Name):
+				return reply(m, dns.RcodeNameError), nil
+			case q.Qtype == dns.TypeA:
+				return reply(m, dns.RcodeSuccess, q.Name+" 60 IN A 10.0.0.1"), nil
+			}
+			return reply(m, dns.RcodeSuccess), nil
+		},
+		delay: func(m *dns.Msg, upstream Upstream) time.Duration {
+			if m.Question[0].Qtype == dns.TypeA {
+				return slow
+			}
+			return fast
+		},
+	}
+
+	for _, parallel := range []bool{false, true} {
+		s := startTestServer(t, &Config{
+			Nameservers:    []string{"192.0.2.1:53"},
+			Exchanger:      ex,
+			AppendDomain:   true,
+			SearchDomains:  []string{"a.example.", "found.example."},
+			ParallelLookup: parallel,
+			ReadTimeout:    2 * time.Second,
+		})
+
+		m := new(dns.Msg)
+		m.SetQuestion("host.", dns.TypeA)
+		start := time.Now()
+		r, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(m, s.conf().DnsAddr)
+		elapsed := time.Since(start)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.Answer) != 2 || r.Answer[1].Header().Name != "host.found.example." || r.Answer[1].Header().Rrtype != dns.TypeA {
+			t.Fatalf("parallel %v: expected the A record of host.found.example., got %v", parallel, r.Answer)
+		}
+		// Sequential, both search names wait for the slow A query. In
+		// parallel, the fast AAAA query already tells host.a.example.
+		// does not exist.
+		if parallel && elapsed >= 2*slow {
+			t.Errorf("expected parallel lookup to take less than %s, took %s", 2*slow, elapsed)
+		}
+		if !parallel && elapsed < 2*slow {
+			t.Errorf("expected sequential lookup to take at least %s, took %s", 2*slow, elapsed)
+		}
+	}
+
+	// The A query for host.a.example. is cancelled
+	for i := 0; i < 50 && ex.cancelledCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ex.cancelledCount(); n != 1 {
+		t.Errorf("expected 1 query to be cancelled, got %d", n)
+	}
+}
+
+func TestAppendNdots(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		names = append(names, req.Question[0].Name)
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	for _, tc := range []struct {
+		appendNdots int
+		want        string
+	}{
+		{0, "service.staging."},
+		{1, "service.staging."},
+		{2, "service.staging.internal.example."},
+	} {
+		mu.Lock()
+		names = nil
+		mu.Unlock()
+		s := startTestServer(t, &Config{
+			Nameservers:   []string{pc.LocalAddr().String()},
+			AppendDomain:  true,
+			SearchDomains: []string{"internal.example."},
+			AppendNdots:   tc.appendNdots,
+		})
+		m := new(dns.Msg)
+		m.SetQuestion("service.staging.", dns.TypeA)
+		_, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(m, s.conf().DnsAddr)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if len(names) != 1 || names[0] != tc.want {
+			t.Errorf("append-ndots %d: expected only %s to be queried, got %v", tc.appendNdots, tc.want, names)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	ex := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		name := m.Question[0].Name
+		mu.Lock()
+		names = append(names, name)
+		mu.Unlock()
+		switch name {
+		case "host.corp.example.", "nodata.corp.example.", "www.example.com.", "web.default.svc.cluster.local.":
+			return reply(m, dns.RcodeSuccess, name+" 60 IN A 10.0.0.1"), nil
+		case "nodata.example.com.":
+			return reply(m, dns.RcodeSuccess), nil
+		}
+		return reply(m, dns.RcodeNameError), nil
+	}}
+	search := []string{"example.com.", "corp.example."}
+	kubernetes := []string{"default.svc.cluster.local.", "svc.cluster.local.", "cluster.local."}
+
+	for _, tc := range []struct {
+		ndots   int
+		search  []string
+		name    string
+		rcode   int
+		answers bool
+		sent    []string
+	}{
+		// Fewer dots than ndots: the search list first, the name as-is last
+		{1, search, "host.", dns.RcodeSuccess, true, []string{"host.example.com.", "host.corp.example."}},
+		{1, search, "missing.", dns.RcodeNameError, false, []string{"missing.example.com.", "missing.corp.example.", "missing."}},
+		// At least ndots dots: the name as-is first
+		{1, search, "www.example.com.", dns.RcodeSuccess, true, []string{"www.example.com."}},
+		{1, search, "missing.test.", dns.RcodeNameError, false, []string{"missing.test.", "missing.test.example.com.", "missing.test.corp.example."}},
+		// NODATA ends the search
+		{1, search, "nodata.", dns.RcodeSuccess, false, []string{"nodata.example.com."}},
+		// With ndots 0 every name is queried as-is first
+		{0, search, "host.", dns.RcodeSuccess, true, []string{"host.", "host.example.com.", "host.corp.example."}},
+		{0, search, "www.example.com.", dns.RcodeSuccess, true, []string{"www.example.com."}},
+		// A search domain listed twice is tried once
+		{1, append([]string{"example.com."}, search...), "missing.", dns.RcodeNameError, false, []string{"missing.example.com.", "missing.corp.example.", "missing."}},
+		// Kubernetes, the search domains a name already ends with are
+		// not appended to it
+		{5, kubernetes, "web.", dns.RcodeSuccess, true, []string{"web.default.svc.cluster.local."}},
+		{5, kubernetes, "web.default.", dns.RcodeSuccess, true, []string{"web.default.default.svc.cluster.local.", "web.default.svc.cluster.local."}},
+		{5, kubernetes, "web.default.svc.cluster.local.", dns.RcodeSuccess, true, []string{"web.default.svc.cluster.local."}},
+		{5, kubernetes, "Web.Default.SVC.cluster.local.", dns.RcodeNameError, false, []string{"Web.Default.SVC.cluster.local."}},
+		{5, kubernetes, "web.other.svc.cluster.local.", dns.RcodeNameError, false, []string{
+			"web.other.svc.cluster.local.default.svc.cluster.local.",
+			"web.other.svc.cluster.local.",
+		}},
+		{5, kubernetes, "www.example.com.", dns.RcodeSuccess, true, []string{
+			"www.example.com.default.svc.cluster.local.",
+			"www.example.com.svc.cluster.local.",
+			"www.example.com.cluster.local.",
+			"www.example.com.",
+		}},
+	} {
+		s := startTestServer(t, &Config{
+			Nameservers:   []string{"192.0.2.1:53"},
+			Exchanger:     ex,
+			AppendDomain:  true,
+			SearchDomains: tc.search,
+		})
+		// startTestServer defaults ndots 0 to 1
+		config := *s.conf()
+		config.Ndots = tc.ndots
+		s.config.Store(&config)
+
+		mu.Lock()
+		names = nil
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		r, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(m, s.conf().DnsAddr)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode || (len(r.Answer) > 0) != tc.answers {
+			t.Errorf("ndots %d %s: expected %s with answers %v, got %s with %v", tc.ndots, tc.name,
+				dns.RcodeToString[tc.rcode], tc.answers, dns.RcodeToString[r.Rcode], r.Answer)
+		}
+		if len(r.Question) != 1 || r.Question[0].Name != tc.name {
+			t.Errorf("ndots %d %s: expected the original question, got %v", tc.ndots, tc.name, r.Question)
+		}
+		mu.Lock()
+		if fmt.Sprint(names) != fmt.Sprint(tc.sent) {
+			t.Errorf("ndots %d %s: expected the queries %v, got %v", tc.ndots, tc.name, tc.sent, names)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	const ns1, ns2, ns3 = "192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"
+	var mu sync.Mutex
+	var names []string
+	ex := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		name := m.Question[0].Name
+		mu.Lock()
+		names = append(names, name)
+		mu.Unlock()
+		switch {
+		case name == "down.example.com.", name == "app.test.example.com.":
+			return nil, errTimeout
+		case name == "flaky.example.com." && upstream.Addr != ns3:
+			return nil, errTimeout
+		case name == "sf.example.com.":
+			return reply(m, dns.RcodeServerFailure), nil
+		case name == "flaky.example.com.", name == "sf.corp.example.":
+			return reply(m, dns.RcodeSuccess, name+" 60 IN A 10.0.0.1"), nil
+		}
+		return reply(m, dns.RcodeNameError), nil
+	}}
+
+	for _, tc := range []struct {
+		retries int
+		name    string
+		rcode   int
+		sent    []string
+	}{
+		// SERVFAIL is retried, then ends the search
+		{1, "sf.", dns.RcodeServerFailure, []string{"sf.example.com.", "sf.example.com."}},
+		// A timeout is never turned into the NXDOMAIN of another name
+		{1, "app.test.", dns.RcodeServerFailure, []string{"app.test.", "app.test.example.com.", "app.test.example.com."}},
+		{0, "down.", dns.RcodeServerFailure, []string{"down.example.com."}},
+		{2, "down.", dns.RcodeServerFailure, []string{"down.example.com.", "down.example.com.", "down.example.com."}},
+		// Only the third nameserver answers
+		{1, "flaky.", dns.RcodeServerFailure, []string{"flaky.example.com.", "flaky.example.com."}},
+		{2, "flaky.", dns.RcodeSuccess, []string{"flaky.example.com.", "flaky.example.com.", "flaky.example.com."}},
+	} {
+		s := startTestServer(t, &Config{
+			Nameservers:   []string{ns1, ns2, ns3},
+			Exchanger:     ex,
+			AppendDomain:  true,
+			SearchDomains: []string{"example.com.", "corp.example."},
+		})
+		// startTestServer defaults 0 retries to 1
+		config := *s.conf()
+		config.UpstreamRetries = tc.retries
+		s.config.Store(&config)
+
+		mu.Lock()
+		names = nil
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		r, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(m, s.conf().DnsAddr)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode {
+			t.Errorf("retries %d %s: expected %s, got %s", tc.retries, tc.name, dns.RcodeToString[tc.rcode], dns.RcodeToString[r.Rcode])
+		}
+		mu.Lock()
+		if fmt.Sprint(names) != fmt.Sprint(tc.sent) {
+			t.Errorf("retries %d %s: expected the queries %v, got %v", tc.retries, tc.name, tc.sent, names)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestMinAnswers(t *testing.T) {
+	const ns1, ns2, ns3 = "192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		desc string
+		// How each nameserver behaves: "slow", "servfail" or "error"
+		upstreams map[string]string
+		rcode     int
+		cancelled int
+	}{
+		// The slow nameserver is not waited for
+		{"quorum met", map[string]string{ns3: "slow"}, dns.RcodeSuccess, 1},
+		// SERVFAIL and errors do not count as answers
+		{"quorum missed", map[string]string{ns2: "servfail", ns3: "error"}, dns.RcodeServerFailure, 0},
+		// Only one nameserver answers within the read timeout
+		{"read timeout", map[string]string{ns2: "slow", ns3: "slow"}, dns.RcodeServerFailure, 2},
+	} {
+		behaviour := tc.upstreams
+		ex := &fakeExchanger{
+			answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+				switch behaviour[upstream.Addr] {
+				case "servfail":
+					return reply(m, dns.RcodeServerFailure), nil
+				case "error":
+					return nil, errTimeout
+				}
+				return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.1"), nil
+			},
+			delay: func(m *dns.Msg, upstream Upstream) time.Duration {
+				if behaviour[upstream.Addr] == "slow" {
+					return 10 * time.Second
+				}
+				return 0
+			},
+		}
+		s := startTestServer(t, &Config{
+			Nameservers: []string{ns1, ns2, ns3},
+			Exchanger:   ex,
+			MinAnswers:  2,
+			ReadTimeout: 200 * time.Millisecond,
+		})
+		out := new(syncBuffer)
+		log.SetOutput(out)
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		start := time.Now()
+		r, _, err := (&dns.Client{Timeout: 5 * time.Second}).Exchange(m, s.conf().DnsAddr)
+		elapsed := time.Since(start)
+		if err != nil {
+			s.Stop()
+			t.Fatalf("%s: %s", tc.desc, err)
+		}
+		if r.Rcode != tc.rcode {
+			t.Errorf("%s: expected %s, got %s", tc.desc, dns.RcodeToString[tc.rcode], dns.RcodeToString[r.Rcode])
+		}
+		if elapsed > 2*time.Second {
+			t.Errorf("%s: expected a response within the read timeout, took %s", tc.desc, elapsed)
+		}
+		if len(ex.sent()) != 3 {
+			t.Errorf("%s: expected the query to be sent to all 3 nameservers, got %v", tc.desc, ex.sent())
+		}
+		warned := strings.Contains(out.String(), "Not enough nameservers answered the query")
+		if warned != (tc.rcode == dns.RcodeServerFailure) {
+			t.Errorf("%s: expected a warning %v, got log %q", tc.desc, !warned, out.String())
+		}
+
+		// The queries still in flight are cancelled
+		for i := 0; i < 50 && ex.cancelledCount() < tc.cancelled; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := ex.cancelledCount(); n != tc.cancelled {
+			t.Errorf("%s: expected %d queries to be cancelled, got %d", tc.desc, tc.cancelled, n)
+		}
+		s.Stop()
+	}
+}
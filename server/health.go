@@ -0,0 +1,171 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// healthProbeInterval is how often the upstream nameservers are probed
+	// when no forwarded query succeeded in the meantime.
+	healthProbeInterval = 10 * time.Second
+	// healthUpstreamMaxAge is how long an upstream success keeps the
+	// server ready.
+	healthUpstreamMaxAge = 3 * healthProbeInterval
+	// healthDrainDelay is how long queries are still answered after
+	// readiness started failing on shutdown.
+	healthDrainDelay = 5 * time.Second
+)
+
+// HealthCheckName is always answered locally, with 127.0.0.1 and ::1, so
+// that probes do not depend on the hostsfile or the upstream nameservers.
+const HealthCheckName = "health.localhost."
+
+// healthCheckRecords returns the answer to q for HealthCheckName.
+func healthCheckRecords(q dns.Question) (records []dns.RR) {
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 0}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeA
+		records = append(records, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeAAAA
+		records = append(records, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+	}
+	return records
+}
+
+// health tracks the state reported by the health endpoints. All fields are
+// updated atomically so that the handlers never block on the query path.
+type health struct {
+	listening       int32
+	stopping        int32
+	resolvConfReady int32
+	lastUpstream    int64 // unix nanoseconds
+}
+
+func (h *health) setListening() {
+	atomic.StoreInt32(&h.listening, 1)
+}
+
+// setStopping marks the server as shutting down. It returns false if it
+// was already marked.
+func (h *health) setStopping() bool {
+	return atomic.CompareAndSwapInt32(&h.stopping, 0, 1)
+}
+
+func (h *health) upstreamSuccess() {
+	atomic.StoreInt64(&h.lastUpstream, time.Now().UnixNano())
+}
+
+func (h *health) upstreamAge() time.Duration {
+	last := atomic.LoadInt64(&h.lastUpstream)
+	if last == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// SetResolvConfReady records that go-dnsmasq was registered as the
+// default nameserver of the host.
+func (s *server) SetResolvConfReady() {
+	atomic.StoreInt32(&s.health.resolvConfReady, 1)
+}
+
+// startHealth starts the HTTP server answering /healthz and /readyz.
+func (s *server) startHealth() error {
+	l, err := net.Listen("tcp", s.conf().HealthListen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	s.healthServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.healthServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Health endpoint failed: %s", err)
+		}
+	}()
+	if !s.conf().NoRec {
+		go s.probeUpstream()
+	}
+	log.Infof("Serving health checks on http://%s", s.conf().HealthListen)
+	return nil
+}
+
+// serveHealthz reports whether the process is up and the DNS listeners
+// are bound.
+func (s *server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.health.listening) == 0 {
+		http.Error(w, "listeners not bound", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz reports whether the server should receive queries.
+func (s *server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if problems := s.notReady(); len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *server) notReady() (problems []string) {
+	if atomic.LoadInt32(&s.health.stopping) == 1 {
+		return []string{"shutting down"}
+	}
+	if atomic.LoadInt32(&s.health.listening) == 0 {
+		problems = append(problems, "listeners not bound")
+	}
+	if h, ok := s.hosts.(lastErrorHostfile); ok {
+		if err := h.LastError(); err != nil {
+			problems = append(problems, fmt.Sprintf("hostsfile not loaded: %s", err))
+		}
+	}
+	if !s.conf().NoRec {
+		if age := s.health.upstreamAge(); age < 0 || age > healthUpstreamMaxAge {
+			problems = append(problems, "no recent answer from upstream nameservers")
+		}
+	}
+	if s.conf().DefaultResolver && atomic.LoadInt32(&s.health.resolvConfReady) == 0 {
+		problems = append(problems, "not registered as default nameserver")
+	}
+	return problems
+}
+
+// probeUpstream periodically queries the upstream nameservers unless a
+// forwarded query succeeded recently.
+func (s *server) probeUpstream() {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	for atomic.LoadInt32(&s.health.stopping) == 0 {
+		if age := s.health.upstreamAge(); age < 0 || age > healthProbeInterval {
+			for _, ns := range s.conf().Nameservers {
+				if _, err := s.exchange(context.Background(), m, ns, s.conf().TcpOnly); err == nil {
+					s.health.upstreamSuccess()
+					break
+				}
+				log.WithField("nameserver", ns).Debug("Health probe failed")
+			}
+		}
+		time.Sleep(healthProbeInterval)
+	}
+}
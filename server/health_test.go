@@ -0,0 +1,27 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNotReadyHostsfile(t *testing.T) {
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local\n"), &Config{NoRec: true})
+	defer s.Stop()
+	if problems := s.notReady(); len(problems) != 0 {
+		t.Errorf("expected the server to be ready, got %v", problems)
+	}
+
+	s = startHostsTestServer(t, lastErrorTestHostfile{err: errors.New("/etc/hosts:3: invalid IP address 1234.1.1.1")},
+		&Config{NoRec: true})
+	defer s.Stop()
+	want := []string{"hostsfile not loaded: /etc/hosts:3: invalid IP address 1234.1.1.1"}
+	if problems := s.notReady(); !reflect.DeepEqual(problems, want) {
+		t.Errorf("expected %v, got %v", want, problems)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// interfacePollInterval is only used if netlink is not available.
+const interfacePollInterval = 5 * time.Second
+
+// Netlink multicast groups of link and address changes, from
+// linux/rtnetlink.h. The syscall package does not define them.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// interfaceEvents returns a channel that receives a value whenever a
+// network interface or address is added, changed or removed, as reported
+// by netlink, until stop is closed.
+func interfaceEvents(stop <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// A non-blocking file uses the runtime poller, so that Close
+	// interrupts a pending Read.
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, os.Getpagesize())
+		for {
+			if _, err := f.Read(buf); err != nil {
+				select {
+				case <-stop:
+				default:
+					log.Errorf("Failed to read network interface changes: %s", err)
+				}
+				return
+			}
+			// The contents do not matter, the interfaces are listed again
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// interfacePollInterval is how often the network interfaces are listed
+// to detect changes.
+const interfacePollInterval = 5 * time.Second
+
+func interfaceEvents(stop <-chan struct{}) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("interface change notifications are only supported on Linux")
+}
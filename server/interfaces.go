@@ -0,0 +1,408 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// interfaceRetryDelay is how long to wait before binding again to
+// addresses that could not be bound, e.g. IPv6 addresses that are still
+// tentative.
+const interfaceRetryDelay = 2 * time.Second
+
+// additionalAddr returns the address of the 'additional-port' listener,
+// or an empty string if there is none.
+func (c *Config) additionalAddr() string {
+	if c.AdditionalPort == 0 {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(c.DnsAddr)
+	return net.JoinHostPort(host, strconv.Itoa(c.AdditionalPort))
+}
+
+// bindsInterfaces reports whether the server binds to the addresses of
+// network interfaces instead of the 'listen' address.
+func (c *Config) bindsInterfaces() bool {
+	return len(c.Interfaces) > 0 || len(c.ExceptInterfaces) > 0
+}
+
+// interfaceAddrs returns the addresses of the network interfaces that are
+// up, mapped to the interface name. Only the interfaces in names are
+// included, or all if names is empty, except those in except. IPv6
+// link-local addresses carry the interface as zone.
+func interfaceAddrs(names, except []string) (map[string]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]string)
+	for _, iface := range ifaces {
+		if len(names) > 0 && !containsString(names, iface.Name) || containsString(except, iface.Name) {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			log.Warnf("Failed to get addresses of interface %s: %s", iface.Name, err)
+			continue
+		}
+		for _, a := range ifaddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.String()
+			if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				ip += "%" + iface.Name
+			}
+			addrs[ip] = iface.Name
+		}
+	}
+	return addrs, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// bindInterfaces starts answering queries on the addresses of the
+// configured network interfaces. With 'bind-dynamic' the interfaces are
+// watched and listeners are added and removed as addresses come and go.
+func (s *server) bindInterfaces(mux dns.Handler) error {
+	config := s.conf()
+	if !config.BindDynamic {
+		for _, name := range config.Interfaces {
+			if _, err := net.InterfaceByName(name); err != nil {
+				return fmt.Errorf("Interface %s: %s", name, err)
+			}
+		}
+	}
+
+	addrs, err := interfaceAddrs(config.Interfaces, config.ExceptInterfaces)
+	if err != nil {
+		return fmt.Errorf("Failed to list network interfaces: %s", err)
+	}
+	if !config.BindDynamic {
+		if len(addrs) == 0 {
+			return fmt.Errorf("No addresses found on the network interfaces to listen on")
+		}
+		return s.listenInterfaces(mux, addrs)
+	}
+	err = s.updateInterfaceServers(mux, addrs)
+
+	if len(addrs) == 0 {
+		log.Infof("Waiting for addresses on the network interfaces to listen on")
+	}
+	retry := err != nil
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		s.watchInterfaces(mux, retry)
+	}()
+	return nil
+}
+
+// watchInterfaces updates the listeners whenever the network interfaces
+// change, until the server is stopped.
+func (s *server) watchInterfaces(mux dns.Handler, retry bool) {
+	events, err := interfaceEvents(s.stop)
+	if err != nil {
+		log.Warnf("Polling the network interfaces every %s: %s", interfacePollInterval, err)
+		events = pollInterfaces(s.stop)
+	}
+
+	var retryC <-chan time.Time
+	if retry {
+		retryC = time.After(interfaceRetryDelay)
+	}
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-events:
+		case <-retryC:
+		}
+		retryC = nil
+
+		config := s.conf()
+		addrs, err := interfaceAddrs(config.Interfaces, config.ExceptInterfaces)
+		if err != nil {
+			log.Warnf("Failed to list network interfaces: %s", err)
+			continue
+		}
+		if err := s.updateInterfaceServers(mux, addrs); err != nil {
+			log.Warnf("%s, retrying in %s", err, interfaceRetryDelay)
+			retryC = time.After(interfaceRetryDelay)
+		}
+	}
+}
+
+// pollInterfaces returns a channel that receives a value every
+// interfacePollInterval until stop is closed.
+func pollInterfaces(stop <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go func() {
+		t := time.NewTicker(interfacePollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// listenInterfaces starts listening on all addresses in addrs, or on none
+// of them if one cannot be bound.
+func (s *server) listenInterfaces(mux dns.Handler, addrs map[string]string) error {
+	_, port, err := net.SplitHostPort(s.conf().DnsAddr)
+	if err != nil {
+		return err
+	}
+	var ips, hostPorts []string
+	for ip := range addrs {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		hostPorts = append(hostPorts, net.JoinHostPort(ip, port))
+	}
+	servers, err := s.listenAddrs(mux, hostPorts)
+	if err != nil {
+		return err
+	}
+	for i, ip := range ips {
+		s.mu.Lock()
+		s.ifaceServers[ip] = servers[i]
+		s.mu.Unlock()
+		log.Infof("Found address %s on interface %s", ip, addrs[ip])
+		for _, srv := range servers[i] {
+			s.serve(srv, hostPorts[i], srv.Net)
+		}
+	}
+	return nil
+}
+
+// updateInterfaceServers starts listening on the addresses in addrs that
+// are not bound yet and stops listening on those that are gone. Addresses
+// that fail to bind are reported and tried again on the next update.
+func (s *server) updateInterfaceServers(mux dns.Handler, addrs map[string]string) error {
+	config := s.conf()
+	_, port, err := net.SplitHostPort(config.DnsAddr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	var gone []string
+	for ip := range s.ifaceServers {
+		if _, ok := addrs[ip]; !ok {
+			gone = append(gone, ip)
+		}
+	}
+	for _, ip := range gone {
+		for _, srv := range s.ifaceServers[ip] {
+			srv.Shutdown()
+			s.removeServer(srv)
+			log.Infof("Stopped answering queries on %s://%s, the address was removed", srv.Net, net.JoinHostPort(ip, port))
+		}
+		delete(s.ifaceServers, ip)
+	}
+	var missing []string
+	for ip := range addrs {
+		if _, ok := s.ifaceServers[ip]; !ok {
+			missing = append(missing, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Strings(missing)
+	var failed []error
+	for _, ip := range missing {
+		addr := net.JoinHostPort(ip, port)
+		servers, err := listenAddr(mux, addr, config)
+		if err != nil {
+			log.Debugf("%s (interface %s)", err, addrs[ip])
+			failed = append(failed, err)
+			continue
+		}
+		s.mu.Lock()
+		s.ifaceServers[ip] = servers
+		s.mu.Unlock()
+		log.Infof("Found address %s on interface %s", ip, addrs[ip])
+		for _, srv := range servers {
+			s.serve(srv, addr, srv.Net)
+		}
+	}
+	if len(failed) > 1 {
+		return fmt.Errorf("%w, and %d more addresses", failed[0], len(failed)-1)
+	} else if len(failed) > 0 {
+		return failed[0]
+	}
+	return nil
+}
+
+// listenAddr binds the TCP and, unless 'tcp-only' is set, the UDP socket
+// for addr. With 'reuseport' the UDP socket is bound that many times, each
+// served by its own read loop.
+func listenAddr(mux dns.Handler, addr string, config *Config) ([]*dns.Server, error) {
+	l, err := net.Listen(listenNetwork("tcp", addr), addr)
+	if err != nil {
+		return nil, &ListenError{Net: "tcp", Addr: addr, Err: err}
+	}
+	servers := []*dns.Server{newTCPServer(l, mux, config)}
+	if !config.TcpOnly {
+		conns, err := listenUDP(addr, config.reusePortSockets())
+		if err != nil {
+			l.Close()
+			return nil, &ListenError{Net: "udp", Addr: addr, Err: err}
+		}
+		for _, p := range conns {
+			servers = append(servers, newUDPServer(p, mux))
+		}
+	}
+	return servers, nil
+}
+
+// listenAddrs binds the sockets of every address in addrs before any of
+// them is served, so that either all or none are bound: the sockets bound
+// in a failed attempt are closed. The attempt is repeated up to
+// 'bind-retries' times while an address fails, or until Stop is called.
+// The failures of the last attempt are returned, as ListenErrors if more
+// than one address failed.
+func (s *server) listenAddrs(mux dns.Handler, addrs []string) ([][]*dns.Server, error) {
+	config := s.conf()
+	for attempt := 1; ; attempt++ {
+		var servers [][]*dns.Server
+		var failed ListenErrors
+		for _, addr := range addrs {
+			srvs, err := listenAddr(mux, addr, config)
+			if err != nil {
+				failed = append(failed, err)
+				continue
+			}
+			servers = append(servers, srvs)
+		}
+		if len(failed) == 0 {
+			return servers, nil
+		}
+		for _, srvs := range servers {
+			closeServers(srvs)
+		}
+
+		var err error = failed
+		if len(failed) == 1 {
+			err = failed[0]
+		}
+		if attempt > config.BindRetries {
+			return nil, err
+		}
+		log.Warnf("%s, retrying in %s (%d of %d)", err, config.BindRetryInterval, attempt, config.BindRetries)
+		select {
+		case <-s.stop:
+			return nil, err
+		case <-time.After(config.BindRetryInterval):
+		}
+	}
+}
+
+// listenNetwork returns network, "tcp" or "udp", restricted to IPv6 if
+// the host of addr is an IPv6 address. The socket of '[::]' then only
+// accepts IPv6 queries instead of IPv4 queries as well.
+func listenNetwork(network, addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return network
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return network + "6"
+	}
+	return network
+}
+
+// reusePortSockets returns the number of UDP sockets to bind per address,
+// one unless 'reuseport' is set and supported.
+func (c *Config) reusePortSockets() int {
+	if c.ReusePort < 2 || !reusePortSupported {
+		return 1
+	}
+	return c.ReusePort
+}
+
+// listenUDP binds n UDP sockets to addr, with SO_REUSEPORT if n > 1.
+func listenUDP(addr string, n int) ([]net.PacketConn, error) {
+	if n < 2 {
+		p, err := net.ListenPacket(listenNetwork("udp", addr), addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{p}, nil
+	}
+	var conns []net.PacketConn
+	for i := 0; i < n; i++ {
+		p, err := listenPacketReusePort(listenNetwork("udp", addr), addr)
+		if err != nil {
+			for _, p := range conns {
+				p.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			// The port chosen by the kernel if addr has none
+			addr = p.LocalAddr().String()
+		}
+		conns = append(conns, p)
+	}
+	return conns, nil
+}
+
+// closeServers closes the sockets of servers that were never started.
+func closeServers(servers []*dns.Server) {
+	for _, srv := range servers {
+		if srv.Listener != nil {
+			srv.Listener.Close()
+		}
+		if srv.PacketConn != nil {
+			srv.PacketConn.Close()
+		}
+	}
+}
+
+// removeServer removes srv from the servers shut down by Stop. s.mu must
+// be held.
+func (s *server) removeServer(srv *dns.Server) {
+	for i, v := range s.dnsServers {
+		if v == srv {
+			s.dnsServers = append(s.dnsServers[:i], s.dnsServers[i+1:]...)
+			return
+		}
+	}
+}
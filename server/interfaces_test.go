@@ -0,0 +1,237 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loopbackInterface returns the name of the loopback interface.
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestInterfaceAddrs(t *testing.T) {
+	lo := loopbackInterface(t)
+
+	addrs, err := interfaceAddrs([]string{lo}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs["127.0.0.1"] != lo {
+		t.Errorf("expected 127.0.0.1 on %s, got %v", lo, addrs)
+	}
+	for ip, name := range addrs {
+		if name != lo {
+			t.Errorf("expected only addresses of %s, got %s on %s", lo, ip, name)
+		}
+	}
+
+	addrs, err = interfaceAddrs(nil, []string{lo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := addrs["127.0.0.1"]; ok {
+		t.Errorf("expected %s to be excluded, got %v", lo, addrs)
+	}
+}
+
+func TestBindInterface(t *testing.T) {
+	lo := loopbackInterface(t)
+	s := startTestServer(t, &Config{NoRec: true, Interfaces: []string{lo}})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateInterfaceServers(t *testing.T) {
+	config := &Config{NoRec: true, DnsAddr: net.JoinHostPort("127.0.0.1", freePort(t)), RCacheTtl: 60, Ndots: 1}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(testHostfile{}, config, "test")
+	defer s.Stop()
+	mux := dns.NewServeMux()
+	mux.Handle(".", s)
+
+	if err := s.updateInterfaceServers(mux, map[string]string{"127.0.0.1": "lo"}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", config.DnsAddr, time.Second)
+	if err != nil {
+		t.Fatalf("expected a listener on %s: %s", config.DnsAddr, err)
+	}
+	conn.Close()
+
+	// Removing the address closes its listeners
+	if err := s.updateInterfaceServers(mux, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", config.DnsAddr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("expected the listener on %s to be closed", config.DnsAddr)
+	}
+	if len(s.ifaceServers) != 0 || len(s.dnsServers) != 0 {
+		t.Errorf("expected no servers, got %d interface addresses and %d servers", len(s.ifaceServers), len(s.dnsServers))
+	}
+}
+
+func TestBindDynamicRequiresInterfaces(t *testing.T) {
+	config := &Config{NoRec: true, DnsAddr: "127.0.0.1:53", RCacheTtl: 60, Ndots: 1, BindDynamic: true}
+	if err := CheckConfig(config); err == nil {
+		t.Error("expected bind-dynamic without interfaces to be rejected")
+	}
+	config.Interfaces = []string{"eth0"}
+	if err := CheckConfig(config); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+func TestAdditionalPort(t *testing.T) {
+	// Forwarded over the protocol of the query
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+	port, err := strconv.Atoi(freePort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}, RCache: 10, AdditionalPort: port})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("ports.example.com.", dns.TypeA)
+	var answers []string
+	for _, addr := range []string{s.conf().DnsAddr, net.JoinHostPort("127.0.0.1", strconv.Itoa(port))} {
+		for _, network := range []string{"udp", "tcp"} {
+			r, _, err := (&dns.Client{Net: network}).Exchange(m, addr)
+			if err != nil {
+				t.Fatalf("%s://%s: %s", network, addr, err)
+			}
+			if len(r.Answer) != 1 {
+				t.Fatalf("%s://%s: expected an answer, got %v", network, addr, r)
+			}
+			// The cached answer has a lower TTL
+			r.Answer[0].Header().Ttl = 0
+			answers = append(answers, r.Answer[0].String())
+		}
+	}
+	for _, a := range answers[1:] {
+		if a != answers[0] {
+			t.Errorf("expected identical answers, got %v", answers)
+			break
+		}
+	}
+}
+
+func TestListenIPv6Only(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	l.Close()
+
+	for _, reusePort := range []int{0, 2} {
+		port := freePort(t)
+		config := &Config{ReusePort: reusePort}
+		servers, err := listenAddr(dns.DefaultServeMux, net.JoinHostPort("::", port), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The IPv4 loopback address is still free on the same port
+		l, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Errorf("expected [::]:%s to accept IPv6 connections only: %s", port, err)
+		} else {
+			l.Close()
+		}
+		p, err := net.ListenPacket("udp4", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Errorf("expected [::]:%s to accept IPv6 datagrams only: %s", port, err)
+		} else {
+			p.Close()
+		}
+		closeServers(servers)
+	}
+
+	for addr, want := range map[string]string{
+		"127.0.0.1:53":         "udp",
+		"0.0.0.0:53":           "udp",
+		"[::]:53":              "udp6",
+		"[fe80::1%eth0]:53":    "udp6",
+		"[::ffff:10.0.0.1]:53": "udp",
+	} {
+		if got := listenNetwork("udp", addr); got != want {
+			t.Errorf("%s: expected %s, got %s", addr, want, got)
+		}
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	conns, err := listenUDP("127.0.0.1:0", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range conns {
+		defer p.Close()
+	}
+	if len(conns) != 3 {
+		t.Fatalf("expected 3 sockets, got %d", len(conns))
+	}
+	for _, p := range conns[1:] {
+		if p.LocalAddr().String() != conns[0].LocalAddr().String() {
+			t.Errorf("expected every socket on %s, got %s", conns[0].LocalAddr(), p.LocalAddr())
+		}
+	}
+
+	// Every read loop answers queries
+	s := startTestServer(t, &Config{NoRec: true, ReusePort: 4})
+	defer s.Stop()
+	s.mu.Lock()
+	if n := len(s.dnsServers); n != 5 {
+		t.Errorf("expected a TCP and 4 UDP servers, got %d", n)
+	}
+	s.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetQuestion(HealthCheckName, dns.TypeA)
+	for i := 0; i < 20; i++ {
+		// A new source port each time, spread over the sockets
+		r, _, err := (&dns.Client{Net: "udp", Timeout: time.Second}).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) == 0 {
+			t.Fatalf("expected an answer, got %v", r)
+		}
+	}
+}
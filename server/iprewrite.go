@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IPRewriteRule maps the addresses of upstream records in Src to the
+// address with the same host bits in Dst. Both have the same prefix length.
+type IPRewriteRule struct {
+	Src *net.IPNet
+	Dst *net.IPNet
+}
+
+// ParseIPRewriteRule parses a rule given as 'src_cidr:dst_cidr'.
+func ParseIPRewriteRule(s string) (IPRewriteRule, error) {
+	// IPv6 addresses contain ':' as well, so split after the prefix length
+	i := strings.Index(s, "/")
+	j := -1
+	if i >= 0 {
+		j = strings.Index(s[i:], ":")
+	}
+	if j < 0 {
+		return IPRewriteRule{}, fmt.Errorf("expected src_cidr:dst_cidr, got %q", s)
+	}
+	j += i
+	_, src, err := net.ParseCIDR(strings.TrimSpace(s[:j]))
+	if err != nil {
+		return IPRewriteRule{}, err
+	}
+	_, dst, err := net.ParseCIDR(strings.TrimSpace(s[j+1:]))
+	if err != nil {
+		return IPRewriteRule{}, err
+	}
+	if len(src.IP) != len(dst.IP) {
+		return IPRewriteRule{}, fmt.Errorf("%s and %s are not of the same address family", src, dst)
+	}
+	srcOnes, _ := src.Mask.Size()
+	dstOnes, _ := dst.Mask.Size()
+	if srcOnes != dstOnes {
+		return IPRewriteRule{}, fmt.Errorf("%s and %s do not have the same prefix length", src, dst)
+	}
+	return IPRewriteRule{Src: src, Dst: dst}, nil
+}
+
+func (r IPRewriteRule) String() string {
+	return fmt.Sprintf("%s:%s", r.Src, r.Dst)
+}
+
+// MarshalText makes the rule appear as 'src_cidr:dst_cidr' in the admin API.
+func (r IPRewriteRule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a rule written by MarshalText.
+func (r *IPRewriteRule) UnmarshalText(text []byte) error {
+	rule, err := ParseIPRewriteRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// rewrite returns ip mapped to Dst, or nil if ip is not in Src. ip must be
+// in its 4 byte form to match an IPv4 rule.
+func (r IPRewriteRule) rewrite(ip net.IP) net.IP {
+	if len(ip) != len(r.Src.IP) || !r.Src.Contains(ip) {
+		return nil
+	}
+	out := make(net.IP, len(ip))
+	for i := range ip {
+		out[i] = r.Dst.IP[i] | ip[i]&^r.Dst.Mask[i]
+	}
+	return out
+}
+
+// rewriteIPs replaces the address of every A and AAAA record in m by that
+// of the first rule whose source network contains it.
+func rewriteIPs(rules []IPRewriteRule, m *dns.Msg) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			var ip *net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				rr.A = rr.A.To4()
+				ip = &rr.A
+			case *dns.AAAA:
+				ip = &rr.AAAA
+			default:
+				continue
+			}
+			for _, rule := range rules {
+				if rewritten := rule.rewrite(*ip); rewritten != nil {
+					*ip = rewritten
+					break
+				}
+			}
+		}
+	}
+}
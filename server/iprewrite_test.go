@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseIPRewriteRule(t *testing.T) {
+	for in, want := range map[string]string{
+		"10.0.0.0/16:172.17.0.0/16":   "10.0.0.0/16:172.17.0.0/16",
+		"10.0.1.2/24 : 172.17.0.9/24": "10.0.1.0/24:172.17.0.0/24",
+		"fd00::/64:fd01:2::/64":       "fd00::/64:fd01:2::/64",
+	} {
+		r, err := ParseIPRewriteRule(in)
+		if err != nil {
+			t.Errorf("%s: %s", in, err)
+			continue
+		}
+		if r.String() != want {
+			t.Errorf("%s: expected %s, got %s", in, want, r)
+		}
+	}
+	for _, in := range []string{
+		"10.0.0.0/8:172.17.0.0/16", // prefix lengths differ
+		"10.0.0.0/8:fd00::/8",
+		"10.0.0.0:172.17.0.0",
+		"10.0.0.0/8",
+		"10.0.0.0/33:172.17.0.0/33",
+	} {
+		if _, err := ParseIPRewriteRule(in); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestRewriteIPs(t *testing.T) {
+	var rules []IPRewriteRule
+	for _, r := range []string{"10.0.0.0/16:172.17.0.0/16", "10.0.0.0/8:11.0.0.0/8", "fd00:1::/32:2001:db8::/32"} {
+		rule, err := ParseIPRewriteRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	for in, want := range map[string]string{
+		"a.example.com. 60 IN A 10.0.3.4":           "172.17.3.4",
+		"a.example.com. 60 IN A 10.1.3.4":           "11.1.3.4", // first match wins
+		"a.example.com. 60 IN A 192.168.3.4":        "192.168.3.4",
+		"a.example.com. 60 IN AAAA fd00:1:2:3::4":   "2001:db8:2:3::4",
+		"a.example.com. 60 IN AAAA fd00:2::4":       "fd00:2::4",
+		"a.example.com. 60 IN AAAA ::ffff:10.0.3.4": "10.0.3.4", // IPv4 rules only apply to A records
+		"a.example.com. 60 IN CNAME b.example.com.": "",
+	} {
+		rr, err := dns.NewRR(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &dns.Msg{Answer: []dns.RR{rr}}
+		rewriteIPs(rules, m)
+		var got string
+		switch rr := m.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", in, want, got)
+		}
+	}
+
+	b, _ := json.Marshal(rules[:1])
+	if string(b) != `["10.0.0.0/16:172.17.0.0/16"]` {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
+
+func TestIPRewrite(t *testing.T) {
+	private, err := ParseIPRewriteRule("127.0.0.0/24:10.1.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ParseIPRewriteRule("192.0.2.0/24:10.1.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprivate, err := ParseIPRewriteRule("127.0.0.0/24:192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback := startTestUpstream(t)
+	documentation, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, tc := range []struct {
+		upstream string
+		config   *Config
+		rcode    int
+		want     string
+	}{
+		{loopback, &Config{IPRewrites: []IPRewriteRule{private}}, dns.RcodeSuccess, "10.1.2.1"},
+		// The rebind check judges the addresses of the upstream, not
+		// the rewritten ones
+		{loopback, &Config{IPRewrites: []IPRewriteRule{private}, StopRebind: true}, dns.RcodeRefused, ""},
+		{loopback, &Config{IPRewrites: []IPRewriteRule{unprivate}, StopRebind: true}, dns.RcodeRefused, ""},
+		{documentation, &Config{IPRewrites: []IPRewriteRule{public}, StopRebind: true}, dns.RcodeSuccess, "10.1.2.1"},
+	} {
+		tc.config.Nameservers = []string{tc.upstream}
+		s := startTestServer(t, tc.config)
+
+		m := new(dns.Msg)
+		m.SetQuestion("rewrite.example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if len(r.Answer) == 1 {
+			got = r.Answer[0].(*dns.A).A.String()
+		}
+		if r.Rcode != tc.rcode || got != tc.want {
+			t.Errorf("%+v: expected %s %q, got %s %v", tc.config, dns.RcodeToString[tc.rcode], tc.want, dns.RcodeToString[r.Rcode], r.Answer)
+		}
+	}
+}
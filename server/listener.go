@@ -0,0 +1,324 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+const (
+	// defaultTCPIdleTimeout and defaultMaxTCPPipeline are used when the
+	// Config leaves 'tcp-idle-timeout' and 'max-tcp-pipeline' zero.
+	defaultTCPIdleTimeout = 10 * time.Second
+	defaultMaxTCPPipeline = 16
+
+	// tcpWriteTimeout is how long writing an answer to a TCP client may
+	// take, the default of dns.Server.
+	tcpWriteTimeout = 2 * time.Second
+)
+
+// errConnDone ends the read loop of dns.Server once pipelineReader has
+// served a connection.
+var errConnDone = errors.New("connection done")
+
+func (c *Config) tcpIdleTimeout() time.Duration {
+	if c.TCPIdleTimeout == 0 {
+		return defaultTCPIdleTimeout
+	}
+	return c.TCPIdleTimeout
+}
+
+func (c *Config) maxTCPPipeline() int {
+	if c.MaxTCPPipeline == 0 {
+		return defaultMaxTCPPipeline
+	}
+	return c.MaxTCPPipeline
+}
+
+// newTCPServer returns a dns.Server answering the connections accepted by
+// l with 'max-tcp-connections', 'tcp-idle-timeout' and 'max-tcp-pipeline'
+// applied.
+func newTCPServer(l net.Listener, mux dns.Handler, config *Config) *dns.Server {
+	idleTimeout, pipeline := config.tcpIdleTimeout(), config.maxTCPPipeline()
+	return &dns.Server{
+		Listener: newLimitListener(l, config.MaxTCPConnections),
+		Handler:  mux,
+		Net:      "tcp",
+		DecorateReader: func(r dns.Reader) dns.Reader {
+			return &pipelineReader{Reader: r, handler: mux, idleTimeout: idleTimeout, max: pipeline}
+		},
+	}
+}
+
+// newUDPServer returns a dns.Server answering the queries read from p.
+func newUDPServer(p net.PacketConn, mux dns.Handler) *dns.Server {
+	return &dns.Server{
+		PacketConn:    p,
+		Handler:       mux,
+		Net:           "udp",
+		MsgAcceptFunc: acceptQuery,
+		DecorateReader: func(r dns.Reader) dns.Reader {
+			return udpReader{r.(dns.PacketConnReader)}
+		},
+	}
+}
+
+// pipelineReader serves a TCP connection from its first ReadTCP call.
+// dns.Server answers the queries of a connection one after the other; this
+// answers up to max of them at once, in the order they complete as RFC 7766
+// allows. While max queries are pending no more are read, leaving them to
+// TCP flow control. The connection is closed once it has been idle for
+// idleTimeout and its pending queries are answered.
+type pipelineReader struct {
+	dns.Reader
+	handler     dns.Handler
+	idleTimeout time.Duration
+	max         int
+}
+
+func (r *pipelineReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	w := &tcpResponseWriter{conn: conn}
+	slots := make(chan struct{}, r.max)
+	var pending sync.WaitGroup
+	for {
+		m, err := r.Reader.ReadTCP(conn, timeout)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				log.Debugf("Closing idle TCP connection from %s", conn.RemoteAddr())
+			}
+			break
+		}
+		// The first read uses the read timeout of the server
+		timeout = r.idleTimeout
+
+		slots <- struct{}{}
+		pending.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				pending.Done()
+			}()
+			serveTCPMessage(r.handler, w, m)
+		}()
+	}
+	pending.Wait()
+	return nil, errConnDone
+}
+
+// serveTCPMessage unpacks m and passes it to h, answering malformed and
+// unsupported queries with FORMERR or NOTIMP, see checkQuery.
+func serveTCPMessage(h dns.Handler, w dns.ResponseWriter, m []byte) {
+	req, reject := checkQuery(m)
+	switch {
+	case req != nil:
+		h.ServeDNS(w, req)
+	case reject != nil:
+		w.WriteMsg(reject)
+	}
+}
+
+// acceptQuery decides which messages are answered. Responses are ignored.
+// Queries with an opcode other than QUERY, such as NOTIFY and UPDATE, are
+// rejected with NOTIMP. Queries without exactly one question, or with more
+// records in the other sections than dns.DefaultMsgAcceptFunc allows, are
+// rejected with FORMERR: only a single question can be answered, and no
+// resolver sends more than one.
+func acceptQuery(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		return dns.MsgIgnore
+	}
+	if opcode := int(dh.Bits>>11) & 0xF; opcode != dns.OpcodeQuery {
+		return dns.MsgRejectNotImplemented
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// checkQuery unpacks the query m. It returns the query if it is to be
+// answered, otherwise the response the client gets instead: FORMERR if m
+// cannot be unpacked, e.g. for a malformed EDNS0 option, or acceptQuery
+// rejects it, or NOTIMP. Both are nil if m is ignored, like responses and
+// messages too short to echo the ID of.
+func checkQuery(m []byte) (req, reject *dns.Msg) {
+	if len(m) < 12 {
+		// Let the client hang, as dns.Server does
+		return nil, nil
+	}
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(m[0:]),
+		Bits:    binary.BigEndian.Uint16(m[2:]),
+		Qdcount: binary.BigEndian.Uint16(m[4:]),
+		Ancount: binary.BigEndian.Uint16(m[6:]),
+		Nscount: binary.BigEndian.Uint16(m[8:]),
+		Arcount: binary.BigEndian.Uint16(m[10:]),
+	}
+
+	// Unpack sets the header even if the rest of m is malformed
+	req = new(dns.Msg)
+	err := req.Unpack(m)
+	action := acceptQuery(dh)
+	switch {
+	case action == dns.MsgIgnore:
+		return nil, nil
+	case action == dns.MsgAccept && err == nil:
+		return req, nil
+	}
+	opcode := req.Opcode
+	req.SetRcodeFormatError(req)
+	req.Zero = false
+	if action == dns.MsgRejectNotImplemented {
+		req.Opcode = opcode
+		req.Rcode = dns.RcodeNotImplemented
+		stats.NotImpQueries.Inc(1)
+		log.Debugf("Answering query %d with NOTIMP, opcode %s is not supported", req.Id, dns.OpcodeToString[opcode])
+	} else {
+		stats.FormErrQueries.Inc(1)
+		log.Debugf("Answering query %d with FORMERR, %d questions, error: %v", req.Id, dh.Qdcount, err)
+	}
+	req.Ns, req.Answer, req.Extra = nil, nil, nil
+	return nil, req
+}
+
+// udpReader answers the malformed and unsupported queries read from UDP
+// sockets, see checkQuery, before dns.Server sees them.
+type udpReader struct {
+	dns.PacketConnReader
+}
+
+func (r udpReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	for {
+		m, session, err := r.PacketConnReader.ReadUDP(conn, timeout)
+		if err != nil {
+			return m, session, err
+		}
+		req, reject := checkQuery(m)
+		if req != nil {
+			return m, session, nil
+		}
+		if reject != nil {
+			if data, err := reject.Pack(); err == nil {
+				dns.WriteToSessionUDP(conn, data, session)
+			}
+		}
+	}
+}
+
+func (r udpReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	for {
+		m, addr, err := r.PacketConnReader.ReadPacketConn(conn, timeout)
+		if err != nil {
+			return m, addr, err
+		}
+		req, reject := checkQuery(m)
+		if req != nil {
+			return m, addr, nil
+		}
+		if reject != nil {
+			if data, err := reject.Pack(); err == nil {
+				conn.WriteTo(data, addr)
+			}
+		}
+	}
+}
+
+// tcpResponseWriter is the dns.ResponseWriter of the queries of a TCP
+// connection. Answers are written whole, one at a time.
+type tcpResponseWriter struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (w *tcpResponseWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *tcpResponseWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w *tcpResponseWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *tcpResponseWriter) Write(m []byte) (int, error) {
+	if len(m) > dns.MaxMsgSize {
+		return 0, errors.New("message too large")
+	}
+	msg := make([]byte, 2+len(m))
+	binary.BigEndian.PutUint16(msg, uint16(len(m)))
+	copy(msg[2:], m)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	n, err := w.conn.Write(msg)
+	if n > 2 {
+		n -= 2
+	} else {
+		n = 0
+	}
+	return n, err
+}
+
+func (w *tcpResponseWriter) Close() error        { return w.conn.Close() }
+func (w *tcpResponseWriter) TsigStatus() error   { return nil }
+func (w *tcpResponseWriter) TsigTimersOnly(bool) {}
+func (w *tcpResponseWriter) Hijack()             {}
+
+// limitListener is a net.Listener that counts the open connections in
+// stats.TCPConnections and closes new connections right after accepting
+// them while max connections are already open. A max of zero means no
+// limit.
+type limitListener struct {
+	net.Listener
+	max  int64
+	open int64
+}
+
+func newLimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{Listener: l, max: int64(max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(&l.open, 1) > l.max && l.max > 0 {
+			atomic.AddInt64(&l.open, -1)
+			stats.TCPRejectedCount.Inc(1)
+			log.Debugf("Rejected TCP connection from %s, limit of %d connections reached", c.RemoteAddr(), l.max)
+			c.Close()
+			continue
+		}
+		stats.TCPConnections.Inc(1)
+		return &limitConn{Conn: c, release: func() {
+			atomic.AddInt64(&l.open, -1)
+			stats.TCPConnections.Inc(-1)
+		}}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/janeczku/go-dnsmasq/stats"
+)
+
+// startDelayUpstream starts an upstream that answers names starting with
+// "slow" after delay and all others at once.
+func startDelayUpstream(t *testing.T, delay time.Duration) (string, func()) {
+	return startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if strings.HasPrefix(req.Question[0].Name, "slow") {
+			time.Sleep(delay)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+}
+
+// pipelineOrder sends the queries on one TCP connection at once and
+// returns the names of the answers in the order they arrive.
+func pipelineOrder(t *testing.T, addr string, names ...string) []string {
+	c, err := dns.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, name := range names {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if err := c.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var order []string
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for range names {
+		resp, err := c.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, resp.Question[0].Name)
+	}
+	return order
+}
+
+func TestTCPPipelining(t *testing.T) {
+	upstream, stop := startDelayUpstream(t, 300*time.Millisecond)
+	defer stop()
+
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}})
+	defer s.Stop()
+
+	order := pipelineOrder(t, s.conf().DnsAddr, "slow.example.", "fast.example.")
+	if order[0] != "fast.example." || order[1] != "slow.example." {
+		t.Errorf("expected the fast query to be answered first, got %v", order)
+	}
+}
+
+func TestTCPPipelineAll(t *testing.T) {
+	upstream, stop := startDelayUpstream(t, 100*time.Millisecond)
+	defer stop()
+
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}})
+	defer s.Stop()
+
+	names := []string{"slow1.example.", "fast1.example.", "slow2.example.", "fast2.example.", "fast3.example."}
+	answered := make(map[string]bool)
+	for _, name := range pipelineOrder(t, s.conf().DnsAddr, names...) {
+		answered[name] = true
+	}
+	for _, name := range names {
+		if !answered[name] {
+			t.Errorf("expected an answer for %s, got %v", name, answered)
+		}
+	}
+}
+
+func TestTCPPipelineInOrder(t *testing.T) {
+	upstream, stop := startDelayUpstream(t, 100*time.Millisecond)
+	defer stop()
+
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}, MaxTCPPipeline: 1})
+	defer s.Stop()
+
+	order := pipelineOrder(t, s.conf().DnsAddr, "slow.example.", "fast.example.")
+	if order[0] != "slow.example." || order[1] != "fast.example." {
+		t.Errorf("expected the queries to be answered in order, got %v", order)
+	}
+}
+
+func tcpConnections() int64 {
+	return stats.TCPConnections.(metrics.Counter).Count()
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, TCPIdleTimeout: 200 * time.Millisecond})
+	defer s.Stop()
+
+	// The startup probe connection may still be counted, let it go away
+	time.Sleep(100 * time.Millisecond)
+	open := tcpConnections()
+
+	c, err := dns.Dial("tcp", s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	if err := c.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if n := tcpConnections(); n != open+1 {
+		t.Errorf("expected %d open TCP connections, got %d", open+1, n)
+	}
+
+	start := time.Now()
+	if _, err := c.ReadMsg(); err == nil {
+		t.Fatal("expected the idle connection to be closed")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("expected the idle connection to be closed, but it is still open")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("idle connection closed after %s", d)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := tcpConnections(); n != open {
+		t.Errorf("expected %d open TCP connections, got %d", open, n)
+	}
+}
+
+func TestTCPMalformedQuery(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true})
+	defer s.Stop()
+
+	c, err := dns.Dial("tcp", s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeA)
+	m.Opcode = dns.OpcodeUpdate
+	if err := c.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNotImplemented || resp.Id != m.Id {
+		t.Errorf("expected NOTIMP for query %d, got %s for %d", m.Id, dns.RcodeToString[resp.Rcode], resp.Id)
+	}
+}
+
+// rawExchange sends the raw query data over network and returns the
+// response.
+func rawExchange(t *testing.T, network, addr string, data []byte) *dns.Msg {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if network == "tcp" {
+		data = append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network == "tcp" {
+		buf, n = buf[2:], n-2
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestMalformedQueries(t *testing.T) {
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local\n"), &Config{NoRec: true})
+	defer s.Stop()
+
+	pack := func(m *dns.Msg) []byte {
+		data, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	query := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("host.local.", dns.TypeA)
+		return m
+	}
+
+	for _, tc := range []struct {
+		name  string
+		data  func() []byte
+		rcode int
+	}{
+		{"no question", func() []byte {
+			m := query()
+			m.Question = nil
+			return pack(m)
+		}, dns.RcodeFormatError},
+		{"two questions", func() []byte {
+			m := query()
+			m.Question = append(m.Question, dns.Question{Name: "other.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			return pack(m)
+		}, dns.RcodeFormatError},
+		{"truncated question", func() []byte {
+			data := pack(query())
+			return data[:len(data)-3]
+		}, dns.RcodeFormatError},
+		{"malformed EDNS0 option", func() []byte {
+			m := query()
+			m.SetEdns0(1232, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+			data := pack(m)
+			// The option claims more data than the record has
+			binary.BigEndian.PutUint16(data[len(data)-10:], 0xff)
+			return data
+		}, dns.RcodeFormatError},
+		{"update", func() []byte {
+			m := query()
+			m.Opcode = dns.OpcodeUpdate
+			return pack(m)
+		}, dns.RcodeNotImplemented},
+		{"notify", func() []byte {
+			m := query()
+			m.Opcode = dns.OpcodeNotify
+			return pack(m)
+		}, dns.RcodeNotImplemented},
+		{"status", func() []byte {
+			m := query()
+			m.Opcode = dns.OpcodeStatus
+			return pack(m)
+		}, dns.RcodeNotImplemented},
+		{"valid", func() []byte { return pack(query()) }, dns.RcodeSuccess},
+	} {
+		for _, network := range []string{"udp", "tcp"} {
+			formerr := stats.FormErrQueries.(metrics.Counter).Count()
+			notimp := stats.NotImpQueries.(metrics.Counter).Count()
+
+			data := tc.data()
+			id := binary.BigEndian.Uint16(data)
+			resp := rawExchange(t, network, s.conf().DnsAddr, data)
+			if resp.Rcode != tc.rcode || resp.Id != id || !resp.Response {
+				t.Errorf("%s %s: expected %s for query %d, got %s for %d", network, tc.name,
+					dns.RcodeToString[tc.rcode], id, dns.RcodeToString[resp.Rcode], resp.Id)
+			}
+
+			var wantFormerr, wantNotimp int64
+			switch tc.rcode {
+			case dns.RcodeFormatError:
+				wantFormerr = 1
+			case dns.RcodeNotImplemented:
+				wantNotimp = 1
+			}
+			if n := stats.FormErrQueries.(metrics.Counter).Count() - formerr; n != wantFormerr {
+				t.Errorf("%s %s: expected %d FORMERR queries counted, got %d", network, tc.name, wantFormerr, n)
+			}
+			if n := stats.NotImpQueries.(metrics.Counter).Count() - notimp; n != wantNotimp {
+				t.Errorf("%s %s: expected %d NOTIMP queries counted, got %d", network, tc.name, wantNotimp, n)
+			}
+		}
+	}
+}
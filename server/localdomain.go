@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isLocalDomain reports whether name is at or below one of LocalDomains.
+func (c *Config) isLocalDomain(name string) bool {
+	for _, domain := range c.LocalDomains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateReverseZones are the reverse zones of 10.0.0.0/8, 172.16.0.0/12,
+// 192.168.0.0/16, 169.254.0.0/16, fd00::/8 and fe80::/10.
+var privateReverseZones = func() []string {
+	zones := []string{"10.in-addr.arpa.", "168.192.in-addr.arpa.", "254.169.in-addr.arpa.", "d.f.ip6.arpa."}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	for _, nibble := range "89ab" {
+		zones = append(zones, fmt.Sprintf("%c.e.f.ip6.arpa.", nibble))
+	}
+	return zones
+}()
+
+// isPrivateReverse reports whether the PTR query q is for an address in
+// the private ranges answered locally with NoPrivateReverse. The reverse
+// zones of stub zones are forwarded to their nameservers.
+func (c *Config) isPrivateReverse(q dns.Question) bool {
+	if !c.NoPrivateReverse || q.Qtype != dns.TypePTR {
+		return false
+	}
+	name := strings.ToLower(q.Name)
+	for _, zone := range privateReverseZones {
+		if dns.IsSubDomain(zone, name) {
+			return !c.inStubZone(name)
+		}
+	}
+	return false
+}
+
+// localDomainStage answers the queries for names under LocalDomains, and
+// the PTR queries for private addresses with NoPrivateReverse, that the
+// stages before it did not answer. A name in the hostsfile is answered
+// with NODATA, any other name with NXDOMAIN. They are never forwarded.
+func (s *server) localDomainStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		config := s.confFor(w)
+		q := req.Question[0]
+		name := strings.ToLower(q.Name)
+		if config.ForwardersOnly || !config.isLocalDomain(name) && !config.isPrivateReverse(q) {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		setSource(w, SourceLocal)
+		m := newReply(config, req)
+		m.Authoritative = true
+		if addrs, err := s.hosts.FindHosts(name); err != nil {
+			logFor(w).WithError(err).Error("Error querying hostsfile records")
+		} else if len(addrs) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		if debugEnabled(w) {
+			logFor(w).WithField("rcode", dns.RcodeToString[m.Rcode]).Debug("Answering for a local domain")
+		}
+		s.writeLocal(w, req, m)
+	})
+}
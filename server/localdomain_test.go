@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalDomain(t *testing.T) {
+	var forwarded int32
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&forwarded, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 known.example.internal\n"),
+		&Config{Nameservers: []string{upstream}, LocalDomains: []string{"example.internal."}})
+	defer s.Stop()
+
+	c := new(dns.Client)
+	for _, tc := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"known.example.internal.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"known.example.internal.", dns.TypeMX, dns.RcodeSuccess, 0},
+		{"unknown.example.internal.", dns.TypeA, dns.RcodeNameError, 0},
+		{"Unknown.Example.Internal.", dns.TypeAAAA, dns.RcodeNameError, 0},
+		{"example.internal.", dns.TypeSOA, dns.RcodeNameError, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		resp, _, err := c.Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != tc.rcode || len(resp.Answer) != tc.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %s with %v", tc.name, dns.TypeToString[tc.qtype],
+				dns.RcodeToString[tc.rcode], tc.answers, dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+		if !resp.Authoritative {
+			t.Errorf("%s %s: expected an authoritative answer", tc.name, dns.TypeToString[tc.qtype])
+		}
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 0 {
+		t.Errorf("expected no query under the local domain to be forwarded, got %d", n)
+	}
+
+	// Names outside of it are forwarded as usual
+	for _, name := range []string{"example.com.", "notexample.internal."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		resp, _, err := c.Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("%s: expected the query to be forwarded, got %s with %v", name, dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 2 {
+		t.Errorf("expected 2 forwarded queries, got %d", n)
+	}
+}
+
+func TestNoPrivateReverse(t *testing.T) {
+	const upstream, stubNS = "192.0.2.1:53", "192.0.2.2:53"
+	e := &fakeExchanger{answer: func(m *dns.Msg, u Upstream) (*dns.Msg, error) {
+		return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN PTR host.example.com."), nil
+	}}
+	stubs := map[string]*StubZone{"0.10.10.in-addr.arpa.": NewStubZone([]string{stubNS})}
+	s := startHostsTestServer(t, newTestHostsfile(t, "192.168.1.10 printer.lan\n"),
+		&Config{Nameservers: []string{upstream}, Stub: &stubs, Exchanger: e, NoPrivateReverse: true})
+	defer s.Stop()
+
+	for _, tc := range []struct {
+		addr  string
+		rcode int
+		sent  string
+	}{
+		{"10.1.2.3", dns.RcodeNameError, ""},
+		{"172.16.0.1", dns.RcodeNameError, ""},
+		{"172.31.255.255", dns.RcodeNameError, ""},
+		{"192.168.1.1", dns.RcodeNameError, ""},
+		{"169.254.1.1", dns.RcodeNameError, ""},
+		{"fd00::1", dns.RcodeNameError, ""},
+		{"fe80::1", dns.RcodeNameError, ""},
+		{"febf::1", dns.RcodeNameError, ""},
+		// In the hostsfile
+		{"192.168.1.10", dns.RcodeSuccess, ""},
+		// Under a stub zone
+		{"10.10.0.5", dns.RcodeSuccess, stubNS},
+		// Public
+		{"172.32.0.1", dns.RcodeSuccess, upstream},
+		{"8.8.8.8", dns.RcodeSuccess, upstream},
+		{"fc00::1", dns.RcodeSuccess, upstream},
+		{"2001:db8::1", dns.RcodeSuccess, upstream},
+	} {
+		before := len(e.sent())
+		name, _ := dns.ReverseAddr(tc.addr)
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypePTR)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode {
+			t.Errorf("%s: expected %s, got %s", tc.addr, dns.RcodeToString[tc.rcode], dns.RcodeToString[r.Rcode])
+		}
+		sent := e.sent()[before:]
+		switch {
+		case tc.sent == "" && len(sent) > 0:
+			t.Errorf("%s: expected no query to be forwarded, got %v", tc.addr, sent)
+		case tc.sent != "" && (len(sent) != 1 || sent[0].Addr != tc.sent):
+			t.Errorf("%s: expected the query to be sent to %s, got %v", tc.addr, tc.sent, sent)
+		}
+	}
+
+	// Disabled, the queries are forwarded
+	config := *s.conf()
+	config.NoPrivateReverse = false
+	s.config.Store(&config)
+	before := len(e.sent())
+	m := new(dns.Msg)
+	m.SetQuestion("3.2.1.10.in-addr.arpa.", dns.TypePTR)
+	if r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the query to be forwarded, got %v, %v", r, err)
+	}
+	if sent := e.sent()[before:]; len(sent) != 1 {
+		t.Errorf("expected the query to be forwarded once, got %v", sent)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// selfAddress reports whether the nameserver ns, host:port, is one of the
+// addresses in listen the server answers queries on. Unspecified listen
+// addresses match every loopback address, but not the addresses of the
+// other network interfaces.
+func selfAddress(ns string, listen []string) bool {
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, l := range listen {
+		lhost, lport, err := net.SplitHostPort(l)
+		if err != nil || lport != port {
+			continue
+		}
+		lip := net.ParseIP(lhost)
+		if lhost == "" || lip != nil && lip.IsUnspecified() {
+			if ip.IsLoopback() || ip.IsUnspecified() {
+				return true
+			}
+		} else if ip.Equal(lip) {
+			return true
+		}
+	}
+	return false
+}
+
+// configListenAddrs returns the addresses the server configured by config
+// will answer queries on, as far as they are known before it is started.
+func configListenAddrs(config *Config) []string {
+	switch {
+	case config.Systemd:
+		return nil
+	case config.bindsInterfaces():
+		_, port, _ := net.SplitHostPort(config.DnsAddr)
+		return []string{net.JoinHostPort("", port)}
+	}
+	if addr := config.additionalAddr(); addr != "" {
+		return []string{config.DnsAddr, addr}
+	}
+	return []string{config.DnsAddr}
+}
+
+// ListenAddrs returns the addresses the server answers queries on.
+func (s *server) ListenAddrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, 0, len(s.dnsServers))
+	for _, srv := range s.dnsServers {
+		if srv.PacketConn != nil {
+			addrs = append(addrs, srv.PacketConn.LocalAddr().String())
+		} else if srv.Listener != nil {
+			addrs = append(addrs, srv.Listener.Addr().String())
+		}
+	}
+	return addrs
+}
+
+// checkLoop returns an error if ns is an address the server answers
+// queries on, as forwarding to it would loop.
+func (s *server) checkLoop(ns string) error {
+	if selfAddress(ns, s.ListenAddrs()) {
+		return fmt.Errorf("Not forwarding to %s, it is an address go-dnsmasq listens on", ns)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/miekg/dns"
+)
+
+func TestSelfAddress(t *testing.T) {
+	for _, tc := range []struct {
+		ns     string
+		listen string
+		self   bool
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"127.0.0.1:53", "127.0.0.1:5353", false},
+		{"127.0.0.53:53", "127.0.0.1:53", false},
+		{"127.0.0.53:53", "0.0.0.0:53", true},
+		{"[::1]:53", "[::]:53", true},
+		{"[::1]:53", ":53", true},
+		{"10.0.0.1:53", "0.0.0.0:53", false},
+		{"10.0.0.1:53", "10.0.0.1:53", true},
+		{"[fe80::1]:53", "[fe80::1]:53", true},
+	} {
+		if got := selfAddress(tc.ns, []string{tc.listen}); got != tc.self {
+			t.Errorf("%s on %s: expected %v, got %v", tc.ns, tc.listen, tc.self, got)
+		}
+	}
+}
+
+func TestResolvConfSkipsSelf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	ctx := cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	ioutil.WriteFile(resolvConfPath, []byte("nameserver 127.0.0.1 # added by go-dnsmasq\nnameserver 10.0.0.1\n"), 0644)
+	config := &Config{DnsAddr: "127.0.0.1:53"}
+	if err := ResolvConf(config, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:53"}; !reflect.DeepEqual(config.Nameservers, want) {
+		t.Errorf("expected nameservers %v, got %v", want, config.Nameservers)
+	}
+
+	// A local stub on another address is kept
+	ioutil.WriteFile(resolvConfPath, []byte("nameserver 127.0.0.53\n"), 0644)
+	config = &Config{DnsAddr: "127.0.0.1:53"}
+	if err := ResolvConf(config, ctx); err != nil || len(config.Nameservers) != 1 {
+		t.Errorf("expected 127.0.0.53 to be kept, got %v, %v", config.Nameservers, err)
+	}
+
+	ioutil.WriteFile(resolvConfPath, []byte("nameserver 127.0.0.1\n"), 0644)
+	config = &Config{DnsAddr: "0.0.0.0:53"}
+	if err := ResolvConf(config, ctx); !errors.Is(err, ErrNoUpstreams) {
+		t.Errorf("expected ErrNoUpstreams, got %v", err)
+	}
+	config = &Config{DnsAddr: "0.0.0.0:53", NoRec: true}
+	if err := ResolvConf(config, ctx); err != nil {
+		t.Errorf("expected no error without recursion, got %s", err)
+	}
+}
+
+func TestForwardLoop(t *testing.T) {
+	upstream := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}})
+	defer s.Stop()
+
+	// Point the server at itself, as if a reload read it from resolv.conf
+	config := *s.conf()
+	config.Nameservers = []string{config.DnsAddr}
+	s.config.Store(&config)
+
+	m := new(dns.Msg)
+	m.SetQuestion("loop.example.com.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, config.DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	// The other nameservers are still used
+	next := config
+	next.Nameservers = []string{config.DnsAddr, upstream}
+	s.config.Store(&next)
+	if r, _, err := new(dns.Client).Exchange(m, config.DnsAddr); err != nil || len(r.Answer) != 1 {
+		t.Errorf("expected an answer from the upstream, got %v, %v", r, err)
+	}
+}
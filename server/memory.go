@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// memoryCheckInterval is how often free memory is compared with
+// 'min-free-memory-mb'.
+const memoryCheckInterval = 5 * time.Second
+
+// memoryRecoveryMargin is how far above 'min-free-memory-mb', in percent,
+// free memory must rise before queries are answered again, so that the
+// server does not flip between both states.
+const memoryRecoveryMargin = 10
+
+// startMemoryWatch starts checking free memory every memoryCheckInterval
+// until the server is stopped.
+func (s *server) startMemoryWatch() error {
+	if _, err := freeMemory(); err != nil {
+		return fmt.Errorf("Failed to read free memory: %s", err)
+	}
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		t := time.NewTicker(memoryCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				free, err := freeMemory()
+				if err != nil {
+					log.Warnf("Failed to read free memory: %s", err)
+					continue
+				}
+				s.checkMemory(free)
+			}
+		}
+	}()
+	return nil
+}
+
+// checkMemory starts throttling if free, in bytes, is below
+// 'min-free-memory-mb' and stops once it is above it by
+// memoryRecoveryMargin percent.
+func (s *server) checkMemory(free uint64) {
+	config := s.conf()
+	min := uint64(config.MinFreeMemoryMB) << 20
+	low := atomic.LoadInt32(&s.lowMemory) == 1
+	switch {
+	case !low && free < min:
+		atomic.StoreInt32(&s.lowMemory, 1)
+		s.rcache.SetCapacity(config.RCache / 2)
+		if s.rcacheShards != nil {
+			s.rcacheShards.SetCapacity(config.RCache / 2)
+		}
+		log.Warnf("Free memory %d MB is below %d MB, answering queries with SERVFAIL and halving the cache until it recovers", free>>20, config.MinFreeMemoryMB)
+	case low && free > min+min*memoryRecoveryMargin/100:
+		atomic.StoreInt32(&s.lowMemory, 0)
+		s.rcache.SetCapacity(config.RCache)
+		if s.rcacheShards != nil {
+			s.rcacheShards.SetCapacity(config.RCache)
+		}
+		log.Infof("Free memory recovered to %d MB, answering queries again", free>>20)
+	}
+}
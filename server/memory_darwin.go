@@ -0,0 +1,26 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeMemory returns the number of free and purgeable pages in bytes. The
+// swap usage reported by vm.swapusage says nothing about the memory left
+// before the system starts swapping, so the page counts are used instead.
+func freeMemory() (uint64, error) {
+	free, err := unix.SysctlUint32("vm.page_free_count")
+	if err != nil {
+		return 0, err
+	}
+	purgeable, err := unix.SysctlUint32("vm.page_purgeable_count")
+	if err != nil {
+		return 0, err
+	}
+	return uint64(free+purgeable) * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem of the container is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// freeMemory returns the memory available to new allocations in bytes.
+// In a cgroup with a memory limit that is the limit minus the memory in
+// use, unless the host has less available.
+func freeMemory() (uint64, error) {
+	free, err := hostFreeMemory()
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := cgroupFreeMemory(cgroupRoot); ok && n < free {
+		return n, nil
+	}
+	return free, nil
+}
+
+// cgroupFreeMemory returns the memory limit of the cgroup mounted at root
+// minus its usage, not counting inactive page cache, which is reclaimed
+// before the limit is hit. It returns false if there is no limit.
+func cgroupFreeMemory(root string) (uint64, bool) {
+	// cgroup v2, then v1
+	limit, ok := readCgroupValue(filepath.Join(root, "memory.max"))
+	usage, _ := readCgroupValue(filepath.Join(root, "memory.current"))
+	inactive := readCgroupStat(filepath.Join(root, "memory.stat"), "inactive_file")
+	if !ok {
+		dir := filepath.Join(root, "memory")
+		limit, ok = readCgroupValue(filepath.Join(dir, "memory.limit_in_bytes"))
+		usage, _ = readCgroupValue(filepath.Join(dir, "memory.usage_in_bytes"))
+		inactive = readCgroupStat(filepath.Join(dir, "memory.stat"), "total_inactive_file")
+	}
+	// Without a limit v1 reports the largest page aligned int64
+	if !ok || limit >= 1<<62 {
+		return 0, false
+	}
+	if inactive < usage {
+		usage -= inactive
+	}
+	if usage >= limit {
+		return 0, true
+	}
+	return limit - usage, true
+}
+
+// readCgroupValue reads the number in the cgroup file at path. It returns
+// false if the file does not exist or holds "max", meaning no limit.
+func readCgroupValue(path string) (uint64, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n, err == nil
+}
+
+// readCgroupStat returns the value of key in the memory.stat file at path,
+// zero if it is missing.
+func readCgroupStat(path, key string) uint64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseUint(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// hostFreeMemory returns MemAvailable from /proc/meminfo in bytes.
+// Kernels older than 3.14 do not report it, MemFree plus the page cache is
+// used instead.
+func hostFreeMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	kb := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemAvailable:    1234567 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			kb[strings.TrimSuffix(fields[0], ":")] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if n, ok := kb["MemAvailable"]; ok {
+		return n << 10, nil
+	}
+	if n, ok := kb["MemFree"]; ok {
+		return (n + kb["Buffers"] + kb["Cached"]) << 10, nil
+	}
+	return 0, fmt.Errorf("no MemAvailable or MemFree in /proc/meminfo")
+}
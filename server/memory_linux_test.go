@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupFreeMemory(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		files map[string]string
+		free  uint64
+		ok    bool
+	}{
+		{"no cgroup", nil, 0, false},
+		{"v2", map[string]string{
+			"memory.max":     "104857600\n",
+			"memory.current": "73400320\n",
+			"memory.stat":    "anon 52428800\nfile 20971520\ninactive_file 10485760\n",
+		}, 41943040, true},
+		{"v2 without limit", map[string]string{"memory.max": "max\n", "memory.current": "73400320\n"}, 0, false},
+		{"v2 over the limit", map[string]string{"memory.max": "1048576\n", "memory.current": "2097152\n"}, 0, true},
+		{"v1", map[string]string{
+			"memory/memory.limit_in_bytes": "104857600\n",
+			"memory/memory.usage_in_bytes": "73400320\n",
+			"memory/memory.stat":           "cache 20971520\ntotal_inactive_file 10485760\n",
+		}, 41943040, true},
+		{"v1 without limit", map[string]string{"memory/memory.limit_in_bytes": "9223372036854771712\n"}, 0, false},
+	} {
+		root, err := ioutil.TempDir("", "cgroup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for name, content := range tc.files {
+			path := filepath.Join(root, name)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		free, ok := cgroupFreeMemory(root)
+		if free != tc.free || ok != tc.ok {
+			t.Errorf("%s: expected %d, %v, got %d, %v", tc.desc, tc.free, tc.ok, free, ok)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package server
+
+import "fmt"
+
+func freeMemory() (uint64, error) {
+	return 0, fmt.Errorf("'min-free-memory-mb' is only supported on Linux and macOS")
+}
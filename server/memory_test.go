@@ -0,0 +1,56 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckMemory(t *testing.T) {
+	upstream := startTestUpstream(t)
+	// A threshold of 1 MB is not reached by the real free memory while
+	// the test runs, checkMemory is called with made up values.
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}, RCache: 10, MinFreeMemoryMB: 1})
+	defer s.Stop()
+
+	query := func(name string) int {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Rcode
+	}
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com.", "d.example.com."} {
+		if rcode := query(name); rcode != dns.RcodeSuccess {
+			t.Fatalf("expected %s to be answered, got %s", name, dns.RcodeToString[rcode])
+		}
+	}
+
+	s.checkMemory(512 << 10)
+	if rcode := query("a.example.com."); rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL below the threshold, got %s", dns.RcodeToString[rcode])
+	}
+	if s.rcache.Capacity() != 5 || s.rcache.Len() > 5 {
+		t.Errorf("expected the cache to be halved, got %d of %d", s.rcache.Len(), s.rcache.Capacity())
+	}
+
+	// Within the recovery margin
+	s.checkMemory(1<<20 + 1)
+	if rcode := query("a.example.com."); rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL within the recovery margin, got %s", dns.RcodeToString[rcode])
+	}
+
+	s.checkMemory(2 << 20)
+	if rcode := query("a.example.com."); rcode != dns.RcodeSuccess {
+		t.Errorf("expected queries to be answered after recovery, got %s", dns.RcodeToString[rcode])
+	}
+	if s.rcache.Capacity() != 10 {
+		t.Errorf("expected the cache capacity to be restored, got %d", s.rcache.Capacity())
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/stats"
+	"github.com/miekg/dns"
+)
+
+// Handler answers a DNS query.
+type Handler interface {
+	ServeDNS(w dns.ResponseWriter, r *dns.Msg)
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(w dns.ResponseWriter, r *dns.Msg)
+
+// ServeDNS calls f(w, r).
+func (f HandlerFunc) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f(w, r)
+}
+
+// Middleware wraps a Handler to process queries before or after it.
+// A middleware may answer a query itself instead of calling next.
+//
+// Queries reach the middlewares after they have been registered for the
+// query log, the statistics and dnstap, so queries answered by a
+// middleware are recorded as well. Wrapping the dns.ResponseWriter
+// passed to next hides details such as the source of the response from
+// the query log.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares into one. The first middleware is the
+// outermost one and sees queries first.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Logging returns a middleware logging every query with its rcode and
+// how long it took to answer to logger.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			start := time.Now()
+			next.ServeDNS(w, r)
+
+			q := r.Question[0]
+			fields := log.Fields{
+				"qname":    q.Name,
+				"qtype":    dns.TypeToString[q.Qtype],
+				"client":   w.RemoteAddr().String(),
+				"duration": time.Since(start),
+			}
+			if qw, ok := w.(*queryWriter); ok {
+				fields["qid"] = qw.id
+				if qw.msg != nil {
+					fields["rcode"] = dns.RcodeToString[qw.msg.Rcode]
+				}
+			}
+			logger.WithFields(fields).Info("Query")
+		})
+	}
+}
+
+// Metrics returns a middleware counting queries in requests and
+// observing how long they took to answer in latency.
+func Metrics(requests stats.Counter, latency stats.Histogram) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			start := time.Now()
+			next.ServeDNS(w, r)
+			requests.Inc(1)
+			latency.Observe(time.Since(start))
+		})
+	}
+}
+
+// rateLimitSweep is how often buckets of idle clients are removed.
+const rateLimitSweep = time.Minute
+
+// RateLimit returns a middleware refusing queries of clients that send
+// more than rate queries per second on average, allowing bursts of up
+// to burst queries.
+func RateLimit(rate float64, burst int) Middleware {
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			client, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+			if l.allow(client, time.Now()) {
+				next.ServeDNS(w, r)
+				return
+			}
+			logFor(w).Debug("Refused query, rate limit exceeded")
+			setSource(w, SourceLocal)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+		})
+	}
+}
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of client and reports whether
+// there was one.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.swept) > rateLimitSweep {
+		for c, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	if b.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens accumulated since the last refill and returns
+// the number of tokens in the bucket.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	return b.tokens
+}
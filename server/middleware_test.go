@@ -0,0 +1,167 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				order = append(order, name)
+				next.ServeDNS(w, r)
+			})
+		}
+	}
+
+	h := Chain(mw("a"), mw("b"), mw("c"))(HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		order = append(order, "handler")
+	}))
+	h.ServeDNS(nil, new(dns.Msg))
+
+	if want := []string{"a", "b", "c", "handler"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 2, burst: 3, buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	l.swept = now
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1", now) {
+			t.Fatalf("query %d: expected burst to be allowed", i)
+		}
+	}
+	if l.allow("10.0.0.1", now) {
+		t.Error("expected query above burst to be refused")
+	}
+	if !l.allow("10.0.0.2", now) {
+		t.Error("expected query of other client to be allowed")
+	}
+	if !l.allow("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Error("expected query to be allowed after refill")
+	}
+
+	l.allow("10.0.0.3", now.Add(2*rateLimitSweep))
+	if len(l.buckets) != 1 {
+		t.Errorf("expected idle clients to be removed, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := startTestServer(t, &Config{Nameservers: []string{startTestUpstream(t)}}, RateLimit(0.01, 1))
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("limited.example.com.", dns.TypeA)
+	for i, want := range []int{dns.RcodeSuccess, dns.RcodeRefused} {
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != want {
+			t.Errorf("query %d: expected rcode %s, got %s", i, dns.RcodeToString[want], dns.RcodeToString[r.Rcode])
+		}
+	}
+}
+
+func TestUseStages(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next.ServeDNS(w, r)
+			})
+		}
+	}
+	tenant := func(next Handler) Handler {
+		return HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name != "printer.tenant.example." {
+				next.ServeDNS(w, r)
+				return
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR("printer.tenant.example. 60 IN A 10.9.0.1")
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		})
+	}
+
+	config := &Config{
+		DnsAddr:     net.JoinHostPort("127.0.0.1", freePort(t)),
+		NoRec:       true,
+		RCache:      100,
+		RCacheTtl:   60,
+		Ndots:       1,
+		ReadTimeout: time.Second,
+	}
+	s := New(newTestHostsfile(t, "10.0.0.1 host.local\n"), config, "test", mw("outer"))
+	if err := s.UseStages(
+		StageMiddleware{Stage: StageHostsfile, Middleware: mw("before hostsfile")},
+		StageMiddleware{Stage: StageCache, After: true, Middleware: mw("after cache")},
+		StageMiddleware{Stage: StageHostsfile, Middleware: tenant},
+		StageMiddleware{Stage: StageHostsfile, After: true, Middleware: mw("after hostsfile")},
+	); err != nil {
+		t.Fatal(err)
+	}
+	go s.Run()
+	defer s.Stop()
+	<-s.Listening()
+
+	for _, tc := range []struct {
+		name   string
+		answer string
+		order  []string
+	}{
+		{"host.local.", "10.0.0.1", []string{"outer", "after cache", "before hostsfile"}},
+		{"host.local.", "10.0.0.1", []string{"outer"}},
+		{"printer.tenant.example.", "10.9.0.1", []string{"outer", "after cache", "before hostsfile"}},
+		{"other.example.", "", []string{"outer", "after cache", "before hostsfile", "after hostsfile"}},
+	} {
+		mu.Lock()
+		order = nil
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, config.DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.answer != "" && (len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tc.answer) {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.answer, r.Answer)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(order, tc.order) {
+			t.Errorf("%s: expected the middlewares %v to run, got %v", tc.name, tc.order, order)
+		}
+		mu.Unlock()
+	}
+
+	for _, mw := range []StageMiddleware{
+		{Stage: "resolve", Middleware: mw("x")},
+		{Stage: StageForward, After: true, Middleware: mw("x")},
+		{Stage: StageCache},
+	} {
+		if err := New(testHostfile{}, config, "test").UseStages(mw); err == nil {
+			t.Errorf("expected an error inserting %+v", mw)
+		}
+	}
+}
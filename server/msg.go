@@ -4,7 +4,12 @@
 
 package server
 
-import "github.com/miekg/dns"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
 
 // Fit will make m fit the size. If a message is larger than size then entire
 // additional section is dropped. If it is still to large and the transport
@@ -52,3 +57,156 @@ func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
 	m.Answer = m.Answer[:max]
 	return m, true
 }
+
+// clientResponse adapts m to what the client that sent req can receive.
+// The OPT record is removed if req had none, and a UDP response larger
+// than the payload size announced in req is fitted into it, setting the
+// TC bit if answers had to be dropped so that the client retries over
+// TCP. Both changes are made to a copy, m itself is never changed.
+func clientResponse(req, m *dns.Msg, tcp bool) *dns.Msg {
+	o := req.IsEdns0()
+	if o == nil && m.IsEdns0() != nil {
+		m = m.Copy()
+		stripOPT(m)
+	}
+	if tcp {
+		return m
+	}
+
+	size := dns.MinMsgSize
+	if o != nil && int(o.UDPSize()) > size {
+		size = int(o.UDPSize())
+	}
+	if m.Len() <= size {
+		return m
+	}
+
+	// Fit drops the additional section, keep the OPT record
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt != nil {
+		stripOPT(m)
+		size -= (&dns.Msg{Extra: []dns.RR{opt}}).Len() - new(dns.Msg).Len()
+	}
+	m, _ = Fit(m, size, false)
+	if opt != nil {
+		m.Extra = append(m.Extra, opt)
+	}
+	return m
+}
+
+// replyHeader returns m with the ID, question section, RD and CD bits of
+// the query the client sent, which was answered with question, and the RA
+// bit set if recursion is available. A response from the cache carries
+// those of the query it was stored for, and forwarding may rewrite the
+// question of the query for an alias. The question is echoed as sent,
+// with the case of the name. m is copied before it is changed, as it may
+// be stored in the cache.
+func replyHeader(req, m *dns.Msg, question []dns.Question, recursion bool) *dns.Msg {
+	if m.Id == req.Id && m.RecursionDesired == req.RecursionDesired &&
+		m.CheckingDisabled == req.CheckingDisabled && m.RecursionAvailable == recursion &&
+		sameQuestion(m.Question, question) {
+		return m
+	}
+	m = m.Copy()
+	m.Id = req.Id
+	m.RecursionDesired = req.RecursionDesired
+	m.CheckingDisabled = req.CheckingDisabled
+	m.RecursionAvailable = recursion
+	m.Question = append([]dns.Question(nil), question...)
+	return m
+}
+
+// sameQuestion reports whether the question sections a and b are equal,
+// including the case of the names.
+func sameQuestion(a, b []dns.Question) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rotateAnswer returns m with the records of each A and AAAA RRset in its
+// answer section rotated by n places. Other records, such as the CNAMEs
+// leading to the RRsets, keep their place. The records are rotated in a
+// copy, the cached m keeps its order for the next query.
+func rotateAnswer(m *dns.Msg, n uint32) *dns.Msg {
+	var keys []string
+	sets := make(map[string][]int) // the indexes of the records of each RRset
+	for i, rr := range m.Answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			key := fmt.Sprintf("%s/%d", strings.ToLower(rr.Header().Name), t)
+			if _, ok := sets[key]; !ok {
+				keys = append(keys, key)
+			}
+			sets[key] = append(sets[key], i)
+		}
+	}
+
+	copied := false
+	for _, key := range keys {
+		idx := sets[key]
+		k := int(n % uint32(len(idx)))
+		if k == 0 {
+			continue
+		}
+		if !copied {
+			m, copied = m.Copy(), true
+		}
+		rrs := make([]dns.RR, len(idx))
+		for j, i := range idx {
+			rrs[j] = m.Answer[i]
+		}
+		for j, i := range idx {
+			m.Answer[i] = rrs[(j+k)%len(idx)]
+		}
+	}
+	return m
+}
+
+// maxCNAMEChain is the number of CNAME records a chain in a response may
+// have. Longer chains are treated like loops.
+const maxCNAMEChain = 8
+
+// validateCNAMEChain follows the CNAME records in the answer section of
+// msg from every owner name and returns an error describing the chain if
+// it loops or is longer than maxCNAMEChain.
+func validateCNAMEChain(msg *dns.Msg) error {
+	cnames := make(map[string]string)
+	var owners []string
+	for _, rr := range msg.Answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			name := strings.ToLower(c.Hdr.Name)
+			if _, ok := cnames[name]; !ok {
+				owners = append(owners, name)
+			}
+			cnames[name] = strings.ToLower(c.Target)
+		}
+	}
+
+	for _, name := range owners {
+		chain := []string{name}
+		seen := map[string]bool{name: true}
+		for {
+			target, ok := cnames[name]
+			if !ok {
+				break
+			}
+			chain = append(chain, target)
+			if seen[target] {
+				return fmt.Errorf("CNAME loop %s", strings.Join(chain, " -> "))
+			}
+			if len(chain)-1 > maxCNAMEChain {
+				return fmt.Errorf("CNAME chain longer than %d records %s", maxCNAMEChain, strings.Join(chain, " -> "))
+			}
+			seen[target] = true
+			name = target
+		}
+	}
+	return nil
+}
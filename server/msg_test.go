@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testResponse returns a reply to req with n A records and an OPT record
+// carrying an EDNS0 cookie.
+func testResponse(req *dns.Msg, n int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for i := 0; i < n; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.%d.%d", req.Question[0].Name, i/256, i%256))
+		m.Answer = append(m.Answer, rr)
+	}
+	m.SetEdns0(4096, false)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	return m
+}
+
+func TestClientResponse(t *testing.T) {
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	edns := plain.Copy()
+	edns.SetEdns0(1232, false)
+
+	// The OPT record is stripped for clients that did not send one
+	resp := testResponse(plain, 1)
+	m := clientResponse(plain, resp, false)
+	if m.IsEdns0() != nil {
+		t.Error("expected OPT record to be stripped")
+	}
+	if resp.IsEdns0() == nil {
+		t.Error("expected the original response to be unchanged")
+	}
+	if len(m.Answer) != 1 || m.Truncated {
+		t.Errorf("expected the answer to be kept, got %v", m)
+	}
+
+	// and kept for clients that did
+	if m := clientResponse(edns, testResponse(edns, 1), false); m.IsEdns0() == nil {
+		t.Error("expected OPT record to be kept")
+	}
+
+	// Responses larger than the client's payload size are truncated
+	for _, tc := range []struct {
+		req  *dns.Msg
+		tcp  bool
+		size int
+	}{
+		{plain, false, 512},
+		{edns, false, 1232},
+		{plain, true, 0},
+	} {
+		resp := testResponse(tc.req, 100)
+		m := clientResponse(tc.req, resp, tc.tcp)
+		if tc.tcp {
+			if len(m.Answer) != 100 || m.Truncated {
+				t.Errorf("expected TCP response to be complete, got %d answers", len(m.Answer))
+			}
+			continue
+		}
+		if !m.Truncated || m.Len() > tc.size {
+			t.Errorf("expected response truncated to %d bytes, got %d bytes, TC %v", tc.size, m.Len(), m.Truncated)
+		}
+		if (tc.req.IsEdns0() != nil) != (m.IsEdns0() != nil) {
+			t.Errorf("expected OPT record only for EDNS0 clients, got %v", m.Extra)
+		}
+		if len(resp.Answer) != 100 {
+			t.Error("expected the original response to be unchanged")
+		}
+	}
+}
+
+// cnameResponse returns a response to a query for the first name with a
+// CNAME record from every name to the next.
+func cnameResponse(names ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(names[0], dns.TypeA)
+	for i := 0; i < len(names)-1; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN CNAME %s", names[i], names[i+1]))
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestValidateCNAMEChain(t *testing.T) {
+	ok := cnameResponse("a.com.", "b.com.", "c.com.")
+	rr, _ := dns.NewRR("c.com. 60 IN A 10.0.0.1")
+	ok.Answer = append(ok.Answer, rr)
+	if err := validateCNAMEChain(ok); err != nil {
+		t.Errorf("expected a valid chain, got %s", err)
+	}
+
+	err := validateCNAMEChain(cnameResponse("a.com.", "b.com.", "A.com."))
+	if err == nil || err.Error() != "CNAME loop a.com. -> b.com. -> a.com." {
+		t.Errorf("expected a loop, got %v", err)
+	}
+	if err := validateCNAMEChain(cnameResponse("a.com.", "a.com.")); err == nil {
+		t.Error("expected a CNAME to itself to be a loop")
+	}
+
+	// A loop that does not start at the question name
+	m := cnameResponse("a.com.", "b.com.", "c.com.", "b.com.")
+	if err := validateCNAMEChain(m); err == nil {
+		t.Error("expected a loop")
+	}
+
+	names := []string{}
+	for i := 0; i <= maxCNAMEChain; i++ {
+		names = append(names, fmt.Sprintf("n%d.com.", i))
+	}
+	if err := validateCNAMEChain(cnameResponse(names...)); err != nil {
+		t.Errorf("expected a chain of %d records to be valid, got %s", maxCNAMEChain, err)
+	}
+	names = append(names, "last.com.")
+	if err := validateCNAMEChain(cnameResponse(names...)); err == nil {
+		t.Errorf("expected a chain of %d records to be rejected", maxCNAMEChain+1)
+	}
+}
+
+func TestRotateAnswer(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeANY)
+	for _, s := range []string{
+		"www.example.com. 60 IN CNAME web.example.com.",
+		"web.example.com. 60 IN A 10.0.0.1",
+		"web.example.com. 60 IN AAAA fd00::1",
+		"web.example.com. 60 IN A 10.0.0.2",
+		"web.example.com. 60 IN AAAA fd00::2",
+		"web.example.com. 60 IN A 10.0.0.3",
+	} {
+		rr, _ := dns.NewRR(s)
+		m.Answer = append(m.Answer, rr)
+	}
+	answer := func(m *dns.Msg) string {
+		var a []string
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				a = append(a, rr.Target)
+			case *dns.A:
+				a = append(a, rr.A.String())
+			case *dns.AAAA:
+				a = append(a, rr.AAAA.String())
+			}
+		}
+		return fmt.Sprint(a)
+	}
+	original := answer(m)
+
+	for n, want := range []string{
+		"[web.example.com. 10.0.0.1 fd00::1 10.0.0.2 fd00::2 10.0.0.3]",
+		"[web.example.com. 10.0.0.2 fd00::2 10.0.0.3 fd00::1 10.0.0.1]",
+		"[web.example.com. 10.0.0.3 fd00::1 10.0.0.1 fd00::2 10.0.0.2]",
+		"[web.example.com. 10.0.0.1 fd00::2 10.0.0.2 fd00::1 10.0.0.3]",
+	} {
+		if got := answer(rotateAnswer(m, uint32(n))); got != want {
+			t.Errorf("rotated by %d: expected %s, got %s", n, want, got)
+		}
+	}
+	if answer(m) != original {
+		t.Errorf("expected the message to be left unchanged, got %s", answer(m))
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	e := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		name := m.Question[0].Name
+		return reply(m, dns.RcodeSuccess, name+" 60 IN A 10.0.0.1", name+" 60 IN A 10.0.0.2", name+" 60 IN A 10.0.0.3"), nil
+	}}
+	s := startTestServer(t, &Config{Nameservers: []string{"192.0.2.1:53"}, Exchanger: e, RCache: 10, RoundRobin: true})
+	defer s.Stop()
+
+	// The first response is forwarded, the others come from the cache
+	first := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 3 {
+			t.Fatalf("expected 3 addresses, got %v", r.Answer)
+		}
+		first[r.Answer[0].(*dns.A).A.String()] = true
+	}
+	if len(first) != 3 {
+		t.Errorf("expected each address to come first once, got %v", first)
+	}
+	if sent := e.sent(); len(sent) != 1 {
+		t.Errorf("expected one forwarded query, got %d", len(sent))
+	}
+}
@@ -0,0 +1,897 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Option sets and validates one or more fields of a Config. Options are
+// named after the command line flag they correspond to.
+type Option func(*Config) error
+
+// DefaultConfig returns a Config with the defaults of the command line
+// flags. It has no nameservers, which CheckConfig requires unless NoRec is
+// set.
+func DefaultConfig() *Config {
+	return &Config{
+		DnsAddr:            "127.0.0.1:53",
+		ReadTimeout:        2 * time.Second,
+		MaxTCPConnections:  100,
+		TCPIdleTimeout:     defaultTCPIdleTimeout,
+		MaxTCPPipeline:     defaultMaxTCPPipeline,
+		BindRetryInterval:  time.Second,
+		MaxConcurrency:     DefaultMaxConcurrency(),
+		RCacheTtl:          60,
+		CacheMinHitCount:   1,
+		CacheIPPrefixLenV4: 24,
+		CacheIPPrefixLenV6: 48,
+		CacheMaxClients:    1024,
+		Ndots:              1,
+		IfaceTtl:           10,
+		LogQueriesFormat:   "text",
+		UpstreamStrategy:   StrategyFirst,
+		UpstreamRetries:    1,
+	}
+}
+
+// NewConfig returns a Config with the defaults of the command line flags,
+// changed by opts in order. Every option validates its own values; the
+// options that depend on each other are checked once all are applied, see
+// CheckConfig. All problems found are returned as ConfigErrors.
+func NewConfig(opts ...Option) (*Config, error) {
+	config := DefaultConfig()
+
+	var errs ConfigErrors
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			if cerrs, ok := err.(ConfigErrors); ok {
+				errs = append(errs, cerrs...)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := CheckConfig(config); err != nil {
+		for _, e := range err.(ConfigErrors) {
+			if !reported(errs, e) {
+				errs = append(errs, e)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// reported reports whether err, or an error wrapping it, is in errs.
+func reported(errs []error, err error) bool {
+	for _, e := range errs {
+		if errors.Is(e, err) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkNonNegative(name string, v int) error {
+	if v < 0 {
+		return fmt.Errorf("'%s' must be equal or greater than 0", name)
+	}
+	return nil
+}
+
+func checkPositive(name string, v int) error {
+	if v <= 0 {
+		return fmt.Errorf("'%s' must be greater than 0", name)
+	}
+	return nil
+}
+
+func checkRange(name string, v, min, max int) error {
+	if v < min || v > max {
+		return fmt.Errorf("'%s' must be between %d and %d", name, min, max)
+	}
+	return nil
+}
+
+// checkHostPort validates an ip:port address.
+func checkHostPort(name, hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fmt.Errorf("'%s' is invalid: %s", name, err)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("'%s' is invalid: Bad IP address: %s", name, host)
+	}
+	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
+		return fmt.Errorf("'%s' is invalid: Bad port number %s", name, port)
+	}
+	return nil
+}
+
+// checkListenAddr is checkHostPort for 'listen', whose host may be empty
+// to listen on all addresses.
+func checkListenAddr(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || host != "" {
+		return checkHostPort("listen", hostPort)
+	}
+	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
+		return fmt.Errorf("'listen' is invalid: Bad port number %s", port)
+	}
+	return nil
+}
+
+// checkDomains returns domains as lower case FQDNs.
+func checkDomains(name string, domains []string) ([]string, error) {
+	var fqdns []string
+	for _, d := range domains {
+		d = dns.Fqdn(strings.ToLower(strings.TrimSpace(d)))
+		if _, ok := dns.IsDomainName(d); !ok || d == "." {
+			return nil, fmt.Errorf("'%s' is invalid: %q is not a domain name", name, d)
+		}
+		fqdns = append(fqdns, d)
+	}
+	return fqdns, nil
+}
+
+// WithListen sets the ip:port to answer queries on. An empty ip answers
+// on all addresses.
+func WithListen(hostPort string) Option {
+	return func(c *Config) error {
+		if err := checkListenAddr(hostPort); err != nil {
+			return err
+		}
+		c.DnsAddr = hostPort
+		return nil
+	}
+}
+
+// WithAdditionalPort answers queries on port as well, on the host of the
+// listen address. Zero disables it.
+func WithAdditionalPort(port int) Option {
+	return func(c *Config) error {
+		if port != 0 {
+			if err := checkRange("additional-port", port, 1, 65535); err != nil {
+				return err
+			}
+		}
+		c.AdditionalPort = port
+		return nil
+	}
+}
+
+// WithBindRetries tries binding the listen sockets again up to n times,
+// every interval, while one of them cannot be bound on startup.
+func WithBindRetries(n int, interval time.Duration) Option {
+	return func(c *Config) error {
+		if err := checkBindRetries(n, interval); err != nil {
+			return err
+		}
+		c.BindRetries, c.BindRetryInterval = n, interval
+		return nil
+	}
+}
+
+func checkBindRetries(n int, interval time.Duration) error {
+	if err := checkNonNegative("bind-retries", n); err != nil {
+		return err
+	}
+	if n > 0 && interval <= 0 {
+		return fmt.Errorf("'bind-retry-interval' must be greater than 0")
+	}
+	return nil
+}
+
+// WithSystemd answers queries on the sockets activated by systemd instead
+// of the listen address.
+func WithSystemd(enable bool) Option {
+	return func(c *Config) error {
+		c.Systemd = enable
+		return nil
+	}
+}
+
+// WithTCPOnly only accepts queries over TCP and forwards them over TCP.
+func WithTCPOnly(enable bool) Option {
+	return func(c *Config) error {
+		c.TcpOnly = enable
+		return nil
+	}
+}
+
+// WithInterfaces answers queries on the addresses of the named network
+// interfaces, on the port of the listen address.
+func WithInterfaces(names ...string) Option {
+	return func(c *Config) error {
+		c.Interfaces = names
+		return nil
+	}
+}
+
+// WithExceptInterfaces does not answer queries on the named network
+// interfaces.
+func WithExceptInterfaces(names ...string) Option {
+	return func(c *Config) error {
+		c.ExceptInterfaces = names
+		return nil
+	}
+}
+
+// WithBindDynamic follows the addresses of the network interfaces as they
+// are added and removed.
+func WithBindDynamic(enable bool) Option {
+	return func(c *Config) error {
+		c.BindDynamic = enable
+		return nil
+	}
+}
+
+// WithMaxTCPConnections limits the number of open TCP client connections.
+// Zero means unlimited.
+func WithMaxTCPConnections(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("max-tcp-connections", n); err != nil {
+			return err
+		}
+		c.MaxTCPConnections = n
+		return nil
+	}
+}
+
+// WithTCPIdleTimeout closes TCP client connections that have been idle
+// for d, once their pending queries are answered.
+func WithTCPIdleTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		if d <= 0 {
+			return fmt.Errorf("'tcp-idle-timeout' must be greater than 0")
+		}
+		c.TCPIdleTimeout = d
+		return nil
+	}
+}
+
+// WithMaxTCPPipeline sets how many queries of one TCP connection are
+// answered at once, in the order they complete. One answers them in order.
+func WithMaxTCPPipeline(n int) Option {
+	return func(c *Config) error {
+		if err := checkPositive("max-tcp-pipeline", n); err != nil {
+			return err
+		}
+		c.MaxTCPPipeline = n
+		return nil
+	}
+}
+
+// WithReusePort binds n UDP sockets to each address with SO_REUSEPORT,
+// each served by its own read loop. Zero or one binds a single socket.
+// Linux only, other platforms fall back to a single socket.
+func WithReusePort(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("reuseport", n); err != nil {
+			return err
+		}
+		c.ReusePort = n
+		return nil
+	}
+}
+
+// WithMaxConcurrency limits the number of queries handled at once. Zero
+// means unlimited.
+func WithMaxConcurrency(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("max-concurrency", n); err != nil {
+			return err
+		}
+		c.MaxConcurrency = n
+		return nil
+	}
+}
+
+// WithMinFreeMemoryMB answers queries with SERVFAIL and halves the cache
+// while less than mb MB of memory are free. Zero disables it.
+func WithMinFreeMemoryMB(mb int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("min-free-memory-mb", mb); err != nil {
+			return err
+		}
+		c.MinFreeMemoryMB = mb
+		return nil
+	}
+}
+
+// WithHealthListen serves the /healthz and /readyz endpoints on hostPort.
+func WithHealthListen(hostPort string) Option {
+	return func(c *Config) error {
+		if err := checkHostPort("health-listen", hostPort); err != nil {
+			return err
+		}
+		c.HealthListen = hostPort
+		return nil
+	}
+}
+
+// WithDebugListen serves pprof and expvar on the loopback hostPort.
+func WithDebugListen(hostPort string) Option {
+	return func(c *Config) error {
+		if err := checkDebugListen(hostPort); err != nil {
+			return err
+		}
+		c.DebugListen = hostPort
+		return nil
+	}
+}
+
+func checkDebugListen(hostPort string) error {
+	host, _, err := net.SplitHostPort(hostPort)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("'debug-listen' must be a loopback address")
+	}
+	return nil
+}
+
+// WithAdminSocket serves the admin API on the unix socket at path.
+func WithAdminSocket(path string) Option {
+	return func(c *Config) error {
+		c.AdminSocket = path
+		return nil
+	}
+}
+
+// WithDefaultResolver marks the server as the default nameserver of the
+// host. Registering it is up to the caller, see the resolvconf package.
+func WithDefaultResolver(enable bool) Option {
+	return func(c *Config) error {
+		c.DefaultResolver = enable
+		return nil
+	}
+}
+
+// WithExtraResolvConf merges the nameservers and search domains of the
+// resolver configuration at path with the configured ones, see ResolvConf.
+func WithExtraResolvConf(path string) Option {
+	return func(c *Config) error {
+		c.ExtraResolvConf = path
+		return nil
+	}
+}
+
+// WithSearchDomains sets the search domains, stored as lower case FQDNs.
+func WithSearchDomains(domains ...string) Option {
+	return func(c *Config) error {
+		fqdns, err := checkDomains("search-domains", domains)
+		if err != nil {
+			return err
+		}
+		c.SearchDomains = fqdns
+		return nil
+	}
+}
+
+// WithAppendSearchDomains resolves queries using the search domains.
+func WithAppendSearchDomains(enable bool) Option {
+	return func(c *Config) error {
+		c.AppendDomain = enable
+		return nil
+	}
+}
+
+// WithParallelLookup sends the A and AAAA queries for each search domain
+// expansion at once.
+func WithParallelLookup(enable bool) Option {
+	return func(c *Config) error {
+		c.ParallelLookup = enable
+		return nil
+	}
+}
+
+// WithHostsfile serves the hostsfiles at paths, polled for changes every
+// poll seconds. Zero disables polling. Empty paths are ignored.
+func WithHostsfile(paths []string, poll int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("hostsfile-poll", poll); err != nil {
+			return err
+		}
+		c.Hostsfile = nil
+		for _, path := range paths {
+			if path != "" {
+				c.Hostsfile = append(c.Hostsfile, path)
+			}
+		}
+		c.PollInterval = poll
+		return nil
+	}
+}
+
+// WithRoundRobin rotates the order of A and AAAA records in answers.
+func WithRoundRobin(enable bool) Option {
+	return func(c *Config) error {
+		c.RoundRobin = enable
+		return nil
+	}
+}
+
+// WithNameservers sets the ip:port addresses of the nameservers queries
+// are forwarded to, in order of preference.
+func WithNameservers(hostPorts ...string) Option {
+	return func(c *Config) error {
+		for _, hostPort := range hostPorts {
+			if err := checkHostPort("nameservers", hostPort); err != nil {
+				return err
+			}
+		}
+		c.Nameservers = hostPorts
+		return nil
+	}
+}
+
+// WithMinAnswers sends forwarded queries to all nameservers at once and
+// waits for n of them to answer. Stub zones are not affected. Zero
+// disables it.
+func WithMinAnswers(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("min-answers", n); err != nil {
+			return err
+		}
+		c.MinAnswers = n
+		return nil
+	}
+}
+
+// WithEdnsBufferSize sets the UDP payload size announced to the
+// nameservers. Zero leaves queries untouched.
+func WithEdnsBufferSize(size int) Option {
+	return func(c *Config) error {
+		if size != 0 {
+			if err := checkRange("edns-buffer-size", size, 512, 65535); err != nil {
+				return err
+			}
+		}
+		c.EdnsBufferSize = size
+		return nil
+	}
+}
+
+// WithNoTCPRetry returns truncated UDP responses of the nameservers to the
+// client instead of retrying the query over TCP.
+func WithNoTCPRetry(disable bool) Option {
+	return func(c *Config) error {
+		c.NoTCPRetry = disable
+		return nil
+	}
+}
+
+// WithUpstreamPoolSize keeps n sockets open per upstream nameserver and
+// protocol instead of opening a socket per query. Zero disables the pool.
+func WithUpstreamPoolSize(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("upstream-pool-size", n); err != nil {
+			return err
+		}
+		c.UpstreamPoolSize = n
+		return nil
+	}
+}
+
+// WithUpstreamStrategy sets the order the upstream nameservers are tried
+// in, one of "first", "round-robin", "random" or "fastest".
+func WithUpstreamStrategy(strategy string) Option {
+	return func(c *Config) error {
+		if err := checkUpstreamStrategy(UpstreamStrategy(strategy)); err != nil {
+			return err
+		}
+		c.UpstreamStrategy = UpstreamStrategy(strategy)
+		return nil
+	}
+}
+
+// WithUpstreamRetries sets how many times a query is sent to the next
+// nameserver after an error, a timeout or SERVFAIL.
+func WithUpstreamRetries(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("upstream-retries", n); err != nil {
+			return err
+		}
+		c.UpstreamRetries = n
+		return nil
+	}
+}
+
+// WithUpstreamRTTWindow sets the number of responses the average response
+// time of a nameserver mostly reflects with the "fastest" strategy. Zero
+// means 10.
+func WithUpstreamRTTWindow(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("upstream-rtt-window", n); err != nil {
+			return err
+		}
+		c.UpstreamRTTWindow = n
+		return nil
+	}
+}
+
+// WithUpstreamSourceIP sends the queries to the upstream and stub zone
+// nameservers from ip. Empty lets the system choose the address.
+func WithUpstreamSourceIP(ip string) Option {
+	return func(c *Config) error {
+		if ip == "" {
+			c.UpstreamSourceIP = nil
+			return nil
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("'upstream-source-ip' is invalid: Bad IP address: %s", ip)
+		}
+		c.UpstreamSourceIP = parsed
+		return nil
+	}
+}
+
+// WithNoRec disables forwarding queries to the nameservers.
+func WithNoRec(enable bool) Option {
+	return func(c *Config) error {
+		c.NoRec = enable
+		return nil
+	}
+}
+
+// WithReadTimeout sets how long to wait for the answer of a nameserver.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		if d <= 0 {
+			return fmt.Errorf("'read-timeout' must be greater than 0")
+		}
+		c.ReadTimeout = d
+		return nil
+	}
+}
+
+// WithForwardersOnly forwards every query as is.
+func WithForwardersOnly(enable bool) Option {
+	return func(c *Config) error {
+		c.ForwardersOnly = enable
+		return nil
+	}
+}
+
+// WithIfaceDiscovery serves the addresses of the network interfaces under
+// domain with the given TTL in seconds.
+func WithIfaceDiscovery(domain string, ttl uint32) Option {
+	return func(c *Config) error {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+			return fmt.Errorf("'iface-domain' is invalid")
+		}
+		c.IfaceDomain, c.IfaceTtl = domain, ttl
+		return nil
+	}
+}
+
+// WithRCache sets the capacity of the response cache. Zero disables it.
+func WithRCache(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("rcache", n); err != nil {
+			return err
+		}
+		c.RCache = n
+		return nil
+	}
+}
+
+// WithRCacheTTL sets how long responses are cached, in seconds.
+func WithRCacheTTL(ttl int) Option {
+	return func(c *Config) error {
+		if err := checkPositive("rcache-ttl", ttl); err != nil {
+			return err
+		}
+		c.RCacheTtl = ttl
+		return nil
+	}
+}
+
+// WithCacheMinHitCount caches responses from their nth lookup on.
+func WithCacheMinHitCount(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("cache-min-hit-count", n); err != nil {
+			return err
+		}
+		c.CacheMinHitCount = n
+		return nil
+	}
+}
+
+// WithCacheByClientIP keeps a response cache per client network of the
+// given prefix lengths, for at most maxClients networks.
+func WithCacheByClientIP(prefixLenV4, prefixLenV6, maxClients int) Option {
+	return func(c *Config) error {
+		var errs ConfigErrors
+		for _, err := range []error{
+			checkRange("cache-ip-prefix-len-v4", prefixLenV4, 0, 32),
+			checkRange("cache-ip-prefix-len-v6", prefixLenV6, 0, 128),
+			checkPositive("cache-max-clients", maxClients),
+		} {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		c.CacheByClientIP = true
+		c.CacheIPPrefixLenV4, c.CacheIPPrefixLenV6, c.CacheMaxClients = prefixLenV4, prefixLenV6, maxClients
+		return nil
+	}
+}
+
+// WithCacheDump writes the contents of the response cache to file as JSON
+// every interval. Zero interval disables it.
+func WithCacheDump(file string, interval time.Duration) Option {
+	return func(c *Config) error {
+		if err := checkCacheDump(file, interval); err != nil {
+			return err
+		}
+		c.CacheDumpFile, c.CacheDumpInterval = file, interval
+		return nil
+	}
+}
+
+func checkCacheDump(file string, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("'cache-dump-interval' must be equal or greater than 0")
+	}
+	if interval > 0 && file == "" {
+		return fmt.Errorf("'cache-dump-interval' requires 'cache-dump-file'")
+	}
+	return nil
+}
+
+// WithFwdNdots sets how many dots a name must have to be forwarded.
+func WithFwdNdots(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("fwd-ndots", n); err != nil {
+			return err
+		}
+		c.FwdNdots = n
+		return nil
+	}
+}
+
+// WithNdots sets how many dots a name must have before it is first
+// queried as an absolute name. With 0 every name is.
+func WithNdots(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("ndots", n); err != nil {
+			return err
+		}
+		c.Ndots = n
+		return nil
+	}
+}
+
+// WithAppendNdots sets how many dots a name must have before it is
+// queried as-is ahead of the search domains. Zero means the value of Ndots.
+func WithAppendNdots(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("append-ndots", n); err != nil {
+			return err
+		}
+		c.AppendNdots = n
+		return nil
+	}
+}
+
+// WithVerbose logs debug messages for every query.
+func WithVerbose(enable bool) Option {
+	return func(c *Config) error {
+		c.Verbose = enable
+		return nil
+	}
+}
+
+// WithDebugDomain logs debug messages for queries of names under domain.
+func WithDebugDomain(domain string) Option {
+	return func(c *Config) error {
+		fqdns, err := checkDomains("debug-domain", []string{domain})
+		if err != nil {
+			return err
+		}
+		c.DebugDomain = fqdns[0]
+		return nil
+	}
+}
+
+// WithDnstapSocket sends dnstap messages to the collector listening on the
+// unix socket at path.
+func WithDnstapSocket(path string) Option {
+	return func(c *Config) error {
+		c.DnstapSocket = path
+		return nil
+	}
+}
+
+// WithOtlpEndpoint sends query traces to the OTLP/gRPC collector at
+// hostPort.
+func WithOtlpEndpoint(hostPort string) Option {
+	return func(c *Config) error {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return fmt.Errorf("'otlp-endpoint' is invalid: %s", err)
+		}
+		c.OtlpEndpoint = hostPort
+		return nil
+	}
+}
+
+// WithTrackTop tracks the n most queried domains and busiest clients.
+func WithTrackTop(n int) Option {
+	return func(c *Config) error {
+		if err := checkNonNegative("track-top", n); err != nil {
+			return err
+		}
+		c.TrackTop = n
+		return nil
+	}
+}
+
+// WithLogSlowQueries logs queries that take longer than d to answer.
+func WithLogSlowQueries(d time.Duration) Option {
+	return func(c *Config) error {
+		if d < 0 {
+			return fmt.Errorf("'log-slow-queries' must be equal or greater than 0")
+		}
+		c.LogSlowQueries = d
+		return nil
+	}
+}
+
+// WithQueryLog logs every query to file, or stdout if it is empty, in
+// format 'text' or 'json'.
+func WithQueryLog(file, format string) Option {
+	return func(c *Config) error {
+		if err := checkLogQueriesFormat(format); err != nil {
+			return err
+		}
+		c.LogQueries, c.LogQueriesFile, c.LogQueriesFormat = true, file, format
+		return nil
+	}
+}
+
+func checkLogQueriesFormat(format string) error {
+	switch format {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("'log-queries-format' must be either 'text' or 'json'")
+}
+
+// WithTTLRewrites overrides the TTL of upstream records, see
+// ParseTTLRewriteRule.
+func WithTTLRewrites(rules ...TTLRewriteRule) Option {
+	return func(c *Config) error {
+		c.TTLRewrites = rules
+		return nil
+	}
+}
+
+// WithIPRewrites maps the addresses of upstream records into another
+// network, see ParseIPRewriteRule.
+func WithIPRewrites(rules ...IPRewriteRule) Option {
+	return func(c *Config) error {
+		c.IPRewrites = rules
+		return nil
+	}
+}
+
+// WithResponseRewrites replaces single addresses in upstream answers, see
+// ParseResponseRewriteRule.
+func WithResponseRewrites(rules ...ResponseRewriteRule) Option {
+	return func(c *Config) error {
+		c.ResponseRewrites = rules
+		return nil
+	}
+}
+
+// WithStopRebind refuses upstream answers with private addresses.
+func WithStopRebind(enable bool) Option {
+	return func(c *Config) error {
+		c.StopRebind = enable
+		return nil
+	}
+}
+
+// WithRebindLocalhostOk allows loopback addresses despite WithStopRebind.
+func WithRebindLocalhostOk(enable bool) Option {
+	return func(c *Config) error {
+		c.RebindLocalhostOk = enable
+		return nil
+	}
+}
+
+// WithRebindDomainOk exempts the answers for names under domains from
+// WithStopRebind.
+func WithRebindDomainOk(domains ...string) Option {
+	return func(c *Config) error {
+		fqdns, err := checkDomains("rebind-domain-ok", domains)
+		if err != nil {
+			return err
+		}
+		c.RebindDomainOk = fqdns
+		return nil
+	}
+}
+
+// WithLocalDomains answers queries for names under domains from the
+// hostsfile or with NXDOMAIN instead of forwarding them.
+func WithLocalDomains(domains ...string) Option {
+	return func(c *Config) error {
+		fqdns, err := checkDomains("local-domain", domains)
+		if err != nil {
+			return err
+		}
+		c.LocalDomains = fqdns
+		return nil
+	}
+}
+
+// WithNoPrivateReverse answers PTR queries for private and link-local
+// addresses that are not in the hostsfile with NXDOMAIN.
+func WithNoPrivateReverse(enable bool) Option {
+	return func(c *Config) error {
+		c.NoPrivateReverse = enable
+		return nil
+	}
+}
+
+// WithQtypeFilter answers queries of the types, given by name such as
+// "AAAA", with NODATA unless the hostsfile has records of the type.
+func WithQtypeFilter(types ...string) Option {
+	return func(c *Config) error {
+		var qtypes []uint16
+		for _, t := range types {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(t))]
+			if !ok {
+				return fmt.Errorf("'qtype-filter' is invalid: %q is not a query type", t)
+			}
+			qtypes = append(qtypes, qtype)
+		}
+		c.QtypeFilter = qtypes
+		return nil
+	}
+}
+
+// WithStubZones forwards queries for names under the domains in zones to
+// their ip:port nameservers.
+func WithStubZones(zones map[string][]string) Option {
+	return func(c *Config) error {
+		stubs := make(map[string]*StubZone)
+		for zone, nameservers := range zones {
+			for _, hostPort := range nameservers {
+				if err := checkHostPort("stubzones", hostPort); err != nil {
+					return err
+				}
+			}
+			stubs[dns.Fqdn(zone)] = NewStubZone(nameservers)
+		}
+		c.Stub = &stubs
+		return nil
+	}
+}
+
+// WithAliases answers queries for names under the domains in aliases with
+// the records of the same names under their target domains.
+func WithAliases(aliases map[string]string) Option {
+	return func(c *Config) error {
+		c.Alias = &aliases
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+	config, err := NewConfig(WithNameservers("8.8.8.8:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DnsAddr != "127.0.0.1:53" || config.ReadTimeout != 2*time.Second || config.Ndots != 1 || config.RCacheTtl != 60 {
+		t.Errorf("expected the defaults of the command line flags, got %+v", config)
+	}
+	if config.Stub == nil || config.Alias == nil {
+		t.Error("expected stub zones and aliases to be initialized")
+	}
+
+	config, err = NewConfig(
+		WithListen("[::1]:5353"),
+		WithNameservers("8.8.8.8:53", "[2001:4860:4860::8888]:53"),
+		WithSearchDomains("Svc.Cluster.Local", "cluster.local."),
+		WithStubZones(map[string][]string{"corp.example": {"10.0.0.1:53"}}),
+		WithCacheByClientIP(24, 56, 10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"svc.cluster.local.", "cluster.local."}; !reflect.DeepEqual(config.SearchDomains, want) {
+		t.Errorf("expected search domains %v, got %v", want, config.SearchDomains)
+	}
+	if _, ok := (*config.Stub)["corp.example."]; !ok {
+		t.Errorf("expected stub zone corp.example., got %v", *config.Stub)
+	}
+	if !config.CacheByClientIP || config.CacheIPPrefixLenV6 != 56 || config.CacheMaxClients != 10 {
+		t.Errorf("expected the client cache options to be set, got %+v", config)
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		opt  Option
+		want string
+	}{
+		{WithListen("localhost:53"), "'listen' is invalid: Bad IP address: localhost"},
+		{WithListen(":0"), "'listen' is invalid: Bad port number 0"},
+		{WithNameservers("8.8.8.8"), "'nameservers' is invalid: address 8.8.8.8: missing port in address"},
+		{WithRCache(-1), "'rcache' must be equal or greater than 0"},
+		{WithRCacheTTL(0), "'rcache-ttl' must be greater than 0"},
+		{WithEdnsBufferSize(100), "'edns-buffer-size' must be between 512 and 65535"},
+		{WithAdditionalPort(53), "'additional-port' must differ from the port of 'listen'"},
+		{WithAdditionalPort(70000), "'additional-port' must be between 1 and 65535"},
+		{WithTCPIdleTimeout(0), "'tcp-idle-timeout' must be greater than 0"},
+		{WithMaxTCPPipeline(0), "'max-tcp-pipeline' must be greater than 0"},
+		{WithReusePort(-1), "'reuseport' must be equal or greater than 0"},
+		{func(c *Config) error { c.Systemd, c.ReusePort = true, 4; return nil }, "'reuseport' cannot be used with 'systemd'"},
+		{WithDebugListen("0.0.0.0:6060"), "'debug-listen' must be a loopback address"},
+		{WithQueryLog("", "xml"), "'log-queries-format' must be either 'text' or 'json'"},
+		{WithQtypeFilter("AAAA", "BOGUS"), `'qtype-filter' is invalid: "BOGUS" is not a query type`},
+		{WithSearchDomains("bad..domain"), `'search-domains' is invalid: "bad..domain." is not a domain name`},
+	} {
+		_, err := NewConfig(WithNameservers("8.8.8.8:53"), tc.opt)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("expected %q, got %v", tc.want, err)
+		}
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("expected ConfigErrors, got %T", err)
+		}
+	}
+
+	// Every problem is reported, the options depending on each other once
+	// all are applied
+	_, err := NewConfig(WithRCache(-1), WithCacheByClientIP(33, 129, 0), WithBindDynamic(true))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 6 {
+		t.Fatalf("expected 6 problems, got %v", err)
+	}
+	if !errors.Is(err, ErrNoUpstreams) {
+		t.Errorf("expected ErrNoUpstreams, got %s", err)
+	}
+
+	// A problem reported by an option is not repeated by CheckConfig
+	wrapped := func(c *Config) error { return fmt.Errorf("%w: because", ErrNoUpstreams) }
+	if _, err := NewConfig(wrapped); err == nil || len(err.(ConfigErrors)) != 1 {
+		t.Errorf("expected 1 problem, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// lookupIP resolves the hostnames given to ParseListenAddr, a variable
+// for testing.
+var lookupIP = net.LookupIP
+
+// ParseListenAddr returns the address s, given as host, host:port, :port,
+// [IPv6] or [IPv6]:port, as host:port with the port 53 if s has none. The
+// host is an IP address, which may be IPv6 without brackets, or a hostname
+// resolved with the system resolver to its first IPv4 address, or its
+// first address if it has none. An empty host listens on all addresses of
+// both IPv4 and IPv6. The port is checked to be in range but may be 0.
+func ParseListenAddr(s string) (string, error) {
+	host, port, err := splitAddr(s)
+	switch {
+	case err != nil:
+		return "", err
+	case host == "" || isIPHost(host):
+	case isHostname(host):
+		if host, err = resolveListenHost(host); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Bad IP address: %s", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseIPAddr returns the address s, which must have an IP address as
+// host, as host:port, see ParseListenAddr.
+func parseIPAddr(s string) (string, error) {
+	host, port, err := splitAddr(s)
+	if err != nil {
+		return "", err
+	}
+	if !isIPHost(host) {
+		return "", fmt.Errorf("Bad IP address: %s", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitAddr splits s, given as host, host:port, :port, [IPv6] or
+// [IPv6]:port, into its host without brackets and its port, 53 if s has
+// none. More than one colon without brackets is an IPv6 address.
+func splitAddr(s string) (host, port string, err error) {
+	s = strings.TrimSpace(s)
+	host, port, hasPort := s, "", false
+	switch {
+	case s == "":
+		return "", "", fmt.Errorf("Missing address")
+	case strings.HasPrefix(s, "["):
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return "", "", fmt.Errorf("Missing ']' in address %s", s)
+		}
+		host, port = s[1:end], s[end+1:]
+		if port != "" {
+			if port[0] != ':' {
+				return "", "", fmt.Errorf("Unexpected %q after ']' in address %s", port, s)
+			}
+			port, hasPort = port[1:], true
+		}
+		if !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("Brackets are only allowed around IPv6 addresses: %s", s)
+		}
+	case strings.Count(s, ":") == 1:
+		i := strings.IndexByte(s, ':')
+		host, port, hasPort = s[:i], s[i+1:], true
+	}
+
+	if !hasPort {
+		return host, "53", nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", "", fmt.Errorf("Bad port number %s", port)
+	}
+	return host, strconv.Itoa(int(p)), nil
+}
+
+// isIPHost reports whether host is an IP address. IPv6 addresses may
+// carry a zone.
+func isIPHost(host string) bool {
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host, ":") {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil
+}
+
+// isHostname reports whether host is a name to resolve rather than a
+// malformed IP address: it has a letter and no characters other than
+// letters, digits, '-' and '.'.
+func isHostname(host string) bool {
+	letter := false
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+			letter = true
+		case r >= '0' && r <= '9' || r == '-' || r == '.':
+		default:
+			return false
+		}
+	}
+	return letter
+}
+
+// resolveListenHost returns the first IPv4 address of hostname, or its
+// first address if it has none.
+func resolveListenHost(hostname string) (string, error) {
+	ips, err := lookupIP(hostname)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve %s: %s", hostname, err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("No addresses found for %s", hostname)
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return ips[0].String(), nil
+}
+
+// parseNameserver returns the address of a nameserver given to the option
+// name, which must have an IP address as host, see ParseListenAddr. The
+// port must not be 0.
+func parseNameserver(name, s string) (string, error) {
+	hostPort, err := parseIPAddr(s)
+	if err == nil {
+		err = checkHostPort(name, hostPort)
+	} else {
+		err = fmt.Errorf("'%s' is invalid: %s", name, err)
+	}
+	return hostPort, err
+}
+
+// splitList returns the comma separated items of s without the spaces
+// around them. Empty items, such as after a trailing comma, are dropped.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseNameservers parses the comma separated nameserver addresses of the
+// 'nameservers' option, IP addresses with an optional port, see
+// ParseListenAddr. All problems found are returned as ConfigErrors.
+func ParseNameservers(s string) ([]string, error) {
+	var nameservers []string
+	var errs ConfigErrors
+	for _, item := range splitList(s) {
+		hostPort, err := parseNameserver("nameservers", item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nameservers = append(nameservers, hostPort)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return nameservers, nil
+}
+
+// ParseSearchDomains parses the comma separated domains of the
+// 'search-domains' option, which must have at least one dot, and returns
+// them as lower case FQDNs. All problems found are returned as
+// ConfigErrors.
+func ParseSearchDomains(s string) ([]string, error) {
+	var domains []string
+	var errs ConfigErrors
+	for _, item := range splitList(s) {
+		domain, err := parseDomain("search-domains", item)
+		if err == nil && dns.CountLabel(domain) < 2 {
+			err = fmt.Errorf("'search-domains' is invalid: %q must have at least one dot", item)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return domains, nil
+}
+
+// parseDomain returns the domain s given to the option name as a lower
+// case FQDN.
+func parseDomain(name, s string) (string, error) {
+	domain := dns.Fqdn(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "." {
+		return "", fmt.Errorf("'%s' is invalid: %q is not a domain name", name, s)
+	}
+	return domain, nil
+}
+
+// ParseAliases parses the values of the 'alias' option, each given as
+// domain/target, into a map of lower case FQDNs. All problems found are
+// returned as ConfigErrors.
+func ParseAliases(args []string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	var errs ConfigErrors
+	for _, arg := range args {
+		segments := strings.Split(arg, "/")
+		if len(segments) != 2 || strings.TrimSpace(segments[0]) == "" || strings.TrimSpace(segments[1]) == "" {
+			errs = append(errs, fmt.Errorf("'alias' is invalid: %q must be given as domain/target", arg))
+			continue
+		}
+		domain, err := parseDomain("alias", segments[0])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		target, err := parseDomain("alias", segments[1])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		aliases[domain] = target
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return aliases, nil
+}
+
+// ParseStubZones parses the values of the 'stubzones' option, each given
+// as domain[,domain...]/host[:port][,host[:port]...], into the nameservers
+// of each domain. The domains are returned as lower case FQDNs, see
+// ParseListenAddr for the addresses. All problems found are returned as
+// ConfigErrors.
+func ParseStubZones(args []string) (map[string][]string, error) {
+	zones := make(map[string][]string)
+	var errs ConfigErrors
+	for _, arg := range args {
+		segments := strings.Split(arg, "/")
+		if len(segments) != 2 {
+			errs = append(errs, fmt.Errorf("'stubzones' is invalid: %q must be given as domain/host[:port]", arg))
+			continue
+		}
+		domains, hosts := splitList(segments[0]), splitList(segments[1])
+		if len(domains) == 0 || len(hosts) == 0 {
+			errs = append(errs, fmt.Errorf("'stubzones' is invalid: %q must be given as domain/host[:port]", arg))
+			continue
+		}
+
+		var nameservers []string
+		for _, host := range hosts {
+			hostPort, err := parseNameserver("stubzones", host)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			nameservers = append(nameservers, hostPort)
+		}
+		for _, d := range domains {
+			domain, err := parseDomain("stubzones", d)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			zones[domain] = append(zones[domain], nameservers...)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return zones, nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "localhost":
+			return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+		case "ip6-localhost":
+			return []net.IP{net.ParseIP("::1")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		// IP
+		{"127.0.0.1", "127.0.0.1:53"},
+		{"0.0.0.0", "0.0.0.0:53"},
+		{" 10.0.0.1 ", "10.0.0.1:53"},
+		{"::", "[::]:53"},
+		{"::1", "[::1]:53"},
+		{"2001:db8::1", "[2001:db8::1]:53"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:53"},
+		{"::ffff:127.0.0.1", "[::ffff:127.0.0.1]:53"},
+		// IP:port
+		{"127.0.0.1:5353", "127.0.0.1:5353"},
+		{"0.0.0.0:0", "0.0.0.0:0"},
+		{"127.0.0.1:053", "127.0.0.1:53"},
+		{"127.0.0.1:65535", "127.0.0.1:65535"},
+		// [IPv6]
+		{"[::]", "[::]:53"},
+		{"[::1]", "[::1]:53"},
+		{"[fe80::1%eth0]", "[fe80::1%eth0]:53"},
+		// [IPv6]:port
+		{"[::]:53", "[::]:53"},
+		{"[::1]:0", "[::1]:0"},
+		{"[2001:db8::1]:5353", "[2001:db8::1]:5353"},
+		{"[fe80::1%eth0]:5353", "[fe80::1%eth0]:5353"},
+		// :port
+		{":53", ":53"},
+		{":5300", ":5300"},
+		{" :0", ":0"},
+		// Hostnames, IPv4 first
+		{"localhost", "127.0.0.1:53"},
+		{"localhost:5300", "127.0.0.1:5300"},
+		{"ip6-localhost", "[::1]:53"},
+		// Invalid
+		{"", ""},
+		{":", ""},
+		{"unknown.example:53", ""},
+		{"local_host", ""},
+		{"[localhost]:53", ""},
+		{"127.0.0.1:", ""},
+		{"127.0.0.1:65536", ""},
+		{"127.0.0.1:-1", ""},
+		{"127.0.0.1:+53", ""},
+		{"127.0.0.1:dns", ""},
+		{"127.0.0.1%eth0", ""},
+		{"999.0.0.1", ""},
+		{"[::1", ""},
+		{"[::1]:", ""},
+		{"[::1]53", ""},
+		{"[::1]:53:53", ""},
+		{"[127.0.0.1]:53", ""},
+		{"[]:53", ""},
+		{"::1]:53", ""},
+		{"::1:53x", ""},
+	} {
+		out, err := ParseListenAddr(tc.in)
+		switch {
+		case tc.out == "" && err == nil:
+			t.Errorf("%q: expected an error, got %q", tc.in, out)
+		case tc.out != "" && err != nil:
+			t.Errorf("%q: expected %q, got error %s", tc.in, tc.out, err)
+		case out != tc.out:
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.out, out)
+		}
+	}
+}
+
+func TestParseNameservers(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		out  string
+		errs int
+	}{
+		{"", "[]", 0},
+		{"8.8.8.8", "[8.8.8.8:53]", 0},
+		{"8.8.8.8:5353, 2001:db8::1,[::1]:54", "[8.8.8.8:5353 [2001:db8::1]:53 [::1]:54]", 0},
+		// Empty segments and trailing commas
+		{"8.8.8.8,", "[8.8.8.8:53]", 0},
+		{",8.8.8.8,,8.8.4.4, ,", "[8.8.8.8:53 8.8.4.4:53]", 0},
+		{",", "[]", 0},
+		// Every problem is reported
+		{"8.8.8.8:0", "", 1},
+		{"dns.google", "", 1},
+		{":53,localhost", "", 2},
+		{"8.8.8.8:65536,localhost,[::1", "", 3},
+		{"8.8.8.8,[127.0.0.1]:53", "", 1},
+	} {
+		out, err := ParseNameservers(tc.in)
+		if tc.errs == 0 {
+			if err != nil {
+				t.Errorf("%q: %s", tc.in, err)
+			} else if fmt.Sprint(out) != tc.out {
+				t.Errorf("%q: expected %s, got %v", tc.in, tc.out, out)
+			}
+			continue
+		}
+		if errs, ok := err.(ConfigErrors); !ok || len(errs) != tc.errs {
+			t.Errorf("%q: expected %d errors, got %v", tc.in, tc.errs, err)
+		}
+	}
+}
+
+func TestParseSearchDomains(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		out  string
+		errs int
+	}{
+		{"", "[]", 0},
+		{"Example.com", "[example.com.]", 0},
+		{" example.com , svc.cluster.local.,", "[example.com. svc.cluster.local.]", 0},
+		{",,example.com,", "[example.com.]", 0},
+		{"local", "", 1},
+		{"local.,com", "", 2},
+		{"example.com,bad..name", "", 1},
+	} {
+		out, err := ParseSearchDomains(tc.in)
+		if tc.errs == 0 {
+			if err != nil {
+				t.Errorf("%q: %s", tc.in, err)
+			} else if fmt.Sprint(out) != tc.out {
+				t.Errorf("%q: expected %s, got %v", tc.in, tc.out, out)
+			}
+			continue
+		}
+		if errs, ok := err.(ConfigErrors); !ok || len(errs) != tc.errs {
+			t.Errorf("%q: expected %d errors, got %v", tc.in, tc.errs, err)
+		}
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		out  string
+		errs int
+	}{
+		{nil, "map[]", 0},
+		{[]string{"mydomain.local/realdomain.com"}, "map[mydomain.local.:realdomain.com.]", 0},
+		{[]string{"A.local./B.example.com.", "c/d"}, "map[a.local.:b.example.com. c.:d.]", 0},
+		{[]string{"mydomain.local"}, "", 1},
+		{[]string{"/realdomain.com", "mydomain.local/", "a/b/c"}, "", 3},
+		{[]string{"a..local/b", "a/b"}, "", 1},
+	} {
+		out, err := ParseAliases(tc.in)
+		if tc.errs == 0 {
+			if err != nil {
+				t.Errorf("%q: %s", tc.in, err)
+			} else if fmt.Sprint(out) != tc.out {
+				t.Errorf("%q: expected %s, got %v", tc.in, tc.out, out)
+			}
+			continue
+		}
+		if errs, ok := err.(ConfigErrors); !ok || len(errs) != tc.errs {
+			t.Errorf("%q: expected %d errors, got %v", tc.in, tc.errs, err)
+		}
+	}
+}
+
+func TestParseStubZones(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		out  string
+		errs int
+	}{
+		{nil, "map[]", 0},
+		{[]string{"consul/10.0.0.1:8600"}, "map[consul.:[10.0.0.1:8600]]", 0},
+		{[]string{"a.local,B.local/10.0.0.1,[2001:db8::53]:5353"}, "map[a.local.:[10.0.0.1:53 [2001:db8::53]:5353] b.local.:[10.0.0.1:53 [2001:db8::53]:5353]]", 0},
+		{[]string{"a.local/10.0.0.1", "a.local/2001:db8::53"}, "map[a.local.:[10.0.0.1:53 [2001:db8::53]:53]]", 0},
+		// Empty segments and trailing commas
+		{[]string{"a.local,,/10.0.0.1,"}, "map[a.local.:[10.0.0.1:53]]", 0},
+		{[]string{"a.local"}, "", 1},
+		{[]string{"a.local/", "/10.0.0.1", ",/,"}, "", 3},
+		{[]string{"a.local/10.0.0.1:0,ns.local,[::1"}, "", 3},
+		{[]string{"a..local,b.local/10.0.0.1"}, "", 1},
+	} {
+		out, err := ParseStubZones(tc.in)
+		if tc.errs == 0 {
+			if err != nil {
+				t.Errorf("%q: %s", tc.in, err)
+			} else if fmt.Sprint(out) != tc.out {
+				t.Errorf("%q: expected %s, got %v", tc.in, tc.out, out)
+			}
+			continue
+		}
+		if errs, ok := err.(ConfigErrors); !ok || len(errs) != tc.errs {
+			t.Errorf("%q: expected %d errors, got %v", tc.in, tc.errs, err)
+		}
+	}
+}
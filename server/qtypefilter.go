@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/stats"
+	"github.com/miekg/dns"
+)
+
+// filtersQtype reports whether queries of qtype are answered with NODATA
+// unless the hostsfile has records of that type.
+func (c *Config) filtersQtype(qtype uint16) bool {
+	for _, t := range c.QtypeFilter {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// qtypeFilterStage answers the queries of the types in QtypeFilter from
+// the hostsfile, or with an empty NOERROR response. Neither the cache nor
+// the upstream nameservers are consulted.
+func (s *server) qtypeFilterStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		config := s.confFor(w)
+		q := req.Question[0]
+		if !config.filtersQtype(q.Qtype) {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		m := newReply(config, req)
+		if !config.ForwardersOnly && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+			records, err := s.AddressRecords(q, strings.ToLower(q.Name))
+			if err != nil {
+				logFor(w).WithError(err).Error("Error querying hostsfile records")
+			}
+			if len(records) > 0 {
+				setSource(w, SourceHostsfile)
+				m.Authoritative = true
+				m.Answer = records
+			}
+		}
+		if len(m.Answer) == 0 {
+			setSource(w, SourceLocal)
+			stats.NoDataCount.Inc(1)
+			if debugEnabled(w) {
+				logFor(w).Debug("Answering with NODATA, the query type is filtered")
+			}
+		}
+
+		bufsize, _, tcp := queryParams(w, req)
+		if tcp {
+			if _, overflow := Fit(m, dns.MaxMsgSize, tcp); overflow {
+				m = new(dns.Msg)
+				s.ServerFailure(m, req)
+			}
+		} else {
+			Fit(m, int(bufsize), tcp)
+		}
+		if err := w.WriteMsg(m); err != nil {
+			log.Errorf("Failed to return reply %q", err)
+		}
+	})
+}
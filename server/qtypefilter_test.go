@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeFilter(t *testing.T) {
+	var forwarded int32
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&forwarded, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 v4.local\nfd00::1 v6.local\n"),
+		&Config{Nameservers: []string{upstream}, RCache: 100, QtypeFilter: []uint16{dns.TypeAAAA}})
+	defer s.Stop()
+
+	c := new(dns.Client)
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		answer string
+	}{
+		{"example.com.", dns.TypeAAAA, ""},
+		{"v4.local.", dns.TypeAAAA, ""},
+		{"v6.local.", dns.TypeAAAA, "fd00::1"},
+		{"example.com.", dns.TypeAAAA, ""},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		resp, _, err := c.Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected NOERROR, got %s", tc.name, dns.RcodeToString[resp.Rcode])
+		}
+		switch {
+		case tc.answer == "" && len(resp.Answer) != 0:
+			t.Errorf("%s: expected NODATA, got %v", tc.name, resp.Answer)
+		case tc.answer != "" && (len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != tc.answer):
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.answer, resp.Answer)
+		}
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 0 {
+		t.Errorf("expected no filtered query to be forwarded, got %d", n)
+	}
+
+	// Other types are forwarded as usual
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	resp, _, err := c.Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || atomic.LoadInt32(&forwarded) != 1 {
+		t.Errorf("expected the A query to be forwarded, got %v", resp.Answer)
+	}
+}
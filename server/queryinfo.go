@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryInfoOption is the EDNS0 option code, from the range reserved for
+// local use, a client adds to a query to learn where the answer came from.
+// The response carries the option with "source=<source>", followed by
+// " upstream=<host:port>" if a nameserver answered the query. As the
+// upstreams are internal topology, like the admin API the option is only
+// answered for clients on this host. It is never forwarded upstream.
+const QueryInfoOption = 65301
+
+// wantsQueryInfo reports whether req, received from the client at addr,
+// carries QueryInfoOption and is to be answered with it.
+func wantsQueryInfo(req *dns.Msg, addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	return ip != nil && ip.IsLoopback() && queryInfoOption(req) != nil
+}
+
+func queryInfoOption(m *dns.Msg) *dns.EDNS0_LOCAL {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == QueryInfoOption {
+			return l
+		}
+	}
+	return nil
+}
+
+// withoutQueryInfo returns a copy of req without QueryInfoOption, or req
+// itself if it does not carry the option.
+func withoutQueryInfo(req *dns.Msg) *dns.Msg {
+	if queryInfoOption(req) == nil {
+		return req
+	}
+	req = req.Copy()
+	opt := req.IsEdns0()
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); !ok || l.Code != QueryInfoOption {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	return req
+}
+
+// addQueryInfo returns a copy of m carrying QueryInfoOption with source
+// and upstream. m may be stored in the cache and is not changed.
+func addQueryInfo(m *dns.Msg, source, upstream string) *dns.Msg {
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.MinMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	// Drop an option echoed by the upstream
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); !ok || l.Code != QueryInfoOption {
+			options = append(options, o)
+		}
+	}
+	info := "source=" + source
+	if upstream != "" {
+		info += " upstream=" + upstream
+	}
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: QueryInfoOption, Data: []byte(info)})
+	return m
+}
+
+// ParseQueryInfo returns the source and upstream in the QueryInfoOption of
+// the response m, and whether m carries the option.
+func ParseQueryInfo(m *dns.Msg) (source, upstream string, ok bool) {
+	l := queryInfoOption(m)
+	if l == nil {
+		return "", "", false
+	}
+	for _, field := range strings.Fields(string(l.Data)) {
+		switch {
+		case strings.HasPrefix(field, "source="):
+			source = strings.TrimPrefix(field, "source=")
+		case strings.HasPrefix(field, "upstream="):
+			upstream = strings.TrimPrefix(field, "upstream=")
+		}
+	}
+	return source, upstream, true
+}
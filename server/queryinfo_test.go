@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryInfo(t *testing.T) {
+	upstream := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}, RCache: 10})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("info.example.com.", dns.TypeA)
+	// Without the option the response carries no OPT record
+	r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := ParseQueryInfo(r); ok || r.IsEdns0() != nil {
+		t.Errorf("expected no query info, got %v", r)
+	}
+
+	m.SetQuestion("info2.example.com.", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: QueryInfoOption})
+	for _, want := range []struct{ source, upstream string }{
+		{SourceForward, upstream},
+		{SourceCache, ""},
+	} {
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, ns, ok := ParseQueryInfo(r)
+		if !ok || source != want.source || ns != want.upstream {
+			t.Errorf("expected source %q upstream %q, got %q %q (%v)", want.source, want.upstream, source, ns, ok)
+		}
+		if len(r.Answer) != 1 {
+			t.Errorf("expected an answer, got %v", r)
+		}
+	}
+}
+
+func TestAddQueryInfo(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	// Echoed by the upstream
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: QueryInfoOption, Data: []byte("source=bogus")})
+
+	r := addQueryInfo(m, SourceStub, "10.0.0.1:53")
+	if source, upstream, _ := ParseQueryInfo(r); source != SourceStub || upstream != "10.0.0.1:53" {
+		t.Errorf("expected stub 10.0.0.1:53, got %s %s", source, upstream)
+	}
+	if n := len(r.IsEdns0().Option); n != 1 {
+		t.Errorf("expected 1 option, got %d", n)
+	}
+	if source, _, _ := ParseQueryInfo(m); source != "bogus" {
+		t.Errorf("expected the original message to be unchanged, got %s", source)
+	}
+}
+
+func TestQueryInfoPrivate(t *testing.T) {
+	var forwarded int32
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if queryInfoOption(req) != nil {
+			atomic.AddInt32(&forwarded, 1)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer stop()
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("private.example.com.", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: QueryInfoOption})
+	r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := ParseQueryInfo(r); !ok {
+		t.Errorf("expected query info for a loopback client, got %v", r)
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 0 {
+		t.Errorf("expected the option not to be forwarded, the upstream got it %d times", n)
+	}
+
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+	} {
+		if wantsQueryInfo(m, addr) {
+			t.Errorf("expected no query info for the client %s", addr)
+		}
+	}
+}
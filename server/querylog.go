@@ -0,0 +1,401 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sources a response may be served from
+const (
+	SourceCache     = "cache"
+	SourceHostsfile = "hostsfile"
+	SourceStub      = "stub"
+	SourceForward   = "forward"
+	SourceLocal     = "local"
+)
+
+// queryLogBacklog is the number of entries that may be queued for writing
+// before new entries are dropped.
+const queryLogBacklog = 4096
+
+// queryWriter wraps a dns.ResponseWriter and records what is needed
+// to describe the handling of a query after the fact.
+type queryWriter struct {
+	dns.ResponseWriter
+	id       uint64
+	config   *Config
+	traced   bool
+	req      *dns.Msg
+	question []dns.Question // of req as received, before any rewrite
+	query    []byte         // req as received, only packed for dnstap
+	start    time.Time
+	source   string
+	upstream string
+	msg      *dns.Msg
+	entry    *log.Entry
+
+	// Only set when tracing is enabled, or for the queries of lookupParallel
+	ctx  context.Context
+	span trace.Span
+
+	// Only recorded when slow queries are logged
+	slow    time.Duration
+	timings []queryTiming
+}
+
+// queryTiming is a step in the handling of a query
+type queryTiming struct {
+	step     string
+	upstream string
+	d        time.Duration
+	err      error
+}
+
+// queryID is the ID of the last query received. It is added to all log
+// entries about a query to tell apart the entries of concurrent queries.
+var queryID uint64
+
+func newQueryWriter(w dns.ResponseWriter, req *dns.Msg) *queryWriter {
+	return &queryWriter{
+		ResponseWriter: w,
+		id:             atomic.AddUint64(&queryID, 1),
+		req:            req,
+		question:       append([]dns.Question(nil), req.Question...),
+		start:          time.Now(),
+	}
+}
+
+var (
+	traceLogger     *log.Logger
+	traceLoggerOnce sync.Once
+)
+
+// tracer returns a logger writing to the same output as the standard
+// logger, but with debug logging enabled. It is used for queries traced
+// through 'debug-domain'.
+func tracer() *log.Logger {
+	traceLoggerOnce.Do(func() {
+		std := log.StandardLogger()
+		traceLogger = &log.Logger{
+			Out:       std.Out,
+			Formatter: std.Formatter,
+			Hooks:     std.Hooks,
+			Level:     log.DebugLevel,
+		}
+	})
+	return traceLogger
+}
+
+// debugEnabled returns whether debug messages about the query answered
+// through w are logged.
+func debugEnabled(w dns.ResponseWriter) bool {
+	if qw, ok := w.(*queryWriter); ok && qw.traced {
+		return true
+	}
+	return log.GetLevel() >= log.DebugLevel
+}
+
+// rotations counts the responses rotated for 'round-robin', each is
+// rotated one place further than the one before.
+var rotations uint32
+
+func (qw *queryWriter) WriteMsg(m *dns.Msg) error {
+	if qw.config != nil && qw.config.RoundRobin {
+		m = rotateAnswer(m, atomic.AddUint32(&rotations, 1))
+	}
+	recursion := m.RecursionAvailable
+	if qw.config != nil {
+		recursion = !qw.config.NoRec
+	}
+	m = replyHeader(qw.req, m, qw.question, recursion)
+	m = clientResponse(qw.req, m, isTCP(qw.ResponseWriter))
+	qw.msg = m
+	if wantsQueryInfo(qw.req, qw.RemoteAddr()) {
+		m = addQueryInfo(m, qw.source, qw.upstream)
+	}
+	if qw.slow > 0 {
+		if d := time.Since(qw.start); d > qw.slow {
+			qw.logSlow(d)
+		}
+	}
+	return qw.ResponseWriter.WriteMsg(m)
+}
+
+// logFor returns a log entry carrying fields that identify the query
+// being answered through w.
+func logFor(w dns.ResponseWriter) *log.Entry {
+	qw, ok := w.(*queryWriter)
+	if !ok {
+		return log.NewEntry(log.StandardLogger())
+	}
+	if qw.entry == nil {
+		q := qw.question[0]
+		logger := log.StandardLogger()
+		if qw.traced && log.GetLevel() < log.DebugLevel {
+			logger = tracer()
+		}
+		qw.entry = logger.WithFields(log.Fields{
+			"qid":    qw.id,
+			"qname":  q.Name,
+			"qtype":  dns.TypeToString[q.Qtype],
+			"client": qw.RemoteAddr().String(),
+		})
+	}
+	return qw.entry
+}
+
+// setSource records where the response for the query was obtained from.
+// It is a no-op when the writer does not record queries.
+func setSource(w dns.ResponseWriter, source string) {
+	if qw, ok := w.(*queryWriter); ok {
+		qw.source = source
+	}
+}
+
+// setUpstream records the nameserver that answered the query.
+func setUpstream(w dns.ResponseWriter, upstream string) {
+	if qw, ok := w.(*queryWriter); ok {
+		qw.upstream = upstream
+	}
+}
+
+// forkWriter returns a copy of w for forwarding a query in another
+// goroutine. What is recorded about the forwarded query is merged back
+// into w by joinWriter.
+func forkWriter(w dns.ResponseWriter) dns.ResponseWriter {
+	qw, ok := w.(*queryWriter)
+	if !ok {
+		return w
+	}
+	// Shared by the copies, so create it before
+	logFor(qw)
+	fork := *qw
+	fork.timings = nil
+	return &fork
+}
+
+// joinWriter merges what was recorded in fork, a copy of w returned by
+// forkWriter, into w.
+func joinWriter(w, fork dns.ResponseWriter) {
+	qw, ok := w.(*queryWriter)
+	fw, fok := fork.(*queryWriter)
+	if !ok || !fok || qw == fw {
+		return
+	}
+	qw.source, qw.upstream = fw.source, fw.upstream
+	qw.timings = append(qw.timings, fw.timings...)
+}
+
+// addTiming records that step took the time since start. It is a no-op
+// unless slow queries are logged.
+func addTiming(w dns.ResponseWriter, step string, start time.Time) {
+	if qw, ok := w.(*queryWriter); ok && qw.slow > 0 {
+		qw.timings = append(qw.timings, queryTiming{step: step, d: time.Since(start)})
+	}
+}
+
+// addExchange records an exchange with an upstream nameserver.
+func addExchange(w dns.ResponseWriter, upstream string, d time.Duration, err error) {
+	if qw, ok := w.(*queryWriter); ok && qw.slow > 0 {
+		qw.timings = append(qw.timings, queryTiming{step: "exchange", upstream: upstream, d: d, err: err})
+	}
+}
+
+// logSlow logs the query along with the time spent in each step.
+func (qw *queryWriter) logSlow(d time.Duration) {
+	var upstreams, steps []string
+	for _, t := range qw.timings {
+		step := fmt.Sprintf("%s=%.3fms", t.step, float64(t.d)/float64(time.Millisecond))
+		if t.upstream != "" {
+			upstreams = append(upstreams, t.upstream)
+			step = fmt.Sprintf("%s(%s)=%.3fms", t.step, t.upstream, float64(t.d)/float64(time.Millisecond))
+			if t.err != nil {
+				step += fmt.Sprintf(" error=%q", t.err.Error())
+			}
+		}
+		steps = append(steps, step)
+	}
+	logFor(qw).WithFields(log.Fields{
+		"duration":  d,
+		"source":    qw.source,
+		"cached":    qw.source == SourceCache,
+		"upstream":  qw.upstream,
+		"upstreams": strings.Join(upstreams, ","),
+		"breakdown": strings.Join(steps, " "),
+	}).Warn("Slow query")
+}
+
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Proto    string    `json:"proto"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Source   string    `json:"source"`
+	Upstream string    `json:"upstream,omitempty"`
+	Latency  float64   `json:"latency_ms"`
+}
+
+func (e *queryLogEntry) String() string {
+	upstream := e.Upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+	return fmt.Sprintf("%s client=%s proto=%s qname=%s qtype=%s rcode=%s answers=%d source=%s upstream=%s latency=%.3fms\n",
+		e.Time.Format(time.RFC3339Nano), e.Client, e.Proto, e.Name, e.Type, e.Rcode,
+		e.Answers, e.Source, upstream, e.Latency)
+}
+
+// queryLogger writes one line per query to a file or stdout. Entries are
+// queued and written by a single goroutine, so a slow disk never delays
+// responses. If the queue is full entries are dropped.
+type queryLogger struct {
+	path    string
+	json    bool
+	entries chan *queryLogEntry
+	done    chan struct{} // closed by Close
+	closed  chan struct{} // closed once the queue is written
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	buf *bufio.Writer
+}
+
+func newQueryLogger(path, format string) (*queryLogger, error) {
+	l := &queryLogger{
+		path:    path,
+		json:    format == "json",
+		entries: make(chan *queryLogEntry, queryLogBacklog),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// Reopen closes and reopens the destination file. It is called on SIGHUP
+// to cooperate with logrotate.
+func (l *queryLogger) Reopen() error {
+	var out io.WriteCloser = os.Stdout
+	if l.path != "" {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buf != nil {
+		l.buf.Flush()
+	}
+	if l.out != nil && l.out != os.Stdout {
+		l.out.Close()
+	}
+	l.out = out
+	l.buf = bufio.NewWriter(out)
+	return nil
+}
+
+func (l *queryLogger) log(qw *queryWriter) {
+	// The question as received, the request may have been rewritten for
+	// an alias
+	q := qw.question[0]
+	e := &queryLogEntry{
+		Time:     qw.start,
+		Client:   qw.RemoteAddr().String(),
+		Proto:    "udp",
+		Name:     q.Name,
+		Type:     dns.TypeToString[q.Qtype],
+		Source:   qw.source,
+		Upstream: qw.upstream,
+		Latency:  float64(time.Since(qw.start)) / float64(time.Millisecond),
+	}
+	if isTCP(qw) {
+		e.Proto = "tcp"
+	}
+	if qw.msg != nil {
+		e.Rcode = dns.RcodeToString[qw.msg.Rcode]
+		e.Answers = len(qw.msg.Answer)
+	}
+
+	select {
+	case l.entries <- e:
+	default:
+		// Never block the query path on a slow writer
+	}
+}
+
+// Close writes the queued entries and closes the destination file.
+// Entries logged afterwards are dropped.
+func (l *queryLogger) Close() {
+	close(l.done)
+	<-l.closed
+}
+
+func (l *queryLogger) run() {
+	defer close(l.closed)
+	for {
+		select {
+		case e := <-l.entries:
+			l.write(e)
+		case <-l.done:
+			for len(l.entries) > 0 {
+				l.write(<-l.entries)
+			}
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if err := l.buf.Flush(); err != nil {
+				log.Errorf("Failed to write query log: %s", err)
+			}
+			if l.out != os.Stdout {
+				l.out.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *queryLogger) write(e *queryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if l.json {
+		var b []byte
+		if b, err = json.Marshal(e); err == nil {
+			b = append(b, '\n')
+			_, err = l.buf.Write(b)
+		}
+	} else {
+		_, err = l.buf.WriteString(e.String())
+	}
+	// Flush once the queue has been drained
+	if err == nil && len(l.entries) == 0 {
+		err = l.buf.Flush()
+	}
+	if err != nil {
+		log.Errorf("Failed to write query log: %s", err)
+	}
+}
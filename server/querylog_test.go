@@ -0,0 +1,50 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLogAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	aliases := map[string]string{"alias.local.": "example.com."}
+	s := startTestServer(t, &Config{Nameservers: []string{startTestUpstream(t)}, Alias: &aliases,
+		LogQueries: true, LogQueriesFile: path, LogQueriesFormat: "json"})
+
+	m := new(dns.Msg)
+	m.SetQuestion("x.alias.local.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+	// Stop writes the queued entries
+	s.Stop()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var e queryLogEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &e); err != nil {
+		t.Fatalf("expected a JSON entry, got %q: %s", b, err)
+	}
+	if e.Name != "x.alias.local." || e.Type != "A" || e.Source != SourceForward {
+		t.Errorf("expected the query to be logged as asked by the client, got %+v", e)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// privateNets are the ranges upstream answers may not point into when
+// rebind protection is enabled.
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// loopbackNets are blocked as well unless 'rebind-localhost-ok' is set.
+var loopbackNets = parseCIDRs(
+	"127.0.0.0/8",
+	"::1/128",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindAddress returns the first address in the answer section of m that
+// rebind protection blocks, or nil. Answers for names at or below one of
+// the domains in 'rebind-domain-ok' are not checked.
+func rebindAddress(config *Config, name string, m *dns.Msg) net.IP {
+	for _, domain := range config.RebindDomainOk {
+		if dns.IsSubDomain(domain, name) {
+			return nil
+		}
+	}
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		// Also catches IPv4-mapped IPv6 addresses
+		if containsIP(privateNets, ip) || !config.RebindLocalhostOk && containsIP(loopbackNets, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// suppressRebind turns the upstream response m to a query for name into
+// REFUSED if it contains an address blocked by rebind protection.
+func suppressRebind(w dns.ResponseWriter, config *Config, name string, m *dns.Msg) {
+	ip := rebindAddress(config, name, m)
+	if ip == nil {
+		return
+	}
+	logFor(w).WithField("address", ip).Warn("Possible DNS rebind attack, suppressing answer")
+	m.Rcode = dns.RcodeRefused
+	m.Answer, m.Ns = nil, nil
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
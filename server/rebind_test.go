@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRebindAddress(t *testing.T) {
+	config := &Config{RebindLocalhostOk: true, RebindDomainOk: []string{"corp.example."}}
+	for answer, blocked := range map[string]bool{
+		"a.example.com. 60 IN A 127.0.0.1":       false,
+		"a.example.com. 60 IN AAAA ::1":          false,
+		"a.example.com. 60 IN A 93.184.216.34":   false,
+		"a.example.com. 60 IN A 10.1.2.3":        true,
+		"a.example.com. 60 IN A 172.20.0.1":      true,
+		"a.example.com. 60 IN A 192.168.1.1":     true,
+		"a.example.com. 60 IN AAAA ::ffff:a01:1": true,
+		"a.example.com. 60 IN AAAA fd00::1":      true,
+	} {
+		rr, err := dns.NewRR(answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &dns.Msg{Answer: []dns.RR{rr}}
+		if got := rebindAddress(config, "a.example.com.", m) != nil; got != blocked {
+			t.Errorf("%s: expected blocked %v, got %v", answer, blocked, got)
+		}
+		if rebindAddress(config, "Host.CORP.example.", m) != nil {
+			t.Errorf("%s: expected no check for an exempted domain", answer)
+		}
+	}
+}
+
+func TestRebindLocalhostOk(t *testing.T) {
+	upstream := startTestUpstream(t)
+
+	for _, tc := range []struct {
+		config *Config
+		rcode  int
+	}{
+		{&Config{}, dns.RcodeSuccess},
+		{&Config{StopRebind: true}, dns.RcodeRefused},
+		{&Config{StopRebind: true, RebindLocalhostOk: true}, dns.RcodeSuccess},
+		{&Config{StopRebind: true, RebindDomainOk: []string{"example.com."}}, dns.RcodeSuccess},
+	} {
+		tc.config.Nameservers = []string{upstream}
+		s := startTestServer(t, tc.config)
+
+		m := new(dns.Msg)
+		m.SetQuestion("rebind.example.com.", dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		s.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode {
+			t.Errorf("%+v: expected %s, got %s", tc.config, dns.RcodeToString[tc.rcode], dns.RcodeToString[r.Rcode])
+		}
+		if tc.rcode == dns.RcodeSuccess && len(r.Answer) != 1 {
+			t.Errorf("%+v: expected 127.0.0.1 to be passed through, got %v", tc.config, r.Answer)
+		}
+		if tc.rcode == dns.RcodeRefused && len(r.Answer) != 0 {
+			t.Errorf("%+v: expected the answer to be suppressed, got %v", tc.config, r.Answer)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// restartFields are the Config fields that are only read when the server
+// starts. Reload keeps their current values.
+var restartFields = map[string]bool{
+	"DnsAddr":            true,
+	"AdditionalPort":     true,
+	"Systemd":            true,
+	"TcpOnly":            true,
+	"Interfaces":         true,
+	"ExceptInterfaces":   true,
+	"BindDynamic":        true,
+	"MaxTCPConnections":  true,
+	"TCPIdleTimeout":     true,
+	"MaxTCPPipeline":     true,
+	"MaxConcurrency":     true,
+	"ReusePort":          true,
+	"BindRetries":        true,
+	"BindRetryInterval":  true,
+	"MinFreeMemoryMB":    true,
+	"HealthListen":       true,
+	"DebugListen":        true,
+	"AdminSocket":        true,
+	"DefaultResolver":    true,
+	"Hostsfile":          true,
+	"PollInterval":       true,
+	"IfaceDomain":        true,
+	"EdnsBufferSize":     true,
+	"UpstreamPoolSize":   true,
+	"UpstreamSourceIP":   true,
+	"ReadTimeout":        true,
+	"RCache":             true,
+	"CacheByClientIP":    true,
+	"CacheIPPrefixLenV4": true,
+	"CacheIPPrefixLenV6": true,
+	"CacheMaxClients":    true,
+	"CacheDumpFile":      true,
+	"CacheDumpInterval":  true,
+	"DnstapSocket":       true,
+	"OtlpEndpoint":       true,
+	"TrackTop":           true,
+	"LogQueries":         true,
+	"LogQueriesFile":     true,
+	"LogQueriesFormat":   true,
+}
+
+// Reload replaces the configuration of the running server. Queries that
+// are being answered finish with the configuration they were received
+// with. Changes to options that are only read on startup are logged as
+// needing a restart and are not applied.
+func (s *server) Reload(config *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.conf()
+	changes, restart := diffConfig(old, config)
+
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(config).Elem()
+	for name := range restartFields {
+		nv.FieldByName(name).Set(ov.FieldByName(name))
+	}
+	// Keep the failover state of stub zones whose nameservers are unchanged
+	if config.Stub != nil && old.Stub != nil {
+		for zone, z := range *config.Stub {
+			if oz, ok := (*old.Stub)[zone]; ok && reflect.DeepEqual(oz.Nameservers, z.Nameservers) {
+				(*config.Stub)[zone] = oz
+			}
+		}
+	}
+
+	s.rcache.SetTTL(config.RCacheTtl)
+	s.rcache.SetMinHits(config.CacheMinHitCount)
+	if s.rcacheShards != nil {
+		s.rcacheShards.SetTTL(config.RCacheTtl)
+		s.rcacheShards.SetMinHits(config.CacheMinHitCount)
+	}
+	s.config.Store(config)
+
+	for _, c := range restart {
+		log.Warnf("Not applying configuration change, needs restart: %s", c)
+	}
+	if len(changes) == 0 {
+		log.Info("Reloaded configuration, nothing changed")
+		return
+	}
+	log.Infof("Reloaded configuration, %d change(s):", len(changes))
+	for _, c := range changes {
+		log.Info(c)
+	}
+}
+
+// diffConfig describes the differences between two configurations, one
+// line per option or map entry. Options named in restartFields are
+// returned in restart.
+func diffConfig(old, config *Config) (changes, restart []string) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(config).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch {
+		case f.Name == "Stub":
+			name = "stubzones"
+		case f.Name == "Alias":
+			name = "aliases"
+		case name == "-":
+			continue
+		}
+
+		if f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Map {
+			changes = append(changes, diffMap(name, mapEntries(ov.Field(i)), mapEntries(nv.Field(i)))...)
+			continue
+		}
+
+		a, b := configValue(ov.Field(i)), configValue(nv.Field(i))
+		if a == b {
+			continue
+		}
+		line := fmt.Sprintf("%s: %s -> %s", name, a, b)
+		if restartFields[f.Name] {
+			restart = append(restart, line)
+		} else {
+			changes = append(changes, "~ "+line)
+		}
+	}
+	return changes, restart
+}
+
+// diffMap describes the entries added to, removed from and changed in a
+// map option.
+func diffMap(name string, old, cur map[string]string) (changes []string) {
+	keys := make([]string, 0, len(old)+len(cur))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		a, inOld := old[k]
+		b, inCur := cur[k]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("+ %s %s: %s", name, k, b))
+		case !inCur:
+			changes = append(changes, fmt.Sprintf("- %s %s: %s", name, k, a))
+		case a != b:
+			changes = append(changes, fmt.Sprintf("~ %s %s: %s -> %s", name, k, a, b))
+		}
+	}
+	return changes
+}
+
+// mapEntries returns the entries of the map v points to as strings.
+func mapEntries(v reflect.Value) map[string]string {
+	entries := make(map[string]string)
+	if v.IsNil() {
+		return entries
+	}
+	m := v.Elem()
+	for _, k := range m.MapKeys() {
+		e := m.MapIndex(k)
+		if z, ok := e.Interface().(*StubZone); ok {
+			entries[k.String()] = strings.Join(z.Nameservers, ",")
+		} else {
+			entries[k.String()] = configValue(e)
+		}
+	}
+	return entries
+}
+
+func configValue(v reflect.Value) string {
+	var s string
+	if ss, ok := v.Interface().([]string); ok {
+		s = strings.Join(ss, ",")
+	} else {
+		s = fmt.Sprint(v.Interface())
+	}
+	if s == "" {
+		return `""`
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseRewriteRule replaces the address From in upstream answers by To.
+type ResponseRewriteRule struct {
+	From net.IP
+	To   net.IP
+}
+
+// ParseResponseRewriteRule parses a rule given as 'from_ip:to_ip'. IPv6
+// addresses may be enclosed in brackets, e.g. '[fd00::1]:[fd00::2]', and
+// must be if the rule is ambiguous otherwise.
+func ParseResponseRewriteRule(s string) (ResponseRewriteRule, error) {
+	s = strings.TrimSpace(s)
+	// IPv6 addresses contain ':' as well, so try every ':' and keep the
+	// split that yields two addresses of the same family
+	var rule ResponseRewriteRule
+	found := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		from := parseRewriteIP(s[:i])
+		to := parseRewriteIP(s[i+1:])
+		if from == nil || to == nil || len(from) != len(to) {
+			continue
+		}
+		rule = ResponseRewriteRule{From: from, To: to}
+		found++
+	}
+	switch {
+	case found == 0:
+		return ResponseRewriteRule{}, fmt.Errorf("expected from_ip:to_ip with addresses of the same family, got %q", s)
+	case found > 1:
+		return ResponseRewriteRule{}, fmt.Errorf("%q is ambiguous, enclose the addresses in brackets", s)
+	}
+	return rule, nil
+}
+
+// parseRewriteIP parses s, optionally enclosed in brackets, returning IPv4
+// addresses in their 4 byte form.
+func parseRewriteIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	bracketed := strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]")
+	if bracketed {
+		s = s[1 : len(s)-1]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || strings.Contains(s, ":") != (ip.To4() == nil) {
+		// Rejects '::ffff:1.2.3.4', which would match A records only
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if bracketed {
+			return nil
+		}
+		return ip4
+	}
+	return ip
+}
+
+func (r ResponseRewriteRule) String() string {
+	if r.From.To4() == nil {
+		return fmt.Sprintf("[%s]:[%s]", r.From, r.To)
+	}
+	return fmt.Sprintf("%s:%s", r.From, r.To)
+}
+
+// MarshalText makes the rule appear as 'from_ip:to_ip' in the admin API.
+func (r ResponseRewriteRule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a rule written by MarshalText.
+func (r *ResponseRewriteRule) UnmarshalText(text []byte) error {
+	rule, err := ParseResponseRewriteRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// rewriteResponse replaces the address of every A and AAAA record in the
+// answer section of m that equals the From address of a rule by its To
+// address. The first matching rule applies.
+func rewriteResponse(rules []ResponseRewriteRule, m *dns.Msg) {
+	for _, rr := range m.Answer {
+		var ip *net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = &rr.A
+		case *dns.AAAA:
+			ip = &rr.AAAA
+		default:
+			continue
+		}
+		_, v4 := rr.(*dns.A)
+		for _, rule := range rules {
+			// Equal treats an IPv4-mapped IPv6 address as the IPv4 address
+			if (rule.From.To4() != nil) == v4 && rule.From.Equal(*ip) {
+				*ip = append(net.IP(nil), rule.To...)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseResponseRewriteRule(t *testing.T) {
+	for in, want := range map[string]string{
+		"1.2.3.4:10.0.0.1":          "1.2.3.4:10.0.0.1",
+		" 1.2.3.4 : 10.0.0.1 ":      "1.2.3.4:10.0.0.1",
+		"[2001:db8::1]:[fd00::1]":   "[2001:db8::1]:[fd00::1]",
+		"2001:db8::1:fd00::1":       "[2001:db8::1]:[fd00::1]",
+		"[2001:db8::1]:fd00:1:2::3": "[2001:db8::1]:[fd00:1:2::3]",
+	} {
+		r, err := ParseResponseRewriteRule(in)
+		if err != nil {
+			t.Errorf("%s: %s", in, err)
+			continue
+		}
+		if r.String() != want {
+			t.Errorf("%s: expected %s, got %s", in, want, r)
+		}
+	}
+	for _, in := range []string{
+		"1.2.3.4",
+		"1.2.3.4:fd00::1", // families differ
+		"1.2.3.4:10.0.0.256",
+		"::ffff:1.2.3.4:10.0.0.1",
+		"2001:db8::1:2:3:4", // ambiguous
+		"[1.2.3.4]:10.0.0.1",
+	} {
+		if _, err := ParseResponseRewriteRule(in); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	var rules []ResponseRewriteRule
+	for _, r := range []string{"1.2.3.4:10.0.0.1", "1.2.3.4:10.0.0.2", "10.0.0.1:10.0.0.3", "2001:db8::1:fd00::1"} {
+		rule, err := ParseResponseRewriteRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	for in, want := range map[string]string{
+		"a.example.com. 60 IN A 1.2.3.4":            "10.0.0.1", // first match wins, not chained
+		"a.example.com. 60 IN A 1.2.3.5":            "1.2.3.5",
+		"a.example.com. 60 IN AAAA 2001:db8::1":     "fd00::1",
+		"a.example.com. 60 IN AAAA ::ffff:1.2.3.4":  "1.2.3.4", // IPv4 rules only apply to A records
+		"a.example.com. 60 IN CNAME b.example.com.": "",
+	} {
+		rr, err := dns.NewRR(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &dns.Msg{Answer: []dns.RR{rr}}
+		rewriteResponse(rules, m)
+		var got string
+		switch rr := m.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if got != want {
+			t.Errorf("%s: expected %q, got %q", in, want, got)
+		}
+	}
+
+	// Only the answer section is rewritten
+	rr, _ := dns.NewRR("ns.example.com. 60 IN A 1.2.3.4")
+	m := &dns.Msg{Extra: []dns.RR{rr}}
+	rewriteResponse(rules, m)
+	if got := m.Extra[0].(*dns.A).A.String(); got != "1.2.3.4" {
+		t.Errorf("expected the additional section to be kept, got %s", got)
+	}
+
+	b, _ := json.Marshal(rules[:1])
+	if string(b) != `["1.2.3.4:10.0.0.1"]` {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
+
+func TestResponseRewrite(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for _, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	rule, err := ParseResponseRewriteRule("1.2.3.4:10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServer(t, &Config{
+		Nameservers:      []string{pc.LocalAddr().String()},
+		RCache:           10,
+		ResponseRewrites: []ResponseRewriteRule{rule},
+	})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("migrating.example.com.", dns.TypeA)
+	// The second answer comes from the cache
+	for i := 0; i < 2; i++ {
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rr := range r.Answer {
+			got = append(got, rr.(*dns.A).A.String())
+			if rr.Header().Name != "migrating.example.com." {
+				t.Errorf("expected the query name, got %s", rr.Header().Name)
+			}
+		}
+		if len(got) != 2 || got[0] != "10.0.0.1" || got[1] != "1.2.3.5" {
+			t.Errorf("query %d: expected [10.0.0.1 1.2.3.5], got %v", i+1, got)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
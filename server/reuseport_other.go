@@ -0,0 +1,16 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import "net"
+
+const reusePortSupported = false
+
+func listenPacketReusePort(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// RuntimeHostfile is a Hostfile that records can be added to and removed
+// from while the server is running, such as *hosts.Hostsfile.
+type RuntimeHostfile interface {
+	Hostfile
+	AddHost(name string, ip net.IP, ttl int) error
+	AddCNAME(name, target string) error
+	RemoveHost(name string) error
+	// FindCNAMEChain returns the targets of the CNAMEs of name, each
+	// target being the name of the next CNAME
+	FindCNAMEChain(name string) []string
+	// HostTTL returns the TTL of the addresses of name, or false to use
+	// HostsTtl
+	HostTTL(name string) (int, bool)
+}
+
+// errNoRuntimeHosts is returned when records are added to a Hostfile that
+// does not support it.
+var errNoRuntimeHosts = errors.New("The hostsfile does not support adding records")
+
+func (s *server) runtimeHosts() (RuntimeHostfile, error) {
+	if rh, ok := s.hosts.(RuntimeHostfile); ok {
+		return rh, nil
+	}
+	return nil, errNoRuntimeHosts
+}
+
+// AddHost answers the A or AAAA queries for name with ip, in addition to
+// the addresses added for name before, with a TTL of ttl seconds or
+// HostsTtl if ttl is 0. The cached responses for name and the
+// reverse name of ip are removed.
+func (s *server) AddHost(name string, ip net.IP, ttl int) error {
+	rh, err := s.runtimeHosts()
+	if err != nil {
+		return err
+	}
+	if err := rh.AddHost(name, ip, ttl); err != nil {
+		return err
+	}
+	s.flushNames(name, ip)
+	return nil
+}
+
+// AddCNAME answers the queries for name with a CNAME to target, followed
+// by the records of target. The cached responses for name are removed.
+func (s *server) AddCNAME(name, target string) error {
+	rh, err := s.runtimeHosts()
+	if err != nil {
+		return err
+	}
+	if err := rh.AddCNAME(name, target); err != nil {
+		return err
+	}
+	s.flushNames(name)
+	return nil
+}
+
+// RemoveHost removes the records added for name with AddHost and AddCNAME,
+// and the cached responses for name and the reverse names of its
+// addresses.
+func (s *server) RemoveHost(name string) error {
+	rh, err := s.runtimeHosts()
+	if err != nil {
+		return err
+	}
+	addrs, _ := rh.FindHosts(strings.ToLower(name))
+	// Copied, the result refers to the records being removed
+	addrs = append([]net.IP(nil), addrs...)
+	if err := rh.RemoveHost(name); err != nil {
+		return err
+	}
+	s.flushNames(name, addrs...)
+	return nil
+}
+
+// flushNames removes the cached responses for name and the reverse names
+// of addrs.
+func (s *server) flushNames(name string, addrs ...net.IP) {
+	names := []string{dns.Fqdn(name)}
+	for _, ip := range addrs {
+		if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+			names = append(names, rev)
+		}
+	}
+	n := s.rcache.FlushNames(names...)
+	if s.rcacheShards != nil {
+		n += s.rcacheShards.FlushNames(names...)
+	}
+	if n > 0 {
+		log.Debugf("Flushed %d cached responses for %s", n, name)
+	}
+}
+
+// cnameRecords returns the CNAME records of the chain starting at the name
+// of q and the last target, or nil if it has no CNAME added by AddCNAME.
+func (s *server) cnameRecords(q dns.Question) ([]dns.RR, string) {
+	rh, ok := s.hosts.(RuntimeHostfile)
+	if !ok {
+		return nil, ""
+	}
+	chain := rh.FindCNAMEChain(strings.ToLower(q.Name))
+	if len(chain) == 0 {
+		return nil, ""
+	}
+	ttl := s.conf().HostsTtl
+	records := make([]dns.RR, len(chain))
+	name := q.Name
+	for i, target := range chain {
+		records[i] = &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: target,
+		}
+		name = target
+	}
+	return records, name
+}
+
+// serveCNAME answers a query for a name with a CNAME added by AddCNAME,
+// following the chain to its target, see chaseCNAME.
+func (s *server) serveCNAME(w dns.ResponseWriter, req *dns.Msg, cnames []dns.RR) {
+	setSource(w, SourceHostsfile)
+	m := newReply(s.confFor(w), req)
+	m.Authoritative = true
+	m.Answer = cnames
+	s.writeLocal(w, req, s.chaseCNAME(w, req, m, true))
+}
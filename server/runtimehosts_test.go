@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRuntimeHosts(t *testing.T) {
+	e := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+		return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 192.0.2.10"), nil
+	}}
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 web.local\n"),
+		&Config{Nameservers: []string{"192.0.2.1:53"}, Exchanger: e, RCache: 100, HostsTtl: 10})
+	defer s.Stop()
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	addrs := func(r *dns.Msg) []string {
+		var a []string
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				a = append(a, rr.A.String())
+			case *dns.CNAME:
+				a = append(a, rr.Target)
+			}
+		}
+		return a
+	}
+
+	// The cached answer is replaced at once
+	if a := addrs(exchange("web.local.", dns.TypeA)); len(a) != 1 || a[0] != "10.0.0.1" {
+		t.Fatalf("expected the hostsfile address, got %v", a)
+	}
+	if err := s.AddHost("web.local", net.ParseIP("10.0.1.1"), 30); err != nil {
+		t.Fatal(err)
+	}
+	r := exchange("web.local.", dns.TypeA)
+	if a := addrs(r); len(a) != 1 || a[0] != "10.0.1.1" || r.Answer[0].Header().Ttl != 30 {
+		t.Errorf("expected the added address with TTL 30, got %v", r.Answer)
+	}
+	if r := exchange("1.1.0.10.in-addr.arpa.", dns.TypePTR); len(r.Answer) != 1 {
+		t.Errorf("expected the PTR record of the added address, got %v", r.Answer)
+	}
+
+	// A CNAME to a local name is answered from the hostsfile, to another
+	// name by the nameservers
+	if err := s.AddCNAME("www.local", "web.local"); err != nil {
+		t.Fatal(err)
+	}
+	if a := addrs(exchange("www.local.", dns.TypeA)); len(a) != 2 || a[0] != "web.local." || a[1] != "10.0.1.1" {
+		t.Errorf("expected the CNAME and the address of web.local, got %v", a)
+	}
+	if err := s.AddCNAME("cdn.local", "cdn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	r = exchange("cdn.local.", dns.TypeA)
+	if a := addrs(r); len(a) != 2 || a[0] != "cdn.example.com." || a[1] != "192.0.2.10" || r.Question[0].Name != "cdn.local." {
+		t.Errorf("expected the CNAME and the forwarded address, got %v", r)
+	}
+	if sent := e.sent(); len(sent) != 1 {
+		t.Errorf("expected the target to be forwarded once, got %v", sent)
+	}
+
+	// Removing the host flushes the chains through it
+	if err := s.RemoveHost("web.local."); err != nil {
+		t.Fatal(err)
+	}
+	if a := addrs(exchange("web.local.", dns.TypeA)); len(a) != 1 || a[0] != "10.0.0.1" {
+		t.Errorf("expected the hostsfile address after the removal, got %v", a)
+	}
+	if a := addrs(exchange("www.local.", dns.TypeA)); len(a) != 2 || a[1] != "10.0.0.1" {
+		t.Errorf("expected the CNAME to the hostsfile address, got %v", a)
+	}
+
+	plain := New(testHostfile{}, &Config{}, "test")
+	if err := plain.AddHost("web.local", net.ParseIP("10.0.1.1"), 0); err != errNoRuntimeHosts {
+		t.Errorf("expected errNoRuntimeHosts, got %v", err)
+	}
+}
+
+func TestAdminHosts(t *testing.T) {
+	s := startHostsTestServer(t, newTestHostsfile(t, ""), &Config{NoRec: true, RCache: 10})
+	defer s.Stop()
+
+	for _, tc := range []struct {
+		target string
+		code   int
+	}{
+		{"/hosts/add?name=web.local&ip=10.0.1.1&ttl=30", http.StatusOK},
+		{"/hosts/add?name=web.local&ip=bogus", http.StatusBadRequest},
+		{"/hosts/add?name=web.local&ip=10.0.1.1&ttl=-1", http.StatusBadRequest},
+		{"/hosts/cname?name=www.local&target=web.local", http.StatusOK},
+		{"/hosts/cname?name=web.local&target=www.local", http.StatusBadRequest},
+		{"/hosts/remove?name=www.local", http.StatusOK},
+		{"/hosts/remove?name=www.local", http.StatusNotFound},
+	} {
+		if code := adminRequest(t, s, "POST", tc.target, nil); code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.target, tc.code, code)
+		}
+	}
+	if addrs, _ := s.hosts.FindHosts("web.local."); len(addrs) != 1 {
+		t.Errorf("expected the address added through the admin API, got %v", addrs)
+	}
+	if code := adminRequest(t, s, "GET", "/hosts/add?name=a.local&ip=10.0.0.1", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", code)
+	}
+}
@@ -8,24 +8,55 @@ package server
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/coreos/go-systemd/activation"
 	"github.com/janeczku/go-dnsmasq/cache"
+	"github.com/janeczku/go-dnsmasq/dnstap"
+	"github.com/janeczku/go-dnsmasq/stats"
 	"github.com/miekg/dns"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type server struct {
 	hosts   Hostfile
-	config  *Config
+	config  atomic.Value // *Config, replaced by Reload
 	version string
+	handler Handler
+
+	stages           Handler // the query path behind the middlewares
+	stageMiddlewares []StageMiddleware
 
 	group        *sync.WaitGroup
-	dnsUDPclient *dns.Client // used for forwarding queries
-	dnsTCPclient *dns.Client // used for forwarding queries
+	exchanger    Exchanger     // used for forwarding queries
+	pool         *upstreamPool // the exchanger if 'upstream-pool-size' is set
+	upstreams    *upstreamSelector
 	rcache       *cache.Cache
+	rcacheShards *cache.Shards // per client network, replaces rcache
+	qlog         *queryLogger
+	tap          *dnstap.Writer
+
+	mu           sync.Mutex
+	dnsServers   []*dns.Server
+	ifaceServers map[string][]*dns.Server // by interface address
+	stop         chan struct{}            // closed by Stop
+	listening    chan struct{}
+	health       health
+	healthServer *http.Server
+	debugServer  *http.Server
+	adminServer  *http.Server
+	reload       func() error
+	lowMemory    int32         // 1 while free memory is below 'min-free-memory-mb'
+	limit        *handlerLimit // nil if 'max-concurrency' is 0
+	err          error         // the first listener failure, returned by Run
+
+	tracer         trace.Tracer // nil when tracing is disabled
+	tracerProvider *sdktrace.TracerProvider
 }
 
 type Hostfile interface {
@@ -33,264 +64,426 @@ type Hostfile interface {
 	FindReverse(name string) (string, error)
 }
 
-// New returns a new server.
-func New(hostfile Hostfile, config *Config, v string) *server {
-	return &server{
+// New returns a new server. Queries pass through the middlewares, the first
+// one being the outermost, before they reach the stages of the query path,
+// see UseStages.
+func New(hostfile Hostfile, config *Config, v string, middlewares ...Middleware) *server {
+	s := &server{
 		hosts:   hostfile,
-		config:  config,
 		version: v,
 
 		group:        new(sync.WaitGroup),
+		listening:    make(chan struct{}),
+		stop:         make(chan struct{}),
+		ifaceServers: make(map[string][]*dns.Server),
 		rcache:       cache.New(config.RCache, config.RCacheTtl),
-		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
-		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
+		exchanger:    newClientExchanger(config),
+		upstreams:    newUpstreamSelector(),
+	}
+	s.config.Store(config)
+	s.rcache.SetMinHits(config.CacheMinHitCount)
+	if config.MaxConcurrency > 0 {
+		s.limit = newHandlerLimit(config.MaxConcurrency)
+	}
+	if config.UpstreamPoolSize > 0 {
+		s.pool = newUpstreamPool(config.UpstreamPoolSize, 2*config.ReadTimeout, config.UpstreamSourceIP)
+		s.exchanger = s.pool
+	}
+	if config.Exchanger != nil {
+		s.exchanger = config.Exchanger
+	}
+	if config.CacheByClientIP {
+		s.rcacheShards = cache.NewShards(config.RCache, config.RCacheTtl, config.CacheMaxClients)
+		s.rcacheShards.SetMinHits(config.CacheMinHitCount)
 	}
+	if config.OtlpEndpoint != "" {
+		if err := s.startTracing(config.OtlpEndpoint); err != nil {
+			log.Errorf("Not sending traces to %s: %s", config.OtlpEndpoint, err)
+		}
+	}
+	s.stages = s.buildStages()
+	s.handler = Chain(middlewares...)(HandlerFunc(s.serveDNS))
+	return s
+}
+
+// conf returns the current configuration. Queries use the configuration
+// that was current when they were received, see confFor.
+func (s *server) conf() *Config {
+	return s.config.Load().(*Config)
+}
+
+// confFor returns the configuration the query answered through w is
+// handled with.
+func (s *server) confFor(w dns.ResponseWriter) *Config {
+	if qw, ok := w.(*queryWriter); ok && qw.config != nil {
+		return qw.config
+	}
+	return s.conf()
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
+// It returns nil once Stop is called, or the error that a listener could not
+// be bound or failed with.
 func (s *server) Run() error {
 	mux := dns.NewServeMux()
 	mux.Handle(".", s)
+	config := s.conf()
+
+	if config.LogQueries {
+		qlog, err := newQueryLogger(config.LogQueriesFile, config.LogQueriesFormat)
+		if err != nil {
+			return fmt.Errorf("Failed to open query log: %s", err)
+		}
+		s.qlog = qlog
+	}
 
-	dnsReadyMsg := func(addr, net string) {
-		log.Infof("Ready for queries on %s://%s [rcache capacity %d]", net, addr, s.config.RCache)
+	if config.DnstapSocket != "" {
+		s.tap = dnstap.NewWriter(config.DnstapSocket, "go-dnsmasq", s.version)
 	}
 
-	if s.config.Systemd {
-		packetConns, err := activation.PacketConns(false)
-		if err != nil {
+	if config.HealthListen != "" {
+		if err := s.startHealth(); err != nil {
+			return fmt.Errorf("Failed to start health endpoint: %s", err)
+		}
+	}
+
+	if config.AdminSocket != "" {
+		if err := s.startAdmin(); err != nil {
+			return fmt.Errorf("Failed to start admin API: %s", err)
+		}
+	}
+
+	if config.DebugListen != "" {
+		if err := s.startDebug(); err != nil {
+			return fmt.Errorf("Failed to start debug endpoint: %s", err)
+		}
+	}
+
+	if config.MinFreeMemoryMB > 0 {
+		if err := s.startMemoryWatch(); err != nil {
 			return err
 		}
-		listeners, err := activation.Listeners(true)
+	}
+
+	if config.CacheDumpInterval > 0 {
+		s.startCacheDump()
+	}
+
+	if config.ReusePort > 1 && !reusePortSupported {
+		log.Warnf("'reuseport' is only supported on Linux, using a single UDP socket per address")
+	}
+
+	if config.Systemd {
+		sockets, err := systemdSockets()
 		if err != nil {
 			return err
 		}
-		if len(packetConns) == 0 && len(listeners) == 0 {
+		if len(sockets) == 0 {
 			return fmt.Errorf("No UDP or TCP sockets supplied by systemd")
 		}
-		for _, p := range packetConns {
-			if u, ok := p.(*net.UDPConn); ok {
-				s.group.Add(1)
-				go func() {
-					defer s.group.Done()
-					if err := dns.ActivateAndServe(nil, u, mux); err != nil {
-						log.Fatalf("%s", err)
-					}
-				}()
-				dnsReadyMsg(u.LocalAddr().String(), "udp")
+		for _, sock := range sockets {
+			if config.TcpOnly && sock.packetConn != nil {
+				closeSockets(sockets)
+				return fmt.Errorf("UDP socket %s supplied by systemd cannot be used with 'tcp-only'. Remove the ListenDatagram socket(s) from the socket unit", sock.name)
 			}
 		}
-		for _, l := range listeners {
-			if t, ok := l.(*net.TCPListener); ok {
-				s.group.Add(1)
-				go func() {
-					defer s.group.Done()
-					if err := dns.ActivateAndServe(t, nil, mux); err != nil {
-						log.Fatalf("%s", err)
-					}
-				}()
-				dnsReadyMsg(t.Addr().String(), "tcp")
+		for _, sock := range sockets {
+			if u := sock.packetConn; u != nil {
+				log.Infof("Socket %s activated by systemd: udp://%s", sock.name, u.LocalAddr())
+				s.serve(newUDPServer(u, mux), u.LocalAddr().String(), "udp")
+			} else {
+				t := sock.listener
+				log.Infof("Socket %s activated by systemd: tcp://%s", sock.name, t.Addr())
+				s.serve(newTCPServer(t, mux, config), t.Addr().String(), "tcp")
 			}
 		}
+	} else if config.bindsInterfaces() {
+		if err := s.bindInterfaces(mux); err != nil {
+			return err
+		}
 	} else {
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "tcp", mux); err != nil {
-				log.Fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "tcp")
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "udp", mux); err != nil {
-				log.Fatalf("%s", err)
+		addrs := []string{config.DnsAddr}
+		if addr := config.additionalAddr(); addr != "" {
+			addrs = append(addrs, addr)
+		}
+		servers, err := s.listenAddrs(mux, addrs)
+		if err != nil {
+			return err
+		}
+		for i, srvs := range servers {
+			for _, srv := range srvs {
+				s.serve(srv, addrs[i], srv.Net)
 			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "udp")
+		}
 	}
+	s.health.setListening()
+	close(s.listening)
+	s.notifyReady()
 
 	s.group.Wait()
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
 }
 
-// Stop stops a server.
-func (s *server) Stop() {
-	// TODO(miek)
-	//s.group.Add(-2)
+// fail stops answering queries after a listener failed. Run returns err
+// once the other listeners are closed.
+func (s *server) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.shutdown()
 }
 
-// ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
-// it to a real dns server and returning a response.
-func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(req)
-	m.Authoritative = false
-	m.RecursionAvailable = true
-	m.Compress = true
-	bufsize := uint16(512)
-	dnssec := false
-	tcp := false
-	local := true
-
-	q := req.Question[0]
-	name := strings.ToLower(q.Name)
+// shutdown closes the listeners, which ends Run.
+func (s *server) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	for _, srv := range s.dnsServers {
+		srv.Shutdown()
+	}
+	s.dnsServers = nil
+}
 
-	/*	if q.Qtype == dns.TypeANY {
-		m.Authoritative = false
-		m.Rcode = dns.RcodeRefused
-		m.RecursionAvailable = false
-		m.RecursionDesired = false
-		m.Compress = false
-		// if write fails don't care
-		w.WriteMsg(m)
+// Listening returns a channel that is closed once Run has bound all
+// listeners.
+func (s *server) Listening() <-chan struct{} {
+	return s.listening
+}
 
-		return
-	}*/
+// activatedSocket is a socket passed by systemd socket activation. Either
+// packetConn or listener is set.
+type activatedSocket struct {
+	name       string
+	packetConn *net.UDPConn
+	listener   *net.TCPListener
+}
 
-	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
-		dnssec = o.Do()
-	}
-	if bufsize < 512 {
-		bufsize = 512
-	}
-	// with TCP we can send 64K
-	if tcp = isTCP(w); tcp {
-		bufsize = dns.MaxMsgSize - 1
+// closeSockets closes sockets that are not going to be served.
+func closeSockets(sockets []activatedSocket) {
+	for _, sock := range sockets {
+		if sock.packetConn != nil {
+			sock.packetConn.Close()
+		}
+		if sock.listener != nil {
+			sock.listener.Close()
+		}
 	}
+}
 
-	StatsRequestCount.Inc(1)
+// serve starts answering queries on the listener or packet conn of srv.
+func (s *server) serve(srv *dns.Server, addr, net string) {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		// Stopped while binding to a new interface address
+		s.mu.Unlock()
+		closeServers([]*dns.Server{srv})
+		return
+	default:
+	}
+	s.dnsServers = append(s.dnsServers, srv)
+	s.mu.Unlock()
+
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		if err := srv.ActivateAndServe(); err != nil {
+			s.fail(fmt.Errorf("Failed to answer queries on %s://%s: %w", net, addr, err))
+		}
+	}()
+	log.Infof("Ready for queries on %s://%s [rcache capacity %d]", net, addr, s.conf().RCache)
+}
 
-	if dnssec {
-		StatsDnssecOkCount.Inc(1)
+// CacheSize returns the number of messages in the response cache
+// and its capacity.
+func (s *server) CacheSize() (int, int) {
+	if s.rcacheShards != nil {
+		return s.rcacheShards.Len(), s.rcacheShards.Capacity()
 	}
+	return s.rcache.Len(), s.rcache.Capacity()
+}
 
-	log.Debugf("Received DNS query for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
+// CacheEvictions returns the number of messages evicted from the response cache.
+func (s *server) CacheEvictions() int64 {
+	if s.rcacheShards != nil {
+		return s.rcacheShards.Evictions()
+	}
+	return s.rcache.Evictions()
+}
 
-	// Check cache first.
-	m1 := s.rcache.Hit(q, dnssec, tcp, m.Id)
-	if m1 != nil {
-		if tcp {
-			if _, overflow := Fit(m1, dns.MaxMsgSize, tcp); overflow {
-				msgFail := new(dns.Msg)
-				s.ServerFailure(msgFail, req)
-				w.WriteMsg(msgFail)
-				return
-			}
-		} else {
-			// Overflow with udp always results in TC.
-			Fit(m1, int(bufsize), tcp)
-		}
-		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-			s.RoundRobin(m1.Answer)
-		}
+// cacheFor returns the response cache for the client of w: the cache of
+// its network with 'cache-by-client-ip', the shared cache otherwise.
+func (s *server) cacheFor(w dns.ResponseWriter) *cache.Cache {
+	if s.rcacheShards == nil {
+		return s.rcache
+	}
+	return s.rcacheShards.Get(clientNetwork(w.RemoteAddr(), s.confFor(w)))
+}
 
-		if err := w.WriteMsg(m1); err != nil {
-			log.Errorf("Failed to return reply %q", err)
-		}
-		StatsCacheHit.Inc(1)
-		return
+// clientNetwork returns the network of the client at addr that has its
+// own response cache, as configured by the 'cache-ip-prefix-len' options.
+func clientNetwork(addr net.Addr, config *Config) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
 	}
+	if ip == nil {
+		return ""
+	}
+	mask := net.CIDRMask(config.CacheIPPrefixLenV6, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(config.CacheIPPrefixLenV4, 8*net.IPv4len)
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
 
-	StatsCacheMiss.Inc(1)
+// Stop stops a server. If the health endpoint is enabled the server reports
+// itself as not ready and keeps answering queries for a short while so that
+// load balancers stop sending traffic before the listeners are closed.
+func (s *server) Stop() {
+	sdNotify("STOPPING=1")
+	if s.health.setStopping() && s.healthServer != nil {
+		log.Infof("Draining queries for %s before shutting down", healthDrainDelay)
+		time.Sleep(healthDrainDelay)
+	}
 
-	defer func() {
-		if local {
-			if m.Rcode == dns.RcodeServerFailure {
-				if err := w.WriteMsg(m); err != nil {
-					log.Errorf("Failed to return reply %q", err)
-				}
-				return
-			}
+	s.shutdown()
 
-			if tcp {
-				if _, overflow := Fit(m, dns.MaxMsgSize, tcp); overflow {
-					msgFail := new(dns.Msg)
-					s.ServerFailure(msgFail, req)
-					w.WriteMsg(msgFail)
-					return
-				}
-			} else {
-				Fit(m, int(bufsize), tcp)
-			}
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), m)
+	if s.healthServer != nil {
+		s.healthServer.Close()
+	}
+	if s.debugServer != nil {
+		s.debugServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if s.tap != nil {
+		s.tap.Close()
+	}
+	if s.qlog != nil {
+		s.qlog.Close()
+	}
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	s.stopTracing()
+}
 
-			if err := w.WriteMsg(m); err != nil {
-				log.Errorf("Failed to return reply %q", err)
-			}
-		}
-	}()
+// ReopenQueryLog reopens the query log file, e.g. after it has been rotated.
+func (s *server) ReopenQueryLog() error {
+	if s.qlog == nil {
+		return nil
+	}
+	return s.qlog.Reopen()
+}
 
-	// Check hosts records before forwarding the query
-	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
-		records, err := s.AddressRecords(q, name)
-		if err != nil {
-			log.Errorf("Error querying hostsfile records: %s", err)
+// recordQuery updates the statistics for a handled query and passes it
+// to the query log and dnstap.
+func (s *server) recordQuery(qw *queryWriter) {
+	switch qw.source {
+	case SourceCache:
+		stats.CacheLatency.Observe(time.Since(qw.start))
+	case SourceHostsfile:
+		stats.HostsfileLatency.Observe(time.Since(qw.start))
+	case SourceStub:
+		stats.StubLatency.Observe(time.Since(qw.start))
+	case SourceForward:
+		stats.ForwardLatency.Observe(time.Since(qw.start))
+	}
+	if qw.msg != nil {
+		stats.RcodeCount.With(dns.RcodeToString[qw.msg.Rcode]).Inc(1)
+		switch qw.msg.Rcode {
+		case dns.RcodeNameError:
+			stats.Inc(stats.NXDomain)
+		case dns.RcodeServerFailure:
+			stats.Inc(stats.ServFail)
 		}
-		if len(records) > 0 {
-			m.Answer = append(m.Answer, records...)
-			return
+		if debugEnabled(qw) {
+			logFor(qw).WithFields(log.Fields{
+				"rcode":    dns.RcodeToString[qw.msg.Rcode],
+				"source":   qw.source,
+				"duration": time.Since(qw.start),
+			}).Debug("Sent reply")
 		}
 	}
+	if s.qlog != nil {
+		s.qlog.log(qw)
+	}
+	if s.tap != nil {
+		s.tapClient(qw)
+	}
+	endTraceQuery(qw)
+}
 
-	if q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
-		local = false
-		resp := s.ServeDNSReverse(w, req)
-		if resp != nil {
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
+// ServeDNS is the handler for DNS requests. It records the query and
+// passes it through the middlewares to serveDNS. Responses are adapted to
+// the EDNS0 support and payload size of the client on the way out.
+func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if s.limit != nil {
+		if !s.limit.acquire(isTCP(w), s.stop) {
+			stats.DroppedQueries.Inc(1)
+			log.Debugf("Dropped query from %s, all %d handlers are busy", w.RemoteAddr(), cap(s.limit.slots))
+			return
 		}
-		return
+		defer s.limit.release()
+	}
+	config := s.conf()
+	qw := newQueryWriter(w, req)
+	qw.config = config
+	qw.slow = config.LogSlowQueries
+	qw.traced = config.DebugDomain != "" && dns.IsSubDomain(config.DebugDomain, strings.ToLower(req.Question[0].Name))
+	if s.tap != nil {
+		// Before the stages rewrite req, e.g. for an alias
+		qw.query, _ = req.Pack()
 	}
+	s.traceQuery(qw)
+	defer s.recordQuery(qw)
 
-	if q.Qclass == dns.ClassCHAOS {
-		m.Authoritative = true
-		if q.Qtype == dns.TypeTXT {
-			switch name {
-			case "authors.bind.":
-				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
-				authors := []string{"Erik St. Martin", "Brian Ketelsen", "Miek Gieben", "Michael Crosby", "Jan Broer"}
-				for _, a := range authors {
-					m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{a}})
-				}
-				for j := 0; j < len(authors)*(int(dns.Id())%4+1); j++ {
-					q := int(dns.Id()) % len(authors)
-					p := int(dns.Id()) % len(authors)
-					if q == p {
-						p = (p + 1) % len(authors)
-					}
-					m.Answer[q], m.Answer[p] = m.Answer[p], m.Answer[q]
-				}
-				return
-			case "version.bind.":
-				fallthrough
-			case "version.server.":
-				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
-				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{s.version}}}
-				return
-			case "hostname.bind.":
-				fallthrough
-			case "id.server.":
-				// TODO(miek): machine name to return
-				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
-				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{"localhost"}}}
-				return
-			}
-		}
-		// still here, fail
-		m.SetReply(req)
+	if atomic.LoadInt32(&s.lowMemory) == 1 {
+		setSource(qw, SourceLocal)
+		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeServerFailure)
+		qw.WriteMsg(m)
 		return
 	}
+	s.handler.ServeDNS(qw, req)
+}
 
-	// Forward all other queries
-	local = false
-	resp := s.ServeDNSForward(w, req)
-	if resp != nil {
-		s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
+// serveDNS counts the query and passes it through the stages of the query
+// path, see Stage.
+func (s *server) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	config := s.confFor(w)
+	q := req.Question[0]
+	_, dnssec, _ := queryParams(w, req)
+
+	stats.Inc(stats.QueryTotal)
+	if config.TrackTop > 0 {
+		client, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		stats.TrackQuery(strings.ToLower(q.Name), client)
+	}
+	stats.QueryTypeCount.With(dns.TypeToString[q.Qtype]).Inc(1)
+
+	if dnssec {
+		stats.DnssecOkCount.Inc(1)
 	}
 
+	if debugEnabled(w) {
+		logFor(w).Debug("Received query")
+	}
+
+	s.stages.ServeDNS(w, req)
 }
 
 func (s *server) AddressRecords(q dns.Question, name string) (records []dns.RR, err error) {
@@ -299,18 +492,29 @@ func (s *server) AddressRecords(q dns.Question, name string) (records []dns.RR,
 		return nil, err
 	}
 
+	config := s.conf()
+	ttl := config.HostsTtl
+	if config.IfaceDomain != "" && strings.HasSuffix(name, "."+dns.Fqdn(config.IfaceDomain)) {
+		ttl = config.IfaceTtl
+	}
+	if rh, ok := s.hosts.(RuntimeHostfile); ok {
+		if t, ok := rh.HostTTL(name); ok {
+			ttl = uint32(t)
+		}
+	}
+
 	for _, ip := range results {
 		switch {
 		case ip.To4() != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
 			r := new(dns.A)
 			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA,
-				Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+				Class: dns.ClassINET, Ttl: ttl}
 			r.A = ip.To4()
 			records = append(records, r)
 		case ip.To4() == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
 			r := new(dns.AAAA)
 			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA,
-				Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+				Class: dns.ClassINET, Ttl: ttl}
 			r.AAAA = ip.To16()
 			records = append(records, r)
 		}
@@ -327,7 +531,7 @@ func (s *server) PTRRecords(q dns.Question) (records []dns.RR, err error) {
 	if result != "" {
 		r := new(dns.PTR)
 		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR,
-			Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+			Class: dns.ClassINET, Ttl: s.conf().HostsTtl}
 		r.Ptr = result
 		records = append(records, r)
 	}
@@ -338,40 +542,6 @@ func (s *server) ServerFailure(m, req *dns.Msg) {
 	m.SetRcode(req, dns.RcodeServerFailure)
 }
 
-func (s *server) RoundRobin(rrs []dns.RR) {
-	if !s.config.RoundRobin {
-		return
-	}
-	// If we have more than 1 CNAME don't touch the packet, because some stub resolver (=glibc)
-	// can't deal with the returned packet if the CNAMEs need to be accesses in the reverse order.
-	cname := 0
-	for _, r := range rrs {
-		if r.Header().Rrtype == dns.TypeCNAME {
-			cname++
-			if cname > 1 {
-				return
-			}
-		}
-	}
-
-	switch l := len(rrs); l {
-	case 2:
-		if dns.Id()%2 == 0 {
-			rrs[0], rrs[1] = rrs[1], rrs[0]
-		}
-	default:
-		for j := 0; j < l*(int(dns.Id())%4+1); j++ {
-			q := int(dns.Id()) % l
-			p := int(dns.Id()) % l
-			if q == p {
-				p = (p + 1) % l
-			}
-			rrs[q], rrs[p] = rrs[p], rrs[q]
-		}
-	}
-
-}
-
 // isTCP returns true if the client is connecting over TCP.
 func isTCP(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
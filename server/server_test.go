@@ -1331,3 +1331,662 @@ func BenchmarkDNSSECSingleNoCache(b *testing.B) {
 	}
 }
 */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/hostsfile"
+	"github.com/miekg/dns"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type testHostfile struct{}
+
+func (testHostfile) FindHosts(name string) ([]net.IP, error) { return nil, nil }
+func (testHostfile) FindReverse(name string) (string, error) { return "", nil }
+
+// newTestHostsfile returns a hostsfile with the entries in data.
+func newTestHostsfile(t *testing.T, data string) *hosts.Hostsfile {
+	h, err := hosts.NewHostsfileFromReader(strings.NewReader(data), &hosts.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// freePort returns a port that is currently unused on the loopback interface.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// startTestServer runs a server with the given config on a free loopback
+// port and waits until its TCP listener accepts connections.
+func startTestServer(t *testing.T, config *Config, middlewares ...Middleware) *server {
+	return startHostsTestServer(t, testHostfile{}, config, middlewares...)
+}
+
+// startHostsTestServer starts a server answering from hostfile.
+func startHostsTestServer(t *testing.T, hostfile Hostfile, config *Config, middlewares ...Middleware) *server {
+	config.DnsAddr = net.JoinHostPort("127.0.0.1", freePort(t))
+	if config.RCacheTtl == 0 {
+		config.RCacheTtl = 60
+	}
+	if config.Ndots == 0 {
+		config.Ndots = 1
+	}
+	if config.UpstreamRetries == 0 {
+		config.UpstreamRetries = 1
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = time.Second
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(hostfile, config, "test", middlewares...)
+	go s.Run()
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", config.DnsAddr); err == nil {
+			conn.Close()
+			// Give the UDP listener a moment as well
+			time.Sleep(50 * time.Millisecond)
+			return s
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("server did not start on %s", config.DnsAddr)
+	return nil
+}
+
+func TestTcpOnly(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, TcpOnly: true})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	resp, _, err := c.Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatalf("TCP query failed: %s", err)
+	}
+	if len(resp.Answer) == 0 {
+		t.Fatal("expected answer to TCP query")
+	}
+
+	c = &dns.Client{Net: "udp", Timeout: time.Second}
+	if _, _, err := c.Exchange(m, s.conf().DnsAddr); err == nil {
+		t.Fatal("expected UDP query to fail")
+	}
+}
+
+func TestMaxTCPConnections(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, MaxTCPConnections: 2})
+	defer s.Stop()
+
+	// The startup probe connection may still be counted, let it go away
+	time.Sleep(100 * time.Millisecond)
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	// Make sure the server accepted the connections
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("tcp", s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected connection beyond the limit to be closed")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("expected connection beyond the limit to be closed, but it is still open")
+	}
+
+	// Closing a connection frees a slot
+	conns[0].Close()
+	conns = conns[1:]
+	time.Sleep(100 * time.Millisecond)
+
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	if _, _, err := client.Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatalf("expected query to succeed after a connection was closed: %s", err)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true})
+
+	check := func(h http.HandlerFunc, want int) {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != want {
+			t.Errorf("expected status %d, got %d: %s", want, rec.Code, rec.Body.String())
+		}
+	}
+
+	check(s.serveHealthz, http.StatusOK)
+	check(s.serveReadyz, http.StatusOK)
+
+	s.conf().NoRec = false
+	check(s.serveReadyz, http.StatusServiceUnavailable)
+	s.health.upstreamSuccess()
+	check(s.serveReadyz, http.StatusOK)
+
+	s.Stop()
+	check(s.serveReadyz, http.StatusServiceUnavailable)
+}
+
+// startTestUpstream starts a nameserver answering every A query with
+// 127.0.0.1 and returns its address.
+func startTestUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String()
+}
+
+func TestStubZoneFailover(t *testing.T) {
+	good := startTestUpstream(t)
+	bad := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	zone := NewStubZone([]string{bad, good})
+	stubs := map[string]*StubZone{"stub.local.": zone}
+	s := startTestServer(t, &Config{Nameservers: []string{good}, Stub: &stubs})
+	defer s.Stop()
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("host.stub.local.", dns.TypeA)
+	for i := 0; i < 4; i++ {
+		r, _, err := c.Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("query %d: expected an answer, got %v", i, r)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if ns := zone.servers(); ns[0] != good || ns[1] != bad {
+			t.Errorf("expected failed nameserver to be tried last, got %v", ns)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
+func TestLogSlowQueries(t *testing.T) {
+	good := startTestUpstream(t)
+	bad := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	out := new(syncBuffer)
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	s := startTestServer(t, &Config{Nameservers: []string{bad, good}, LogSlowQueries: time.Nanosecond})
+
+	m := new(dns.Msg)
+	m.SetQuestion("slow.example.com.", dns.TypeA)
+	if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50 && !strings.Contains(out.String(), "Slow query"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	line := out.String()
+	for _, want := range []string{"Slow query", "qname=slow.example.com.", "cache=", "exchange(" + bad + ")=", "exchange(" + good + ")=", "cached=false", "upstream=\"" + good + "\""} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in log output %q", want, line)
+		}
+	}
+}
+
+func TestDebugEndpoint(t *testing.T) {
+	if err := CheckConfig(&Config{DnsAddr: "127.0.0.1:53", Ndots: 1, NoRec: true, DebugListen: "0.0.0.0:6060"}); err == nil {
+		t.Error("expected non-loopback debug address to be rejected")
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", freePort(t))
+	s := startTestServer(t, &Config{NoRec: true, DebugListen: addr})
+
+	resp, err := http.Get("http://" + addr + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	s.Stop()
+	if _, err := http.Get("http://" + addr + "/debug/vars"); err == nil {
+		t.Error("expected debug endpoint to be closed after Stop")
+	}
+}
+
+func TestDebugDomain(t *testing.T) {
+	out := new(syncBuffer)
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	s := startTestServer(t, &Config{NoRec: true, DebugDomain: "debug.example."})
+
+	c := new(dns.Client)
+	for _, name := range []string{"quiet.example.", "Host.Debug.Example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if _, _, err := c.Exchange(m, s.conf().DnsAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50 && !strings.Contains(out.String(), "Sent reply"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logged := out.String()
+	if strings.Contains(logged, "quiet.example.") {
+		t.Errorf("expected no debug messages for names outside the debug domain, got %q", logged)
+	}
+	for _, want := range []string{"Received query", "Checked cache", "Sent reply", "qid="} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("expected %q in log output %q", want, logged)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	good := startTestUpstream(t)
+	bad := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	out := new(syncBuffer)
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	zone := NewStubZone([]string{good})
+	stubs := map[string]*StubZone{"stub.local.": zone}
+	s := startTestServer(t, &Config{Nameservers: []string{bad}, Stub: &stubs})
+	defer s.Stop()
+	addr := s.conf().DnsAddr
+
+	config := &Config{
+		DnsAddr:     "127.0.0.1:1",
+		Nameservers: []string{good},
+		RCacheTtl:   60,
+		Ndots:       1,
+		ReadTimeout: time.Second,
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	(*config.Stub)["stub.local."] = NewStubZone([]string{good})
+	(*config.Alias)["a.local."] = "b.local."
+	s.Reload(config)
+
+	if s.conf().DnsAddr != addr {
+		t.Errorf("expected listen address %s to be kept, got %s", addr, s.conf().DnsAddr)
+	}
+	if (*s.conf().Stub)["stub.local."] != zone {
+		t.Error("expected unchanged stub zone to be kept")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("reload.example.com.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("expected an answer from the new nameserver, got %v", r)
+	}
+
+	for _, want := range []string{
+		"needs restart: dns_addr: " + addr + " -> 127.0.0.1:1",
+		"~ nameservers: " + bad + " -> " + good,
+		"+ aliases a.local.: b.local.",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in log output %q", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "stubzones") {
+		t.Errorf("expected no change of stub zones in log output %q", out.String())
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("go-dnsmasq-notify-%d.sock", os.Getpid()))
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "200000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	s := startTestServer(t, &Config{NoRec: true})
+
+	buf := make([]byte, 64)
+	for _, want := range []string{"READY=1", "WATCHDOG=1", "WATCHDOG=1"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected %s: %s", want, err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+
+	go s.Stop()
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected STOPPING=1: %s", err)
+		}
+		if string(buf[:n]) == "STOPPING=1" {
+			break
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer func(f func(string) (sdktrace.SpanExporter, error)) { traceExporter = f }(traceExporter)
+	traceExporter = func(endpoint string) (sdktrace.SpanExporter, error) {
+		if endpoint != "collector:4317" {
+			t.Errorf("expected endpoint collector:4317, got %s", endpoint)
+		}
+		return exporter, nil
+	}
+
+	good := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{good}, RCache: 10, OtlpEndpoint: "collector:4317"})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("traced.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The span of a query ends after the response was written
+	time.Sleep(50 * time.Millisecond)
+	s.tracerProvider.ForceFlush(context.Background())
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	attrs := func(span tracetest.SpanStub) map[string]string {
+		m := make(map[string]string)
+		for _, kv := range span.Attributes {
+			m[string(kv.Key)] = kv.Value.Emit()
+		}
+		return m
+	}
+
+	upstream, query, cached := spans[0], spans[1], spans[2]
+	if upstream.Name != "dns.upstream" || query.Name != "dns.query" || cached.Name != "dns.query" {
+		t.Fatalf("unexpected spans %s, %s, %s", upstream.Name, query.Name, cached.Name)
+	}
+	if upstream.Parent.SpanID() != query.SpanContext.SpanID() {
+		t.Error("expected upstream span to be a child of the query span")
+	}
+	for span, want := range map[*tracetest.SpanStub]map[string]string{
+		&upstream: {"upstream.address": good, "dns.response.code": "NOERROR"},
+		&query: {"dns.question.name": "traced.example.com.", "dns.question.type": "A",
+			"dns.response.code": "NOERROR", "upstream.address": good, "cache.hit": "false"},
+		&cached: {"cache.hit": "true"},
+	} {
+		got := attrs(*span)
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: expected %s=%s, got %q", span.Name, k, v, got[k])
+			}
+		}
+	}
+}
+
+func TestForwardersOnly(t *testing.T) {
+	upstream := startTestUpstream(t)
+	bad := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	for _, forwardersOnly := range []bool{false, true} {
+		stubs := map[string]*StubZone{"stub.local.": NewStubZone([]string{bad})}
+		s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local"),
+			&Config{Nameservers: []string{upstream}, ForwardersOnly: forwardersOnly, Stub: &stubs})
+
+		want := map[string]string{"host.local.": "10.0.0.1", "host.stub.local.": ""}
+		if forwardersOnly {
+			want = map[string]string{"host.local.": "127.0.0.1", "host.stub.local.": "127.0.0.1"}
+		}
+		for name, ip := range want {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if len(r.Answer) == 1 {
+				got = r.Answer[0].(*dns.A).A.String()
+			}
+			if got != ip {
+				t.Errorf("forwarders-only %v: expected %s to resolve to %q, got %v", forwardersOnly, name, ip, r.Answer)
+			}
+		}
+		s.Stop()
+	}
+}
+
+func TestHealthCheckName(t *testing.T) {
+	s := startTestServer(t, &Config{NoRec: true, ForwardersOnly: true})
+	defer s.Stop()
+
+	for qtype, want := range map[uint16]string{dns.TypeA: "127.0.0.1", dns.TypeAAAA: "::1", dns.TypeMX: ""} {
+		m := new(dns.Msg)
+		m.SetQuestion("Health.Localhost.", qtype)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected NOERROR, got %s", dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+		}
+		var got string
+		switch {
+		case len(r.Answer) != 1:
+		case qtype == dns.TypeA:
+			got = r.Answer[0].(*dns.A).A.String()
+		case qtype == dns.TypeAAAA:
+			got = r.Answer[0].(*dns.AAAA).AAAA.String()
+		}
+		if got != want || want == "" && len(r.Answer) != 0 {
+			t.Errorf("%s: expected %q, got %v", dns.TypeToString[qtype], want, r.Answer)
+		}
+	}
+}
+
+func TestNoRecRefused(t *testing.T) {
+	s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local"), &Config{NoRec: true})
+	defer s.Stop()
+
+	for _, net := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: net, Timeout: time.Second}
+		for _, q := range []struct {
+			name  string
+			qtype uint16
+		}{{"missing.local.", dns.TypeA}, {"2.0.0.10.in-addr.arpa.", dns.TypePTR}} {
+			m := new(dns.Msg)
+			m.SetQuestion(q.name, q.qtype)
+			r, _, err := c.Exchange(m, s.conf().DnsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != dns.RcodeRefused || r.RecursionAvailable || len(r.Answer) != 0 {
+				t.Errorf("%s %s %s: expected REFUSED without RA, got %s", net, q.name, dns.TypeToString[q.qtype], r)
+			}
+		}
+
+		// Hostsfile answers are authoritative
+		for _, q := range []struct {
+			name  string
+			qtype uint16
+		}{{"host.local.", dns.TypeA}, {"1.0.0.10.in-addr.arpa.", dns.TypePTR}} {
+			m := new(dns.Msg)
+			m.SetQuestion(q.name, q.qtype)
+			r, _, err := c.Exchange(m, s.conf().DnsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != dns.RcodeSuccess || !r.Authoritative || r.RecursionAvailable || len(r.Answer) != 1 {
+				t.Errorf("%s %s %s: expected an authoritative answer without RA, got %s", net, q.name, dns.TypeToString[q.qtype], r)
+			}
+		}
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	upstream, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		m.RecursionAvailable = false
+		rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, norec := range []bool{false, true} {
+		s := startHostsTestServer(t, newTestHostsfile(t, "10.0.0.1 host.local\n"),
+			&Config{Nameservers: []string{upstream}, NoRec: norec, RCache: 100, LocalDomains: []string{"lan."}})
+		if err := s.AddCNAME("www.local", "host.local"); err != nil {
+			t.Fatal(err)
+		}
+
+		c := new(dns.Client)
+		for _, tc := range []struct {
+			path          string
+			name          string
+			qclass, qtype uint16
+			rcode         int
+			aa            bool
+		}{
+			{"hostsfile", "Host.Local.", dns.ClassINET, dns.TypeA, dns.RcodeSuccess, true},
+			{"cname", "WWW.local.", dns.ClassINET, dns.TypeA, dns.RcodeSuccess, true},
+			{"ptr", "1.0.0.10.In-Addr.Arpa.", dns.ClassINET, dns.TypePTR, dns.RcodeSuccess, true},
+			{"health", "Health.Localhost.", dns.ClassINET, dns.TypeA, dns.RcodeSuccess, true},
+			{"chaos", "Version.Bind.", dns.ClassCHAOS, dns.TypeTXT, dns.RcodeSuccess, true},
+			{"local-domain", "Missing.LAN.", dns.ClassINET, dns.TypeA, dns.RcodeNameError, true},
+			{"forward", "Www.Example.Com.", dns.ClassINET, dns.TypeA, dns.RcodeSuccess, false},
+		} {
+			if norec && tc.path == "forward" {
+				tc.rcode = dns.RcodeRefused
+			}
+			// The second query of each name is answered from the cache,
+			// which holds the response to the first
+			for _, rd := range []bool{true, false} {
+				m := new(dns.Msg)
+				m.SetQuestion(tc.name, tc.qtype)
+				m.Question[0].Qclass = tc.qclass
+				m.RecursionDesired = rd
+				r, _, err := c.Exchange(m, s.conf().DnsAddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				desc := fmt.Sprintf("no-rec %v, %s, RD %v", norec, tc.path, rd)
+				if r.Rcode != tc.rcode {
+					t.Errorf("%s: expected %s, got %s", desc, dns.RcodeToString[tc.rcode], dns.RcodeToString[r.Rcode])
+				}
+				if r.Id != m.Id || len(r.Question) != 1 || r.Question[0] != m.Question[0] {
+					t.Errorf("%s: expected ID %d and question %v, got %d and %v", desc, m.Id, m.Question, r.Id, r.Question)
+				}
+				if r.Authoritative != tc.aa {
+					t.Errorf("%s: expected AA %v, got %v", desc, tc.aa, r.Authoritative)
+				}
+				if r.RecursionAvailable != !norec {
+					t.Errorf("%s: expected RA %v, got %v", desc, !norec, r.RecursionAvailable)
+				}
+				if r.RecursionDesired != rd {
+					t.Errorf("%s: expected RD %v, got %v", desc, rd, r.RecursionDesired)
+				}
+			}
+		}
+		s.Stop()
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/janeczku/go-dnsmasq/cache"
+	"github.com/janeczku/go-dnsmasq/stats"
+	"github.com/miekg/dns"
+)
+
+// Stage names a step of the query path. Each stage answers the queries it
+// is responsible for and passes the others on to the next stage.
+type Stage string
+
+// The stages of the query path, in the order queries pass through them
+const (
+	// Answers the query types in QtypeFilter from the hostsfile or with NODATA
+	StageQtypeFilter Stage = "qtype-filter"
+	// Answers from the response cache
+	StageCache Stage = "cache"
+	// Answers the health check name
+	StageHealth Stage = "health"
+	// Answers A, AAAA and ANY queries for names in the hostsfile and PTR
+	// queries for its addresses, and the queries for the names with a CNAME
+	// added by AddCNAME
+	StageHostsfile Stage = "hostsfile"
+	// Answers queries of the CHAOS class such as version.bind
+	StageChaos Stage = "chaos"
+	// Answers the queries for names under LocalDomains with NXDOMAIN, or
+	// NODATA for names in the hostsfile, and the PTR queries for private
+	// addresses with NoPrivateReverse
+	StageLocalDomain Stage = "local-domain"
+	// Forwards the query to the nameservers of its stub zone or to the
+	// upstream nameservers, applying aliases and search domains. It
+	// answers every query reaching it.
+	StageForward Stage = "forward"
+)
+
+var stages = []Stage{StageQtypeFilter, StageCache, StageHealth, StageHostsfile, StageChaos, StageLocalDomain, StageForward}
+
+// StageMiddleware is a Middleware inserted into the query path next to a
+// Stage, see UseStages.
+type StageMiddleware struct {
+	Stage Stage
+	// Run Middleware for the queries the stage passes on instead of the
+	// queries reaching the stage
+	After      bool
+	Middleware Middleware
+}
+
+// UseStages inserts middlewares into the query path. A middleware before
+// a stage may answer queries instead of it, e.g. to route the queries of
+// a tenant, or wrap the dns.ResponseWriter to see its answers. Middlewares
+// at the same position run in the order given, the first being the
+// outermost. It must be called before Run.
+func (s *server) UseStages(middlewares ...StageMiddleware) error {
+	for _, mw := range middlewares {
+		known := false
+		for _, stage := range stages {
+			known = known || stage == mw.Stage
+		}
+		switch {
+		case !known:
+			return fmt.Errorf("Unknown stage %q", mw.Stage)
+		case mw.Stage == StageForward && mw.After:
+			return fmt.Errorf("No middleware can run after stage %q, it answers every query", mw.Stage)
+		case mw.Middleware == nil:
+			return fmt.Errorf("No middleware given for stage %q", mw.Stage)
+		}
+	}
+	s.stageMiddlewares = append(s.stageMiddlewares, middlewares...)
+	s.stages = s.buildStages()
+	return nil
+}
+
+// buildStages chains the stages and the middlewares inserted next to them.
+func (s *server) buildStages() Handler {
+	handlers := map[Stage]Middleware{
+		StageQtypeFilter: s.qtypeFilterStage,
+		StageCache:       s.cacheStage,
+		StageHealth:      s.healthStage,
+		StageHostsfile:   s.hostsfileStage,
+		StageChaos:       s.chaosStage,
+		StageLocalDomain: s.localDomainStage,
+		StageForward:     s.forwardStage,
+	}
+	var chain []Middleware
+	for _, stage := range stages {
+		var after []Middleware
+		for _, mw := range s.stageMiddlewares {
+			switch {
+			case mw.Stage != stage:
+			case mw.After:
+				after = append(after, mw.Middleware)
+			default:
+				chain = append(chain, mw.Middleware)
+			}
+		}
+		chain = append(chain, handlers[stage])
+		chain = append(chain, after...)
+	}
+	// Not reached, StageForward answers every query
+	return Chain(chain...)(HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {}))
+}
+
+// queryParams returns the size the response to req must fit in, whether
+// req has the DO bit set and whether it was received over TCP.
+func queryParams(w dns.ResponseWriter, req *dns.Msg) (bufsize uint16, dnssec, tcp bool) {
+	bufsize = 512
+	if o := req.IsEdns0(); o != nil {
+		bufsize = o.UDPSize()
+		dnssec = o.Do()
+	}
+	if bufsize < 512 {
+		bufsize = 512
+	}
+	// with TCP we can send 64K
+	if tcp = isTCP(w); tcp {
+		bufsize = dns.MaxMsgSize - 1
+	}
+	return bufsize, dnssec, tcp
+}
+
+// newReply returns an empty response to req.
+func newReply(config *Config, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = false
+	m.RecursionAvailable = !config.NoRec
+	m.Compress = true
+	return m
+}
+
+// writeLocal fits the response m given by the server itself into the
+// size the client accepts, adds it to the cache and writes it.
+func (s *server) writeLocal(w dns.ResponseWriter, req, m *dns.Msg) {
+	if m.Rcode == dns.RcodeServerFailure {
+		if err := w.WriteMsg(m); err != nil {
+			log.Errorf("Failed to return reply %q", err)
+		}
+		return
+	}
+
+	bufsize, dnssec, tcp := queryParams(w, req)
+	if tcp {
+		if _, overflow := Fit(m, dns.MaxMsgSize, tcp); overflow {
+			msgFail := new(dns.Msg)
+			s.ServerFailure(msgFail, req)
+			w.WriteMsg(msgFail)
+			return
+		}
+	} else {
+		Fit(m, int(bufsize), tcp)
+	}
+	s.cacheFor(w).InsertMessage(cache.Key(req.Question[0], dnssec, tcp), m)
+
+	if err := w.WriteMsg(m); err != nil {
+		log.Errorf("Failed to return reply %q", err)
+	}
+}
+
+func (s *server) cacheStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		bufsize, dnssec, tcp := queryParams(w, req)
+
+		cacheStart := time.Now()
+		m := s.cacheFor(w).Hit(q, dnssec, tcp, req.Id)
+		addTiming(w, "cache", cacheStart)
+		if debugEnabled(w) {
+			logFor(w).WithField("hit", m != nil).Debug("Checked cache")
+		}
+		if m == nil {
+			stats.Inc(stats.CacheMiss)
+			next.ServeDNS(w, req)
+			return
+		}
+
+		setSource(w, SourceCache)
+		if tcp {
+			if _, overflow := Fit(m, dns.MaxMsgSize, tcp); overflow {
+				msgFail := new(dns.Msg)
+				s.ServerFailure(msgFail, req)
+				w.WriteMsg(msgFail)
+				return
+			}
+		} else {
+			// Overflow with udp always results in TC.
+			Fit(m, int(bufsize), tcp)
+		}
+
+		if err := w.WriteMsg(m); err != nil {
+			log.Errorf("Failed to return reply %q", err)
+		}
+		stats.Inc(stats.CacheHit)
+	})
+}
+
+func (s *server) healthStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		if strings.ToLower(q.Name) != HealthCheckName || q.Qclass != dns.ClassINET {
+			next.ServeDNS(w, req)
+			return
+		}
+		setSource(w, SourceLocal)
+		m := newReply(s.confFor(w), req)
+		m.Authoritative = true
+		m.Answer = healthCheckRecords(q)
+		s.writeLocal(w, req, m)
+	})
+}
+
+// isReverse reports whether q is answered from the reverse zones.
+func isReverse(q dns.Question) bool {
+	name := strings.ToLower(q.Name)
+	return q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
+
+func (s *server) hostsfileStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		config := s.confFor(w)
+		q := req.Question[0]
+		if config.ForwardersOnly {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		if q.Qclass == dns.ClassINET {
+			if cnames, _ := s.cnameRecords(q); len(cnames) > 0 {
+				s.serveCNAME(w, req, cnames)
+				return
+			}
+		}
+
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			hostsStart := time.Now()
+			records, err := s.AddressRecords(q, strings.ToLower(q.Name))
+			addTiming(w, "hostsfile", hostsStart)
+			if err != nil {
+				logFor(w).WithError(err).Error("Error querying hostsfile records")
+			}
+			if len(records) > 0 {
+				setSource(w, SourceHostsfile)
+				m := newReply(config, req)
+				// The hostsfile is the authority for its names
+				m.Authoritative = true
+				m.Answer = records
+				s.writeLocal(w, req, m)
+				return
+			}
+		}
+
+		if isReverse(q) {
+			if records, err := s.PTRRecords(q); err == nil && len(records) > 0 {
+				setSource(w, SourceHostsfile)
+				m := newReply(config, req)
+				m.Authoritative = true
+				m.Answer = records
+				if err := w.WriteMsg(m); err != nil {
+					log.Errorf("Failed to send reply: %q", err)
+				}
+				_, dnssec, tcp := queryParams(w, req)
+				s.cacheFor(w).InsertMessage(cache.Key(q, dnssec, tcp), m)
+				return
+			}
+		}
+		next.ServeDNS(w, req)
+	})
+}
+
+// chaosStage answers the CHAOS class queries except those for the reverse
+// zones, which are forwarded.
+func (s *server) chaosStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		if q.Qclass != dns.ClassCHAOS || isReverse(q) {
+			next.ServeDNS(w, req)
+			return
+		}
+
+		setSource(w, SourceLocal)
+		m := newReply(s.confFor(w), req)
+		m.Authoritative = true
+		if q.Qtype == dns.TypeTXT {
+			switch strings.ToLower(q.Name) {
+			case "authors.bind.":
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+				authors := []string{"Erik St. Martin", "Brian Ketelsen", "Miek Gieben", "Michael Crosby", "Jan Broer"}
+				for _, a := range authors {
+					m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{a}})
+				}
+				for j := 0; j < len(authors)*(int(dns.Id())%4+1); j++ {
+					q := int(dns.Id()) % len(authors)
+					p := int(dns.Id()) % len(authors)
+					if q == p {
+						p = (p + 1) % len(authors)
+					}
+					m.Answer[q], m.Answer[p] = m.Answer[p], m.Answer[q]
+				}
+				s.writeLocal(w, req, m)
+				return
+			case "version.bind.":
+				fallthrough
+			case "version.server.":
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{s.version}}}
+				s.writeLocal(w, req, m)
+				return
+			case "hostname.bind.":
+				fallthrough
+			case "id.server.":
+				// TODO(miek): machine name to return
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{"localhost"}}}
+				s.writeLocal(w, req, m)
+				return
+			}
+		}
+		// still here, fail
+		m.SetReply(req)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		s.writeLocal(w, req, m)
+	})
+}
+
+func (s *server) forwardStage(next Handler) Handler {
+	return HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// Taken before forwarding, which may replace the name of an alias
+		q := req.Question[0]
+		_, dnssec, tcp := queryParams(w, req)
+		resp := s.ServeDNSForward(w, req)
+		if resp != nil {
+			s.cacheFor(w).InsertMessage(cache.Key(q, dnssec, tcp), resp)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stubZoneDownTime is how long a stub zone nameserver that failed to
+// answer is passed over in favour of the other nameservers of the zone.
+const stubZoneDownTime = 30 * time.Second
+
+// StubZone holds the nameservers of a stub zone. Queries are spread over
+// the nameservers round-robin, skipping nameservers that recently failed.
+type StubZone struct {
+	Nameservers []string `json:"nameservers"`
+
+	next uint32
+	down []int64 // unix nanoseconds until which a nameserver is skipped
+}
+
+// NewStubZone returns a stub zone forwarding to the given nameservers.
+func NewStubZone(nameservers []string) *StubZone {
+	return &StubZone{
+		Nameservers: nameservers,
+		down:        make([]int64, len(nameservers)),
+	}
+}
+
+// servers returns the nameservers in the order they should be tried for
+// the next query. Nameservers that recently failed come last.
+func (z *StubZone) servers() []string {
+	n := len(z.Nameservers)
+	start := int(atomic.AddUint32(&z.next, 1)-1) % n
+	now := time.Now().UnixNano()
+
+	up := make([]string, 0, n)
+	var down []string
+	for i := 0; i < n; i++ {
+		j := (start + i) % n
+		if atomic.LoadInt64(&z.down[j]) > now {
+			down = append(down, z.Nameservers[j])
+		} else {
+			up = append(up, z.Nameservers[j])
+		}
+	}
+	return append(up, down...)
+}
+
+// markDown excludes the nameserver for stubZoneDownTime.
+func (z *StubZone) markDown(ns string) {
+	z.setDown(ns, time.Now().Add(stubZoneDownTime).UnixNano())
+}
+
+// markUp makes the nameserver available again.
+func (z *StubZone) markUp(ns string) {
+	z.setDown(ns, 0)
+}
+
+func (z *StubZone) setDown(ns string, until int64) {
+	for i, n := range z.Nameservers {
+		if n == ns {
+			atomic.StoreInt64(&z.down[i], until)
+		}
+	}
+}
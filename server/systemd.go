@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/miekg/dns"
+)
+
+// sdNotify sends state to systemd. It is a no-op unless the server runs
+// as a Type=notify service, i.e. NOTIFY_SOCKET is set.
+func sdNotify(state string) {
+	if err := daemon.SdNotify(state); err != nil && err != daemon.SdNotifyNoSocket {
+		log.Warnf("Failed to notify systemd: %s", err)
+	}
+}
+
+// watchdogInterval returns the interval in which systemd expects watchdog
+// pings from this process, or zero if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd that the server is answering queries and
+// starts pinging the watchdog if it is enabled.
+func (s *server) notifyReady() {
+	sdNotify("READY=1")
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	s.mu.Lock()
+	srv := s.dnsServers[0]
+	s.mu.Unlock()
+
+	c := &dns.Client{Net: "udp", ReadTimeout: interval / 4, WriteTimeout: interval / 4}
+	addr := ""
+	if srv.PacketConn != nil {
+		addr = srv.PacketConn.LocalAddr().String()
+	} else {
+		c.Net = "tcp"
+		addr = srv.Listener.Addr().String()
+	}
+	log.Infof("Pinging systemd watchdog every %s", interval/2)
+	go s.watchdog(c, addr, interval/2)
+}
+
+// watchdog pings the systemd watchdog every interval as long as the
+// server answers a query that does not need to be forwarded.
+func (s *server) watchdog(c *dns.Client, addr string, interval time.Duration) {
+	m := new(dns.Msg)
+	m.SetQuestion("version.server.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+
+	for range time.Tick(interval) {
+		if atomic.LoadInt32(&s.health.stopping) == 1 {
+			return
+		}
+		if _, _, err := c.Exchange(m, addr); err != nil {
+			log.Warnf("Not pinging systemd watchdog, local query failed: %s", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceShutdownTimeout is how long Stop waits for pending spans to be sent.
+const traceShutdownTimeout = 5 * time.Second
+
+// traceExporter returns the exporter sending spans to the OTLP collector
+// at endpoint. Tests replace it with an in-memory exporter.
+var traceExporter = func(endpoint string) (sdktrace.SpanExporter, error) {
+	return otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure())
+}
+
+// startTracing sets up the tracer spans of queries and upstream exchanges
+// are recorded with.
+func (s *server) startTracing(endpoint string) error {
+	exporter, err := traceExporter(endpoint)
+	if err != nil {
+		return err
+	}
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "go-dnsmasq"),
+			attribute.String("service.version", s.version),
+		)),
+	)
+	s.tracer = s.tracerProvider.Tracer("github.com/janeczku/go-dnsmasq/server")
+	return nil
+}
+
+// stopTracing sends the pending spans and shuts the tracer down.
+func (s *server) stopTracing() {
+	if s.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := s.tracerProvider.Shutdown(ctx); err != nil {
+		log.Warnf("Failed to send pending traces: %s", err)
+	}
+}
+
+// traceQuery starts the root span of the query answered through qw.
+func (s *server) traceQuery(qw *queryWriter) {
+	if s.tracer == nil {
+		return
+	}
+	q := qw.req.Question[0]
+	qw.ctx, qw.span = s.tracer.Start(context.Background(), "dns.query",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(qw.start),
+		trace.WithAttributes(
+			attribute.String("dns.question.name", q.Name),
+			attribute.String("dns.question.type", dns.TypeToString[q.Qtype]),
+		))
+}
+
+// endTraceQuery ends the root span of the query answered through qw.
+func endTraceQuery(qw *queryWriter) {
+	if qw.span == nil {
+		return
+	}
+	qw.span.SetAttributes(attribute.Bool("cache.hit", qw.source == SourceCache))
+	if qw.upstream != "" {
+		qw.span.SetAttributes(attribute.String("upstream.address", qw.upstream))
+	}
+	if qw.msg != nil {
+		qw.span.SetAttributes(attribute.String("dns.response.code", dns.RcodeToString[qw.msg.Rcode]))
+		if qw.msg.Rcode == dns.RcodeServerFailure {
+			qw.span.SetStatus(codes.Error, "SERVFAIL")
+		}
+	}
+	qw.span.End()
+}
+
+// traceExchange records a span for an exchange with the upstream
+// nameserver ns started at qtime, as a child of the span of the query
+// answered through w.
+func (s *server) traceExchange(w dns.ResponseWriter, ns string, resp *dns.Msg, qtime time.Time, err error) {
+	qw, ok := w.(*queryWriter)
+	if !ok || qw.span == nil {
+		return
+	}
+	_, span := s.tracer.Start(qw.ctx, "dns.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(qtime),
+		trace.WithAttributes(attribute.String("upstream.address", ns)))
+	if resp != nil {
+		span.SetAttributes(attribute.String("dns.response.code", dns.RcodeToString[resp.Rcode]))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
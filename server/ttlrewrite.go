@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTLRewriteRule overrides the TTL of upstream records whose owner name
+// matches Pattern.
+type TTLRewriteRule struct {
+	// Lower case FQDN. A leading '*' matches any prefix, so that
+	// '*.example.com.' matches all names below example.com.
+	Pattern string `json:"pattern"`
+	TTL     uint32 `json:"ttl"`
+}
+
+// ParseTTLRewriteRule parses a rule given as 'pattern:ttl'.
+func ParseTTLRewriteRule(s string) (TTLRewriteRule, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 1 {
+		return TTLRewriteRule{}, fmt.Errorf("expected pattern:ttl, got %q", s)
+	}
+	pattern := dns.Fqdn(strings.ToLower(strings.TrimSpace(s[:i])))
+	if strings.Contains(pattern[1:], "*") {
+		return TTLRewriteRule{}, fmt.Errorf("'*' is only allowed at the start of the pattern %q", pattern)
+	}
+	suffix := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+	if _, ok := dns.IsDomainName(dns.Fqdn(suffix)); !ok {
+		return TTLRewriteRule{}, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	ttl, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 10, 32)
+	if err != nil {
+		return TTLRewriteRule{}, fmt.Errorf("invalid TTL in %q", s)
+	}
+	return TTLRewriteRule{Pattern: pattern, TTL: uint32(ttl)}, nil
+}
+
+func (r TTLRewriteRule) String() string {
+	return fmt.Sprintf("%s:%d", r.Pattern, r.TTL)
+}
+
+func (r TTLRewriteRule) match(name string) bool {
+	if strings.HasPrefix(r.Pattern, "*") {
+		return strings.HasSuffix(name, r.Pattern[1:])
+	}
+	return name == r.Pattern
+}
+
+// rewriteTTLs sets the TTL of every record in m to that of the first rule
+// matching its owner name.
+func rewriteTTLs(rules []TTLRewriteRule, m *dns.Msg) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			name := strings.ToLower(hdr.Name)
+			for _, rule := range rules {
+				if rule.match(name) {
+					hdr.Ttl = rule.TTL
+					break
+				}
+			}
+		}
+	}
+}
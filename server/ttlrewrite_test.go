@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTTLRewriteRule(t *testing.T) {
+	for in, want := range map[string]string{
+		"*.amazonaws.com:300": "*.amazonaws.com.:300",
+		"Example.COM.:0":      "example.com.:0",
+		"*:60":                "*.:60",
+	} {
+		r, err := ParseTTLRewriteRule(in)
+		if err != nil {
+			t.Errorf("%s: %s", in, err)
+			continue
+		}
+		if r.String() != want {
+			t.Errorf("%s: expected %s, got %s", in, want, r)
+		}
+	}
+	for _, in := range []string{"example.com", ":300", "example.com:-1", "a.*.example.com:300", "example.com:ttl"} {
+		if _, err := ParseTTLRewriteRule(in); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestTTLRewrite(t *testing.T) {
+	var rules []TTLRewriteRule
+	for _, r := range []string{"exact.example.com:10", "*.example.com:300", "*.exact.example.com:20"} {
+		rule, err := ParseTTLRewriteRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	good := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{good}, TTLRewrites: rules})
+	defer s.Stop()
+
+	for name, ttl := range map[string]uint32{
+		"exact.example.com.":     10,
+		"Host.Example.com.":      300,
+		"sub.exact.example.com.": 300, // first match wins
+		"example.com.":           60,
+		"other.org.":             60,
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != ttl {
+			t.Errorf("%s: expected TTL %d, got %v", name, ttl, r.Answer)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errPoolClosed = errors.New("upstream connection pool is closed")
+
+// upstreamPool sends the queries to each upstream nameserver over up to
+// size long-lived connections per protocol instead of a new socket per
+// query. Queries share a connection: each gets an unused message ID and
+// the responses are matched to the waiting query by ID and question.
+type upstreamPool struct {
+	size     int
+	timeout  time.Duration
+	sourceIP net.IP
+
+	mu     sync.Mutex
+	conns  map[string][]*pooledConn // by network and address
+	next   map[string]int           // round robin index by network and address
+	closed bool
+}
+
+// pooledConn is a connection of the pool and the queries waiting for a
+// response on it.
+type pooledConn struct {
+	conn *dns.Conn
+	wmu  sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	waiters map[uint16]*pooledQuery
+	err     error         // why the connection was closed
+	done    chan struct{} // closed when the reader stops
+}
+
+type pooledQuery struct {
+	question dns.Question
+	reply    chan *dns.Msg
+}
+
+func newUpstreamPool(size int, timeout time.Duration, sourceIP net.IP) *upstreamPool {
+	return &upstreamPool{
+		size:     size,
+		timeout:  timeout,
+		sourceIP: sourceIP,
+		conns:    make(map[string][]*pooledConn),
+		next:     make(map[string]int),
+	}
+}
+
+// Exchange sends m to upstream over one of the pooled connections and
+// returns the response.
+func (p *upstreamPool) Exchange(ctx context.Context, m *dns.Msg, upstream Upstream) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	key := upstream.Net + "/" + upstream.Addr
+	pc, err := p.get(upstream.Net, upstream.Addr, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := pc.exchange(ctx, m, p.timeout)
+	if err != nil && pc.failed() {
+		p.remove(key, pc)
+	}
+	return r, time.Since(start), err
+}
+
+// get returns a connection to addr, dialing a new one while the pool for
+// addr has fewer than size.
+func (p *upstreamPool) get(network, addr, key string) (*pooledConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	if conns := p.conns[key]; len(conns) >= p.size {
+		pc := conns[p.next[key]%len(conns)]
+		p.next[key]++
+		p.mu.Unlock()
+		return pc, nil
+	}
+	p.mu.Unlock()
+
+	c, err := upstreamDialer(network, p.sourceIP, p.timeout).Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Large enough for any UDP response, whatever EDNS0 size the query
+	// advertises
+	pc := &pooledConn{
+		conn:    &dns.Conn{Conn: c, UDPSize: dns.MaxMsgSize},
+		waiters: make(map[uint16]*pooledQuery),
+		done:    make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return nil, errPoolClosed
+	}
+	if conns := p.conns[key]; len(conns) >= p.size {
+		// Another query filled the pool meanwhile
+		c.Close()
+		pc = conns[p.next[key]%len(conns)]
+		p.next[key]++
+		return pc, nil
+	}
+	p.conns[key] = append(p.conns[key], pc)
+	go func() {
+		pc.read()
+		p.remove(key, pc)
+	}()
+	return pc, nil
+}
+
+// remove drops pc from the pool and closes it.
+func (p *upstreamPool) remove(key string, pc *pooledConn) {
+	p.mu.Lock()
+	conns := p.conns[key]
+	for i, c := range conns {
+		if c == pc {
+			p.conns[key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[key]) == 0 {
+		delete(p.conns, key)
+		delete(p.next, key)
+	}
+	p.mu.Unlock()
+	pc.conn.Close()
+}
+
+// Close closes the connections of the pool, failing the queries waiting on
+// them.
+func (p *upstreamPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[string][]*pooledConn)
+	p.mu.Unlock()
+	for _, list := range conns {
+		for _, pc := range list {
+			pc.conn.Close()
+		}
+	}
+}
+
+// exchange sends m on the connection and waits up to timeout for the
+// response. m is not modified; the response carries the ID of m.
+func (pc *pooledConn) exchange(ctx context.Context, m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("expected a query with one question, got %d", len(m.Question))
+	}
+	q := &pooledQuery{question: m.Question[0], reply: make(chan *dns.Msg, 1)}
+	id, err := pc.register(q)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.unregister(id)
+
+	out := m.Copy()
+	out.Id = id
+	pc.wmu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = pc.conn.WriteMsg(out)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.fail(err)
+		return nil, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-q.reply:
+		r.Id = m.Id
+		return r, nil
+	case <-pc.done:
+		return nil, pc.failure()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+		return nil, fmt.Errorf("no response from %s within %s", pc.conn.RemoteAddr(), timeout)
+	}
+}
+
+// register assigns an unused message ID to q.
+func (pc *pooledConn) register(q *pooledQuery) (uint16, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	if len(pc.waiters) > 1<<15 {
+		return 0, fmt.Errorf("too many queries waiting on %s", pc.conn.RemoteAddr())
+	}
+	for {
+		if id := dns.Id(); pc.waiters[id] == nil {
+			pc.waiters[id] = q
+			return id, nil
+		}
+	}
+}
+
+func (pc *pooledConn) unregister(id uint16) {
+	pc.mu.Lock()
+	delete(pc.waiters, id)
+	pc.mu.Unlock()
+}
+
+// read delivers the responses to the waiting queries until the connection
+// fails or is closed. Responses that match no query are dropped.
+func (pc *pooledConn) read() {
+	for {
+		r, err := pc.conn.ReadMsg()
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) || isTCPConn(pc.conn) {
+				pc.fail(err)
+				return
+			}
+			// A malformed UDP datagram, the socket is still fine
+			continue
+		}
+		if len(r.Question) != 1 {
+			continue
+		}
+		pc.mu.Lock()
+		q := pc.waiters[r.Id]
+		if q != nil && questionMatches(q.question, r.Question[0]) {
+			delete(pc.waiters, r.Id)
+			q.reply <- r
+		}
+		pc.mu.Unlock()
+	}
+}
+
+func questionMatches(a, b dns.Question) bool {
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
+
+func isTCPConn(c *dns.Conn) bool {
+	_, ok := c.Conn.(*net.TCPConn)
+	return ok
+}
+
+// fail marks the connection as failed with err and closes it, so that the
+// reader and the waiting queries stop.
+func (pc *pooledConn) fail(err error) {
+	pc.mu.Lock()
+	if pc.err == nil {
+		pc.err = err
+		close(pc.done)
+	}
+	pc.mu.Unlock()
+	pc.conn.Close()
+}
+
+func (pc *pooledConn) failed() bool {
+	select {
+	case <-pc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pc *pooledConn) failure() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
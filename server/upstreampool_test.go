@@ -0,0 +1,175 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startPoolUpstream starts a nameserver answering with handler over UDP and
+// TCP on the same port.
+func startPoolUpstream(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	// The TCP port may be taken even though the UDP port is free
+	for i := 0; i < 10; i++ {
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	return pc.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+	addr, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		sources[w.RemoteAddr().String()] = true
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN TXT ok")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	for _, network := range []string{"udp", "tcp"} {
+		mu.Lock()
+		sources = make(map[string]bool)
+		mu.Unlock()
+		p := newUpstreamPool(2, time.Second, nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				m := new(dns.Msg)
+				m.SetQuestion(dns.Fqdn(strings.Repeat("a", i+1)+".example.com"), dns.TypeTXT)
+				r, _, err := p.Exchange(context.Background(), m, Upstream{Addr: addr, Net: network})
+				if err != nil {
+					t.Errorf("%s: %s", network, err)
+					return
+				}
+				if r.Id != m.Id || len(r.Answer) != 1 || r.Answer[0].Header().Name != m.Question[0].Name {
+					t.Errorf("%s: response %v does not match query %v", network, r, m)
+				}
+			}(i)
+		}
+		wg.Wait()
+		p.Close()
+
+		mu.Lock()
+		if len(sources) > 2 {
+			t.Errorf("%s: expected at most 2 sockets, got %d", network, len(sources))
+		}
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeTXT)
+		if _, _, err := p.Exchange(context.Background(), m, Upstream{Addr: addr, Net: network}); err != errPoolClosed {
+			t.Errorf("%s: expected %v after Close, got %v", network, errPoolClosed, err)
+		}
+	}
+}
+
+func TestUpstreamPoolMismatch(t *testing.T) {
+	addr, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// A response for another question, then the right one
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Question[0].Name = "spoofed.example.com."
+		w.WriteMsg(m)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	p := newUpstreamPool(1, time.Second, nil)
+	defer p.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("Example.COM.", dns.TypeA)
+	r, _, err := p.Exchange(context.Background(), m, Upstream{Addr: addr, Net: "udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Question[0].Name != "Example.COM." {
+		t.Errorf("expected the response for the query, got %v", r)
+	}
+}
+
+func TestUpstreamPoolTimeout(t *testing.T) {
+	addr, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	defer stop()
+
+	p := newUpstreamPool(1, 100*time.Millisecond, nil)
+	defer p.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := p.Exchange(context.Background(), m, Upstream{Addr: addr, Net: "udp"}); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	// The socket is kept
+	if n := len(p.conns["udp/"+addr]); n != 1 {
+		t.Errorf("expected 1 socket in the pool, got %d", n)
+	}
+}
+
+func TestUpstreamPoolContext(t *testing.T) {
+	addr, stop := startPoolUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {})
+	defer stop()
+
+	p := newUpstreamPool(1, time.Minute, nil)
+	defer p.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.Exchange(ctx, m, Upstream{Addr: addr, Net: "udp"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the exchange to end with the context, got %v", err)
+	}
+}
+
+func TestForwardUpstreamPool(t *testing.T) {
+	upstream := startTestUpstream(t)
+	s := startTestServer(t, &Config{Nameservers: []string{upstream}, UpstreamPoolSize: 1})
+	m := new(dns.Msg)
+	m.SetQuestion("pool.example.com.", dns.TypeA)
+	r, _, err := new(dns.Client).Exchange(m, s.conf().DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("expected an answer, got %v", r)
+	}
+	s.Stop()
+	if _, _, err := s.pool.Exchange(context.Background(), m, Upstream{Addr: upstream, Net: "udp"}); err != errPoolClosed {
+		t.Errorf("expected the pool to be closed by Stop, got %v", err)
+	}
+}
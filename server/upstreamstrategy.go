@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamStrategy selects the order the upstream nameservers are tried in
+// for each forwarded query. The nameservers of stub zones are always tried
+// round-robin.
+type UpstreamStrategy string
+
+const (
+	// Try the nameservers in the order they are configured
+	StrategyFirst UpstreamStrategy = "first"
+	// Start with the next nameserver for each query
+	StrategyRoundRobin UpstreamStrategy = "round-robin"
+	// Start with a nameserver picked uniformly at random
+	StrategyRandom UpstreamStrategy = "random"
+	// Start with the nameserver with the lowest average response time
+	StrategyFastest UpstreamStrategy = "fastest"
+)
+
+// defaultRTTWindow is used when UpstreamRTTWindow is 0.
+const defaultRTTWindow = 10
+
+func checkUpstreamStrategy(strategy UpstreamStrategy) error {
+	switch strategy {
+	case "", StrategyFirst, StrategyRoundRobin, StrategyRandom, StrategyFastest:
+		return nil
+	}
+	return fmt.Errorf("'upstream-strategy' must be one of 'first', 'round-robin', 'random' or 'fastest'")
+}
+
+// upstreamSelector orders the upstream nameservers for UpstreamStrategy.
+// It belongs to the server so that its state is kept across reloads.
+type upstreamSelector struct {
+	next uint32
+
+	mu   sync.Mutex
+	rtts map[string]time.Duration // average response time by nameserver
+}
+
+func newUpstreamSelector() *upstreamSelector {
+	return &upstreamSelector{rtts: make(map[string]time.Duration)}
+}
+
+// order returns the nameservers of config in the order they should be
+// tried for the next query.
+func (u *upstreamSelector) order(config *Config) []string {
+	nameservers := config.Nameservers
+	if len(nameservers) < 2 {
+		return nameservers
+	}
+	switch config.UpstreamStrategy {
+	case StrategyRoundRobin:
+		start := int(atomic.AddUint32(&u.next, 1)-1) % len(nameservers)
+		order := append([]string(nil), nameservers[start:]...)
+		return append(order, nameservers[:start]...)
+	case StrategyRandom:
+		order := make([]string, len(nameservers))
+		for i, j := range rand.Perm(len(nameservers)) {
+			order[i] = nameservers[j]
+		}
+		return order
+	case StrategyFastest:
+		order := append([]string(nil), nameservers...)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		// Nameservers without a response time yet sort first, so that
+		// every nameserver is measured
+		sort.SliceStable(order, func(i, j int) bool {
+			return u.rtts[order[i]] < u.rtts[order[j]]
+		})
+		return order
+	}
+	return nameservers
+}
+
+// observe adds the response time rtt of the nameserver to its exponentially
+// weighted average, which mostly reflects the last window responses. The
+// first response time is taken as is.
+func (u *upstreamSelector) observe(ns string, rtt time.Duration, window int) {
+	if window <= 0 {
+		window = defaultRTTWindow
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	avg, ok := u.rtts[ns]
+	if !ok {
+		u.rtts[ns] = rtt
+		return
+	}
+	alpha := 2 / float64(window+1)
+	u.rtts[ns] = avg + time.Duration(alpha*float64(rtt-avg))
+}
+
+// rtt returns the average response time of the nameserver and whether it
+// has one.
+func (u *upstreamSelector) rtt(ns string) (time.Duration, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	rtt, ok := u.rtts[ns]
+	return rtt, ok
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamRTT(t *testing.T) {
+	const fast, slow = "192.0.2.1:53", "192.0.2.2:53"
+	u := newUpstreamSelector()
+	config := &Config{Nameservers: []string{slow, fast}, UpstreamStrategy: StrategyFastest}
+
+	// Unmeasured nameservers keep their order
+	if order := u.order(config); fmt.Sprint(order) != fmt.Sprint([]string{slow, fast}) {
+		t.Errorf("expected the configured order, got %v", order)
+	}
+
+	// With a window of 3 every response weighs half
+	for _, tc := range []struct {
+		ns   string
+		rtt  time.Duration
+		want time.Duration
+	}{
+		{slow, 100 * time.Millisecond, 100 * time.Millisecond},
+		{slow, 20 * time.Millisecond, 60 * time.Millisecond},
+		{slow, 20 * time.Millisecond, 40 * time.Millisecond},
+		{fast, 10 * time.Millisecond, 10 * time.Millisecond},
+		{fast, 50 * time.Millisecond, 30 * time.Millisecond},
+	} {
+		u.observe(tc.ns, tc.rtt, 3)
+		if rtt, ok := u.rtt(tc.ns); !ok || rtt != tc.want {
+			t.Errorf("%s: expected an average of %s after %s, got %s", tc.ns, tc.want, tc.rtt, rtt)
+		}
+	}
+	if order := u.order(config); fmt.Sprint(order) != fmt.Sprint([]string{fast, slow}) {
+		t.Errorf("expected the fastest nameserver first, got %v", order)
+	}
+
+	// A slow response moves the fastest nameserver back
+	u.observe(fast, 100*time.Millisecond, 3)
+	if order := u.order(config); fmt.Sprint(order) != fmt.Sprint([]string{slow, fast}) {
+		t.Errorf("expected the slowed down nameserver last, got %v", order)
+	}
+}
+
+func TestUpstreamStrategy(t *testing.T) {
+	const fast, slow = "192.0.2.1:53", "192.0.2.2:53"
+	for _, tc := range []struct {
+		strategy UpstreamStrategy
+		// Expected number of queries sent to each nameserver
+		check func(sent map[string]int) bool
+	}{
+		{StrategyFirst, func(sent map[string]int) bool { return sent[slow] == 20 && sent[fast] == 0 }},
+		{StrategyRoundRobin, func(sent map[string]int) bool { return sent[slow] == 10 && sent[fast] == 10 }},
+		{StrategyRandom, func(sent map[string]int) bool { return sent[slow] > 0 && sent[fast] > 0 }},
+		// Each nameserver is measured once, then the fast one is preferred
+		{StrategyFastest, func(sent map[string]int) bool { return sent[slow] == 1 && sent[fast] == 19 }},
+	} {
+		ex := &fakeExchanger{answer: func(m *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+			if upstream.Addr == slow {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return reply(m, dns.RcodeSuccess, m.Question[0].Name+" 60 IN A 10.0.0.1"), nil
+		}}
+		s := startTestServer(t, &Config{Nameservers: []string{slow, fast}, Exchanger: ex, UpstreamStrategy: tc.strategy})
+		c := new(dns.Client)
+		for i := 0; i < 20; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion(fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+			if _, _, err := c.Exchange(m, s.conf().DnsAddr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Stop()
+
+		sent := make(map[string]int)
+		for _, upstream := range ex.sent() {
+			sent[upstream.Addr]++
+		}
+		if !tc.check(sent) {
+			t.Errorf("%s: unexpected queries per nameserver %v", tc.strategy, sent)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "go-dnsmasq"
+
+// serviceStopTimeout is how long '--service stop' waits for the service
+// to stop.
+const serviceStopTimeout = 30 * time.Second
+
+// service answers the requests of the service control manager.
+type service struct {
+	exitReason chan<- error
+	// Closed once the server has shut down
+	done chan struct{}
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Info("Application exit requested by the service control manager")
+				status <- svc.Status{State: svc.StopPending}
+				// runServer may have returned already, e.g. with an error
+				select {
+				case s.exitReason <- nil:
+				case <-s.done:
+				}
+				<-s.done
+				return false, 0
+			}
+		case <-s.done:
+			return false, 0
+		}
+	}
+}
+
+// runService connects to the service control manager when started by it
+// and turns stop requests into an exit without error. The returned
+// function must be called once the server has shut down, so that the
+// service is reported as stopped.
+func runService(exitReason chan<- error) (stopped func(), err error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}, err
+	}
+
+	s := &service{exitReason: exitReason, done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, s); err != nil {
+			log.Errorf("Service failed: %s", err)
+		}
+		close(finished)
+	}()
+	return func() {
+		close(s.done)
+		<-finished
+	}, nil
+}
+
+// controlService installs, uninstalls, starts or stops the service. The
+// service is installed with the other flags given on the command line.
+func controlService(action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		return installService(m)
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	switch action {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(serviceName)
+	case "start":
+		return s.Start()
+	case "stop":
+		st, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(serviceStopTimeout)
+		for st.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service did not stop within %s", serviceStopTimeout)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q, must be one of install, uninstall, start or stop", action)
+	}
+}
+
+func installService(m *mgr.Mgr) error {
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "go-dnsmasq",
+		Description: "Lightweight caching DNS forwarder",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(os.Args[1:])...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %s", err)
+	}
+	return nil
+}
+
+// serviceArgs returns args without the --service flag.
+func serviceArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		switch a := strings.TrimLeft(args[i], "-"); {
+		case a == "service" && strings.HasPrefix(args[i], "-"):
+			i++
+		case strings.HasPrefix(a, "service=") && strings.HasPrefix(args[i], "-"):
+		default:
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rcrowley/go-metrics"
+)
+
+var started = time.Now()
+
+// counterVec is a family of go-metrics counters registered as prefix-label.
+type counterVec struct {
+	prefix string
+
+	sync.RWMutex
+	m map[string]metrics.Counter
+}
+
+func newCounterVec(prefix string) *counterVec {
+	return &counterVec{prefix: prefix, m: make(map[string]metrics.Counter)}
+}
+
+func (v *counterVec) With(label string) Counter {
+	v.RLock()
+	c, ok := v.m[label]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if c, ok = v.m[label]; !ok {
+		c = metrics.GetOrRegisterCounter(v.prefix+"-"+label, metrics.DefaultRegistry)
+		v.m[label] = c
+	}
+	return c
+}
+
+// format returns the counters as a sorted list of label=count pairs.
+func (v *counterVec) format() string {
+	v.RLock()
+	pairs := make([]string, 0, len(v.m))
+	for label, c := range v.m {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", label, c.Count()))
+	}
+	v.RUnlock()
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (v *counterVec) count(label string) int64 {
+	v.RLock()
+	defer v.RUnlock()
+	if c, ok := v.m[label]; ok {
+		return c.Count()
+	}
+	return 0
+}
+
+func (v *counterVec) labels() []string {
+	v.RLock()
+	labels := make([]string, 0, len(v.m))
+	for label := range v.m {
+		labels = append(labels, label)
+	}
+	v.RUnlock()
+	sort.Strings(labels)
+	return labels
+}
+
+// CacheInfo provides the state of the response cache
+type CacheInfo interface {
+	CacheSize() (int, int)
+	CacheEvictions() int64
+}
+
+// HostsInfo provides the state of the hostsfile
+type HostsInfo interface {
+	Len() int
+}
+
+// Dump writes the current statistics to the log. Counters are read
+// without locking the query path.
+func Dump(c CacheInfo, h HostsInfo) {
+	s := Snapshot()
+	log.Infof("stats: uptime=%s queries=%d forwarded=%d stub_forwarded=%d nxdomain=%d servfail=%d blocked=%d",
+		time.Since(started)/time.Second*time.Second, s.QueryTotal, s.Forwarded,
+		count(StubForwardCount), s.NXDomain, s.ServFail, s.Blocked)
+	log.Infof("stats: qtypes %s", queryTypes.format())
+	log.Infof("stats: rcodes %s", rcodes.format())
+
+	size, capacity := c.CacheSize()
+	log.Infof("stats: cache size=%d capacity=%d hits=%d misses=%d evictions=%d",
+		size, capacity, s.CacheHit, s.CacheMiss, c.CacheEvictions())
+
+	for _, ns := range upstreams.labels() {
+		log.Infof("stats: upstream=%s queries=%d errors=%d",
+			ns, upstreams.count(ns), upstreamErrors.count(ns))
+	}
+
+	for _, zone := range stubZones.labels() {
+		log.Infof("stats: stubzone=%s queries=%d errors=%d",
+			zone, stubZones.count(zone), stubZoneErrors.count(zone))
+	}
+
+	for _, l := range latencies {
+		log.Infof("stats: latency path=%s %s", l.path, l.h.format())
+	}
+
+	if TopDomains != nil {
+		log.Infof("stats: top domains %s", formatTop(TopDomains.Top()))
+		log.Infof("stats: top clients %s", formatTop(TopClients.Top()))
+	}
+
+	log.Infof("stats: tcp connections=%d rejected_connections=%d truncated_retries=%d",
+		count(TCPConnections), count(TCPRejectedCount), count(TCPRetryCount))
+	log.Infof("stats: rejected queries formerr=%d notimp=%d", count(FormErrQueries), count(NotImpQueries))
+	log.Infof("stats: hostsfile entries=%d", h.Len())
+
+	r := RuntimeSnapshot()
+	log.Infof("stats: runtime goroutines=%d heap_inuse=%d gc_count=%d gc_pause_total=%s upstream_sockets=%d",
+		r.Goroutines, r.HeapInUse, r.GCCount, r.GCPauseTotal, r.UpstreamSockets)
+	log.Infof("stats: concurrency active=%d queued=%d dropped=%d",
+		r.ActiveQueries, r.QueuedQueries, count(DroppedQueries))
+}
+
+func formatTop(entries []TopEntry) string {
+	pairs := make([]string, len(entries))
+	for i, e := range entries {
+		pairs[i] = fmt.Sprintf("%s=%d", e.Key, e.Count)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func count(c Counter) int64 {
+	if mc, ok := c.(metrics.Counter); ok {
+		return mc.Count()
+	}
+	return 0
+}
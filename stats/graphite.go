@@ -2,67 +2,78 @@
 // Use of this source code is governed by The MIT License (MIT) that can be
 // found in the LICENSE file.
 
-// Package stats may be imported to record statistics about a DNS server.
+// Package stats records statistics about a DNS server.
 // If the GRAPHITE_SERVER environment variable is set, the statistics can
 // be periodically reported to that server.
 package stats
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-metrics/stathat"
 
-	"github.com/janeczku/go-dnsmasq/server"
+	"github.com/janeczku/go-dnsmasq/dnstap"
 )
 
+// NoHosts prevents host names of metrics servers from being resolved
+// through the operating system, which may consult /etc/hosts. Only IP
+// addresses are accepted when it is set.
+var NoHosts bool
+
 var (
 	graphiteServer = os.Getenv("GRAPHITE_SERVER")
 	graphitePrefix = os.Getenv("GRAPHITE_PREFIX")
 	stathatUser    = os.Getenv("STATHAT_USER")
 )
 
+// Counters mirroring the fields of Global for the go-metrics reporters
+var totals = []struct {
+	c     metrics.Counter
+	value func(Stats) int64
+}{
+	{newCounter("go-dnsmaq-requests"), func(s Stats) int64 { return s.QueryTotal }},
+	{newCounter("go-dnsmaq-cache-hit"), func(s Stats) int64 { return s.CacheHit }},
+	{newCounter("go-dnsmaq-cache-miss"), func(s Stats) int64 { return s.CacheMiss }},
+	{newCounter("go-dnsmaq-forward-requests"), func(s Stats) int64 { return s.Forwarded }},
+	{newCounter("go-dnsmaq-nameerror-responses"), func(s Stats) int64 { return s.NXDomain }},
+	{newCounter("go-dnsmasq-servfail-responses"), func(s Stats) int64 { return s.ServFail }},
+	{newCounter("go-dnsmasq-blocked-requests"), func(s Stats) int64 { return s.Blocked }},
+}
+
 func init() {
 	if graphitePrefix == "" {
 		graphitePrefix = "go-dnsmasq"
 	}
 
-	server.StatsForwardCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-forward-requests", server.StatsForwardCount)
-
-	server.StatsStubForwardCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-stub-forward-requests", server.StatsStubForwardCount)
-
-	server.StatsDnssecOkCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-dnssecok-requests", server.StatsDnssecOkCount)
-
-	server.StatsDnssecCacheMiss = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-dnssec-cache-miss", server.StatsDnssecCacheMiss)
-
-	server.StatsLookupCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-internal-lookups", server.StatsLookupCount)
-
-	server.StatsRequestCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-requests", server.StatsRequestCount)
-
-	server.StatsNameErrorCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nameerror-responses", server.StatsNameErrorCount)
+	dnstap.StatsFramesSent = newCounter("go-dnsmasq-dnstap-frames")
+	dnstap.StatsFramesDropped = newCounter("go-dnsmasq-dnstap-dropped-frames")
+}
 
-	server.StatsNoDataCount = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nodata-responses", server.StatsNoDataCount)
+func Collect() {
+	sampleRuntime()
 
-	server.StatsCacheMiss = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nodata-responses", server.StatsCacheMiss)
+	if graphiteServer == "" && stathatUser == "" {
+		return
+	}
 
-	server.StatsCacheHit = metrics.NewCounter()
-	metrics.Register("go-dnsmaq-nodata-responses", server.StatsCacheHit)
-}
+	go func() {
+		for range time.Tick(time.Second) {
+			s := Snapshot()
+			for _, t := range totals {
+				t.c.Inc(t.value(s) - t.c.Count())
+			}
+		}
+	}()
 
-func Collect() {
 	if graphiteServer != "" {
-		addr, err := net.ResolveTCPAddr("tcp", graphiteServer)
-		if err == nil {
+		if err := checkResolve(graphiteServer); err != nil {
+			log.Errorf("Not sending metrics to Graphite: %s", err)
+		} else if addr, err := net.ResolveTCPAddr("tcp", graphiteServer); err == nil {
 			go metrics.Graphite(metrics.DefaultRegistry, 10e9, graphitePrefix, addr)
 		}
 	}
@@ -71,3 +82,16 @@ func Collect() {
 		go stathat.Stathat(metrics.DefaultRegistry, 10e9, stathatUser)
 	}
 }
+
+// checkResolve returns an error if hostPort would have to be resolved
+// through the operating system while NoHosts is set.
+func checkResolve(hostPort string) error {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	if NoHosts && net.ParseIP(host) == nil {
+		return fmt.Errorf("%s is not an IP address, host names are not resolved with 'no-hosts'", host)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Upper bounds of the latency buckets in milliseconds. Slower
+// observations are counted in an additional 1000ms+ bucket.
+var latencyBuckets = []float64{0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// histogram counts latencies into fixed buckets. Each bucket is a
+// go-metrics counter so that recording is a single atomic increment.
+type histogram struct {
+	names  []string
+	counts []metrics.Counter
+}
+
+func newHistogram(prefix string) *histogram {
+	h := &histogram{}
+	for _, b := range latencyBuckets {
+		h.names = append(h.names, "le_"+strconv.FormatFloat(b, 'f', -1, 64)+"ms")
+	}
+	h.names = append(h.names, "1000ms+")
+	for _, name := range h.names {
+		c := metrics.NewCounter()
+		metrics.Register(prefix+"-"+strings.Replace(name, "_", "-", -1), c)
+		h.counts = append(h.counts, c)
+	}
+	return h
+}
+
+// Observe records a single latency.
+func (h *histogram) Observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(latencyBuckets) && ms > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Inc(1)
+}
+
+// format returns the bucket counts as name=count pairs.
+func (h *histogram) format() string {
+	pairs := make([]string, len(h.names))
+	for i, name := range h.names {
+		pairs[i] = fmt.Sprintf("%s=%d", name, h.counts[i].Count())
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	for _, tc := range []struct {
+		d      time.Duration
+		bucket string
+	}{
+		{0, "le_0.5ms"},
+		{500 * time.Microsecond, "le_0.5ms"},
+		{500*time.Microsecond + 1, "le_1ms"},
+		{3 * time.Millisecond, "le_5ms"},
+		{250 * time.Millisecond, "le_250ms"},
+		{time.Second, "le_1000ms"},
+		{time.Second + 1, "1000ms+"},
+		{time.Minute, "1000ms+"},
+	} {
+		h := newHistogram("test-histogram-buckets")
+		h.Observe(tc.d)
+		for _, pair := range strings.Fields(h.format()) {
+			want := "=0"
+			if strings.HasPrefix(pair, tc.bucket+"=") {
+				want = "=1"
+			}
+			if !strings.HasSuffix(pair, want) {
+				t.Errorf("%s: expected only %s to be counted, got %s", tc.d, tc.bucket, h.format())
+				break
+			}
+		}
+	}
+
+	names := strings.Fields(newHistogram("test-histogram-names").format())
+	if len(names) != 12 || names[0] != "le_0.5ms=0" || names[11] != "1000ms+=0" {
+		t.Errorf("expected 12 buckets from le_0.5ms to 1000ms+, got %v", names)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Counter is the metric interface used by the server
+type Counter interface {
+	Inc(i int64)
+}
+
+// Histogram is the latency distribution interface used by the server
+type Histogram interface {
+	Observe(d time.Duration)
+}
+
+// CounterVec is a family of counters partitioned by a label
+type CounterVec interface {
+	With(label string) Counter
+}
+
+var (
+	StubForwardCount Counter = newCounter("go-dnsmaq-stub-forward-requests")
+	LookupCount      Counter = newCounter("go-dnsmaq-internal-lookups")
+	DnssecOkCount    Counter = newCounter("go-dnsmaq-dnssecok-requests")
+	NoDataCount      Counter = newCounter("go-dnsmaq-nodata-responses")
+
+	DnssecCacheMiss Counter = newCounter("go-dnsmaq-dnssec-cache-miss")
+
+	TCPRejectedCount Counter = newCounter("go-dnsmasq-tcp-rejected-connections")
+	DroppedQueries   Counter = newCounter("go-dnsmasq-dropped-queries")
+	TCPRetryCount    Counter = newCounter("go-dnsmasq-tcp-retries")
+	FormErrQueries   Counter = newCounter("go-dnsmasq-formerr-queries")
+	NotImpQueries    Counter = newCounter("go-dnsmasq-notimp-queries")
+
+	CacheLatency     Histogram = latencies[0].h
+	HostsfileLatency Histogram = latencies[1].h
+	StubLatency      Histogram = latencies[2].h
+	ForwardLatency   Histogram = latencies[3].h
+
+	QueryTypeCount     CounterVec = queryTypes
+	RcodeCount         CounterVec = rcodes
+	UpstreamCount      CounterVec = upstreams
+	UpstreamErrorCount CounterVec = upstreamErrors
+	StubZoneCount      CounterVec = stubZones
+	StubZoneErrorCount CounterVec = stubZoneErrors
+)
+
+var (
+	queryTypes     = newCounterVec("go-dnsmasq-qtype")
+	rcodes         = newCounterVec("go-dnsmasq-rcode")
+	upstreams      = newCounterVec("go-dnsmasq-upstream-requests")
+	upstreamErrors = newCounterVec("go-dnsmasq-upstream-errors")
+	stubZones      = newCounterVec("go-dnsmasq-stubzone-requests")
+	stubZoneErrors = newCounterVec("go-dnsmasq-stubzone-errors")
+
+	latencies = []struct {
+		path string
+		h    *histogram
+	}{
+		{"cache", newHistogram("go-dnsmasq-latency-cache")},
+		{"hostsfile", newHistogram("go-dnsmasq-latency-hostsfile")},
+		{"stub", newHistogram("go-dnsmasq-latency-stub")},
+		{"forward", newHistogram("go-dnsmasq-latency-forward")},
+	}
+)
+
+func newCounter(name string) metrics.Counter {
+	c := metrics.NewCounter()
+	metrics.Register(name, c)
+	return c
+}
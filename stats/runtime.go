@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// runtimeSampleInterval is how often the process metrics are sampled.
+// Reading them stops the world briefly, so they are not read on demand.
+const runtimeSampleInterval = 10 * time.Second
+
+// UpstreamSockets counts the sockets currently open to upstream
+// nameservers. It is incremented and decremented around each exchange.
+var UpstreamSockets Counter = newCounter("go-dnsmasq-upstream-sockets")
+
+// TCPConnections counts the open TCP client connections.
+var TCPConnections Counter = newCounter("go-dnsmasq-tcp-connections")
+
+// ActiveQueries counts the queries being handled, QueuedQueries those
+// waiting for a handler because 'max-concurrency' is reached.
+var (
+	ActiveQueries Counter = newCounter("go-dnsmasq-active-queries")
+	QueuedQueries Counter = newCounter("go-dnsmasq-queued-queries")
+)
+
+// Runtime holds the process metrics of the latest sample
+type Runtime struct {
+	Uptime          time.Duration
+	Goroutines      int
+	HeapInUse       uint64
+	GCCount         uint32
+	GCPauseTotal    time.Duration
+	UpstreamSockets int64
+	ActiveQueries   int64
+	QueuedQueries   int64
+	TCPConnections  int64
+}
+
+var (
+	runtimeMu     sync.RWMutex
+	runtimeSample Runtime
+	runtimeOnce   sync.Once
+
+	goroutinesGauge = metrics.NewRegisteredGauge("go-dnsmasq-goroutines", metrics.DefaultRegistry)
+	heapGauge       = metrics.NewRegisteredGauge("go-dnsmasq-heap-inuse-bytes", metrics.DefaultRegistry)
+	gcCountGauge    = metrics.NewRegisteredGauge("go-dnsmasq-gc-count", metrics.DefaultRegistry)
+	gcPauseGauge    = metrics.NewRegisteredGauge("go-dnsmasq-gc-pause-total-ns", metrics.DefaultRegistry)
+)
+
+// RuntimeSnapshot returns the latest sample of the process metrics.
+func RuntimeSnapshot() Runtime {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return runtimeSample
+}
+
+// sampleRuntime starts sampling the process metrics. Further calls are
+// no-ops.
+func sampleRuntime() {
+	runtimeOnce.Do(func() {
+		updateRuntime()
+		go func() {
+			for range time.Tick(runtimeSampleInterval) {
+				updateRuntime()
+			}
+		}()
+	})
+}
+
+func updateRuntime() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	r := Runtime{
+		Uptime:          time.Since(started),
+		Goroutines:      runtime.NumGoroutine(),
+		HeapInUse:       ms.HeapInuse,
+		GCCount:         ms.NumGC,
+		GCPauseTotal:    time.Duration(ms.PauseTotalNs),
+		UpstreamSockets: count(UpstreamSockets),
+		ActiveQueries:   count(ActiveQueries),
+		QueuedQueries:   count(QueuedQueries),
+		TCPConnections:  count(TCPConnections),
+	}
+
+	goroutinesGauge.Update(int64(r.Goroutines))
+	heapGauge.Update(int64(r.HeapInUse))
+	gcCountGauge.Update(int64(r.GCCount))
+	gcPauseGauge.Update(int64(r.GCPauseTotal))
+
+	runtimeMu.Lock()
+	runtimeSample = r
+	runtimeMu.Unlock()
+}
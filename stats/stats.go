@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import "sync/atomic"
+
+// Stats holds the totals of handled queries. Fields are updated
+// atomically; use Snapshot to read a consistent copy.
+type Stats struct {
+	QueryTotal int64 `json:"queries"`
+	CacheHit   int64 `json:"cache_hits"`
+	CacheMiss  int64 `json:"cache_misses"`
+	Forwarded  int64 `json:"forwarded"`
+	NXDomain   int64 `json:"nxdomain"`
+	ServFail   int64 `json:"servfail"`
+	Blocked    int64 `json:"blocked"`
+}
+
+// Field identifies a counter of Stats
+type Field int
+
+// Fields of Stats that can be incremented with Inc
+const (
+	QueryTotal Field = iota
+	CacheHit
+	CacheMiss
+	Forwarded
+	NXDomain
+	ServFail
+	Blocked
+)
+
+// Global holds the totals of the running server.
+var Global Stats
+
+// Inc increments the given field of Global by one.
+func Inc(f Field) {
+	Global.Inc(f)
+}
+
+// Snapshot returns a copy of Global.
+func Snapshot() Stats {
+	return Global.Snapshot()
+}
+
+// Inc increments the given field by one.
+func (s *Stats) Inc(f Field) {
+	if p := s.field(f); p != nil {
+		atomic.AddInt64(p, 1)
+	}
+}
+
+// Snapshot returns a copy of s.
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		QueryTotal: atomic.LoadInt64(&s.QueryTotal),
+		CacheHit:   atomic.LoadInt64(&s.CacheHit),
+		CacheMiss:  atomic.LoadInt64(&s.CacheMiss),
+		Forwarded:  atomic.LoadInt64(&s.Forwarded),
+		NXDomain:   atomic.LoadInt64(&s.NXDomain),
+		ServFail:   atomic.LoadInt64(&s.ServFail),
+		Blocked:    atomic.LoadInt64(&s.Blocked),
+	}
+}
+
+func (s *Stats) field(f Field) *int64 {
+	switch f {
+	case QueryTotal:
+		return &s.QueryTotal
+	case CacheHit:
+		return &s.CacheHit
+	case CacheMiss:
+		return &s.CacheMiss
+	case Forwarded:
+		return &s.Forwarded
+	case NXDomain:
+		return &s.NXDomain
+	case ServFail:
+		return &s.ServFail
+	case Blocked:
+		return &s.Blocked
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStatsInc(t *testing.T) {
+	var s Stats
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Inc(QueryTotal)
+			s.Inc(CacheMiss)
+		}()
+	}
+	wg.Wait()
+	s.Inc(NXDomain)
+
+	snap := s.Snapshot()
+	if snap.QueryTotal != 100 || snap.CacheMiss != 100 {
+		t.Errorf("expected 100 queries and cache misses, got %+v", snap)
+	}
+	if snap.NXDomain != 1 || snap.CacheHit != 0 {
+		t.Errorf("unexpected counts %+v", snap)
+	}
+}
+
+func TestRuntimeSnapshot(t *testing.T) {
+	UpstreamSockets.Inc(1)
+	defer UpstreamSockets.Inc(-1)
+
+	updateRuntime()
+	r := RuntimeSnapshot()
+	if r.Goroutines == 0 || r.HeapInUse == 0 {
+		t.Errorf("expected goroutines and heap to be sampled, got %+v", r)
+	}
+	if r.UpstreamSockets != 1 {
+		t.Errorf("expected 1 upstream socket, got %d", r.UpstreamSockets)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StatsdMetrics documents the metric names sent to statsd, relative to
+// the configured prefix.
+const StatsdMetrics = "queries, cache.hits, cache.misses, forwarded, nxdomain, servfail, blocked, " +
+	"rcode.<rcode>, upstream.<ns>.requests, upstream.<ns>.errors (counters), " +
+	"latency.<cache|hostsfile|stub|forward> (timers in ms), " +
+	"runtime.goroutines, runtime.heap_inuse (bytes), runtime.gc_count, runtime.gc_pause_total (ms), " +
+	"runtime.upstream_sockets, runtime.active_queries, runtime.queued_queries, runtime.tcp_connections, " +
+	"uptime (seconds) (gauges)"
+
+const (
+	// statsdMaxSamples is the number of latency samples per path kept
+	// between two flushes. Further samples are accounted for with the
+	// statsd sample rate.
+	statsdMaxSamples = 1000
+	// statsdMaxPacket keeps packets below the common network MTU.
+	statsdMaxPacket = 1432
+)
+
+// sampledHistogram records latencies in a Histogram and keeps a bounded
+// set of raw samples for statsd timers.
+type sampledHistogram struct {
+	Histogram
+
+	sync.Mutex
+	samples []float64
+	seen    int
+}
+
+func (h *sampledHistogram) Observe(d time.Duration) {
+	h.Histogram.Observe(d)
+
+	h.Lock()
+	if len(h.samples) < statsdMaxSamples {
+		h.samples = append(h.samples, float64(d)/float64(time.Millisecond))
+	}
+	h.seen++
+	h.Unlock()
+}
+
+// take returns and resets the samples and the number of observations
+// they were taken from.
+func (h *sampledHistogram) take() ([]float64, int) {
+	h.Lock()
+	defer h.Unlock()
+	samples, seen := h.samples, h.seen
+	h.samples, h.seen = make([]float64, 0, len(samples)), 0
+	return samples, seen
+}
+
+type statsd struct {
+	conn   net.Conn
+	prefix string
+
+	last   Stats
+	counts map[string]int64
+	timers map[string]*sampledHistogram
+	buf    bytes.Buffer
+}
+
+// StartStatsd sends the statistics to the statsd daemon at addr every
+// interval. It must be called before the server starts answering queries.
+// Metrics are sent over UDP, so a missing daemon never blocks the server.
+func StartStatsd(addr, prefix string, interval time.Duration) error {
+	if err := checkResolve(addr); err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := &statsd{
+		conn:   conn,
+		prefix: strings.TrimSuffix(prefix, "."),
+		counts: make(map[string]int64),
+		timers: make(map[string]*sampledHistogram),
+	}
+	for _, h := range []struct {
+		path string
+		h    *Histogram
+	}{
+		{"cache", &CacheLatency},
+		{"hostsfile", &HostsfileLatency},
+		{"stub", &StubLatency},
+		{"forward", &ForwardLatency},
+	} {
+		sh := &sampledHistogram{Histogram: *h.h}
+		s.timers[h.path] = sh
+		*h.h = sh
+	}
+
+	sampleRuntime()
+	go func() {
+		for range time.Tick(interval) {
+			s.flush()
+		}
+	}()
+	return nil
+}
+
+func (s *statsd) flush() {
+	cur := Snapshot()
+	s.counter("queries", cur.QueryTotal-s.last.QueryTotal)
+	s.counter("cache.hits", cur.CacheHit-s.last.CacheHit)
+	s.counter("cache.misses", cur.CacheMiss-s.last.CacheMiss)
+	s.counter("forwarded", cur.Forwarded-s.last.Forwarded)
+	s.counter("nxdomain", cur.NXDomain-s.last.NXDomain)
+	s.counter("servfail", cur.ServFail-s.last.ServFail)
+	s.counter("blocked", cur.Blocked-s.last.Blocked)
+	s.last = cur
+
+	s.counterVec("rcode.%s", rcodes)
+	s.counterVec("upstream.%s.requests", upstreams)
+	s.counterVec("upstream.%s.errors", upstreamErrors)
+
+	r := RuntimeSnapshot()
+	s.gauge("runtime.goroutines", int64(r.Goroutines))
+	s.gauge("runtime.heap_inuse", int64(r.HeapInUse))
+	s.gauge("runtime.gc_count", int64(r.GCCount))
+	s.gauge("runtime.gc_pause_total", int64(r.GCPauseTotal/time.Millisecond))
+	s.gauge("runtime.upstream_sockets", r.UpstreamSockets)
+	s.gauge("runtime.active_queries", r.ActiveQueries)
+	s.gauge("runtime.queued_queries", r.QueuedQueries)
+	s.gauge("runtime.tcp_connections", r.TCPConnections)
+	s.gauge("uptime", int64(r.Uptime/time.Second))
+
+	for path, h := range s.timers {
+		samples, seen := h.take()
+		rate := ""
+		if len(samples) < seen {
+			rate = fmt.Sprintf("|@%.4f", float64(len(samples))/float64(seen))
+		}
+		for _, ms := range samples {
+			s.send(fmt.Sprintf("%s.latency.%s:%.3f|ms%s", s.prefix, path, ms, rate))
+		}
+	}
+	s.sendPacket()
+}
+
+// counterVec sends the change of every counter of v since the last flush.
+func (s *statsd) counterVec(format string, v *counterVec) {
+	for _, label := range v.labels() {
+		name := fmt.Sprintf(format, statsdSanitize(label))
+		c := v.count(label)
+		s.counter(name, c-s.counts[name])
+		s.counts[name] = c
+	}
+}
+
+func (s *statsd) counter(name string, delta int64) {
+	if delta != 0 {
+		s.send(fmt.Sprintf("%s.%s:%d|c", s.prefix, name, delta))
+	}
+}
+
+func (s *statsd) gauge(name string, value int64) {
+	s.send(fmt.Sprintf("%s.%s:%d|g", s.prefix, name, value))
+}
+
+// send queues a metric line, sending the queued lines first if they would
+// no longer fit in a packet.
+func (s *statsd) send(line string) {
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > statsdMaxPacket {
+		s.sendPacket()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+func (s *statsd) sendPacket() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		log.Debugf("Failed to send metrics to statsd: %s", err)
+	}
+	s.buf.Reset()
+}
+
+// statsdSanitize replaces the characters statsd treats specially.
+func statsdSanitize(name string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_").Replace(name)
+}
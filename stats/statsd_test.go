@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if err := StartStatsd(pc.LocalAddr().String(), "dnsmasq.", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	Inc(QueryTotal)
+	rcodes.With("NOERROR").Inc(1)
+	upstreams.With("8.8.8.8:53").Inc(1)
+	ForwardLatency.Observe(1500 * time.Microsecond)
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, statsdMaxPacket)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	for _, want := range []string{
+		"dnsmasq.queries:1|c",
+		"dnsmasq.rcode.NOERROR:1|c",
+		"dnsmasq.upstream.8_8_8_8_53.requests:1|c",
+		"dnsmasq.latency.forward:1.500|ms",
+	} {
+		found := false
+		for _, l := range lines {
+			found = found || l == want
+		}
+		if !found {
+			t.Errorf("expected %q in %q", want, lines)
+		}
+	}
+}
+
+func TestStatsdNoHosts(t *testing.T) {
+	NoHosts = true
+	defer func() { NoHosts = false }()
+
+	if err := StartStatsd("localhost:8125", "dnsmasq", time.Second); err == nil {
+		t.Error("expected host name to be rejected with NoHosts")
+	}
+	if err := checkResolve("127.0.0.1:8125"); err != nil {
+		t.Errorf("expected IP address to be accepted, got %s", err)
+	}
+}
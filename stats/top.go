@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// topDecayInterval is how often all counts of a TopTracker are halved, so
+// that the ranking reflects the last few minutes.
+const topDecayInterval = time.Minute
+
+// topSlack is the factor by which a TopTracker keeps more keys than it
+// reports, so that keys rising into the top N are not lost on eviction.
+const topSlack = 10
+
+// TopEntry is a key and its decayed count
+type TopEntry struct {
+	Key   string
+	Count int64
+}
+
+// TopTracker approximates the most frequent keys. It holds at most
+// topSlack*n keys regardless of how many distinct keys are added, and
+// counts are halved every topDecayInterval.
+type TopTracker struct {
+	n int
+
+	sync.Mutex
+	counts    map[string]int64
+	lastDecay time.Time
+}
+
+// NewTopTracker returns a tracker of the n most frequent keys.
+func NewTopTracker(n int) *TopTracker {
+	return &TopTracker{
+		n:         n,
+		counts:    make(map[string]int64, topSlack*n),
+		lastDecay: time.Now(),
+	}
+}
+
+// Add counts one occurrence of key.
+func (t *TopTracker) Add(key string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if time.Since(t.lastDecay) >= topDecayInterval {
+		t.decay()
+	}
+	if _, ok := t.counts[key]; !ok && len(t.counts) >= topSlack*t.n {
+		// Misra-Gries: instead of adding a new key to a full tracker,
+		// decrement all counts. Keys seen more often than once per
+		// topSlack*n additions are never evicted this way.
+		t.shrink(func(c int64) int64 { return c - 1 })
+		return
+	}
+	t.counts[key]++
+}
+
+// decay halves all counts and forgets keys that drop to zero.
+func (t *TopTracker) decay() {
+	t.shrink(func(c int64) int64 { return c / 2 })
+	t.lastDecay = time.Now()
+}
+
+func (t *TopTracker) shrink(f func(int64) int64) {
+	for k, c := range t.counts {
+		if c = f(c); c <= 0 {
+			delete(t.counts, k)
+		} else {
+			t.counts[k] = c
+		}
+	}
+}
+
+// Top returns up to n keys ordered by decreasing count.
+func (t *TopTracker) Top() []TopEntry {
+	t.Lock()
+	entries := make([]TopEntry, 0, len(t.counts))
+	for k, c := range t.counts {
+		entries = append(entries, TopEntry{k, c})
+	}
+	t.Unlock()
+
+	sort.Sort(byCount(entries))
+	if len(entries) > t.n {
+		entries = entries[:t.n]
+	}
+	return entries
+}
+
+type byCount []TopEntry
+
+func (p byCount) Len() int      { return len(p) }
+func (p byCount) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byCount) Less(i, j int) bool {
+	if p[i].Count != p[j].Count {
+		return p[i].Count > p[j].Count
+	}
+	return p[i].Key < p[j].Key
+}
+
+// Trackers of the most queried domains and the busiest clients. Both are
+// nil unless enabled with TrackTop.
+var (
+	TopDomains *TopTracker
+	TopClients *TopTracker
+)
+
+// TrackTop enables tracking of the n most queried domains and busiest
+// clients.
+func TrackTop(n int) {
+	TopDomains = NewTopTracker(n)
+	TopClients = NewTopTracker(n)
+}
+
+// TrackQuery records a query for name from client if tracking is enabled.
+func TrackQuery(name, client string) {
+	if TopDomains == nil {
+		return
+	}
+	TopDomains.Add(name)
+	TopClients.Add(client)
+}
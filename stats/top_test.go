@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Jan Broer
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopTracker(t *testing.T) {
+	tr := NewTopTracker(2)
+	for i := 0; i < 5; i++ {
+		tr.Add("a.")
+	}
+	for i := 0; i < 3; i++ {
+		tr.Add("b.")
+	}
+	tr.Add("c.")
+
+	top := tr.Top()
+	if len(top) != 2 || top[0].Key != "a." || top[1].Key != "b." {
+		t.Fatalf("unexpected top entries %v", top)
+	}
+
+	// The number of keys stays bounded and frequent keys survive
+	for i := 0; i < 10000; i++ {
+		tr.Add(strconv.Itoa(i))
+		if i%10 == 0 {
+			tr.Add("a.")
+		}
+	}
+	if len(tr.counts) > topSlack*2 {
+		t.Errorf("expected at most %d keys, got %d", topSlack*2, len(tr.counts))
+	}
+	if top = tr.Top(); top[0].Key != "a." {
+		t.Errorf("expected a. to stay on top, got %v", top)
+	}
+}